@@ -8,6 +8,7 @@ package leveldb
 
 import (
 	"encoding/binary"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/memdb"
@@ -16,6 +17,7 @@ import (
 var (
 	errBatchTooShort  = errors.ErrCorrupt("batch in too short")
 	errBatchBadRecord = errors.ErrCorrupt("bad record in batch")
+	errBatchNoReplay  = errors.ErrInvalid("batch has merge or range delete operations, which cannot be replayed")
 )
 
 const kBatchHdrLen = 8 + 4
@@ -27,10 +29,33 @@ type batchReplay interface {
 
 // Batch represent a write batch.
 type Batch struct {
-	buf  []byte
-	rLen int
-	seq  uint64
-	sync bool
+	buf   []byte
+	rLen  int
+	seq   uint64
+	sync  bool
+	noWAL bool
+	hasTs bool
+
+	// whether the batch holds range tombstones
+	hasRangeDel bool
+
+	// buf is referenced by memdb, thus must not be reused
+	shared bool
+
+	// value of the last record, held by reference instead of being
+	// copied to buf; see putNoCopy
+	vref []byte
+}
+
+// Copy the value held by reference into buf, so that records may be
+// appended after it.
+func (b *Batch) own() {
+	if b.vref != nil {
+		v := b.vref
+		b.vref = nil
+		b.grow(len(v))
+		b.buf = append(b.buf, v...)
+	}
 }
 
 func (b *Batch) grow(n int) {
@@ -38,30 +63,47 @@ func (b *Batch) grow(n int) {
 	if off == 0 {
 		// include headers
 		off = kBatchHdrLen
-		n += off
 	}
 	if cap(b.buf)-off >= n {
+		// don't write to buf unless needed, it may be read concurrently
+		if len(b.buf) < off {
+			b.buf = b.buf[:off]
+		}
 		return
 	}
-	buf := make([]byte, 2*cap(b.buf)+n)
+	buf := make([]byte, 2*cap(b.buf)+off+n)
 	copy(buf, b.buf)
 	b.buf = buf[:off]
 }
 
-func (b *Batch) appendRec(t vType, key, value []byte) {
+func (b *Batch) appendRec(t vType, key, value []byte, ts uint64) {
+	b.own()
 	n := 1 + binary.MaxVarintLen32 + len(key)
-	if t == tVal {
+	if t != tDel {
 		n += binary.MaxVarintLen32 + len(value)
 	}
+	if ts != 0 {
+		n += 8
+	}
 	b.grow(n)
 	off := len(b.buf)
 	buf := b.buf[:off+n]
-	buf[off] = byte(t)
-	off += 1
+	if ts != 0 {
+		buf[off] = byte(t | tTs)
+		binary.LittleEndian.PutUint64(buf[off+1:], ts)
+		off += 9
+		b.hasTs = true
+	} else {
+		buf[off] = byte(t)
+		off += 1
+	}
+	if t == tRangeDel {
+		b.hasRangeDel = true
+	}
 	off += binary.PutUvarint(buf[off:], uint64(len(key)))
 	copy(buf[off:], key)
 	off += len(key)
-	if t == tVal {
+	if t != tDel {
 		off += binary.PutUvarint(buf[off:], uint64(len(value)))
 		copy(buf[off:], value)
 		off += len(value)
@@ -71,26 +113,197 @@ func (b *Batch) appendRec(t vType, key, value []byte) {
 
 // Put put given key/value to the batch for insert operation.
 func (b *Batch) Put(key, value []byte) {
-	b.appendRec(tVal, key, value)
+	b.appendRec(tVal, key, value, 0)
 	b.rLen++
 }
 
 // Delete put given key to the batch for delete operation.
 func (b *Batch) Delete(key []byte) {
-	b.appendRec(tDel, key, nil)
+	b.appendRec(tDel, key, nil, 0)
+	b.rLen++
+}
+
+// Merge put given key/operand to the batch for merge operation. The
+// operand is combined with the existing value of the key by the
+// opt.Merger of the database.
+func (b *Batch) Merge(key, operand []byte) {
+	b.appendRec(tMerge, key, operand, 0)
+	b.rLen++
+}
+
+// DeleteRange put given key range to the batch for range delete
+// operation, which delete every key within [start, limit) written before
+// it. See DB.DeleteRange.
+func (b *Batch) DeleteRange(start, limit []byte) {
+	b.appendRec(tRangeDel, start, limit, 0)
 	b.rLen++
 }
 
-// Reset reset contents of the batch.
+// Like Put, but value is not copied; it is held by reference until the
+// batch is written, or another record is appended.
+func (b *Batch) putNoCopy(key, value []byte) {
+	if len(value) == 0 {
+		b.Put(key, value)
+		return
+	}
+	b.own()
+	n := 1 + binary.MaxVarintLen32 + len(key) + binary.MaxVarintLen32
+	b.grow(n)
+	off := len(b.buf)
+	buf := b.buf[:off+n]
+	buf[off] = byte(tVal)
+	off += 1
+	off += binary.PutUvarint(buf[off:], uint64(len(key)))
+	copy(buf[off:], key)
+	off += len(key)
+	off += binary.PutUvarint(buf[off:], uint64(len(value)))
+	b.buf = buf[:off]
+	b.vref = value
+	b.rLen++
+}
+
+// PutWithTs put given key/value to the batch for insert operation, with
+// given user-defined timestamp. For the same key, the entry with higher
+// timestamp wins regardless of write order; ties are broken by write
+// order. Entries written without timestamp have timestamp zero.
+func (b *Batch) PutWithTs(key, value []byte, ts uint64) {
+	b.appendRec(tVal, key, value, ts)
+	b.rLen++
+}
+
+// DeleteWithTs put given key to the batch for delete operation, with given
+// user-defined timestamp. See PutWithTs.
+func (b *Batch) DeleteWithTs(key []byte, ts uint64) {
+	b.appendRec(tDel, key, nil, ts)
+	b.rLen++
+}
+
+// PutWithTTL put given key/value to the batch for insert operation; the
+// entry expires once given duration has passed since this call, after
+// which it reads as deleted and is dropped by compaction.
+func (b *Batch) PutWithTTL(key, value []byte, ttl time.Duration) {
+	b.appendRec(tTTL, key, encodeTTLValue(value, ttlNow()+int64(ttl)), 0)
+	b.rLen++
+}
+
+// Append append operations of given batch to the batch, after the
+// operations already in it. The operations are copied, thus other may be
+// reused afterward.
+func (b *Batch) Append(other *Batch) {
+	if other.rLen == 0 {
+		return
+	}
+	b.own()
+	b.grow(len(other.buf) - kBatchHdrLen + len(other.vref))
+	b.buf = append(b.buf, other.buf[kBatchHdrLen:]...)
+	b.buf = append(b.buf, other.vref...)
+	b.rLen += other.rLen
+	if other.hasTs {
+		b.hasTs = true
+	}
+	if other.hasRangeDel {
+		b.hasRangeDel = true
+	}
+}
+
+// Reset reset contents of the batch. The backing buffer is kept for
+// reuse, unless the batch has been written to a database; the database
+// may still reference the buffer.
 func (b *Batch) Reset() {
-	b.buf = nil
+	if b.shared {
+		b.buf = nil
+		b.shared = false
+	} else {
+		b.buf = b.buf[:0]
+	}
+	b.vref = nil
 	b.seq = 0
 	b.rLen = 0
 	b.sync = false
+	b.noWAL = false
+	b.hasTs = false
+	b.hasRangeDel = false
+}
+
+// Size return the encoded length of the batch in bytes, including the
+// batch header and per-record overhead; this is the length the batch
+// contributes to the journal. Size is zero if the batch is empty.
+func (b *Batch) Size() int {
+	return len(b.buf) + len(b.vref)
+}
+
+// Len return number of operations in the batch.
+func (b *Batch) Len() int {
+	return b.rLen
+}
+
+// Replay decode the batch and call put or del for each of its operations,
+// in order; nil callback is skipped. The key and value passed to the
+// callbacks are only valid until the callback returns. Timestamps of
+// operations written by PutWithTs or DeleteWithTs are not passed, nor are
+// expiries of operations written by PutWithTTL. Replay returns
+// errors.ErrInvalid, without calling any callback, if the batch has
+// operations written by Merge or DeleteRange, and errors.ErrCorrupt if
+// the batch is malformed; the callbacks may have been called for
+// preceding operations.
+func (b *Batch) Replay(put func(key, value []byte), del func(key []byte)) error {
+	var noReplay bool
+	if err := b.decodeRec(func(i int, t vType, key, value []byte, ts uint64) {
+		if t == tMerge || t == tRangeDel {
+			noReplay = true
+		}
+	}); err != nil {
+		return err
+	}
+	if noReplay {
+		return errBatchNoReplay
+	}
+	return b.decodeRec(func(i int, t vType, key, value []byte, ts uint64) {
+		if t == tTTL && len(value) >= 8 {
+			t, value = tVal, value[8:]
+		}
+		switch t {
+		case tVal:
+			if put != nil {
+				put(key, value)
+			}
+		case tDel:
+			if del != nil {
+				del(key)
+			}
+		}
+	})
 }
 
-func (b *Batch) init(sync bool) {
+// Dump return the encoded operations of the batch, in the same format as
+// written to the journal. The batch can be reconstructed by Load.
+func (b *Batch) Dump() []byte {
+	return append(append([]byte{}, b.encode()...), b.vref...)
+}
+
+// Load reset the batch and load operations from given data, as returned
+// by Dump. The data is copied. Load returns errors.ErrCorrupt if the data
+// is malformed, e.g. the record count doesn't match the records, in which
+// case the batch is left empty.
+func (b *Batch) Load(data []byte) error {
+	b.Reset()
+	err := b.decode(append([]byte{}, data...))
+	if err == nil {
+		var n int
+		n, err = b.decodeRecN(func(i int, t vType, key, value []byte, ts uint64) {})
+		if err == nil && n != len(b.buf) {
+			err = errors.ErrCorrupt("trailing data after batch records")
+		}
+	}
+	if err != nil {
+		b.Reset()
+	}
+	return err
+}
+
+func (b *Batch) init(sync, noWAL bool) {
 	b.sync = sync
+	b.noWAL = noWAL
 }
 
 func (b *Batch) put(key, value []byte, seq uint64) {
@@ -108,14 +321,14 @@ func (b *Batch) delete(key []byte, seq uint64) {
 }
 
 func (b *Batch) append(p *Batch) {
-	if p.rLen > 0 {
-		b.grow(len(p.buf) - kBatchHdrLen)
-		b.buf = append(b.buf, p.buf[kBatchHdrLen:]...)
-		b.rLen += p.rLen
-	}
+	b.Append(p)
 	if p.sync {
 		b.sync = true
 	}
+	// journaled if any of the merged batches must be
+	if !p.noWAL {
+		b.noWAL = false
+	}
 }
 
 func (b *Batch) len() int {
@@ -123,7 +336,7 @@ func (b *Batch) len() int {
 }
 
 func (b *Batch) size() int {
-	return len(b.buf)
+	return len(b.buf) + len(b.vref)
 }
 
 func (b *Batch) encode() []byte {
@@ -146,46 +359,72 @@ func (b *Batch) decode(buf []byte) error {
 	return nil
 }
 
-func (b *Batch) decodeRec(f func(i int, t vType, key, value []byte)) error {
-	off := kBatchHdrLen
+func (b *Batch) decodeRec(f func(i int, t vType, key, value []byte, ts uint64)) error {
+	_, err := b.decodeRecN(f)
+	return err
+}
+
+// Like decodeRec, but also return the length of the decoded buffer.
+func (b *Batch) decodeRecN(f func(i int, t vType, key, value []byte, ts uint64)) (off int, err error) {
+	off = kBatchHdrLen
 	for i := 0; i < b.rLen; i++ {
 		if off >= len(b.buf) {
-			return errors.ErrCorrupt("invalid batch record length")
+			return off, errors.ErrCorrupt("invalid batch record length")
 		}
 
 		t := vType(b.buf[off])
-		if t > tVal {
-			return errors.ErrCorrupt("invalid batch record type in batch")
-		}
 		off += 1
 
+		var ts uint64
+		if t&tTs != 0 {
+			if off+8 > len(b.buf) {
+				return off, errBatchBadRecord
+			}
+			ts = binary.LittleEndian.Uint64(b.buf[off:])
+			off += 8
+			t &^= tTs
+			b.hasTs = true
+		}
+		if !t.valid() {
+			return off, errors.ErrCorrupt("invalid batch record type in batch")
+		}
+		if t == tRangeDel {
+			b.hasRangeDel = true
+		}
+
 		x, n := binary.Uvarint(b.buf[off:])
 		off += n
-		if n <= 0 || off+int(x) > len(b.buf) {
-			return errBatchBadRecord
+		if n <= 0 || x > uint64(len(b.buf)-off) {
+			return off, errBatchBadRecord
 		}
 		key := b.buf[off : off+int(x)]
 		off += int(x)
 
 		var value []byte
-		if t == tVal {
+		if t != tDel {
 			x, n := binary.Uvarint(b.buf[off:])
 			off += n
-			if n <= 0 || off+int(x) > len(b.buf) {
-				return errBatchBadRecord
+			if n <= 0 {
+				return off, errBatchBadRecord
+			}
+			if b.vref != nil && off == len(b.buf) && x == uint64(len(b.vref)) {
+				value = b.vref
+			} else if x > uint64(len(b.buf)-off) {
+				return off, errBatchBadRecord
+			} else {
+				value = b.buf[off : off+int(x)]
+				off += int(x)
 			}
-			value = b.buf[off : off+int(x)]
-			off += int(x)
 		}
 
-		f(i, t, key, value)
+		f(i, t, key, value, ts)
 	}
 
-	return nil
+	return
 }
 
 func (b *Batch) replay(to batchReplay) error {
-	return b.decodeRec(func(i int, t vType, key, value []byte) {
+	return b.decodeRec(func(i int, t vType, key, value []byte, ts uint64) {
 		switch t {
 		case tVal:
 			to.put(key, value, b.seq+uint64(i))
@@ -195,16 +434,31 @@ func (b *Batch) replay(to batchReplay) error {
 	})
 }
 
+// Return range tombstones of the batch.
+func (b *Batch) rangeDels() (rdels rangeDels, err error) {
+	err = b.decodeRec(func(i int, t vType, key, value []byte, ts uint64) {
+		if t == tRangeDel {
+			rdels = append(rdels, &rangeDel{start: dupBytes(key), limit: dupBytes(value), seq: b.seq + uint64(i)})
+		}
+	})
+	return
+}
+
 func (b *Batch) memReplay(to *memdb.DB) error {
-	return b.decodeRec(func(i int, t vType, key, value []byte) {
-		ikey := newIKey(key, b.seq+uint64(i), t)
-		to.Put(ikey, value)
+	b.shared = true
+	return b.decodeRec(func(i int, t vType, key, value []byte, ts uint64) {
+		ikey := newIKeyTs(key, ts, b.seq+uint64(i), t)
+		if b.vref != nil && i == b.rLen-1 {
+			to.PutRef(ikey, value)
+		} else {
+			to.Put(ikey, value)
+		}
 	})
 }
 
 func (b *Batch) revertMemReplay(to *memdb.DB) error {
-	return b.decodeRec(func(i int, t vType, key, value []byte) {
-		ikey := newIKey(key, b.seq+uint64(i), t)
+	return b.decodeRec(func(i int, t vType, key, value []byte, ts uint64) {
+		ikey := newIKeyTs(key, ts, b.seq+uint64(i), t)
 		to.Remove(ikey)
 	})
 }
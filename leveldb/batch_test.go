@@ -9,6 +9,8 @@ package leveldb
 import (
 	"bytes"
 	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/errors"
 )
 
 type tbRec struct {
@@ -70,6 +72,8 @@ func TestBatch_EncodeDecode(t *testing.T) {
 	b1.Put([]byte("zzzzzzzzzzz"), []byte("zzzzzzzzzzzzzzzzzzzzzzzz"))
 	b1.Delete([]byte("key10000"))
 	b1.Delete([]byte("k"))
+	b1.PutWithTs([]byte("ts"), []byte("value"), 10)
+	b1.DeleteWithTs([]byte("ts"), 11)
 	buf := b1.encode()
 	b2 := new(Batch)
 	err := b2.decode(buf)
@@ -98,3 +102,217 @@ func TestBatch_Append(t *testing.T) {
 	b2a.append(b2b)
 	compareBatch(t, b1, b2a)
 }
+
+func TestBatch_AppendCopy(t *testing.T) {
+	b1 := new(Batch)
+	b1.Put([]byte("key1"), []byte("value1"))
+	b1.Delete([]byte("key2"))
+	b1.Put([]byte("foo"), []byte("foovalue"))
+	b1.Delete([]byte("bar"))
+
+	b2 := new(Batch)
+	b2.Put([]byte("key1"), []byte("value1"))
+	b2.Delete([]byte("key2"))
+	b3 := new(Batch)
+	b3.Put([]byte("foo"), []byte("foovalue"))
+	b3.Delete([]byte("bar"))
+	b2.Append(b3)
+	b2.Append(new(Batch))
+
+	// other is reused afterward
+	b3.Reset()
+	b3.Put([]byte("xxx"), []byte("xxxxxxxx"))
+
+	compareBatch(t, b1, b2)
+	if b1.Size() != b2.Size() {
+		t.Errorf("invalid size want %d, got %d", b1.Size(), b2.Size())
+	}
+
+	b4 := new(Batch)
+	b4.Append(b1)
+	compareBatch(t, b1, b4)
+	if b1.Size() != b4.Size() {
+		t.Errorf("invalid size of appended empty batch want %d, got %d", b1.Size(), b4.Size())
+	}
+}
+
+func TestBatch_PutNoCopy(t *testing.T) {
+	b1 := new(Batch)
+	b1.Put([]byte("key1"), []byte("value1"))
+	b1.Put([]byte("key2"), []byte("value2"))
+	b2 := new(Batch)
+	b2.Put([]byte("key1"), []byte("value1"))
+	value := []byte("value2")
+	b2.putNoCopy([]byte("key2"), value)
+
+	if b2.vref == nil {
+		t.Fatal("value not held by reference")
+	}
+	compareBatch(t, b1, b2)
+	if b1.Size() != b2.Size() {
+		t.Errorf("invalid size want %d, got %d", b1.Size(), b2.Size())
+	}
+	if !bytes.Equal(b1.Dump(), b2.Dump()) {
+		t.Error("invalid dump")
+	}
+
+	// appending a record copies the value
+	b1.Delete([]byte("key1"))
+	b2.Delete([]byte("key1"))
+	copy(value, "xxxxxx")
+	compareBatch(t, b1, b2)
+
+	b3 := new(Batch)
+	b3.putNoCopy([]byte("key3"), []byte("value3"))
+	b4 := new(Batch)
+	b4.Append(b3)
+	b1.Reset()
+	b1.Put([]byte("key3"), []byte("value3"))
+	compareBatch(t, b1, b4)
+}
+
+func TestBatch_Replay(t *testing.T) {
+	b := new(Batch)
+	b.Put([]byte("key1"), []byte("value1"))
+	b.Delete([]byte("key2"))
+	b.PutWithTs([]byte("key3"), []byte("value3"), 7)
+	b.DeleteWithTs([]byte("key4"), 8)
+	if b.Len() != 4 {
+		t.Errorf("invalid record length want 4, got %d", b.Len())
+	}
+
+	var res string
+	err := b.Replay(func(key, value []byte) {
+		res += "put:" + string(key) + "=" + string(value) + " "
+	}, func(key []byte) {
+		res += "del:" + string(key) + " "
+	})
+	if err != nil {
+		t.Fatal("error when replaying batch: ", err)
+	}
+	if want := "put:key1=value1 del:key2 put:key3=value3 del:key4 "; res != want {
+		t.Errorf("invalid replay want %q, got %q", want, res)
+	}
+
+	for _, f := range []func(b *Batch){
+		func(b *Batch) { b.Merge([]byte("key5"), []byte("operand")) },
+		func(b *Batch) { b.DeleteRange([]byte("key5"), []byte("key6")) },
+	} {
+		b2 := new(Batch)
+		b2.Put([]byte("key1"), []byte("value1"))
+		f(b2)
+		called := false
+		err := b2.Replay(func(key, value []byte) {
+			called = true
+		}, nil)
+		if _, ok := err.(errors.ErrInvalid); !ok {
+			t.Errorf("batch with merge or range delete: want invalid error, got %v", err)
+		}
+		if called {
+			t.Error("batch with merge or range delete: callback called")
+		}
+	}
+
+	// Truncated records and overrunning length prefixes.
+	buf := b.encode()
+	for _, x := range [][]byte{
+		buf[:len(buf)-1],
+		buf[:kBatchHdrLen+3],
+		append(append([]byte{}, buf[:kBatchHdrLen+1]...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01),
+	} {
+		b2 := new(Batch)
+		if err := b2.decode(x); err != nil {
+			t.Fatal("error when decoding batch: ", err)
+		}
+		if err := b2.Replay(nil, nil); err == nil {
+			t.Errorf("malformed batch %q replayed without error", x)
+		}
+	}
+}
+
+func TestBatch_DumpLoad(t *testing.T) {
+	b1 := new(Batch)
+	b1.Put([]byte("key1"), []byte("value1"))
+	b1.Put([]byte("key2"), []byte("value2"))
+	b1.Delete([]byte("key1"))
+	b1.PutWithTs([]byte("ts"), []byte("value"), 10)
+	data := b1.Dump()
+
+	b2 := new(Batch)
+	if err := b2.Load(data); err != nil {
+		t.Fatal("error when loading batch: ", err)
+	}
+	data[len(data)-1]++
+	compareBatch(t, b1, b2)
+	if !b2.hasTs {
+		t.Error("timestamp flag not loaded")
+	}
+
+	h := newDbHarness(t)
+	defer h.close()
+	if err := h.db.Write(b2, h.wo); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+	h.get("key1", false)
+	h.getVal("key2", "value2")
+	h.getVal("ts", "value")
+
+	// Malformed input is rejected and leaves the batch empty.
+	good := b1.Dump()
+	badCount := append([]byte{}, good...)
+	badCount[8]++
+	for _, x := range [][]byte{
+		nil,
+		good[:kBatchHdrLen-1],
+		good[:len(good)-1],
+		append(append([]byte{}, good...), 0),
+		badCount,
+	} {
+		b3 := new(Batch)
+		b3.Put([]byte("foo"), []byte("bar"))
+		if err := b3.Load(x); err == nil {
+			t.Errorf("malformed data %q loaded without error", x)
+		}
+		if b3.Len() != 0 || b3.size() != 0 {
+			t.Errorf("batch not empty after failed load")
+		}
+	}
+}
+
+func TestBatch_SizeReset(t *testing.T) {
+	b := new(Batch)
+	if b.Size() != 0 {
+		t.Errorf("empty batch size want 0, got %d", b.Size())
+	}
+	b.Put([]byte("key1"), []byte("value1"))
+	if want := kBatchHdrLen + 1 + 1 + 4 + 1 + 6; b.Size() != want {
+		t.Errorf("batch size want %d, got %d", want, b.Size())
+	}
+	b.Delete([]byte("key2"))
+	if want := len(b.encode()); b.Size() != want {
+		t.Errorf("batch size want %d, got %d", want, b.Size())
+	}
+
+	buf := b.buf
+	b.Reset()
+	if b.Size() != 0 || b.Len() != 0 {
+		t.Errorf("batch not empty after reset, size %d, len %d", b.Size(), b.Len())
+	}
+	b.Put([]byte("key3"), []byte("value3"))
+	if &b.buf[0] != &buf[0] {
+		t.Error("backing buffer reallocated after reset")
+	}
+	b2 := new(Batch)
+	b2.Put([]byte("key3"), []byte("value3"))
+	compareBatch(t, b2, b)
+
+	// The database may reference buffer of written batch.
+	h := newDbHarness(t)
+	defer h.close()
+	if err := h.db.Write(b, h.wo); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+	b.Reset()
+	b.Put([]byte("key3"), []byte("xxxxx3"))
+	h.getVal("key3", "value3")
+}
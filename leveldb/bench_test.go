@@ -170,6 +170,36 @@ func (p *dbBench) writes(perBatch int) {
 	b.SetBytes(116)
 }
 
+// Like puts, but from given number of goroutines concurrently; batches
+// of concurrent writers are committed together.
+func (p *dbBench) concurrentPuts(writers int) {
+	b := p.b
+	db := p.db
+
+	n := len(p.keys)
+	errc := make(chan error, writers)
+	b.ResetTimer()
+	b.StartTimer()
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			for i := w; i < n; i += writers {
+				if err := db.Put(p.keys[i], p.values[i], p.wo); err != nil {
+					errc <- err
+					return
+				}
+			}
+			errc <- nil
+		}(w)
+	}
+	for w := 0; w < writers; w++ {
+		if err := <-errc; err != nil {
+			b.Fatal("put failed: ", err)
+		}
+	}
+	b.StopTimer()
+	b.SetBytes(116)
+}
+
 func (p *dbBench) drop() {
 	p.keys, p.values = nil, nil
 	runtime.GC()
@@ -328,6 +358,29 @@ func BenchmarkDBPut(b *testing.B) {
 	p.close()
 }
 
+func BenchmarkDBPutConcurrent(b *testing.B) {
+	p := openDBBench(b)
+	p.populate(b.N)
+	p.concurrentPuts(16)
+	p.close()
+}
+
+func BenchmarkDBPutConcurrentSync(b *testing.B) {
+	p := openDBBench(b)
+	p.wo.Flag = opt.WFSync
+	p.populate(b.N)
+	p.concurrentPuts(16)
+	p.close()
+}
+
+func BenchmarkDBPutSync(b *testing.B) {
+	p := openDBBench(b)
+	p.wo.Flag = opt.WFSync
+	p.populate(b.N)
+	p.puts()
+	p.close()
+}
+
 func BenchmarkDBRead(b *testing.B) {
 	p := openDBBench(b)
 	p.populate(b.N)
@@ -14,6 +14,7 @@ import (
 
 	"github.com/syndtr/goleveldb/leveldb/comparer"
 	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
 )
 
 // Reader represent a block reader.
@@ -211,6 +212,24 @@ type Iterator struct {
 	err error
 	ri  int           // restart index
 	rr  *restartRange // restart range
+
+	releaser iterator.Releaser
+}
+
+// SetReleaser set releaser to be released along with the iterator, e.g.
+// the cache handle of the block.
+func (i *Iterator) SetReleaser(r iterator.Releaser) {
+	i.releaser = r
+}
+
+// Release drop the block and release the releaser set by SetReleaser.
+func (i *Iterator) Release() {
+	i.b = nil
+	i.rr = nil
+	if i.releaser != nil {
+		i.releaser.Release()
+		i.releaser = nil
+	}
 }
 
 func (i *Iterator) getRestartOffset(idx int) (offset int, err error) {
@@ -343,6 +362,18 @@ func (i *Iterator) Seek(key []byte) (r bool) {
 	return false
 }
 
+func (i *Iterator) SeekForPrev(key []byte) bool {
+	if i.Seek(key) {
+		if i.b.cmp.Compare(i.rr.key(), key) == 0 {
+			return true
+		}
+	} else if i.err != nil || i.Empty() {
+		return false
+	}
+	// either past 'key' or past the last key
+	return i.Prev()
+}
+
 func (i *Iterator) Next() bool {
 	if i.err != nil || i.Empty() || i.ri == i.b.restartLen {
 		return false
@@ -420,4 +451,18 @@ func (i *Iterator) Value() []byte {
 	return i.rr.value()
 }
 
+func (i *Iterator) KeyCopy(dst []byte) []byte {
+	if i.rr == nil {
+		return dst
+	}
+	return append(dst, i.rr.key()...)
+}
+
+func (i *Iterator) ValueCopy(dst []byte) []byte {
+	if i.rr == nil {
+		return dst
+	}
+	return append(dst, i.rr.value()...)
+}
+
 func (i *Iterator) Error() error { return i.err }
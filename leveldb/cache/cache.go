@@ -11,6 +11,20 @@ package cache
 // event of key has no mapping.
 type SetFunc func() (ok bool, value interface{}, charge int, fin func())
 
+// Stats holds counters of cache operations. Hits and Misses count
+// lookups, Inserts count caches set on a miss and Evictions count caches
+// evicted to stay within the capacity.
+type Stats struct {
+	Hits, Misses, Inserts, Evictions uint64
+}
+
+// StatsGetter is the interface that wraps the GetStats method. A Cache
+// may optionally implement this interface.
+type StatsGetter interface {
+	// Get counters of cache operations so far.
+	GetStats() Stats
+}
+
 type Cache interface {
 	// Set cache capacity.
 	SetCapacity(capacity int)
@@ -43,6 +57,21 @@ type Namespace interface {
 	// to it have been released and the finalizer will finally be executed.
 	Delete(key uint64, fin func()) bool
 
+	// Pin the cache for given key, if exist, so that it is not evicted
+	// until unpinned; pins of the same key nest. A pinned cache still
+	// counts toward the capacity, and may still be deleted.
+	Pin(key uint64) bool
+
+	// Unpin the cache for given key, which is then evictable once all of
+	// its pins have been unpinned.
+	Unpin(key uint64)
+
+	// Set function called with the key of each cache of the namespace
+	// once actually removed, i.e. evicted or deleted and all of its
+	// handles released, after the finalizers have been executed. Unlike
+	// the finalizers it is not tied to a cache; it may be nil.
+	SetOnEvict(f func(key uint64))
+
 	// Delete all caches. Note that the caches will be kept around until all
 	// of its existing handles have been released and the finalizer will
 	// finally be executed.
@@ -136,6 +136,44 @@ func TestLRUCache_Eviction(t *testing.T) {
 	}
 }
 
+func TestLRUCache_Pin(t *testing.T) {
+	c := NewLRUCache(3)
+	ns := c.GetNamespace(0)
+	set(ns, 1, 1, 1, nil).Release()
+	if !ns.Pin(1) || !ns.Pin(1) {
+		t.Fatal("cannot pin key '1'")
+	}
+	if ns.Pin(2) {
+		t.Error("pinned missing key '2'")
+	}
+	for i := uint64(2); i < 10; i++ {
+		set(ns, i, int(i), 1, nil).Release()
+	}
+	if r, ok := ns.Get(1, nil); !ok {
+		t.Fatal("miss for pinned key '1'")
+	} else {
+		r.Release()
+	}
+
+	// Unpin once, still pinned.
+	ns.Unpin(1)
+	set(ns, 10, 10, 1, nil).Release()
+	if r, ok := ns.Get(1, nil); !ok {
+		t.Fatal("miss for pinned key '1'")
+	} else {
+		r.Release()
+	}
+
+	ns.Unpin(1)
+	for i := uint64(11); i < 14; i++ {
+		set(ns, i, int(i), 1, nil).Release()
+	}
+	if r, ok := ns.Get(1, nil); ok {
+		t.Error("hit for unpinned key '1'")
+		r.Release()
+	}
+}
+
 func TestLRUCache_SetGet(t *testing.T) {
 	c := NewLRUCache(13)
 	ns := c.GetNamespace(0)
@@ -158,6 +196,102 @@ func TestLRUCache_SetGet(t *testing.T) {
 	}
 }
 
+func TestLRUCache_Stats(t *testing.T) {
+	c := NewLRUCache(2)
+	ns := c.GetNamespace(0)
+	set(ns, 1, 1, 1, nil).Release()
+	set(ns, 2, 2, 1, nil).Release()
+	set(ns, 1, 1, 1, nil).Release()
+	if _, ok := ns.Get(3, nil); ok {
+		t.Fatal("hit for key '3'")
+	}
+	set(ns, 3, 3, 1, nil).Release()
+
+	want := Stats{Hits: 1, Misses: 4, Inserts: 3, Evictions: 1}
+	if got := c.GetStats(); got != want {
+		t.Errorf("invalid stats, want %+v, got %+v", want, got)
+	}
+}
+
+func TestLRUCache_OnEvict(t *testing.T) {
+	c := NewLRUCache(1)
+	ns := c.GetNamespace(0)
+	var evicted []uint64
+	ns.SetOnEvict(func(key uint64) {
+		evicted = append(evicted, key)
+	})
+
+	fin := false
+	r := set(ns, 1, 1, 1, func() {
+		fin = true
+	})
+	set(ns, 2, 2, 1, nil).Release()
+	if len(evicted) != 0 {
+		t.Fatalf("evict callback called while handle held: %v", evicted)
+	}
+	r.Release()
+	if !fin || len(evicted) != 1 || evicted[0] != 1 {
+		t.Fatalf("expect key '1' evicted after finalizer, fin=%v evicted=%v", fin, evicted)
+	}
+	ns.Delete(2, nil)
+	if len(evicted) != 2 || evicted[1] != 2 {
+		t.Fatalf("expect key '2' evicted, got %v", evicted)
+	}
+}
+
+func TestShardedLRUCache_SetGet(t *testing.T) {
+	c := NewShardedLRUCache(64, 4)
+	ns := c.GetNamespace(0)
+	for i := uint64(0); i < 1000; i++ {
+		set(ns, i, i, 1, nil).Release()
+		if p, ok := ns.Get(i, nil); ok {
+			if got := p.Value().(uint64); got != i {
+				t.Errorf("invalid value for key '%d' want '%d', got '%d'", i, i, got)
+			}
+			p.Release()
+		} else {
+			t.Errorf("key '%d' doesn't exist", i)
+		}
+	}
+
+	n := 0
+	for i := uint64(0); i < 1000; i++ {
+		if p, ok := ns.Get(i, nil); ok {
+			p.Release()
+			n++
+		}
+	}
+	if n == 0 || n > 64 {
+		t.Errorf("invalid number of cached keys, want 1 to 64, got %d", n)
+	}
+}
+
+func benchmarkCacheGetParallel(b *testing.B, c Cache) {
+	const n = 1000
+	ns := c.GetNamespace(0)
+	for i := uint64(0); i < n; i++ {
+		set(ns, i, i, 1, nil).Release()
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			if p, ok := ns.Get(uint64(r.Intn(n)), nil); ok {
+				p.Release()
+			}
+		}
+	})
+}
+
+// Run with GOMAXPROCS>1, e.g. -cpu 8, to compare lock contention.
+func BenchmarkLRUCache_GetParallel(b *testing.B) {
+	benchmarkCacheGetParallel(b, NewLRUCache(1000))
+}
+
+func BenchmarkShardedLRUCache_GetParallel(b *testing.B) {
+	benchmarkCacheGetParallel(b, NewShardedLRUCache(1000, 16))
+}
+
 func BenchmarkLRUCache_SetRelease(b *testing.B) {
 	capacity := b.N / 100
 	if capacity <= 0 {
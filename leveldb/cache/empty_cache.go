@@ -6,8 +6,19 @@
 
 package cache
 
+// EmptyCache is a cache that never retains anything. GetNamespace
+// returns a stateless pass-through namespace, allocating nothing; Get
+// calls the setter on every lookup and the finalizer once the returned
+// object is released. Thus, used as block cache, every block read hits
+// the storage.
 type EmptyCache struct{}
 
+// NewNoCache returns a cache that never retains anything, i.e. an
+// EmptyCache. It may be used to disable the block cache.
+func NewNoCache() Cache {
+	return EmptyCache{}
+}
+
 func (EmptyCache) SetCapacity(capacity int) {}
 
 func (EmptyCache) GetNamespace(id uint64) Namespace {
@@ -41,6 +52,15 @@ func (emptyCacheNs) Delete(key uint64, fin func()) bool {
 	return false
 }
 
+func (emptyCacheNs) Pin(key uint64) bool {
+	return false
+}
+
+func (emptyCacheNs) Unpin(key uint64) {}
+
+// SetOnEvict does nothing, as nothing is ever cached.
+func (emptyCacheNs) SetOnEvict(f func(key uint64)) {}
+
 func (emptyCacheNs) Purge(fin func()) {
 	if fin != nil {
 		fin()
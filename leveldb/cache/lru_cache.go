@@ -13,6 +13,9 @@ import (
 
 // LRUCache represent a LRU cache state.
 type LRUCache struct {
+	// Need 64-bit alignment.
+	hits, misses, inserts, evictions uint64
+
 	sync.Mutex
 
 	recent   lruNode
@@ -69,10 +72,30 @@ func (c *LRUCache) Purge(fin func()) {
 		n.evict_NB()
 		n = c.recent.rPrev
 	}
+	// pinned caches are not on the recent list
+	for _, ns := range c.table {
+		for _, n := range ns.table {
+			if n.pin > 0 && !n.deleted {
+				n.deleted = true
+				n.delfin = fin
+				n.evict_NB()
+			}
+		}
+	}
 	c.size = 0
 	c.Unlock()
 }
 
+// GetStats return counters of cache operations so far.
+func (c *LRUCache) GetStats() Stats {
+	return Stats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Inserts:   atomic.LoadUint64(&c.inserts),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+}
+
 func (c *LRUCache) Zap() {
 	c.Lock()
 	for _, ns := range c.table {
@@ -80,6 +103,9 @@ func (c *LRUCache) Zap() {
 			n.rNext = nil
 			n.rPrev = nil
 			n.execFin()
+			if ns.onEvict != nil {
+				ns.onEvict(n.key)
+			}
 		}
 		ns.zapped = true
 		ns.table = nil
@@ -97,15 +123,17 @@ func (c *LRUCache) evict() {
 		n.rRemove()
 		n.evict_NB()
 		c.size -= n.charge
+		atomic.AddUint64(&c.evictions, 1)
 		n = c.recent.rPrev
 	}
 }
 
 type lruNs struct {
-	lru    *LRUCache
-	id     uint64
-	table  map[uint64]*lruNode
-	zapped bool
+	lru     *LRUCache
+	id      uint64
+	table   map[uint64]*lruNode
+	zapped  bool
+	onEvict func(key uint64)
 }
 
 func (p *lruNs) Get(key uint64, setf SetFunc) (obj Object, ok bool) {
@@ -114,6 +142,7 @@ func (p *lruNs) Get(key uint64, setf SetFunc) (obj Object, ok bool) {
 
 	if p.zapped {
 		lru.Unlock()
+		atomic.AddUint64(&lru.misses, 1)
 		if setf == nil {
 			return
 		}
@@ -125,13 +154,15 @@ func (p *lruNs) Get(key uint64, setf SetFunc) (obj Object, ok bool) {
 
 	n, ok := p.table[key]
 	if ok {
-		if !n.deleted {
+		atomic.AddUint64(&lru.hits, 1)
+		if !n.deleted && n.pin == 0 {
 			// bump to front
 			n.rRemove()
 			n.rInsert(&lru.recent)
 		}
 		atomic.AddInt32(&n.ref, 1)
 	} else {
+		atomic.AddUint64(&lru.misses, 1)
 		if setf == nil {
 			lru.Unlock()
 			return
@@ -142,6 +173,7 @@ func (p *lruNs) Get(key uint64, setf SetFunc) (obj Object, ok bool) {
 			lru.Unlock()
 			return nil, false
 		}
+		atomic.AddUint64(&lru.inserts, 1)
 
 		n = &lruNode{
 			ns:     p,
@@ -199,6 +231,50 @@ func (p *lruNs) Delete(key uint64, fin func()) bool {
 	return true
 }
 
+func (p *lruNs) Pin(key uint64) bool {
+	lru := p.lru
+	lru.Lock()
+	defer lru.Unlock()
+
+	if p.zapped {
+		return false
+	}
+	n, ok := p.table[key]
+	if !ok || n.deleted || (n.pin == 0 && n.rPrev == nil) {
+		// not cached, or evicted while handles still held
+		return false
+	}
+	n.pin++
+	// out of the recent list, thus never picked for eviction
+	n.rRemove()
+	return true
+}
+
+func (p *lruNs) Unpin(key uint64) {
+	lru := p.lru
+	lru.Lock()
+	defer lru.Unlock()
+
+	if p.zapped {
+		return
+	}
+	n, ok := p.table[key]
+	if !ok || n.pin == 0 {
+		return
+	}
+	n.pin--
+	if n.pin == 0 && !n.deleted {
+		n.rInsert(&lru.recent)
+		lru.evict()
+	}
+}
+
+func (p *lruNs) SetOnEvict(f func(key uint64)) {
+	p.lru.Lock()
+	p.onEvict = f
+	p.lru.Unlock()
+}
+
 func (p *lruNs) Purge(fin func()) {
 	lru := p.lru
 
@@ -232,6 +308,9 @@ func (p *lruNs) Zap() {
 			lru.size -= n.charge
 		}
 		n.execFin()
+		if p.onEvict != nil {
+			p.onEvict(n.key)
+		}
 	}
 	p.zapped = true
 	p.table = nil
@@ -248,6 +327,7 @@ type lruNode struct {
 	value   interface{}
 	charge  int
 	ref     int32
+	pin     int
 	deleted bool
 	setfin  func()
 	delfin  func()
@@ -296,6 +376,9 @@ func (n *lruNode) doEvict() {
 
 	// execute finalizer
 	n.execFin()
+	if n.ns.onEvict != nil {
+		n.ns.onEvict(n.key)
+	}
 
 	n.value = nil
 }
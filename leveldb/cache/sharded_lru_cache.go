@@ -0,0 +1,120 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package cache
+
+// ShardedLRUCache represent a LRU cache split into independent shards,
+// each with its own lock. Caches are spread across the shards by hash of
+// their namespace id and key, thus concurrent accesses rarely contend on
+// the same lock. Each shard evicts on its own, holding an equal share of
+// the capacity.
+type ShardedLRUCache struct {
+	shards []*LRUCache
+}
+
+// NewShardedLRUCache create new initialized sharded LRU cache with given
+// total capacity and number of shards; shards less than one is one.
+func NewShardedLRUCache(capacity, shards int) *ShardedLRUCache {
+	if shards < 1 {
+		shards = 1
+	}
+	c := &ShardedLRUCache{shards: make([]*LRUCache, shards)}
+	for i := range c.shards {
+		c.shards[i] = NewLRUCache(shardCapacity(capacity, shards))
+	}
+	return c
+}
+
+func shardCapacity(capacity, shards int) int {
+	return (capacity + shards - 1) / shards
+}
+
+// SetCapacity set cache capacity, divided equally among the shards.
+func (c *ShardedLRUCache) SetCapacity(capacity int) {
+	for _, s := range c.shards {
+		s.SetCapacity(shardCapacity(capacity, len(c.shards)))
+	}
+}
+
+// GetNamespace return namespace object for given id.
+func (c *ShardedLRUCache) GetNamespace(id uint64) Namespace {
+	p := &shardedNs{id: id, ns: make([]Namespace, len(c.shards))}
+	for i, s := range c.shards {
+		p.ns[i] = s.GetNamespace(id)
+	}
+	return p
+}
+
+// Purge purge entire cache.
+func (c *ShardedLRUCache) Purge(fin func()) {
+	for _, s := range c.shards {
+		s.Purge(fin)
+	}
+}
+
+// GetStats return counters of cache operations so far, summed over the
+// shards.
+func (c *ShardedLRUCache) GetStats() (st Stats) {
+	for _, s := range c.shards {
+		x := s.GetStats()
+		st.Hits += x.Hits
+		st.Misses += x.Misses
+		st.Inserts += x.Inserts
+		st.Evictions += x.Evictions
+	}
+	return
+}
+
+func (c *ShardedLRUCache) Zap() {
+	for _, s := range c.shards {
+		s.Zap()
+	}
+}
+
+type shardedNs struct {
+	id uint64
+	ns []Namespace
+}
+
+// Return namespace of the shard holding given key.
+func (p *shardedNs) shard(key uint64) Namespace {
+	h := (p.id*0x9e3779b97f4a7c15 ^ key) * 0xbf58476d1ce4e5b9
+	return p.ns[(h>>32)%uint64(len(p.ns))]
+}
+
+func (p *shardedNs) Get(key uint64, setf SetFunc) (obj Object, ok bool) {
+	return p.shard(key).Get(key, setf)
+}
+
+func (p *shardedNs) Delete(key uint64, fin func()) bool {
+	return p.shard(key).Delete(key, fin)
+}
+
+func (p *shardedNs) Pin(key uint64) bool {
+	return p.shard(key).Pin(key)
+}
+
+func (p *shardedNs) Unpin(key uint64) {
+	p.shard(key).Unpin(key)
+}
+
+func (p *shardedNs) SetOnEvict(f func(key uint64)) {
+	for _, ns := range p.ns {
+		ns.SetOnEvict(f)
+	}
+}
+
+func (p *shardedNs) Purge(fin func()) {
+	for _, ns := range p.ns {
+		ns.Purge(fin)
+	}
+}
+
+func (p *shardedNs) Zap() {
+	for _, ns := range p.ns {
+		ns.Zap()
+	}
+}
@@ -20,7 +20,11 @@ func (p *iComparer) Compare(a, b []byte) int {
 	ia, ib := iKey(a), iKey(b)
 	r := p.cmp.Compare(ia.ukey(), ib.ukey())
 	if r == 0 {
-		an, bn := ia.num(), ib.num()
+		// Higher timestamp first, then higher sequence number first
+		an, bn := ia.ts(), ib.ts()
+		if an == bn {
+			an, bn = ia.num(), ib.num()
+		}
 		if an > bn {
 			r = -1
 		} else if an < bn {
@@ -30,18 +34,23 @@ func (p *iComparer) Compare(a, b []byte) int {
 	return r
 }
 
+// The user comparer separator is used only if it is shorter and within
+// the user keys range, otherwise a is kept as is; a separator outside of
+// the range would misdirect index block lookups.
 func (p *iComparer) Separator(a, b []byte) []byte {
 	ua, ub := iKey(a).ukey(), iKey(b).ukey()
 	r := p.cmp.Separator(ua, ub)
-	if len(r) < len(ua) && p.cmp.Compare(ua, r) < 0 {
+	if len(r) < len(ua) && p.cmp.Compare(ua, r) < 0 && p.cmp.Compare(r, ub) < 0 {
 		rr := make([]byte, len(r)+8)
 		copy(rr, r)
 		copy(rr[len(r):], kMaxNumBytes)
 		return rr
 	}
-	return append(r, a[len(r):]...)
+	return a
 }
 
+// Like Separator, the user comparer successor is used only if it is
+// shorter and not less than the user key.
 func (p *iComparer) Successor(b []byte) []byte {
 	ub := iKey(b).ukey()
 	r := p.cmp.Successor(ub)
@@ -51,5 +60,5 @@ func (p *iComparer) Successor(b []byte) []byte {
 		copy(rr[len(r):], kMaxNumBytes)
 		return rr
 	}
-	return append(r, b[len(r):]...)
+	return b
 }
@@ -0,0 +1,89 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package comparer
+
+type caseInsensitiveComparer struct{}
+
+// NewCaseInsensitive returns a bytewise comparer that ignores case of
+// ASCII letters, i.e. keys are ordered as if ASCII upper case letters
+// were lower case. Keys differing only in case are equal, thus they are
+// the same key.
+//
+// Note that filters hash the key bytes as is, hence must not be used
+// along with this comparer; a lookup with different case than the key
+// was written with could be ruled out by the filter.
+func NewCaseInsensitive() Comparer {
+	return caseInsensitiveComparer{}
+}
+
+func foldByte(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func (caseInsensitiveComparer) Compare(a, b []byte) int {
+	n := len(a)
+	if n > len(b) {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		ca, cb := foldByte(a[i]), foldByte(b[i])
+		if ca < cb {
+			return -1
+		} else if ca > cb {
+			return 1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+func (caseInsensitiveComparer) Name() string {
+	return "leveldb.CaseInsensitiveBytewiseComparator"
+}
+
+func (caseInsensitiveComparer) Separator(a, b []byte) []byte {
+	i, n := 0, len(a)
+	if n > len(b) {
+		n = len(b)
+	}
+	for i < n && foldByte(a[i]) == foldByte(b[i]) {
+		i++
+	}
+
+	if i >= n {
+		// Do not shorten if one string is a prefix of the other
+	} else if c := foldByte(a[i]); c < 0xff && foldByte(c+1) == c+1 && c+1 < foldByte(b[i]) {
+		// An upper case c+1 would fold past b[i], it is never used
+		r := make([]byte, i+1)
+		copy(r, a)
+		r[i] = c + 1
+		return r
+	}
+	return a
+}
+
+func (caseInsensitiveComparer) Successor(b []byte) []byte {
+	for i := range b {
+		if c := foldByte(b[i]); c != 0xff {
+			// c+1 folds to itself or to a greater letter, either way
+			// greater than b[i]
+			r := make([]byte, i+1)
+			copy(r, b)
+			r[i] = c + 1
+			return r
+		}
+	}
+	return b
+}
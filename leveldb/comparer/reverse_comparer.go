@@ -0,0 +1,58 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package comparer
+
+type reverseComparer struct {
+	cmp Comparer
+}
+
+// Reverse returns a comparer ordering keys in the reverse order of given
+// comparer, named "reverse(<name of given comparer>)".
+//
+// Separator and Successor shorten keys if given comparer is BytesComparer,
+// for other comparers keys are returned unchanged, which is correct albeit
+// less space efficient.
+func Reverse(cmp Comparer) Comparer {
+	return reverseComparer{cmp}
+}
+
+func (p reverseComparer) Compare(a, b []byte) int {
+	return p.cmp.Compare(b, a)
+}
+
+func (p reverseComparer) Name() string {
+	return "reverse(" + p.cmp.Name() + ")"
+}
+
+// Return a short string in (b,a] of the bytewise order, given b < a.
+func (p reverseComparer) Separator(a, b []byte) []byte {
+	if _, ok := p.cmp.(BytesComparer); !ok {
+		return a
+	}
+	i, n := 0, len(a)
+	if n > len(b) {
+		n = len(b)
+	}
+	for i < n && a[i] == b[i] {
+		i++
+	}
+	if i < len(a) && p.Compare(a, b) < 0 {
+		// Either a[i] > b[i], or b is a prefix of a; the prefix of a up
+		// to i is then greater than b in the bytewise order.
+		return a[:i+1]
+	}
+	return a
+}
+
+// The empty string is the smallest of the bytewise order, thus the
+// greatest of the reverse order.
+func (p reverseComparer) Successor(b []byte) []byte {
+	if _, ok := p.cmp.(BytesComparer); !ok {
+		return b
+	}
+	return b[:0]
+}
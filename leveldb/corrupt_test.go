@@ -10,9 +10,12 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"sort"
 	"testing"
 
 	"github.com/syndtr/goleveldb/leveldb/cache"
+	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/journal"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/storage"
@@ -124,6 +127,48 @@ func (h *dbCorruptHarness) corrupt(ft storage.FileType, offset, n int) {
 	w.Close()
 }
 
+func (h *dbCorruptHarness) truncate(ft storage.FileType, n int) {
+	p := &h.dbHarness
+	t := p.t
+
+	var file storage.File
+	for _, f := range p.stor.GetFiles(ft) {
+		if file == nil || f.Num() > file.Num() {
+			file = f
+		}
+	}
+	if file == nil {
+		t.Fatalf("no such file with type %q", ft)
+	}
+
+	r, err := file.Open()
+	if err != nil {
+		t.Fatal("cannot open file: ", err)
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("cannot read file: ", err)
+	}
+	r.Close()
+	if n > len(buf) {
+		n = len(buf)
+	}
+
+	err = file.Remove()
+	if err != nil {
+		t.Fatal("cannot remove old file: ", err)
+	}
+	w, err := file.Create()
+	if err != nil {
+		t.Fatal("cannot create new file: ", err)
+	}
+	_, err = w.Write(buf[:len(buf)-n])
+	if err != nil {
+		t.Fatal("cannot write new file: ", err)
+	}
+	w.Close()
+}
+
 func (h *dbCorruptHarness) check(min, max int) {
 	p := &h.dbHarness
 	t := p.t
@@ -169,6 +214,29 @@ func TestCorruptDB_Journal(t *testing.T) {
 	h.close()
 }
 
+func TestCorruptDB_JournalTornTail(t *testing.T) {
+	// Cut the last record mid-payload, mid-header and within a
+	// fragment spanning a block boundary.
+	for _, x := range []struct{ n, want int }{
+		{500, 99},
+		{ctValSize + 10, 99},
+		{journal.BlockSize / 2, 84},
+	} {
+		h := newDbCorruptHarness(t)
+
+		h.build(100)
+		h.closeDB()
+		h.truncate(storage.TypeJournal, x.n)
+
+		h.openDB()
+		h.check(x.want, x.want)
+		h.put(string(tkey(100)), "v")
+		h.getVal(string(tkey(100)), "v")
+
+		h.close()
+	}
+}
+
 func TestCorruptDB_Table(t *testing.T) {
 	h := newDbCorruptHarness(t)
 
@@ -268,6 +336,76 @@ func TestCorruptDB_SequenceNumberRecoveryTable(t *testing.T) {
 	h.close()
 }
 
+func TestCorruptDB_RecoverSkipsUnreadableTable(t *testing.T) {
+	h := newDbCorruptHarness(t)
+
+	h.put("a", "va")
+	h.compactMem()
+	h.put("b", "vb")
+	h.compactMem()
+	h.put("c", "vc")
+	h.closeDB()
+	h.corrupt(storage.TypeTable, -100, 100)
+	h.corrupt(storage.TypeManifest, 0, 1000)
+	h.openAssert(false)
+
+	h.recover()
+	h.getVal("a", "va")
+	h.get("b", false)
+	h.getVal("c", "vc")
+	h.put("d", "vd")
+
+	// the unreadable table is moved aside rather than removed
+	lost := func() int {
+		h.stor.mu.Lock()
+		defer h.stor.mu.Unlock()
+		return len(h.stor.lost)
+	}
+	if n := lost(); n != 1 {
+		t.Errorf("tables moved aside: want 1, got %d", n)
+	}
+
+	h.reopenDB()
+	h.getKeyVal("(a->va)(c->vc)(d->vd)")
+	if n := lost(); n != 1 {
+		t.Errorf("tables moved aside after reopen: want 1, got %d", n)
+	}
+
+	h.close()
+}
+
+func TestCorruptDB_RecoverRangeDel(t *testing.T) {
+	h := newDbCorruptHarness(t)
+
+	h.put("a", "va")
+	h.put("b", "vb")
+	h.put("c", "vc")
+	h.put("d", "vd")
+	h.compactMem()
+	if err := h.db.DeleteRange([]byte("b"), []byte("d"), h.wo); err != nil {
+		t.Fatal("DeleteRange: got error: ", err)
+	}
+	h.put("e", "ve")
+	h.compactMem()
+	h.closeDB()
+	h.corrupt(storage.TypeManifest, 0, 1000)
+	h.openAssert(false)
+
+	h.recover()
+	h.getKeyVal("(a->va)(d->vd)(e->ve)")
+	h.put("c", "vc2")
+
+	h.reopenDB()
+	h.getKeyVal("(a->va)(c->vc2)(d->vd)(e->ve)")
+	h.compactRange("", "")
+	h.getKeyVal("(a->va)(c->vc2)(d->vd)(e->ve)")
+	if n := len(h.db.s.version().rdels); n != 0 {
+		t.Errorf("got %d range tombstones after compaction, want 0", n)
+	}
+
+	h.close()
+}
+
 func TestCorruptDB_CorruptedManifest(t *testing.T) {
 	h := newDbCorruptHarness(t)
 
@@ -301,6 +439,119 @@ func TestCorruptDB_CompactionInputError(t *testing.T) {
 	h.close()
 }
 
+func TestCorruptDB_CorruptedTableError(t *testing.T) {
+	h := newDbCorruptHarness(t)
+
+	h.build(10)
+	h.compactMem()
+	h.closeDB()
+	tables := h.stor.GetFiles(storage.TypeTable)
+	if len(tables) != 1 {
+		t.Fatalf("expect a single table, got %d", len(tables))
+	}
+	h.corrupt(storage.TypeTable, 100, 1)
+
+	h.openDB()
+	check := func(err error) {
+		e, ok := err.(*errors.ErrCorrupted)
+		if !ok {
+			t.Fatalf("expect ErrCorrupted, got %#v", err)
+		}
+		if e.File != tables[0].Num() || e.Offset != 0 {
+			t.Errorf("invalid ErrCorrupted, got file=%d offset=%d, want file=%d offset=0",
+				e.File, e.Offset, tables[0].Num())
+		}
+		if !errors.IsCorrupted(err) {
+			t.Error("IsCorrupted: got false")
+		}
+	}
+	ro := &opt.ReadOptions{Flag: opt.RFVerifyChecksums}
+	_, err := h.db.Get(tkey(0), ro)
+	check(err)
+	iter := h.db.NewIterator(ro)
+	for iter.Next() {
+	}
+	check(iter.Error())
+	iter.Release()
+
+	h.close()
+}
+
+func TestCorruptDB_SkipCorrupt(t *testing.T) {
+	h := newDbCorruptHarness(t)
+
+	// Two level-0 tables: keys 0..9, then keys 10..19 along with a newer
+	// version of key 5.
+	h.build(10)
+	h.compactMem()
+	p := &h.dbHarness
+	for i := 10; i < 20; i++ {
+		p.put(string(tkey(i)), string(tval(i, ctValSize)))
+	}
+	p.put(string(tkey(5)), "new")
+	h.compactMem()
+	h.closeDB()
+	// corrupt the first data block of the newest table
+	h.corrupt(storage.TypeTable, 100, 1)
+	var num uint64
+	for _, f := range h.stor.GetFiles(storage.TypeTable) {
+		if f.Num() > num {
+			num = f.Num()
+		}
+	}
+
+	h.openDB()
+	if nums := p.db.SkippedTables(); len(nums) != 0 {
+		t.Errorf("SkippedTables: got %v, want none", nums)
+	}
+
+	ro := &opt.ReadOptions{Flag: opt.RFVerifyChecksums}
+	iter := p.db.NewIterator(ro)
+	for iter.Next() {
+	}
+	if !errors.IsCorrupted(iter.Error()) {
+		t.Errorf("expect corruption error without skip, got %v", iter.Error())
+	}
+	iter.Release()
+
+	ro.Flag |= opt.RFSkipCorrupt
+	for _, backward := range []bool{false, true} {
+		iter = p.db.NewIterator(ro)
+		var keys []int
+		for ok := iter.First(); ok; ok = iter.Next() {
+			if backward {
+				break
+			}
+			k := 0
+			fmt.Sscanf(string(iter.Key()), "%d", &k)
+			keys = append(keys, k)
+		}
+		if backward {
+			for ok := iter.Last(); ok; ok = iter.Prev() {
+				k := 0
+				fmt.Sscanf(string(iter.Key()), "%d", &k)
+				keys = append([]int{k}, keys...)
+			}
+		}
+		if err := iter.Error(); err != nil {
+			t.Errorf("backward=%v: iterator error: %v", backward, err)
+		}
+		iter.Release()
+		// Only the older table is left going forward. Going backward,
+		// entries of the newest table past its corrupt block were yielded
+		// before the corruption was found.
+		if len(keys) < 10 || !sort.IntsAreSorted(keys) || keys[0] != 0 || keys[9] != 9 ||
+			(!backward && len(keys) != 10) {
+			t.Errorf("backward=%v: got keys %v, want 0..9", backward, keys)
+		}
+	}
+	if nums := p.db.SkippedTables(); len(nums) != 1 || nums[0] != num {
+		t.Errorf("SkippedTables: got %v, want [%d]", nums, num)
+	}
+
+	h.close()
+}
+
 func TestCorruptDB_UnrelatedKeys(t *testing.T) {
 	h := newDbCorruptHarness(t)
 
@@ -7,48 +7,92 @@
 package leveldb
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
+	"github.com/syndtr/goleveldb/leveldb/cache"
 	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/filter"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/memdb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/table"
 )
 
 // DB represent a database session.
 type DB struct {
+	*dbState
+
+	shared   *sharedDB // registry entry, if opened by OpenFile
+	released bool      // whether the reference is closed; guarded by sharedMu
+	copMu    sync.Mutex
+	cop      *closeOp // close in progress, started by CloseWithTimeout
+}
+
+// dbState is the state of a database session, shared by its handles.
+type dbState struct {
 	// Need 64-bit alignment.
-	seq, fseq uint64
+	seq, fseq, sseq, dseq uint64
 
 	s *session
 
-	cch     chan cSignal       // compaction worker signal
-	creq    chan *cReq         // compaction request
-	wlock   chan struct{}      // writer mutex
-	wqueue  chan *Batch        // writer queue
-	wack    chan error         // writer ack
-	jch     chan *Batch        // journal writer chan
-	jack    chan error         // journal writer ack
-	ewg     sync.WaitGroup     // exit WaitGroup
-	cstats  [kNumLevels]cStats // Compaction stats
+	cch     chan cSignal   // compaction worker signal
+	creq    chan *cReq     // compaction request
+	wlock   chan struct{}  // writer mutex
+	wqueue  chan *Batch    // writer queue
+	wack    chan error     // writer ack
+	jch     chan *Batch    // journal writer chan
+	jack    chan error     // journal writer ack
+	ewg     sync.WaitGroup // exit WaitGroup
+	cwg     sync.WaitGroup // compaction workers WaitGroup
+	cbusy   bool           // compaction workers running; compaction goroutine only
+	swg     sync.WaitGroup // journal syncer exit WaitGroup
+	cstats  []cStats       // Compaction stats
+	climit  rateLimiter    // Compaction IO limiter
+	cprogMu sync.Mutex     // guards cprog
+	cprog   []*cProgress   // progress of running table compactions
 	closeCb func() error
+	nsMu    sync.Mutex
+	nsdbs   map[string]*NamespaceDB // handles of GetNamespaceDB
 
 	mem      unsafe.Pointer
 	journal  *journalWriter
 	fjournal *journalWriter
 	snaps    *snaps
 	closed   uint32
+	readOnly bool
 	err      unsafe.Pointer
+	pins     unsafe.Pointer
+	ts       uint32
+	nowal    uint32 // whether mem may hold writes not journaled
+	nwseq    uint64 // first seq not journaled held by current mem, or zero
+	fnwseq   uint64 // first seq not journaled held by frozen mem, or zero
+	niters   int32  // outstanding iterators
+	nsnaps   int32  // outstanding snapshots
+
+	dmu sync.Mutex
+	dch chan struct{} // closed when durable seq advanced
+
+	amu      sync.Mutex
+	aqueue   []*asyncWrite // pending async writes, in submission order
+	arunning bool          // whether the async writer goroutine runs
+
+	closeC chan struct{} // closed when DB closed
 }
 
 func openDB(s *session) (db *DB, err error) {
-	db = &DB{
+	db = &DB{dbState: &dbState{
 		s:      s,
 		cch:    make(chan cSignal),
 		creq:   make(chan *cReq),
@@ -59,27 +103,66 @@ func openDB(s *session) (db *DB, err error) {
 		jack:   make(chan error),
 		seq:    s.stSeq,
 		snaps:  newSnaps(),
+		dch:    make(chan struct{}),
+		cstats: make([]cStats, s.o.GetNumLevels()),
+		closeC: make(chan struct{}),
+	}}
+	if s.stTs {
+		db.ts = 1
 	}
 
-	err = db.recoverJournal()
+	db.readOnly = s.o.HasFlag(opt.OFReadOnly)
+	if db.readOnly {
+		err = db.recoverJournalReadOnly()
+	} else {
+		err = db.recoverJournal()
+	}
 	if err != nil {
 		return
 	}
 
+	// recovered journals had been flushed to tables
+	db.dseq = db.seq
+
+	// snapshots of previous session are gone
+	db.snaps.setRetained(db.seq)
+
+	if db.readOnly {
+		// neither compaction nor journal writer is needed
+		db = db.handle()
+		return
+	}
+
 	// remove any obsolete files
 	db.cleanFiles()
 
 	db.ewg.Add(2)
 	go db.compaction()
 	go db.writeJournal()
+	if interval := s.o.GetWALSyncInterval(); interval > 0 {
+		db.swg.Add(1)
+		go db.syncJournal(interval)
+	}
 	// wait for compaction goroutine
 	db.cch <- cWait
 
-	runtime.SetFinalizer(db, (*DB).Close)
+	db = db.handle()
 	return
 }
 
+// Return a new handle of the DB, which is closed once unreachable; the
+// goroutines of the DB hold a handle of their own, thus don't keep it
+// reachable.
+func (d *DB) handle() *DB {
+	h := &DB{dbState: d.dbState}
+	runtime.SetFinalizer(h, (*DB).Close)
+	return h
+}
+
 // Open open or create database from given storage.
+//
+// If opt.OFReadOnly flag is set the database must exist; it is never
+// created nor written to.
 func Open(p storage.Storage, o *opt.Options) (db *DB, err error) {
 	s, err := openSession(p, o)
 	if err != nil {
@@ -92,7 +175,7 @@ func Open(p storage.Storage, o *opt.Options) (db *DB, err error) {
 	}()
 
 	err = s.recover()
-	if os.IsNotExist(err) && s.o.HasFlag(opt.OFCreateIfMissing) {
+	if os.IsNotExist(err) && s.o.HasFlag(opt.OFCreateIfMissing) && !s.o.HasFlag(opt.OFReadOnly) {
 		err = s.create()
 	} else if err == nil && s.o.HasFlag(opt.OFErrorIfExist) {
 		err = os.ErrExist
@@ -104,6 +187,60 @@ func Open(p storage.Storage, o *opt.Options) (db *DB, err error) {
 	return openDB(s)
 }
 
+// sharedDB is an entry of the OpenFile registry.
+type sharedDB struct {
+	key   string
+	o     *opt.Options
+	db    *DB           // not counted, nor closed once unreachable
+	err   error         // error of opening, if failed
+	refs  int           // zero once the last reference is being closed
+	ready chan struct{} // closed once opened, or failed to
+	done  chan struct{} // closed when the database is truly closed
+}
+
+var (
+	sharedMu  sync.Mutex
+	sharedDBs = make(map[string]*sharedDB)
+)
+
+// sharedPath return the canonical form of given path, used as key of the
+// OpenFile registry.
+func sharedPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	if real, err := filepath.EvalSymlinks(abs); err == nil {
+		return real
+	}
+	return abs
+}
+
+// Return a new reference handle of the shared DB; need sharedMu held.
+func (e *sharedDB) ref(o *opt.Options) (*DB, error) {
+	if o.HasFlag(opt.OFErrorIfExist) {
+		return nil, os.ErrExist
+	}
+	// options the content of the database depends on must agree
+	if x, y := e.o.GetComparer().Name(), o.GetComparer().Name(); x != y {
+		return nil, errors.ErrInvalid(fmt.Sprintf("shared database opened with comparer %q, got %q", x, y))
+	}
+	if x, y := filterName(e.o.GetFilter()), filterName(o.GetFilter()); x != y {
+		return nil, errors.ErrInvalid(fmt.Sprintf("shared database opened with filter %q, got %q", x, y))
+	}
+	e.refs++
+	h := e.db.handle()
+	h.shared = e
+	return h, nil
+}
+
+func filterName(f filter.Filter) string {
+	if f == nil {
+		return ""
+	}
+	return f.Name()
+}
+
 // OpenFile open or create database from given file.
 //
 // This is alias of:
@@ -111,8 +248,72 @@ func Open(p storage.Storage, o *opt.Options) (db *DB, err error) {
 //	...
 //	db, err := Open(stor, &opt.Options{})
 //	...
+//
+// Opening a path that is already open within this process return a new
+// handle of the same database, with its reference count incremented; the
+// given options are ignored in that case, except that opt.OFErrorIfExist
+// fails with os.ErrExist, and that a comparer or filter other than those
+// the database is opened with fails with errors.ErrInvalid. Each handle
+// must be closed, closing it again returns errors.ErrClosed; the database
+// is truly closed once every handle is closed.
+//
+// If opt.OFReadOnly flag is set, storage.OpenFileReadOnly is used instead,
+// and the returned DB is never shared.
 func OpenFile(path string, o *opt.Options) (db *DB, err error) {
-	stor, err := storage.OpenFile(path)
+	if o.HasFlag(opt.OFReadOnly) {
+		return openFile(path, o)
+	}
+
+	key := sharedPath(path)
+	for {
+		sharedMu.Lock()
+		e, ok := sharedDBs[key]
+		if !ok {
+			break
+		}
+		sharedMu.Unlock()
+
+		// wait for the opening by another caller
+		<-e.ready
+		sharedMu.Lock()
+		if e.err == nil && e.refs > 0 {
+			db, err = e.ref(o)
+			sharedMu.Unlock()
+			return
+		}
+		sharedMu.Unlock()
+		if e.err == nil {
+			// wait for the last reference to be closed
+			<-e.done
+		}
+	}
+	e := &sharedDB{key: key, o: o, ready: make(chan struct{}), done: make(chan struct{})}
+	sharedDBs[key] = e
+	sharedMu.Unlock()
+
+	db, err = openFile(path, o)
+
+	sharedMu.Lock()
+	if err == nil {
+		e.db = &DB{dbState: db.dbState}
+		e.refs = 1
+		db.shared = e
+	} else {
+		e.err = err
+		delete(sharedDBs, key)
+	}
+	close(e.ready)
+	sharedMu.Unlock()
+	return
+}
+
+func openFile(path string, o *opt.Options) (db *DB, err error) {
+	var stor *storage.FileStorage
+	if o.HasFlag(opt.OFReadOnly) {
+		stor, err = storage.OpenFileReadOnly(path)
+	} else {
+		stor, err = storage.OpenFile(path)
+	}
 	if err != nil {
 		return
 	}
@@ -127,7 +328,19 @@ func OpenFile(path string, o *opt.Options) (db *DB, err error) {
 
 // Recover recover database with missing or corrupted manifest file. It will
 // ignore any manifest files, valid or not.
+//
+// Every table file of the storage is added to level 0 of a brand new
+// manifest, then surviving journals are replayed as usual. Tables that
+// cannot be opened, or whose first and last keys cannot be read, are
+// skipped and moved aside by the storage.Archiver of their file, e.g.
+// renamed with ".lost" suffix by the file system storage, so that they are
+// not removed as obsolete files; Recover fails if a skipped table cannot
+// be moved aside. The number of recovered and skipped tables is logged. Range tombstones
+// are recovered from the tables holding them.
 func Recover(p storage.Storage, o *opt.Options) (db *DB, err error) {
+	if o.HasFlag(opt.OFReadOnly) {
+		return nil, errors.ErrReadOnly
+	}
 	s, err := openSession(p, o)
 	if err != nil {
 		return
@@ -146,65 +359,95 @@ func Recover(p storage.Storage, o *opt.Options) (db *DB, err error) {
 
 	rec := new(sessionRecord)
 
+	// tables that cannot be read are moved aside rather than left to be
+	// removed as obsolete
+	var skipped int
+	skip := func(f storage.File, serr error) error {
+		skipped++
+		a, ok := f.(storage.Archiver)
+		if !ok {
+			return errors.ErrInvalid(fmt.Sprintf("unreadable table %d cannot be moved aside: %v", f.Num(), serr))
+		}
+		if err := a.Archive(); err != nil {
+			return err
+		}
+		s.printf("Recover: table moved aside, num=%d err=%q", f.Num(), serr)
+		return nil
+	}
+
 	// recover tables
 	ro := &opt.ReadOptions{}
-	var nt *tFile
+	var lseq uint64
+	var recovered int
 	for _, f := range ff {
 		if f.Type() != storage.TypeTable {
 			continue
 		}
 
-		var size uint64
-		size, err = f.Size()
-		if err != nil {
-			return
+		size, serr := f.Size()
+		if serr != nil {
+			if err = skip(f, serr); err != nil {
+				return
+			}
+			continue
 		}
 
-		t := newTFile(f, size, nil, nil)
+		t := newTFile(f, size, nil, nil, s.o.GetSeekCompactionBytesPerSeek())
 		iter := s.tops.newIterator(t, ro)
-		// min ikey
+		// min and max ikey
 		if iter.First() {
-			t.min = iter.Key()
-		} else if iter.Error() != nil {
-			err = iter.Error()
-			return
-		} else {
-			continue
+			t.min = iKey(dupBytes(iter.Key()))
 		}
-		// max ikey
 		if iter.Last() {
-			t.max = iter.Key()
-		} else if iter.Error() != nil {
-			err = iter.Error()
-			return
-		} else {
+			t.max = iKey(dupBytes(iter.Key()))
+		}
+		if t.min == nil || t.max == nil {
+			serr := iter.Error()
+			iter.Release()
+			if serr != nil {
+				s.tops.evict(t)
+				if err = skip(f, serr); err != nil {
+					return
+				}
+			}
 			continue
 		}
 
-		// add table to level 0
-		rec.addTableFile(0, t)
-
-		nt = t
-	}
-
-	// extract largest seq number from newest table
-	if nt != nil {
-		var lseq uint64
-		iter := s.tops.newIterator(nt, ro)
-		for iter.Next() {
-			seq, _, ok := iKey(iter.Key()).parseNum()
+		// extract largest seq number and check for timestamped keys;
+		// whatever can be read counts
+		for ok := iter.First(); ok; ok = iter.Next() {
+			ikey := iKey(iter.Key())
+			seq, kt, ok := ikey.parseNum()
 			if !ok {
 				continue
 			}
 			if seq > lseq {
 				lseq = seq
 			}
+			if kt == tRangeDel {
+				rec.addRangeDel(&rangeDel{start: dupBytes(ikey.ukey()), limit: dupBytes(iter.Value()), seq: seq})
+			}
+			if !rec.hasTs && ikey.hasTs() {
+				rec.setTs()
+			}
 		}
-		rec.setSeq(lseq)
+		if iter.Error() != nil {
+			s.printf("Recover: table partially readable, num=%d err=%q", f.Num(), iter.Error())
+		}
+		iter.Release()
+
+		// add table to level 0
+		rec.addTableFile(0, t)
+		recovered++
 	}
+	rec.setSeq(lseq)
+
+	s.printf("Recover: tables recovered, recovered=%d skipped=%d seq=%d", recovered, skipped, lseq)
 
 	// set file num based on largest one
-	s.stFileNum = ff[len(ff)-1].Num() + 1
+	if len(ff) > 0 {
+		s.stFileNum = ff[len(ff)-1].Num() + 1
+	}
 
 	// create brand new manifest
 	err = s.create()
@@ -241,6 +484,11 @@ func (d *DB) recoverJournal() (err error) {
 	}
 
 	var r, fr *journalReader
+	defer func() {
+		if err != nil && r != nil {
+			r.close()
+		}
+	}()
 	for _, journal := range rJournals {
 		s.printf("JournalRecovery: recovering, num=%d", journal.Num())
 
@@ -257,6 +505,9 @@ func (d *DB) recoverJournal() (err error) {
 				}
 			}
 
+			if d.hasTs() {
+				cm.rec.setTs()
+			}
 			err = cm.commit(r.file.Num(), d.seq)
 			if err != nil {
 				return
@@ -264,7 +515,8 @@ func (d *DB) recoverJournal() (err error) {
 
 			cm.reset()
 
-			fr.remove()
+			fr.close()
+			s.removeFile(fr.file)
 			fr = nil
 		}
 
@@ -280,8 +532,15 @@ func (d *DB) recoverJournal() (err error) {
 			if err != nil {
 				return
 			}
+			if batch.hasTs {
+				d.setTs()
+			}
 
-			d.seq = batch.seq + uint64(batch.len())
+			// journals left over from before a Recover may be older
+			// than tables
+			if seq := batch.seq + uint64(batch.len()); seq > d.seq {
+				d.seq = seq
+			}
 
 			if mem.Size() > s.o.GetWriteBuffer() {
 				// flush to table
@@ -317,15 +576,76 @@ func (d *DB) recoverJournal() (err error) {
 		}
 	}
 
+	if d.hasTs() {
+		cm.rec.setTs()
+	}
 	err = cm.commit(d.journal.file.Num(), d.seq)
 	if err != nil {
 		return
 	}
 
 	if fr != nil {
-		fr.remove()
+		fr.close()
+		s.removeFile(fr.file)
+	}
+
+	return
+}
+
+// Like recoverJournal, but replay journals into the current mem only;
+// nothing is flushed, written or removed.
+func (d *DB) recoverJournalReadOnly() (err error) {
+	s := d.s
+
+	s.printf("JournalRecovery: started, min=%d readonly", s.stJournalNum)
+
+	mem := &memSet{cur: memdb.New(s.cmp), curRd: new(memRangeDels)}
+	batch := new(Batch)
+
+	journals := files(s.getFiles(storage.TypeJournal))
+	journals.sort()
+	for _, journal := range journals {
+		if journal.Num() < s.stJournalNum && journal.Num() != s.stPrevJournalNum {
+			continue
+		}
+
+		s.printf("JournalRecovery: recovering, num=%d", journal.Num())
+
+		var r *journalReader
+		r, err = newJournalReader(journal, true, s.journalDropFunc("journal", journal.Num()))
+		if err != nil {
+			return
+		}
+
+		for r.journal.Next() {
+			err = batch.decode(r.journal.Record())
+			if err == nil {
+				err = batch.memReplay(mem.cur)
+			}
+			if err == nil && batch.hasRangeDel {
+				var rdels rangeDels
+				rdels, err = batch.rangeDels()
+				mem.curRd.add(rdels)
+			}
+			if err != nil {
+				r.close()
+				return
+			}
+			if batch.hasTs {
+				d.setTs()
+			}
+
+			d.seq = batch.seq + uint64(batch.len())
+		}
+
+		err = r.journal.Error()
+		r.close()
+		if err != nil {
+			return
+		}
 	}
 
+	d.mem = unsafe.Pointer(mem)
 	return
 }
 
@@ -335,12 +655,42 @@ func (d *DB) GetOptionsSetter() opt.OptionsSetter {
 	return d.s.o
 }
 
-func (d *DB) get(key []byte, seq uint64, ro *opt.ReadOptions) (value []byte, err error) {
+// Lookup given key at given seq number; if noValue is true the value
+// isn't read out of table. The value is copied, unless opt.RFDontCopyBuffer
+// is set and it isn't read in place from a mapped table.
+func (d *DB) get(key []byte, seq uint64, ro *opt.ReadOptions, noValue bool) (value []byte, level int, err error) {
+	if d.hasTs() {
+		value, level, err = d.getTs(key, seq, ro)
+		if err == nil && !ro.HasFlag(opt.RFDontCopyBuffer) {
+			value = dupBytes(value)
+		}
+		return
+	}
+	// tables are held until the value is copied, thus a value read in
+	// place is copied only once
+	th := &tHandles{tops: d.s.tops}
+	defer th.release()
+	value, level, err = d.getIn(d.getMem(), d.s.version(), th, key, seq, ro, noValue)
+	if err == nil && (th.mapped || !ro.HasFlag(opt.RFDontCopyBuffer)) {
+		value = dupBytes(value)
+	}
+	return
+}
+
+// Like get, but lookup within given mem and version; tables are looked up
+// through given handles, if not nil. Timestamped keys are not resolved.
+func (d *DB) getIn(mem *memSet, v *version, th *tHandles, key []byte, seq uint64, ro *opt.ReadOptions, noValue bool) (value []byte, level int, err error) {
 	s := d.s
 
 	ucmp := s.cmp.cmp
 	ikey := newIKey(key, seq, tSeek)
 
+	// entries below floor are deleted by a range tombstone
+	var floor uint64
+	if rdels := getRangeDels(mem, v); rdels != nil {
+		floor = rdels.coverSeq(key, seq, ucmp)
+	}
+
 	memGet := func(m *memdb.DB) bool {
 		var k []byte
 		k, value, err = m.Find(ikey)
@@ -351,31 +701,87 @@ func (d *DB) get(key []byte, seq uint64, ro *opt.ReadOptions) (value []byte, err
 		if ucmp.Compare(ik.ukey(), key) != 0 {
 			return false
 		}
-		if _, t, ok := ik.parseNum(); ok {
-			if t == tDel {
+		if kseq, t, ok := ik.parseNum(); ok {
+			if kseq < floor {
+				t = tDel
+			}
+			t, value = resolveTTL(t, value, ttlNow())
+			switch t {
+			case tDel, tRangeDel:
 				value = nil
 				err = errors.ErrNotFound
+			case tMerge:
+				err = errMergeOperand
 			}
 			return true
 		}
 		return false
 	}
 
-	mem := d.getMem()
-	if memGet(mem.cur) || (mem.froze != nil && memGet(mem.froze)) {
-		return
+	if memGet(mem.cur) {
+		level = -1
+	} else if mem.froze != nil && memGet(mem.froze) {
+		level = -2
+	} else {
+		var cState bool
+		value, level, cState, err = v.get(ikey, floor, ro, noValue, th)
+
+		if cState && !d.isClosed() {
+			// schedule compaction
+			select {
+			case d.cch <- cSched:
+			default:
+			}
+		}
+	}
+
+	if err == errMergeOperand {
+		value, err = d.getMerge(mem, v, key, seq, ro)
 	}
+	return
+}
 
-	value, cState, err := s.version().get(ikey, ro)
+// getTs is like get, but resolve timestamped keys.
+func (d *DB) getTs(key []byte, seq uint64, ro *opt.ReadOptions) (value []byte, level int, err error) {
+	s := d.s
+	icmp := s.cmp
 
-	if cState && !d.isClosed() {
-		// schedule compaction
-		select {
-		case d.cch <- cSched:
-		default:
+	ikey := newSeekIKey(key, seq)
+
+	var rkey iKey
+	mem, ver := d.getMem(), s.version()
+	for i, m := range []*memdb.DB{mem.cur, mem.froze} {
+		if m == nil {
+			continue
+		}
+		k, v, _ := seekVisible(m.NewIterator(), ikey, seq, icmp.cmp)
+		if k != nil && (rkey == nil || icmp.Compare(k, rkey) < 0) {
+			rkey, value, level = k, v, -1-i
 		}
 	}
 
+	k, v, l, err := ver.getTs(ikey, seq, ro)
+	if err != nil {
+		return
+	}
+	if k != nil && (rkey == nil || icmp.Compare(k, rkey) < 0) {
+		rkey, value, level = k, v, l
+	}
+
+	if rkey == nil {
+		return nil, 0, errors.ErrNotFound
+	}
+	rseq, t, _ := rkey.parseNum()
+	if rdels := getRangeDels(mem, ver); rdels != nil && rdels.coverSeq(key, seq, icmp.cmp) > rseq {
+		t = tDel
+	}
+	t, value = resolveTTL(t, value, ttlNow())
+	switch t {
+	case tDel, tRangeDel:
+		return nil, level, errors.ErrNotFound
+	case tMerge:
+		value, err = d.getMerge(mem, ver, key, seq, ro)
+	}
 	return
 }
 
@@ -386,17 +792,148 @@ func (d *DB) Get(key []byte, ro *opt.ReadOptions) (value []byte, err error) {
 		return
 	}
 
-	value, err = d.get(key, d.getSeq(), ro)
-	if ro.HasFlag(opt.RFDontCopyBuffer) {
+	value, _, err = d.get(key, d.getSeq(), ro, false)
+	return
+}
+
+// MultiGet get values for given keys of the latest snapshot of database.
+// The values and errors are returned in the same order as the keys; a
+// missing key yields nil value and errors.ErrNotFound. All keys are looked
+// up against the same snapshot, in sorted order, and each table is looked
+// up from the table cache only once; thus MultiGet is cheaper than calling
+// Get for each key.
+func (d *DB) MultiGet(keys [][]byte, ro *opt.ReadOptions) (values [][]byte, errs []error) {
+	values = make([][]byte, len(keys))
+	errs = make([]error, len(keys))
+	if err := d.rok(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return
+	}
+
+	s := d.s
+	seq := d.getSeq()
+	ts := d.hasTs()
+	mem := d.getMem()
+	v := s.version()
+	th := &tHandles{tops: s.tops}
+	defer th.release()
+
+	for _, i := range newKeysIndex(keys, s.cmp.cmp).idx {
+		var value []byte
+		var err error
+		if ts {
+			value, _, err = d.getTs(keys[i], seq, ro)
+		} else {
+			value, _, err = d.getIn(mem, v, th, keys[i], seq, ro, false)
+		}
+		if err == nil && (th.mapped || !ro.HasFlag(opt.RFDontCopyBuffer)) {
+			value = dupBytes(value)
+		}
+		values[i], errs[i] = value, err
+	}
+	return
+}
+
+// Has return true if the latest snapshot of database does contains the
+// given key; a key whose newest entry is a deletion is not contained. Has
+// is cheaper than Get since the value is never read out of table.
+func (d *DB) Has(key []byte, ro *opt.ReadOptions) (ret bool, err error) {
+	err = d.rok()
+	if err != nil {
+		return
+	}
+
+	_, _, err = d.get(key, d.getSeq(), ro, true)
+	switch err {
+	case nil:
+		ret = true
+	case errors.ErrNotFound:
+		err = nil
+	}
+	return
+}
+
+// GetWithLevel is like Get but also return the level the value was found
+// at. The level is -1 if the value was found in the current memdb, -2 if
+// it was found in the frozen memdb, otherwise it is the level of the table
+// that hold the value. The level is only meaningful if err is nil.
+func (d *DB) GetWithLevel(key []byte, ro *opt.ReadOptions) (value []byte, level int, err error) {
+	err = d.rok()
+	if err != nil {
 		return
 	}
-	return dupBytes(value), err
+
+	value, level, err = d.get(key, d.getSeq(), ro, false)
+	return
+}
+
+// PinKeys set keys that should be kept at shallow levels for fast reads,
+// replacing previously pinned keys; nil keys unpin all keys. When a table
+// compaction would push a pinned key down, the key is kept at the source
+// level instead; when a memdb compaction holds a pinned key, the table is
+// kept at level 0. Pinned keys are still overwritten or deleted by newer
+// writes as usual.
+//
+// Pinning is an optimization hint intended for a small set of hot keys; it
+// applies only to compactions that start after the call.
+func (d *DB) PinKeys(keys [][]byte) error {
+	err := d.rok()
+	if err != nil {
+		return err
+	}
+
+	var p *pinSet
+	if len(keys) > 0 {
+		p = newPinSet(d.s.cmp.cmp, keys)
+	}
+	atomic.StorePointer(&d.pins, unsafe.Pointer(p))
+	return nil
+}
+
+// DurableSequence return the highest sequence number known to be durable.
+// Writes up to this sequence number had either been synced to the journal
+// or flushed to a table, thus will survive a power loss; later writes may
+// only reside in the OS buffer. The durable sequence advances whenever a
+// write with WFSync flag, a background journal sync (see
+// opt.Options.WALSyncInterval) or a memdb compaction completes. Writes
+// made with opt.WFNoWAL are only durable once their memdb is flushed,
+// thus the durable sequence stays below them until then.
+func (d *DB) DurableSequence() uint64 {
+	return d.getDurableSeq()
+}
+
+// WaitForDurable block until the durable sequence reach given sequence
+// number, see DurableSequence. If seq is beyond anything written so far,
+// it blocks until such write is made durable. It returns early with the
+// context error if ctx is done, or with ErrClosed if the database is
+// closed.
+func (d *DB) WaitForDurable(ctx context.Context, seq uint64) error {
+	for {
+		ch := d.durableWait()
+		if d.getDurableSeq() >= seq {
+			return nil
+		}
+		if err := d.rok(); err != nil {
+			return err
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
 // NewIterator return an iterator over the contents of the latest snapshot of
 // database. The result of NewIterator() is initially invalid (caller must
 // call Next or one of Seek method, i.e. First, Last or Seek).
 //
+// The iterator hold table cache handles and its own snapshot; the caller
+// should call Release once done with it, rather than waiting for it to be
+// garbage collected.
+//
 // Please note that the iterator is not thread-safe, you may not use same
 // iterator instance concurrently without external synchronization.
 func (d *DB) NewIterator(ro *opt.ReadOptions) iterator.Iterator {
@@ -408,15 +945,56 @@ func (d *DB) NewIterator(ro *opt.ReadOptions) iterator.Iterator {
 	i := p.NewIterator(ro)
 	x, ok := i.(*dbIter)
 	if ok {
-		runtime.SetFinalizer(x, func(x *dbIter) {
-			p.Release()
-		})
+		x.releaser = p
 	} else {
 		p.Release()
 	}
 	return i
 }
 
+// NewRawIterator return an iterator over the raw entries of memdb and
+// tables of database, meant for debugging and inspection tools. Unlike
+// NewIterator, every version of a key is iterated, including deletions and
+// merge operands: Key return the encoded internal key, which can be parsed
+// by ParseInternalKey, and Seek accept an internal key, such as returned by
+// InternalSeekKey. Range tombstones are iterated as entries keyed by their
+// start, with their limit as value. Key range of given read options, if
+// any, is honored.
+//
+// The iterator doesn't hold a snapshot; the caller should call Release once
+// done with it.
+func (d *DB) NewRawIterator(ro *opt.ReadOptions) iterator.Iterator {
+	if err := d.rok(); err != nil {
+		return &iterator.EmptyIterator{Err: err}
+	}
+	return d.newRawIterator(ro)
+}
+
+// NewPrefixIterator is like NewIterator but the iterator is bounded to
+// keys starting with the given prefix: First position at the first key
+// at or past the prefix, and the iterator become invalid once a key no
+// longer shares the prefix. The bound is intersected with the key range
+// of given read options, if any.
+//
+// The upper bound is derived from the prefix in bytewise order, thus the
+// DB comparer must order keys sharing a common prefix contiguously, e.g.
+// the default bytewise comparer. A prefix of all 0xff bytes leaves the
+// upper bound open.
+func (d *DB) NewPrefixIterator(prefix []byte, ro *opt.ReadOptions) iterator.Iterator {
+	pro := &opt.ReadOptions{Start: prefix, Limit: prefixLimit(prefix)}
+	if ro != nil {
+		ucmp := d.s.cmp.cmp
+		pro.Flag = ro.Flag
+		if ro.Start != nil && ucmp.Compare(ro.Start, pro.Start) > 0 {
+			pro.Start = ro.Start
+		}
+		if ro.Limit != nil && (pro.Limit == nil || ucmp.Compare(ro.Limit, pro.Limit) < 0) {
+			pro.Limit = ro.Limit
+		}
+	}
+	return d.NewIterator(pro)
+}
+
 // GetSnapshot return a handle to the current DB state.
 // Iterators created with this handle will all observe a stable snapshot
 // of the current DB state. The caller must call *Snapshot.Release() when the
@@ -428,10 +1006,45 @@ func (d *DB) GetSnapshot() (snap *Snapshot, err error) {
 	}
 
 	snap = d.newSnapshot()
+	snap.count()
+	runtime.SetFinalizer(snap, (*Snapshot).Release)
+	return
+}
+
+// GetSnapshotAt is like GetSnapshot but pins the given seq number, e.g.
+// one returned by Snapshot.Sequence. It returns
+// errors.ErrSnapshotNotRetained if compaction may already have dropped
+// entries visible at the seq number; the seq number is retained as long
+// as a snapshot at or below it is alive within this session. It returns
+// errors.ErrInvalid if the seq number is past the latest one.
+func (d *DB) GetSnapshotAt(seq uint64) (snap *Snapshot, err error) {
+	err = d.rok()
+	if err != nil {
+		return
+	}
+
+	if seq > d.getSeq() {
+		return nil, errors.ErrInvalid("snapshot seq is past the latest seq")
+	}
+	e := d.snaps.acquireAt(seq)
+	if e == nil {
+		return nil, errors.ErrSnapshotNotRetained
+	}
+	snap = &Snapshot{d: d, entry: e}
+	snap.count()
 	runtime.SetFinalizer(snap, (*Snapshot).Release)
 	return
 }
 
+// SkippedTables return numbers of the table files found corrupt and
+// skipped by iterators created with opt.RFSkipCorrupt, since the database
+// was opened, in ascending order. The tables are still part of the
+// database; lookups and iterators without opt.RFSkipCorrupt keep failing
+// on their corrupt blocks.
+func (d *DB) SkippedTables() []uint64 {
+	return d.s.tops.getSkipped()
+}
+
 // GetProperty used to query exported database state.
 //
 // Valid property names include:
@@ -442,6 +1055,26 @@ func (d *DB) GetSnapshot() (snap *Snapshot, err error) {
 //     about the internal operation of the DB.
 //  "leveldb.sstables" - returns a multi-line string that storribes all
 //     of the sstables that make up the db contents.
+//  "leveldb.filter-stats" - returns the number of table lookups checked
+//     against a filter, of those the filter predicted absent and of those
+//     the filter did not rule out but turned out absent.
+//  "leveldb.blockcache-stats" - returns the number of hits, misses,
+//     inserts and evictions of the block cache, if it reports them.
+//  "leveldb.tablecache-stats" - returns the number of hits, misses,
+//     inserts and evictions of the table cache.
+//  "leveldb.total-size" - returns the number of bytes used on disk by the
+//     live files of the db, see SizeOnDisk.
+//  "leveldb.num-iterators" - returns the number of iterators not yet
+//     released nor garbage collected. Iterators pin the tables they read,
+//     thus leaked iterators prevent obsolete tables from being deleted.
+//  "leveldb.num-snapshots" - returns the number of snapshots, as returned
+//     by GetSnapshot or GetSnapshotAt, not yet released nor garbage
+//     collected.
+//  "leveldb.compaction-pending" - returns the estimated number of bytes
+//     to compact until every level is within its size limit.
+//  "leveldb.running-compaction" - returns a line for each running table
+//     compaction, holding its level, number and size of input tables,
+//     and the bytes of entries processed so far; empty if none.
 func (d *DB) GetProperty(prop string) (value string, err error) {
 	err = d.rok()
 	if err != nil {
@@ -460,7 +1093,7 @@ func (d *DB) GetProperty(prop string) (value string, err error) {
 		var level uint
 		var rest string
 		n, _ := fmt.Scanf("%d%s", &level, &rest)
-		if n != 1 || level >= kNumLevels {
+		if n != 1 || int(level) >= len(s.version().tables) {
 			return "", errors.ErrInvalid("invalid property: " + prop)
 		}
 		value = fmt.Sprint(s.version().tLen(int(level)))
@@ -470,7 +1103,7 @@ func (d *DB) GetProperty(prop string) (value string, err error) {
 			" Level |   Tables   |    Size(MB)   |    Time(sec)  |    Read(MB)   |   Write(MB)\n" +
 			"-------+------------+---------------+---------------+---------------+---------------\n"
 		for level, tt := range v.tables {
-			duration, read, write := d.cstats[level].get()
+			duration, read, write, _ := d.cstats[level].get()
 			if len(tt) == 0 && duration == 0 {
 				continue
 			}
@@ -478,6 +1111,34 @@ func (d *DB) GetProperty(prop string) (value string, err error) {
 				level, len(tt), float64(tt.size())/1048576.0, duration.Seconds(),
 				float64(read)/1048576.0, float64(write)/1048576.0)
 		}
+	case p == "blockcache-stats":
+		value, err = cacheStats(s.o.GetBlockCache())
+	case p == "tablecache-stats":
+		value, err = cacheStats(s.tops.cache)
+	case p == "total-size":
+		var size uint64
+		size, err = d.SizeOnDisk()
+		if err != nil {
+			return
+		}
+		value = fmt.Sprint(size)
+	case p == "num-iterators":
+		value = fmt.Sprint(atomic.LoadInt32(&d.niters))
+	case p == "num-snapshots":
+		value = fmt.Sprint(atomic.LoadInt32(&d.nsnaps))
+	case p == "filter-stats":
+		fs := s.tops.fstats
+		value = fmt.Sprintf("checks=%d predicted-absent=%d confirmed-absent=%d",
+			fs.Checks(), fs.Absent(), fs.ConfirmedAbsent())
+	case p == "compaction-pending":
+		value = fmt.Sprint(s.version().pendingCompactionBytes())
+	case p == "running-compaction":
+		d.cprogMu.Lock()
+		for _, x := range d.cprog {
+			value += fmt.Sprintf("level=%d tables=%d size=%d processed=%d\n",
+				x.level, x.tables, x.size, atomic.LoadUint64(&x.processed))
+		}
+		d.cprogMu.Unlock()
 	case p == "sstables":
 		v := s.version()
 		for level, tt := range v.tables {
@@ -493,24 +1154,82 @@ func (d *DB) GetProperty(prop string) (value string, err error) {
 	return
 }
 
-// GetApproximateSizes calculate approximate sizes of given ranges.
-//
-// Note that the returned sizes measure file system space usage, so
-// if the user data compresses by a factor of ten, the returned
-// sizes will be one-tenth the size of the corresponding user data size.
-//
-// The results may not include the sizes of recently written data.
-func (d *DB) GetApproximateSizes(rr []Range) (sizes Sizes, err error) {
-	err = d.rok()
+func cacheStats(c cache.Cache) (string, error) {
+	sg, ok := c.(cache.StatsGetter)
+	if !ok {
+		return "", errors.ErrInvalid("cache does not report stats")
+	}
+	st := sg.GetStats()
+	return fmt.Sprintf("hits=%d misses=%d inserts=%d evictions=%d",
+		st.Hits, st.Misses, st.Inserts, st.Evictions), nil
+}
+
+// GetStats return per-level statistics of the database. See DBStats.
+// Tables whose entry counts are not known yet are opened to read them.
+func (d *DB) GetStats() (*DBStats, error) {
+	if err := d.rok(); err != nil {
+		return nil, err
+	}
+
+	v := d.s.version()
+	n := len(v.tables)
+	stats := &DBStats{
+		LevelTables:          make([]int, n),
+		LevelSizes:           make([]uint64, n),
+		LevelDurations:       make([]time.Duration, n),
+		LevelRead:            make([]uint64, n),
+		LevelWrite:           make([]uint64, n),
+		LevelSeekCompactions: make([]uint64, n),
+		LevelEntries:         make([]uint64, n),
+		LevelDeletions:       make([]uint64, n),
+	}
+	for level, tt := range v.tables {
+		stats.LevelTables[level] = len(tt)
+		stats.LevelSizes[level] = tt.size()
+		stats.LevelDurations[level], stats.LevelRead[level], stats.LevelWrite[level],
+			stats.LevelSeekCompactions[level] = d.cstats[level].get()
+		for _, t := range tt {
+			entries, dels, _, err := d.s.tops.stats(t)
+			if err != nil {
+				return nil, err
+			}
+			stats.LevelEntries[level] += entries
+			stats.LevelDeletions[level] += dels
+		}
+	}
+	return stats, nil
+}
+
+// GetApproximateSizes calculate approximate sizes of given ranges.
+//
+// Note that the returned sizes measure file system space usage, so
+// if the user data compresses by a factor of ten, the returned
+// sizes will be one-tenth the size of the corresponding user data size.
+//
+// The results may not include the sizes of recently written data.
+//
+// If opt.OFDiscountDeletions flag is set, space estimated to be shadowed
+// by deletions is not counted.
+func (d *DB) GetApproximateSizes(rr []Range) (sizes Sizes, err error) {
+	err = d.rok()
 	if err != nil {
 		return
 	}
 
 	v := d.s.version()
+	discount := d.s.o.HasFlag(opt.OFDiscountDeletions)
 	sizes = make(Sizes, 0, len(rr))
 	for _, r := range rr {
 		min := newIKey(r.Start, kMaxSeq, tSeek)
 		max := newIKey(r.Limit, kMaxSeq, tSeek)
+		if discount {
+			size, err := v.approximateDiscountedSize(min, max)
+			if err != nil {
+				return nil, err
+			}
+			sizes = append(sizes, size)
+			continue
+		}
 		start, err := v.approximateOffsetOf(min)
 		if err != nil {
 			return nil, err
@@ -529,6 +1248,273 @@ func (d *DB) GetApproximateSizes(rr []Range) (sizes Sizes, err error) {
 	return
 }
 
+// GetApproximateMemSize returns approximate number of bytes used by
+// entries held in memory, i.e. the current memdb and the frozen memdb
+// not yet written into a table, if any. Unlike GetApproximateSizes this
+// measures the in-memory encoding of the entries, it is maintained as
+// entries are added thus is cheap to call.
+func (d *DB) GetApproximateMemSize() uint64 {
+	mem := d.getMem()
+	size := mem.cur.Size()
+	if mem.froze != nil {
+		size += mem.froze.Size()
+	}
+	return uint64(size)
+}
+
+// SizeOnDisk returns number of bytes used on disk by the live files of the
+// database, i.e. tables of the current version, the current journal and
+// the current manifest. Obsolete files awaiting deletion are not counted.
+func (d *DB) SizeOnDisk() (size uint64, err error) {
+	if err = d.rok(); err != nil {
+		return
+	}
+
+	for _, tt := range d.s.version().tables {
+		size += tt.size()
+	}
+
+	d.wlock <- struct{}{}
+	var jsize uint64
+	if d.journal != nil {
+		jsize, err = d.journal.file.Size()
+	}
+	<-d.wlock
+	if err != nil {
+		return
+	}
+	size += jsize
+
+	f, err := d.s.stor.GetManifest()
+	if err != nil {
+		return
+	}
+	msize, err := f.Size()
+	if err != nil {
+		return
+	}
+	return size + msize, nil
+}
+
+// ExportKeyFilter build a single bloom filter over all live user keys of a
+// snapshot of the database, using given bits per key. The filter can be
+// queried without the database with filter.BloomFilter KeyMayMatch, e.g.
+// filter.NewBloomFilter(bits).KeyMayMatch(key, f).
+//
+// A bloom filter never give false negative; its false positive rate given
+// n live keys is roughly (1 - e^(-k/bits))^k, where k = bits * 0.69 is the
+// number of probes, i.e. about 1% at 10 bits per key and about 0.1% at 15
+// bits per key. The filter size is n * bits / 8 bytes, and all live keys
+// are held in memory while building it.
+func (d *DB) ExportKeyFilter(bits int) (f []byte, err error) {
+	if bits < 1 {
+		return nil, errors.ErrInvalid("invalid bits per key")
+	}
+
+	snap, err := d.GetSnapshot()
+	if err != nil {
+		return
+	}
+	defer snap.Release()
+
+	var keys [][]byte
+	iter := snap.NewIterator(&opt.ReadOptions{Flag: opt.RFDontFillCache})
+	for iter.Next() {
+		keys = append(keys, iter.Key())
+	}
+	err = iter.Error()
+	iter.Release()
+	if err != nil {
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	filter.NewBloomFilter(bits).CreateFilter(keys, buf)
+	return buf.Bytes(), nil
+}
+
+// Size return the total size of all tables of the current version.
+//
+// Unlike GetApproximateSizes, the returned size is exact since the size
+// of each table is known. The size does not include the journal, the
+// manifest nor any data which still reside in memdb.
+func (d *DB) Size() (size uint64, err error) {
+	err = d.rok()
+	if err != nil {
+		return
+	}
+
+	v := d.s.version()
+	for _, tt := range v.tables {
+		size += tt.size()
+	}
+	return
+}
+
+// Flush writes the current memdb into a table and blocks until it has
+// been persisted. It is a no-op if the memdb is empty. Any compaction
+// error encountered is returned.
+func (d *DB) Flush() error {
+	err := d.wok()
+	if err != nil {
+		return err
+	}
+
+	d.wlock <- struct{}{}
+	err = d.freezeMem()
+	<-d.wlock
+	if err != nil {
+		return err
+	}
+
+	if d.hasFrozenMem() {
+		d.cch <- cSched
+		d.cch <- cWait
+	}
+	return d.wok()
+}
+
+// WALSize return the number of bytes appended so far to the current
+// journal; a journal being flushed by Flush or compaction is not
+// counted. Zero is returned if the database is closed or read-only.
+func (d *DB) WALSize() uint64 {
+	if d.wok() != nil {
+		return 0
+	}
+	d.wlock <- struct{}{}
+	var size int64
+	if d.journal != nil && !d.journal.closed() {
+		size = d.journal.journal.Size()
+	}
+	<-d.wlock
+	return uint64(size)
+}
+
+// RotateWAL is an alias of Flush, as flushing the memdb closes the journal
+// recording it and starts a new one; the closed journal is removed once
+// flushed. It may be used to bound the journal size, thus the recovery
+// time, e.g. once WALSize exceeds a threshold.
+func (d *DB) RotateWAL() error {
+	return d.Flush()
+}
+
+// CompactManifest write a new manifest holding the current version as a
+// single record, switch CURRENT to it and remove the old manifest. The
+// manifest is also rotated automatically once it grows beyond
+// opt.Options.MaxManifestSize.
+func (d *DB) CompactManifest() error {
+	if err := d.wok(); err != nil {
+		return err
+	}
+
+	req := &cReq{manifest: true}
+	d.creq <- req
+	d.cch <- cWait
+	if req.err != nil {
+		return req.err
+	}
+	return d.wok()
+}
+
+// Checkpoint write a consistent point-in-time copy of the database into
+// dst, which must not hold a database already. The memdb is flushed
+// first, thus the copy is made of tables and a manifest only, without
+// journal. Tables are linked rather than copied if dst implements
+// storage.Linker and the link succeeds. Writes may go on concurrently;
+// those not flushed are not part of the copy.
+//
+// Tables of the copied version are not deleted by compaction until the
+// checkpoint is done, as obsolete tables are only deleted once no longer
+// referenced by any version.
+func (d *DB) Checkpoint(dst storage.Storage) (err error) {
+	err = d.Flush()
+	if err != nil {
+		return
+	}
+
+	l, err := dst.Lock()
+	if err != nil {
+		return
+	}
+	defer l.Release()
+	if _, merr := dst.GetManifest(); merr == nil {
+		return errors.ErrInvalid("checkpoint destination already holds a database")
+	}
+
+	s := d.s
+	v := s.version()
+	rec := new(sessionRecord)
+	rec.setComparer(s.cmp.cmp.Name())
+	rec.setJournalNum(0)
+	rec.setSeq(d.getSeq())
+	if d.hasTs() {
+		rec.setTs()
+	}
+	if n := len(v.tables); n != opt.DefaultNumLevels {
+		rec.setNumLevels(n)
+	}
+	v.fillRecord(rec)
+	num := s.fileNum()
+	rec.setNextNum(num + 1)
+
+	linker, _ := dst.(storage.Linker)
+	for _, tt := range v.tables {
+		for _, t := range tt {
+			f := t.file
+			if linker != nil && linker.Link(f, f.Num(), storage.TypeTable) == nil {
+				continue
+			}
+			err = copyFile(f, dst.GetFile(f.Num(), storage.TypeTable))
+			if err != nil {
+				return
+			}
+		}
+	}
+	// keep the version, thus its tables, until all have been copied
+	runtime.KeepAlive(v)
+
+	w, err := newJournalWriter(dst.GetFile(num, storage.TypeManifest))
+	if err != nil {
+		return
+	}
+	err = w.journal.Append(rec.encode())
+	if err == nil {
+		err = w.writer.Sync()
+	}
+	w.close()
+	if err != nil {
+		return
+	}
+	return dst.SetManifest(w.file)
+}
+
+// ExportRange write keys of range [start,limit) of the latest snapshot of
+// database into w, as a single table file which table.Reader is able to
+// read using the options of database. The table hold user keys, deleted
+// keys are omitted. A nil start or limit means the range is unbounded on
+// that side.
+//
+// w is neither synced nor closed, that is left to the caller.
+func (d *DB) ExportRange(start, limit []byte, w io.Writer) (err error) {
+	if err = d.rok(); err != nil {
+		return
+	}
+
+	iter := d.NewIterator(&opt.ReadOptions{Start: start, Limit: limit})
+	defer iter.Release()
+
+	tw := table.NewWriter(nopWriter{w}, uOptions{d.s.o})
+	for iter.Next() {
+		if err = tw.Add(iter.Key(), iter.Value()); err != nil {
+			return
+		}
+	}
+	if err = iter.Error(); err != nil {
+		return
+	}
+	return tw.Finish()
+}
+
 // CompactRange compact the underlying storage for the key range.
 //
 // In particular, deleted and overwritten versions are discarded,
@@ -541,28 +1527,470 @@ func (d *DB) GetApproximateSizes(rr []Range) (sizes Sizes, err error) {
 // Therefore calling with Start==nil and Limit==nil will compact entire
 // database.
 func (d *DB) CompactRange(r Range) error {
+	return d.CompactRangeCtx(context.Background(), r)
+}
+
+// CompactRangeCtx is like CompactRange but can be cancelled using given
+// context.
+//
+// A large range is compacted in a series of smaller compactions; the
+// context is checked before each of them, and whenever a compaction
+// finishes an output table. If the context is cancelled the remaining
+// compactions are abandoned and ctx.Err() is returned. The running one is
+// stopped at the first key its input tables can be split before, which
+// for overlapping level-0 tables may be its end; its output so far is
+// committed. The database is thus left in a consistent state with the
+// range partially compacted, and no completed work is lost.
+func (d *DB) CompactRangeCtx(ctx context.Context, r Range) error {
 	err := d.wok()
 	if err != nil {
 		return err
 	}
+	return d.compactRange(ctx, -1, r)
+}
 
-	req := &cReq{level: -1}
+// CompactRangeAt is like CompactRange but only compacts tables of given
+// level overlapping the key range into the next level, rather than
+// cascading through every level. The last level cannot be compacted since
+// there is no level below it.
+func (d *DB) CompactRangeAt(level int, r Range) error {
+	err := d.wok()
+	if err != nil {
+		return err
+	}
+
+	if level < 0 || level >= len(d.s.version().tables)-1 {
+		return errors.ErrInvalid("compact range: invalid level")
+	}
+	return d.compactRange(context.Background(), level, r)
+}
+
+// CompactRangeAsync is like CompactRange but returns immediately. The
+// returned channel receives the result once the compaction is done, or
+// an error if the DB is closed before then. Async compactions are queued
+// and executed one at a time by the compaction goroutine.
+func (d *DB) CompactRangeAsync(r Range) (<-chan error, error) {
+	err := d.wok()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &cReq{level: -1, done: make(chan error, 1)}
 	req.min = r.Start
 	req.max = r.Limit
+	done := req.done
+
+	go func() {
+		select {
+		case d.creq <- req:
+		case <-d.closeC:
+			req.reply(errors.ErrClosed)
+		}
+	}()
+	return done, nil
+}
+
+// Order a range compaction at given level, or of all levels if level is
+// negative, to the compaction goroutine and wait until it is done.
+func (d *DB) compactRange(ctx context.Context, level int, r Range) error {
+	cancel := ctx.Done()
+	req := &cReq{level: level, ctx: ctx, cancel: cancel}
+	req.min = r.Start
+	req.max = r.Limit
+
+	select {
+	case d.creq <- req:
+	case <-cancel:
+		return ctx.Err()
+	}
+	d.cch <- cWait
+
+	if req.err != nil {
+		return req.err
+	}
+	return d.wok()
+}
+
+// MergeTables merge given tables of given level into a single table. The
+// tables must be adjacent within the level and must be given in the same
+// order as they are within the level, i.e. ascending key order. Level-0
+// tables are not allowed since they may overlap each other.
+//
+// This is a lower-level primitive than CompactRange, the merged table stay
+// at the same level and no entries are dropped. The merge is executed by
+// the compaction goroutine, thus never conflict with automatic compaction.
+func (d *DB) MergeTables(level int, nums []uint64) error {
+	err := d.wok()
+	if err != nil {
+		return err
+	}
+
+	if level <= 0 || level >= len(d.s.version().tables) {
+		return errors.ErrInvalid("merge tables: invalid level")
+	}
+	if len(nums) < 2 {
+		return errors.ErrInvalid("merge tables: need at least two tables")
+	}
+
+	req := &cReq{level: level, tables: nums}
 
 	d.creq <- req
 	d.cch <- cWait
 
+	if req.err != nil {
+		return req.err
+	}
 	return d.wok()
 }
 
+// BulkLoadSorted writes entries yielded by src directly into new tables,
+// bypassing both the memdb and the journal. The keys must be in strictly
+// ascending order according to the DB comparer; out of order or duplicate
+// keys are rejected with errors.ErrInvalid and nothing is loaded.
+//
+// The produced tables are installed by a single manifest edit at the
+// deepest level that doesn't overlap with newer data, and the loaded
+// entries share a single seq number newer than any existing entry. Writes
+// are blocked while loading. This is much faster than putting the entries
+// one by one, and is intended for initial population from an already
+// sorted source.
+func (d *DB) BulkLoadSorted(src iterator.Iterator) (count uint64, err error) {
+	err = d.wok()
+	if err != nil {
+		return
+	}
+
+	s := d.s
+	ucmp := s.cmp.cmp
+
+	// block writes; nothing may be written in between that would be
+	// shadowed by, or shadow, the loaded entries
+	d.wlock <- struct{}{}
+	defer func() {
+		<-d.wlock
+	}()
+
+	// entries in the memdb are older, they must be flushed before the
+	// loaded tables are created, as level-0 tables are read newest file
+	// first
+	err = d.flushMem()
+	if err != nil {
+		return
+	}
+
+	seq := d.seq + 1
+
+	var tt tFiles
+	var tw *tWriter
+	defer func() {
+		if err != nil {
+			if tw != nil {
+				tw.drop()
+			}
+			for _, t := range tt {
+				s.tops.remove(t)
+			}
+			count = 0
+		}
+	}()
+
+	var last []byte
+	for src.Next() {
+		key := src.Key()
+		if count > 0 && ucmp.Compare(key, last) <= 0 {
+			err = errors.ErrInvalid("bulk load: keys not in ascending order")
+			return
+		}
+		last = append(last[:0], key...)
+
+		if tw == nil {
+			tw, err = s.tops.create(0)
+			if err != nil {
+				return
+			}
+		}
+		err = tw.add(newIKey(key, seq, tVal), src.Value())
+		if err != nil {
+			return
+		}
+		count++
+
+		if tw.tw.Size() >= kMaxTableSize {
+			var t *tFile
+			t, err = tw.finish()
+			if err != nil {
+				return
+			}
+			tt, tw = append(tt, t), nil
+		}
+	}
+	err = src.Error()
+	if err != nil {
+		return
+	}
+	if tw != nil {
+		var t *tFile
+		t, err = tw.finish()
+		if err != nil {
+			return
+		}
+		tt, tw = append(tt, t), nil
+	}
+	if len(tt) == 0 {
+		return
+	}
+
+	req := &cReq{load: tt, seq: seq}
+	d.creq <- req
+	d.cch <- cWait
+	if err = req.err; err != nil {
+		return
+	}
+
+	d.addSeq(1)
+	return count, d.wok()
+}
+
+// IngestSST adds entries of given table file into the database, the same
+// way as BulkLoadSorted does. The file must be a table holding user keys
+// in the order of the DB comparer, as written by ExportRange; its
+// checksums are verified while reading. Entries are rewritten into new
+// tables with a fresh file number and a seq number newer than any
+// existing entry, thus the file itself is left untouched.
+func (d *DB) IngestSST(file storage.File) (err error) {
+	if err = d.wok(); err != nil {
+		return
+	}
+
+	size, err := file.Size()
+	if err != nil {
+		return
+	}
+	r, err := file.Open()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	tr, err := table.NewReader(r, size, uOptions{d.s.o}, nil)
+	if err != nil {
+		return
+	}
+
+	iter := tr.NewIterator(&opt.ReadOptions{Flag: opt.RFVerifyChecksums})
+	defer iter.Release()
+	_, err = d.BulkLoadSorted(iter)
+	return
+}
+
+// Partition fully compacts the database into bottom level tables of
+// approximately targetTableBytes each, and returns the key range of each
+// table in key order. A user key never spans two tables, so the ranges
+// are exact: they don't overlap and collectively cover the whole key
+// space, the first range has nil Start and the last has nil Limit. The
+// returned ranges is nil if the database is empty.
+//
+// The ranges may be used to process the database in parallel. Writes
+// made concurrently with Partition may not be included in the
+// partitioned tables, and later compactions may move data across the
+// partition boundaries. Pinned keys are flattened into the bottom level
+// as well.
+func (d *DB) Partition(targetTableBytes uint64) (rs []Range, err error) {
+	err = d.wok()
+	if err != nil {
+		return
+	}
+
+	if targetTableBytes == 0 {
+		return nil, errors.ErrInvalid("partition: zero target table size")
+	}
+
+	d.wlock <- struct{}{}
+	err = d.freezeMem()
+	<-d.wlock
+	if err != nil {
+		return
+	}
+
+	req := &cReq{partition: targetTableBytes}
+	d.creq <- req
+	d.cch <- cWait
+
+	if req.err != nil {
+		return nil, req.err
+	}
+	return req.ranges, d.wok()
+}
+
+// Return tables of the current version overlapping given range.
+func (d *DB) rangeTables(r Range) (tt tFiles) {
+	ucmp := d.s.cmp.cmp
+	for _, lt := range d.s.version().tables {
+		for _, t := range lt {
+			if !t.isAfter(r.Start, ucmp) && !t.isBefore(r.Limit, ucmp) {
+				tt = append(tt, t)
+			}
+		}
+	}
+	return
+}
+
+// PinTables loads the tables overlapping given range into the table cache
+// and keeps them there regardless of the cache churn, until unpinned by
+// UnpinTables with the same range. Pinned tables count toward
+// opt.Options.MaxOpenFiles. Tables created by later compactions are not
+// pinned.
+func (d *DB) PinTables(r Range) error {
+	if err := d.rok(); err != nil {
+		return err
+	}
+
+	tops := d.s.tops
+	tt := d.rangeTables(r)
+	for i, t := range tt {
+		if err := tops.pin(t); err != nil {
+			for _, t := range tt[:i] {
+				tops.unpin(t)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// UnpinTables unpins the tables overlapping given range, pinned by
+// PinTables.
+func (d *DB) UnpinTables(r Range) error {
+	if err := d.rok(); err != nil {
+		return err
+	}
+
+	for _, t := range d.rangeTables(r) {
+		d.s.tops.unpin(t)
+	}
+	return nil
+}
+
+// PurgeObsoleteFiles removes obsolete files kept so far since
+// opt.OFKeepObsoleteFiles is set. A table is obsolete once no longer
+// referenced by the current version nor by any live snapshot or
+// iterator; a journal once its entries are written into a table.
+func (d *DB) PurgeObsoleteFiles() error {
+	if err := d.wok(); err != nil {
+		return err
+	}
+	return d.s.purgeFiles()
+}
+
+type closeOp struct {
+	done chan struct{}
+	err  error
+}
+
+// CloseWithTimeout is like Close, but gives up waiting after given timeout,
+// returning errors.ErrCloseTimeout. The DB is then left closing in the
+// background; calling CloseWithTimeout again resumes waiting for it.
+func (d *DB) CloseWithTimeout(timeout time.Duration) error {
+	d.copMu.Lock()
+	op := d.cop
+	if op == nil {
+		op = &closeOp{done: make(chan struct{})}
+		d.cop = op
+		go func() {
+			op.err = d.Close()
+			close(op.done)
+		}()
+	}
+	d.copMu.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-op.done:
+		d.copMu.Lock()
+		if d.cop == op {
+			d.cop = nil
+		}
+		d.copMu.Unlock()
+		return op.err
+	case <-t.C:
+		return errors.ErrCloseTimeout
+	}
+}
+
+// OpenCount return the number of references to the DB; more than one only
+// if the DB is shared by OpenFile. Zero is returned once the handle is
+// closed.
+func (d *DB) OpenCount() int {
+	if e := d.shared; e != nil {
+		sharedMu.Lock()
+		defer sharedMu.Unlock()
+		if d.released {
+			return 0
+		}
+		return e.refs
+	}
+	if d.isClosed() {
+		return 0
+	}
+	return 1
+}
+
 // Close closes the database. Snapshot and iterator are invalid
-// after this call
+// after this call. Writes made with opt.WFNoWAL are flushed to a table
+// first.
+//
+// Close waits for a running compaction, which is stopped once its current
+// table is finished; a stopped compaction is not committed, thus the
+// compacted tables are left as they were.
+//
+// A handle of a DB shared by OpenFile is only released by this call, unless
+// it is the last reference.
 func (d *DB) Close() error {
+	if e := d.shared; e != nil {
+		sharedMu.Lock()
+		if d.released {
+			sharedMu.Unlock()
+			return errors.ErrClosed
+		}
+		d.released = true
+		e.refs--
+		if e.refs > 0 {
+			sharedMu.Unlock()
+			return nil
+		}
+		sharedMu.Unlock()
+		defer func() {
+			sharedMu.Lock()
+			delete(sharedDBs, e.key)
+			sharedMu.Unlock()
+			close(e.done)
+		}()
+	}
+
+	// writes not journaled survive only if flushed
+	if atomic.LoadUint32(&d.nowal) != 0 && d.wok() == nil {
+		d.wlock <- struct{}{}
+		if d.freezeMem() == nil && d.hasFrozenMem() {
+			d.cch <- cSched
+			d.cch <- cWait
+		}
+		<-d.wlock
+	}
+
 	if !d.setClosed() {
 		return errors.ErrClosed
 	}
 
+	// don't hold the compaction goroutine back
+	d.climit.lift(true)
+
+	// wake durable waiters and pending async requests
+	d.durableWake()
+	close(d.closeC)
+
+	// the journal syncer must be done with the writer mutex
+	d.swg.Wait()
+
 	d.wlock <- struct{}{}
 drain:
 	for {
@@ -575,14 +2003,16 @@ drain:
 	}
 	close(d.wlock)
 
-	// wake journal writer goroutine
-	d.jch <- nil
+	if !d.readOnly {
+		// wake journal writer goroutine
+		d.jch <- nil
 
-	// wake Compaction goroutine
-	d.cch <- cClose
+		// wake Compaction goroutine
+		d.cch <- cClose
 
-	// wait for the WaitGroup
-	d.ewg.Wait()
+		// wait for the WaitGroup
+		d.ewg.Wait()
+	}
 
 	// close journal
 	if d.journal != nil {
@@ -7,10 +7,15 @@
 package leveldb
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/memdb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
 type cStats struct {
@@ -18,6 +23,7 @@ type cStats struct {
 	duration time.Duration
 	read     uint64
 	write    uint64
+	seeks    uint64 // seek-triggered compactions
 }
 
 func (p *cStats) add(n *cStatsStaging) {
@@ -28,10 +34,48 @@ func (p *cStats) add(n *cStatsStaging) {
 	p.Unlock()
 }
 
-func (p *cStats) get() (duration time.Duration, read, write uint64) {
+func (p *cStats) addSeek() {
+	p.Lock()
+	p.seeks++
+	p.Unlock()
+}
+
+func (p *cStats) get() (duration time.Duration, read, write, seeks uint64) {
 	p.Lock()
 	defer p.Unlock()
-	return p.duration, p.read, p.write
+	return p.duration, p.read, p.write, p.seeks
+}
+
+// cProgress is the progress of a running table compaction.
+type cProgress struct {
+	level     int
+	tables    int
+	size      uint64
+	processed uint64 // bytes of entries processed; atomic
+}
+
+// Publish progress of given compaction until endProgress is called.
+func (d *DB) startProgress(c *compaction) *cProgress {
+	p := &cProgress{
+		level:  c.level,
+		tables: len(c.tables[0]) + len(c.tables[1]),
+		size:   c.tables[0].size() + c.tables[1].size(),
+	}
+	d.cprogMu.Lock()
+	d.cprog = append(d.cprog, p)
+	d.cprogMu.Unlock()
+	return p
+}
+
+func (d *DB) endProgress(p *cProgress) {
+	d.cprogMu.Lock()
+	defer d.cprogMu.Unlock()
+	for i, x := range d.cprog {
+		if x == p {
+			d.cprog = append(d.cprog[:i], d.cprog[i+1:]...)
+			break
+		}
+	}
 }
 
 type cStatsStaging struct {
@@ -42,6 +86,79 @@ type cStatsStaging struct {
 	write    uint64
 }
 
+// rateLimiter is a token bucket limiting compaction IO to given number of
+// bytes per second, allowing bursts of up to a second worth of bytes.
+type rateLimiter struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	lifted int32 // number of lifts in effect
+}
+
+// Wait until n bytes may be transferred at given rate; rate <= 0 means no
+// limit. Waiting ends early once the limiter is lifted.
+func (l *rateLimiter) wait(n, rate int) {
+	if rate <= 0 || atomic.LoadInt32(&l.lifted) > 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := float64(rate)
+	refill := func() {
+		now := time.Now()
+		if l.last.IsZero() {
+			l.tokens = r
+		} else {
+			l.tokens += now.Sub(l.last).Seconds() * r
+		}
+		if l.tokens > r {
+			l.tokens = r
+		}
+		l.last = now
+	}
+	refill()
+	l.tokens -= float64(n)
+	for l.tokens < 0 {
+		if atomic.LoadInt32(&l.lifted) > 0 {
+			l.tokens = 0
+			return
+		}
+		d := time.Duration(-l.tokens / r * float64(time.Second))
+		if d > 10*time.Millisecond {
+			d = 10 * time.Millisecond
+		}
+		time.Sleep(d)
+		refill()
+	}
+}
+
+// Lift or restore the limit; lifts nest.
+func (l *rateLimiter) lift(on bool) {
+	if on {
+		atomic.AddInt32(&l.lifted, 1)
+	} else {
+		atomic.AddInt32(&l.lifted, -1)
+	}
+}
+
+// limitIter throttle iteration by the compaction rate limit.
+type limitIter struct {
+	iterator.Iterator
+	d *DB
+}
+
+func (d *DB) newLimitIter(iter iterator.Iterator) iterator.Iterator {
+	return &limitIter{Iterator: iter, d: d}
+}
+
+func (i *limitIter) Next() bool {
+	if !i.Iterator.Next() {
+		return false
+	}
+	i.d.climit.wait(len(i.Key())+len(i.Value()), i.d.s.o.GetCompactionRateLimit())
+	return true
+}
+
 func (p *cStatsStaging) startTimer() {
 	if !p.timerOn {
 		p.start = time.Now()
@@ -59,6 +176,40 @@ func (p *cStatsStaging) stopTimer() {
 type cReq struct {
 	level    int
 	min, max iKey
+	tables   []uint64 // tables to merge, if set
+	load     tFiles   // bulk loaded tables to install, if set
+	seq      uint64   // seq number of bulk loaded entries
+	manifest bool     // rotate the manifest, if set
+
+	partition uint64  // partition table size, if set
+	ranges    []Range // partition ranges
+
+	ctx    context.Context
+	cancel <-chan struct{} // ctx.Done(), nil if not cancellable
+	err    error
+	done   chan error // receives the result of an async request, if set
+}
+
+// Deliver the result of an async request; at most once.
+func (r *cReq) reply(err error) {
+	if r.done != nil {
+		r.done <- err
+		r.done = nil
+	}
+}
+
+// Check whether the request has been cancelled.
+func (r *cReq) cancelled() bool {
+	if r.ctx == nil {
+		return false
+	}
+	select {
+	case <-r.ctx.Done():
+		r.err = r.ctx.Err()
+		return true
+	default:
+	}
+	return false
 }
 
 type cSignal int
@@ -81,14 +232,42 @@ func newCMem(s *session) *cMem {
 }
 
 func (c *cMem) flush(mem *memdb.DB, level int) error {
+	return c.flushWith(mem, level, 0, nil)
+}
+
+// Like flush, but drop entries covered by range tombstones of the memdb
+// visible at minSeq, and pass entries through given wrap function, if not
+// nil.
+func (c *cMem) flushWith(mem *memdb.DB, level int, minSeq uint64, wrap func(iterator.Iterator) iterator.Iterator) error {
 	s := c.s
 
-	// Write memdb to table
-	t, n, err := s.tops.createFrom(mem.NewIterator())
+	rd := newRangeDelIter(mem.NewIterator(), s.cmp.cmp, nil, minSeq)
+	var iter iterator.Iterator = newTTLCompactIter(rd, ttlNow())
+	if wrap != nil {
+		iter = wrap(iter)
+	}
+
+	// Write memdb to table; level is not yet known if negative
+	clevel := level
+	if clevel < 0 {
+		clevel = 0
+	}
+	t, n, err := s.tops.createFrom(iter, clevel)
 	if err != nil {
 		return err
 	}
 
+	if t == nil {
+		s.print("Compaction: no table created, source=mem")
+		c.level = 0
+		return nil
+	}
+	// Range tombstones written to the table are indexed by the version
+	for _, r := range rd.rdels {
+		c.rec.addRangeDel(r)
+	}
+	t.cleanSeq = minSeq
+
 	if level < 0 {
 		level = s.version().pickLevel(t.min.ukey(), t.max.ukey())
 	}
@@ -157,6 +336,26 @@ func (d *DB) transact(f func() error) {
 	}
 }
 
+// Like transact, but for compaction workers, which leave the compaction
+// channel to the compaction goroutine and just bail out once closed.
+func (d *DB) transactWorker(f func() error) {
+	s := d.s
+	for {
+		if d.isClosed() {
+			panic(d)
+		}
+		err := f()
+		if (d.geterr() == nil) != (err == nil) {
+			d.seterr(err)
+		}
+		if err == nil {
+			return
+		}
+		s.printf("Transact: worker err=%q", err)
+		time.Sleep(time.Second)
+	}
+}
+
 func (d *DB) memCompaction(mem *memdb.DB) {
 	s := d.s
 	c := newCMem(s)
@@ -164,19 +363,52 @@ func (d *DB) memCompaction(mem *memdb.DB) {
 
 	s.printf("MemCompaction: started, size=%d entries=%d", mem.Size(), mem.Len())
 
+	// keep pinned keys at level 0; so does tables flushed while workers
+	// are running, as their outputs are not yet known
+	level := -1
+	if pins := d.getPins(); d.cbusy || (pins != nil && pins.inMem(mem)) {
+		level = 0
+	}
+
 	d.transact(func() (err error) {
 		stats.startTimer()
 		defer stats.stopTimer()
-		return c.flush(mem, -1)
+		// every entry of the frozen mem is at or below fseq
+		minSeq := d.snaps.seq(d.getSeq())
+		if minSeq > d.fseq {
+			minSeq = d.fseq
+		}
+		var wrap func(iterator.Iterator) iterator.Iterator
+		if merger := s.o.GetMerger(); merger != nil {
+			v := s.version_NB()
+			wrap = func(iter iterator.Iterator) iterator.Iterator {
+				return newMergeCompactIter(iter, merger, s.cmp.cmp, minSeq, func(ukey []byte) bool {
+					return !v.hasKey(ukey, 0)
+				})
+			}
+		}
+		return c.flushWith(mem, level, minSeq, wrap)
 	})
 
+	if d.hasTs() {
+		c.rec.setTs()
+	}
+
 	d.transact(func() (err error) {
 		stats.startTimer()
 		defer stats.stopTimer()
 		return c.commit(d.journal.file.Num(), d.fseq)
 	})
 
-	stats.write = c.t.size
+	// frozen mem now persisted to table, so does writes synced to the
+	// current journal
+	atomic.StoreUint64(&d.fnwseq, 0)
+	d.setDurableSeq(d.fseq)
+	d.setDurableSeq(atomic.LoadUint64(&d.sseq))
+
+	if c.t != nil {
+		stats.write = c.t.size
+	}
 	d.cstats[c.level].add(stats)
 
 	// drop frozen mem
@@ -185,21 +417,38 @@ func (d *DB) memCompaction(mem *memdb.DB) {
 	c = nil
 }
 
-func (d *DB) doCompaction(c *compaction, noTrivial bool) {
+// Compact given compaction; return table that hold pinned keys kept at
+// compacted level, if any.
+func (d *DB) doCompaction(c *compaction, noTrivial bool) (pt *tFile) {
 	s := d.s
 	ucmp := s.cmp.cmp
+	transact := d.transact
+	if c.worker {
+		transact = d.transactWorker
+	}
 
-	s.printf("Compaction: compacting, level=%d tables=%d, level=%d tables=%d",
-		c.level, len(c.tables[0]), c.level+1, len(c.tables[1]))
+	olevel := c.outLevel()
+	s.printf("Compaction: compacting, level=%d tables=%d, level=%d tables=%d tier=%v",
+		c.level, len(c.tables[0]), c.level+1, len(c.tables[1]), c.tier)
 
 	rec := new(sessionRecord)
 	rec.addCompactPointer(c.level, c.max)
 
-	if !noTrivial && c.trivial() {
+	if c.seek {
+		d.cstats[c.level+1].addSeek()
+	}
+
+	// Pinned keys within range of "level" tables are kept at "level"
+	pins := d.getPins()
+	if c.level == 0 || (pins != nil && !pins.overlaps(c.min.ukey(), c.max.ukey())) {
+		pins = nil
+	}
+
+	if !noTrivial && pins == nil && c.trivial() {
 		t := c.tables[0][0]
 		rec.deleteTable(c.level, t.file.Num())
 		rec.addTableFile(c.level+1, t)
-		d.transact(func() (err error) {
+		transact(func() (err error) {
 			return s.commit(rec)
 		})
 		s.printf("Compaction: table level changed, num=%d from=%d to=%d",
@@ -211,28 +460,45 @@ func (d *DB) doCompaction(c *compaction, noTrivial bool) {
 	var snapHasUkey bool
 	var snapSeq uint64
 	var snapIter int
+	var snapPinned int
+	var snapProcessed uint64
 	var tw *tWriter
+	var pinned [][2][]byte
+	var dropped rangeDels
+	var snapDropped int
+	var stopping bool // cancelled, stop at the next clean cut
+	var prev []byte   // user key of previous entry, once stopping
+	var cut []byte    // user key compacted tables were split before, if set
 	minSeq := d.snaps.seq(d.getSeq())
+	cleanSeq := d.cleanSeq(minSeq)
 	stats := new(cStatsStaging)
+	progress := d.startProgress(c)
+	defer d.endProgress(progress)
 
 	finish := func() error {
 		t, err := tw.finish()
 		if err != nil {
 			return err
 		}
-		rec.addTableFile(c.level+1, t)
+		t.cleanSeq = cleanSeq
+		rec.addTableFile(olevel, t)
 		stats.write += t.size
 		s.printf("Compaction: table created, source=file level=%d num=%d size=%d entries=%d min=%q max=%q",
-			c.level+1, t.file.Num(), t.size, tw.tw.Len(), t.min, t.max)
+			olevel, t.file.Num(), t.size, tw.tw.Len(), t.min, t.max)
 		return nil
 	}
 
-	d.transact(func() (err error) {
+	transact(func() (err error) {
 		tw = nil
-		ukey := snapUkey
+		prev = nil
+		// copied, as moving on may release the table holding the key
+		ukey := append([]byte{}, snapUkey...)
 		hasUkey := snapHasUkey
 		lseq := snapSeq
 		snapSched := snapIter == 0
+		pinned = pinned[:snapPinned]
+		dropped = dropped[:snapDropped]
+		atomic.StoreUint64(&progress.processed, snapProcessed)
 
 		defer func() {
 			stats.stopTimer()
@@ -243,15 +509,27 @@ func (d *DB) doCompaction(c *compaction, noTrivial bool) {
 		}()
 
 		stats.startTimer()
-		iter := c.newIterator()
+		iter := d.newLimitIter(c.newIterator())
+		if rdels := c.version.rdels; len(rdels) > 0 {
+			iter = newRangeDelIter(iter, ucmp, rdels, minSeq)
+		}
+		iter = newTTLCompactIter(iter, ttlNow())
+		if merger := s.o.GetMerger(); merger != nil {
+			iter = newMergeCompactIter(iter, merger, ucmp, minSeq, func(ukey []byte) bool {
+				return !c.tier && !c.version.hasKey(ukey, c.level+2)
+			})
+		}
+		defer iter.Release()
 		for i := 0; iter.Next(); i++ {
 			// Skip until last state
 			if i < snapIter {
 				continue
 			}
 
-			// Prioritize memdb compaction
-			if mem := d.getFrozenMem(); mem != nil {
+			// Prioritize memdb compaction; not while merging a tier,
+			// since flushed tables must be newer than the merged one,
+			// and left to the compaction goroutine for workers.
+			if mem := d.getFrozenMem(); mem != nil && !c.tier && !c.worker {
 				stats.stopTimer()
 				d.memCompaction(mem)
 				// dry the channel
@@ -271,6 +549,32 @@ func (d *DB) doCompaction(c *compaction, noTrivial bool) {
 
 			key := iKey(iter.Key())
 
+			// Once cancelled, stop before the first entry of a user key
+			// the compacted tables may be split before, as long as the
+			// range tombstones dropped so far don't reach it; the rest
+			// is left uncompacted.
+			if stopping {
+				if _, _, ok := key.parseNum(); ok {
+					if prev != nil && ucmp.Compare(key.ukey(), prev) > 0 &&
+						c.isCleanCut(key.ukey()) && dropped.before(key.ukey(), ucmp) {
+						if tw != nil {
+							if tw.tw.Len() > 0 {
+								err = finish()
+							} else {
+								tw.drop()
+							}
+							if err != nil {
+								return
+							}
+							tw = nil
+						}
+						cut = dupBytes(key.ukey())
+						return
+					}
+					prev = append(prev[:0], key.ukey()...)
+				}
+			}
+
 			if c.shouldStopBefore(key) && tw != nil {
 				err = finish()
 				if err != nil {
@@ -279,18 +583,22 @@ func (d *DB) doCompaction(c *compaction, noTrivial bool) {
 				snapSched = true
 
 				// create new table but don't check for error now
-				tw, err = s.tops.create()
+				tw, err = s.tops.create(olevel)
 			}
 
 			// Scheduled for snapshot, snapshot will used to retry compaction
 			// if error occured.
 			if snapSched {
-				snapUkey = ukey
+				snapUkey = append(snapUkey[:0], ukey...)
 				snapHasUkey = hasUkey
 				snapSeq = lseq
 				snapIter = i
+				snapPinned = len(pinned)
+				snapDropped = len(dropped)
+				snapProcessed = atomic.LoadUint64(&progress.processed)
 				snapSched = false
 			}
+			atomic.AddUint64(&progress.processed, uint64(len(key)+len(iter.Value())))
 
 			// defered error checking from above new table creation
 			if err != nil {
@@ -302,10 +610,18 @@ func (d *DB) doCompaction(c *compaction, noTrivial bool) {
 				ukey = nil
 				hasUkey = false
 				lseq = kMaxSeq
+			} else if t == tRangeDel {
+				// Range tombstone doesn't shadow entries of its start key;
+				// it was applied to every compacted entry it cover if
+				// visible to every snapshot.
+				if r := (&rangeDel{start: key.ukey(), limit: iter.Value(), seq: seq}); seq <= minSeq && c.isBaseLevelForRangeDel(r) {
+					dropped = append(dropped, &rangeDel{start: dupBytes(r.start), limit: dupBytes(r.limit), seq: seq})
+					continue
+				}
 			} else {
 				if !hasUkey || ucmp.Compare(key.ukey(), ukey) != 0 {
 					// First occurrence of this user key
-					ukey = key.ukey()
+					ukey = append(ukey[:0], key.ukey()...)
 					hasUkey = true
 					lseq = kMaxSeq
 				}
@@ -325,15 +641,25 @@ func (d *DB) doCompaction(c *compaction, noTrivial bool) {
 					drop = true
 				}
 
-				lseq = seq
+				// Older entries are needed to resolve unresolved merge
+				// operands
+				if t != tMerge {
+					lseq = seq
+				}
 				if drop {
 					continue
 				}
+
+				if pins != nil && pins.contains(ukey) &&
+					ucmp.Compare(ukey, c.min.ukey()) >= 0 && ucmp.Compare(ukey, c.max.ukey()) <= 0 {
+					pinned = append(pinned, [2][]byte{dupBytes(key), dupBytes(iter.Value())})
+					continue
+				}
 			}
 
 			// Create new table if not already
 			if tw == nil {
-				tw, err = s.tops.create()
+				tw, err = s.tops.create(olevel)
 				if err != nil {
 					return
 				}
@@ -345,14 +671,29 @@ func (d *DB) doCompaction(c *compaction, noTrivial bool) {
 				return
 			}
 
-			// Finish table if it is big enough
-			if tw.tw.Size() >= kMaxTableSize {
+			// Finish table if it is big enough; a tier is merged into
+			// a single table, as level-0 tables may overlap
+			if !c.tier && tw.tw.Size() >= kMaxTableSize {
 				err = finish()
 				if err != nil {
 					return
 				}
 				snapSched = true
 				tw = nil
+
+				// Stop if closed, the compaction won't be committed;
+				// created tables are removed as obsolete files on open
+				if d.isClosed() {
+					return
+				}
+				if !stopping {
+					select {
+					case <-c.cancel:
+						stopping = true
+						prev = append(prev[:0], key.ukey()...)
+					default:
+					}
+				}
 			}
 		}
 
@@ -364,40 +705,464 @@ func (d *DB) doCompaction(c *compaction, noTrivial bool) {
 		return
 	})
 
-	s.print("Compaction: done")
+	// Write pinned keys back to "level"
+	if len(pinned) > 0 {
+		transact(func() (err error) {
+			stats.startTimer()
+			defer stats.stopTimer()
+			tw, err := s.tops.create(c.level)
+			if err != nil {
+				return
+			}
+			for _, kv := range pinned {
+				err = tw.add(kv[0], kv[1])
+				if err != nil {
+					tw.drop()
+					return
+				}
+			}
+			t, err := tw.finish()
+			if err != nil {
+				tw.drop()
+				return
+			}
+			t.cleanSeq = cleanSeq
+			rec.addTableFile(c.level, t)
+			stats.write += t.size
+			pt = t
+			s.printf("Compaction: table created, source=pinned level=%d num=%d size=%d entries=%d min=%q max=%q",
+				c.level, t.file.Num(), t.size, len(pinned), t.min, t.max)
+			return
+		})
+	}
+
+	if cut != nil {
+		s.printf("Compaction: cancelled, compacted before %q", cut)
+	} else {
+		s.print("Compaction: done")
+	}
 
 	for n, tt := range c.tables {
 		for _, t := range tt {
+			// Tables at or after the cut are left as is
+			if cut != nil && ucmp.Compare(t.max.ukey(), cut) >= 0 {
+				continue
+			}
 			stats.read += t.size
 			// Insert deleted tables into record
 			rec.deleteTable(c.level+n, t.file.Num())
 		}
 	}
+	for _, r := range dropped {
+		rec.deleteRangeDel(r.seq)
+	}
+	if len(dropped) > 0 {
+		s.printf("Compaction: range tombstones dropped, tombstones=%d", len(dropped))
+	}
 
 	// Commit changes
-	d.transact(func() (err error) {
+	transact(func() (err error) {
 		stats.startTimer()
 		defer stats.stopTimer()
 		return s.commit(rec)
 	})
 
 	// Save compaction stats
-	d.cstats[c.level+1].add(stats)
+	d.cstats[olevel].add(stats)
+	return
+}
+
+// Run given compactions concurrently, each by its own worker goroutine,
+// while the compaction goroutine keep serving the compaction channel and
+// flushing frozen memdb.
+func (d *DB) runCompactions(cs []*compaction) {
+	s := d.s
+	if len(cs) == 1 {
+		d.doCompaction(cs[0], false)
+		return
+	}
+
+	s.printf("Compaction: running %d compactions concurrently", len(cs))
+	var wg sync.WaitGroup
+	wg.Add(len(cs))
+	d.cwg.Add(len(cs))
+	for _, c := range cs {
+		c.worker = true
+		go func(c *compaction) {
+			defer func() {
+				wg.Done()
+				d.cwg.Done()
+				if x := recover(); x != nil && x != d {
+					panic(x)
+				}
+			}()
+			d.doCompaction(c, false)
+		}(c)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	d.cbusy = true
+	defer func() {
+		d.cbusy = false
+	}()
+
+	closed := false
+	for {
+		select {
+		case <-done:
+			if closed {
+				panic(d)
+			}
+			return
+		case signal := <-d.cch:
+			if signal == cClose {
+				// wait for the workers, which bail out once closed
+				closed = true
+				continue
+			}
+		}
+		if mem := d.getFrozenMem(); mem != nil && !closed {
+			d.memCompaction(mem)
+		}
+	}
+}
+
+func (d *DB) mergeTables(level int, nums []uint64) (err error) {
+	s := d.s
+
+	v := s.version_NB()
+	tt := v.tables[level]
+
+	// Tables must be adjacent within the level
+	start := -1
+	for i, t := range tt {
+		if t.file.Num() == nums[0] {
+			start = i
+			break
+		}
+	}
+	if start < 0 || start+len(nums) > len(tt) {
+		return errors.ErrInvalid("merge tables: table not found or not adjacent")
+	}
+	t0 := tt[start : start+len(nums)]
+	for i, t := range t0 {
+		if t.file.Num() != nums[i] {
+			return errors.ErrInvalid("merge tables: table not found or not adjacent")
+		}
+	}
+
+	s.printf("MergeTables: merging, level=%d tables=%d", level, len(t0))
+
+	stats := new(cStatsStaging)
+	stats.startTimer()
+
+	ro := &opt.ReadOptions{
+		Flag: opt.RFDontFillCache,
+	}
+	if s.o.HasFlag(opt.OFParanoidCheck) {
+		ro.Flag |= opt.RFVerifyChecksums
+	}
+	iter := d.newLimitIter(iterator.NewIndexedIterator(t0.newIndexIterator(s.tops, s.cmp, ro)))
+	t, n, err := s.tops.createFrom(iter, level)
+	iter.Release()
+	if err != nil {
+		return
+	}
+
+	rec := new(sessionRecord)
+	t.cleanSeq = t0[0].cleanSeq
+	for _, x := range t0 {
+		stats.read += x.size
+		rec.deleteTable(level, x.file.Num())
+		if x.cleanSeq < t.cleanSeq {
+			t.cleanSeq = x.cleanSeq
+		}
+	}
+	rec.addTableFile(level, t)
+	err = s.commit(rec)
+	if err != nil {
+		t.file.Remove()
+		s.reuseFileNum(t.file.Num())
+		return
+	}
+	stats.write = t.size
+	stats.stopTimer()
+
+	s.printf("MergeTables: table created, level=%d num=%d size=%d entries=%d min=%q max=%q",
+		level, t.file.Num(), t.size, n, t.min, t.max)
+
+	d.cstats[level].add(stats)
+	return
+}
+
+// Install bulk loaded tables at the deepest level that none of the
+// levels above it overlap with; entries on those levels would otherwise
+// shadow the newer loaded ones.
+func (d *DB) installTables(tt tFiles, seq uint64) (err error) {
+	s := d.s
+
+	// the memdb had been flushed before the tables were created, thus
+	// any level-0 table holding older entries is older than the tables
+	min, max := tt[0].min.ukey(), tt[len(tt)-1].max.ukey()
+	v := s.version_NB()
+	level := 0
+	for i, x := range v.tables {
+		if x.isOverlaps(min, max, i > 0, s.cmp) {
+			break
+		}
+		level = i
+	}
+
+	rec := new(sessionRecord)
+	for _, t := range tt {
+		// loaded entries are newer than any range tombstone
+		t.cleanSeq = seq - 1
+		rec.addTableFile(level, t)
+	}
+	rec.setSeq(seq)
+	err = s.commit(rec)
+	if err != nil {
+		return
+	}
+
+	var size uint64
+	for _, t := range tt {
+		size += t.size
+	}
+	s.printf("BulkLoad: tables installed, level=%d tables=%d size=%d min=%q max=%q",
+		level, len(tt), size, min, max)
+
+	d.cstats[level].add(&cStatsStaging{write: size})
+	return
+}
+
+// Rewrite all tables into bottom level tables of about given size each,
+// never splitting a user key across tables; return key ranges of the
+// tables.
+func (d *DB) partition(size uint64) (rs []Range, err error) {
+	s := d.s
+	ucmp := s.cmp.cmp
+
+	// frozen mem must be persisted first
+	if mem := d.getFrozenMem(); mem != nil {
+		d.memCompaction(mem)
+	}
+
+	level := len(s.version_NB().tables) - 1
+	s.printf("Partition: started, size=%d", size)
+
+	stats := new(cStatsStaging)
+	stats.startTimer()
+
+	ro := &opt.ReadOptions{
+		Flag: opt.RFDontFillCache,
+	}
+	if s.o.HasFlag(opt.OFParanoidCheck) {
+		ro.Flag |= opt.RFVerifyChecksums
+	}
+	v := s.version_NB()
+	minSeq := d.snaps.seq(d.getSeq())
+	cleanSeq := d.cleanSeq(minSeq)
+	var iter iterator.Iterator = iterator.NewMergedIterator(v.getIterators(ro), s.cmp)
+	if len(v.rdels) > 0 {
+		iter = newRangeDelIter(iter, ucmp, v.rdels, minSeq)
+	}
+	iter = newTTLCompactIter(iter, ttlNow())
+	if merger := s.o.GetMerger(); merger != nil {
+		iter = newMergeCompactIter(iter, merger, ucmp, minSeq, func([]byte) bool {
+			return true
+		})
+	}
+	defer iter.Release()
+
+	var tt tFiles
+	var tw *tWriter
+	var dropped []uint64
+	defer func() {
+		if err != nil {
+			if tw != nil {
+				tw.drop()
+			}
+			for _, t := range tt {
+				s.tops.remove(t)
+			}
+		}
+	}()
+
+	finish := func() (err error) {
+		t, err := tw.finish()
+		if err != nil {
+			return
+		}
+		t.cleanSeq = cleanSeq
+		s.printf("Partition: table created, level=%d num=%d size=%d entries=%d min=%q max=%q",
+			level, t.file.Num(), t.size, tw.tw.Len(), t.min, t.max)
+		tt, tw = append(tt, t), nil
+		return
+	}
+
+	var ukey []byte
+	var hasUkey bool
+	lseq := kMaxSeq
+	for iter.Next() {
+		key := iKey(iter.Key())
+		seq, t, ok := key.parseNum()
+		first := !ok || !hasUkey || ucmp.Compare(key.ukey(), ukey) != 0
+
+		// Only split on user key boundary
+		if first && tw != nil && uint64(tw.tw.Size()) >= size {
+			err = finish()
+			if err != nil {
+				return
+			}
+		}
+
+		if !ok {
+			// Don't drop error keys
+			ukey = nil
+			hasUkey = false
+			lseq = kMaxSeq
+		} else {
+			if first {
+				ukey = append(ukey[:0], key.ukey()...)
+				hasUkey = true
+				lseq = kMaxSeq
+			}
+
+			// Everything is compacted into the bottom level, so deletion
+			// markers are obsolete as soon as no snapshot need them.
+			if t == tRangeDel {
+				if seq <= minSeq {
+					dropped = append(dropped, seq)
+					continue
+				}
+			} else {
+				drop := lseq <= minSeq || (t == tDel && seq <= minSeq)
+				if t != tMerge {
+					lseq = seq
+				}
+				if drop {
+					continue
+				}
+			}
+		}
+
+		if tw == nil {
+			tw, err = s.tops.create(level)
+			if err != nil {
+				return
+			}
+		}
+		err = tw.add(key, iter.Value())
+		if err != nil {
+			return
+		}
+	}
+	err = iter.Error()
+	if err != nil {
+		return
+	}
+	if tw != nil {
+		err = finish()
+		if err != nil {
+			return
+		}
+	}
+
+	rec := new(sessionRecord)
+	for i, x := range v.tables {
+		for _, t := range x {
+			stats.read += t.size
+			rec.deleteTable(i, t.file.Num())
+		}
+	}
+	for _, t := range tt {
+		stats.write += t.size
+		rec.addTableFile(level, t)
+	}
+	for _, seq := range dropped {
+		rec.deleteRangeDel(seq)
+	}
+	err = s.commit(rec)
+	if err != nil {
+		return
+	}
+	stats.stopTimer()
+	d.cstats[level].add(stats)
+
+	s.printf("Partition: done, tables=%d", len(tt))
+	if len(dropped) > 0 {
+		s.printf("Partition: range tombstones dropped, tombstones=%d", len(dropped))
+	}
+
+	for i, t := range tt {
+		rs = append(rs, Range{})
+		if i > 0 {
+			start := dupBytes(t.min.ukey())
+			rs[i].Start = start
+			rs[i-1].Limit = start
+		}
+	}
+	return
+}
+
+// Compact given level for range of the request, one compaction at a time
+// until no table left within the range or the request is cancelled.
+func (d *DB) compactRangeAt(creq *cReq, level int) {
+	s := d.s
+	// tables holding pinned keys kept at level by this request
+	var kept map[uint64]bool
+	for !creq.cancelled() {
+		c := s.getCompactionRange(level, creq.min, creq.max)
+		if c == nil {
+			return
+		}
+		c.cancel = creq.cancel
+		done := kept != nil
+		for _, t := range c.tables[0] {
+			if !kept[t.file.Num()] {
+				done = false
+				break
+			}
+		}
+		if done {
+			return
+		}
+		if pt := d.doCompaction(c, true); pt != nil {
+			if kept == nil {
+				kept = make(map[uint64]bool)
+			}
+			kept[pt.file.Num()] = true
+		}
+	}
 }
 
 func (d *DB) compaction() {
+	var creq *cReq
 	defer func() {
 		if x := recover(); x != nil {
 			if x != d {
 				panic(x)
 			}
 		}
+		if creq != nil {
+			creq.reply(errors.ErrClosed)
+		}
+		// workers must be done with the session
+		d.cwg.Wait()
 		// dry the channel
 	drain:
 		for {
 			select {
 			case <-d.cch:
-			case <-d.creq:
+			case r := <-d.creq:
+				if r != nil {
+					r.reply(errors.ErrClosed)
+				}
 			default:
 				break drain
 			}
@@ -407,7 +1172,7 @@ func (d *DB) compaction() {
 	}()
 
 	for s := d.s; true; {
-		var creq *cReq
+		creq = nil
 		select {
 		case signal := <-d.cch:
 			switch signal {
@@ -422,6 +1187,26 @@ func (d *DB) compaction() {
 				continue
 			}
 
+			if creq.tables != nil {
+				creq.err = d.mergeTables(creq.level, creq.tables)
+				break
+			}
+
+			if creq.load != nil {
+				creq.err = d.installTables(creq.load, creq.seq)
+				break
+			}
+
+			if creq.manifest {
+				creq.err = s.rotateManifest()
+				break
+			}
+
+			if creq.partition > 0 {
+				creq.ranges, creq.err = d.partition(creq.partition)
+				break
+			}
+
 			s.printf("CompactRange: ordered, level=%d", creq.level)
 
 			if mem := d.getFrozenMem(); mem != nil {
@@ -429,10 +1214,7 @@ func (d *DB) compaction() {
 			}
 
 			if creq.level >= 0 {
-				c := s.getCompactionRange(creq.level, creq.min, creq.max)
-				if c != nil {
-					d.doCompaction(c, true)
-				}
+				d.compactRangeAt(creq, creq.level)
 			} else {
 				v := s.version()
 				maxLevel := 1
@@ -441,14 +1223,17 @@ func (d *DB) compaction() {
 						maxLevel = i + 1
 					}
 				}
-				for i := 0; i < maxLevel; i++ {
-					c := s.getCompactionRange(i, creq.min, creq.max)
-					if c != nil {
-						d.doCompaction(c, true)
-					}
+				for i := 0; i < maxLevel && creq.err == nil; i++ {
+					d.compactRangeAt(creq, i)
 				}
 			}
-			s.print("CompactRange: done")
+			if creq.err != nil {
+				s.printf("CompactRange: aborted, err=%q", creq.err)
+				creq.reply(creq.err)
+			} else {
+				s.print("CompactRange: done")
+				creq.reply(d.geterr())
+			}
 		}
 
 		for a, b := true, true; a || b; {
@@ -460,7 +1245,11 @@ func (d *DB) compaction() {
 			}
 
 			if s.version().needCompaction() {
-				d.doCompaction(s.pickCompaction(), false)
+				if n := s.o.GetMaxCompactions(); n > 1 {
+					d.runCompactions(s.pickCompactions(n))
+				} else {
+					d.doCompaction(s.pickCompaction(), false)
+				}
 				b = true
 			}
 		}
@@ -7,6 +7,9 @@
 package leveldb
 
 import (
+	"bytes"
+	"sync/atomic"
+
 	"github.com/syndtr/goleveldb/leveldb/comparer"
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
@@ -15,9 +18,41 @@ import (
 
 var errIKeyCorrupt = errors.ErrCorrupt("internal key corrupted")
 
+// Return internal key bounds of the key range of given read options; nil
+// means unbounded.
+func readRange(ro *opt.ReadOptions) (start, limit iKey) {
+	if ro == nil {
+		return
+	}
+	if ro.Start != nil {
+		start = newSeekIKey(ro.Start, kMaxSeq)
+	}
+	if ro.Limit != nil {
+		limit = newSeekIKey(ro.Limit, kMaxSeq)
+	}
+	return
+}
+
+// Bound given internal key iterator to the key range of given read
+// options, if any.
+func boundIter(it iterator.Iterator, ro *opt.ReadOptions, icmp *iComparer) iterator.Iterator {
+	start, limit := readRange(ro)
+	if start == nil && limit == nil {
+		return it
+	}
+	return iterator.NewRangeIterator(it, start, limit, icmp)
+}
+
 // newRawIterator return merged interators of current version, current frozen memdb
-// and current memdb.
+// and current memdb; each of them bounded to the key range of read options.
 func (d *DB) newRawIterator(ro *opt.ReadOptions) iterator.Iterator {
+	it, _ := d.newRawIteratorRd(ro)
+	return it
+}
+
+// Like newRawIterator, but also return range tombstones within the
+// iterated memdb and version.
+func (d *DB) newRawIteratorRd(ro *opt.ReadOptions) (iterator.Iterator, rangeDels) {
 	s := d.s
 
 	mem := d.getMem()
@@ -25,13 +60,13 @@ func (d *DB) newRawIterator(ro *opt.ReadOptions) iterator.Iterator {
 
 	ti := v.getIterators(ro)
 	ii := make([]iterator.Iterator, 0, len(ti)+2)
-	ii = append(ii, mem.cur.NewIterator())
+	ii = append(ii, boundIter(mem.cur.NewIterator(), ro, s.cmp))
 	if mem.froze != nil {
-		ii = append(ii, mem.froze.NewIterator())
+		ii = append(ii, boundIter(mem.froze.NewIterator(), ro, s.cmp))
 	}
 	ii = append(ii, ti...)
 
-	return iterator.NewMergedIterator(ii, s.cmp)
+	return iterator.NewMergedIterator(ii, s.cmp), getRangeDels(mem, v)
 }
 
 // dbIter represent an interator states over a database session.
@@ -40,34 +75,73 @@ type dbIter struct {
 	cmp        comparer.BasicComparer
 	it         iterator.Iterator
 	seq        uint64
+	ts         bool // source may hold timestamped keys besides the db
+	merger     opt.Merger
+	rdels      rangeDels
 	copyBuffer bool
+	releaser   iterator.Releaser // released along with the iterator
+	now        int64             // time TTL values expire against
+	released   bool
+	d          *DB // counted in DB outstanding iterators, if not nil
 
 	valid    bool
 	backward bool
 	last     bool
+	merged   bool // forward entry resolved from merge operands
+	passed   bool // last forward move passed over a deleted key
 	skey     []byte
 	sval     []byte
+	err      error
+
+	// Entries kept past a move are copied, as moving on may release the
+	// table holding them, which is unmapped if read in place.
+	kbuf, vbuf []byte
+}
+
+// Check whether given entry is deleted by a range tombstone.
+func (i *dbIter) covered(ukey []byte, seq uint64) bool {
+	return len(i.rdels) > 0 && i.rdels.coverSeq(ukey, i.seq, i.cmp) > seq
 }
 
 func (i *dbIter) clear() {
 	i.skey, i.sval = nil, nil
+	i.merged = false
 }
 
 func (i *dbIter) scanNext(skip []byte) {
 	cmp := i.cmp
 	it := i.it
 
+	if skip != nil {
+		i.kbuf = copyBytes(i.kbuf, skip)
+		skip = i.kbuf
+	}
+
+	i.passed = false
 	for {
 		key := iKey(it.Key())
-		if seq, t, ok := key.parseNum(); ok && seq <= i.seq {
+		if seq, t, ok := key.parseNum(); ok && seq <= i.seq && t != tRangeDel {
+			if i.covered(key.ukey(), seq) {
+				t = tDel
+			}
+			t, _ = resolveTTL(t, it.Value(), i.now)
 			switch t {
 			case tDel:
-				skip = key.ukey()
+				if skip == nil || cmp.Compare(key.ukey(), skip) > 0 {
+					i.passed = true
+				}
+				i.kbuf = copyBytes(i.kbuf, key.ukey())
+				skip = i.kbuf
 			case tVal:
 				if skip == nil || cmp.Compare(key.ukey(), skip) > 0 {
 					i.valid = true
 					return
 				}
+			case tMerge:
+				if skip == nil || cmp.Compare(key.ukey(), skip) > 0 {
+					i.mergeNext()
+					return
+				}
 			}
 		}
 
@@ -79,6 +153,49 @@ func (i *dbIter) scanNext(skip []byte) {
 	i.valid = false
 }
 
+// Resolve merge operands of the user key at current position; the result
+// is saved and the underlying iterator is left positioned past the
+// operands.
+func (i *dbIter) mergeNext() {
+	cmp := i.cmp
+	it := i.it
+
+	ukey := dupBytes(iKey(it.Key()).ukey())
+	var base []byte
+	var ops [][]byte
+	for ok := true; ok; ok = it.Next() {
+		key := iKey(it.Key())
+		if cmp.Compare(key.ukey(), ukey) != 0 {
+			break
+		}
+		seq, t, valid := key.parseNum()
+		if !valid || seq > i.seq {
+			continue
+		}
+		if i.covered(ukey, seq) {
+			break
+		}
+		if t == tMerge {
+			ops = append(ops, dupBytes(it.Value()))
+			continue
+		}
+		if t, value := resolveTTL(t, it.Value(), i.now); t == tVal {
+			base = value
+		}
+		break
+	}
+
+	value, err := applyMerge(i.merger, ukey, base, ops)
+	if err != nil {
+		i.err = err
+		i.valid = false
+		return
+	}
+	i.skey, i.sval = ukey, value
+	i.merged = true
+	i.valid = true
+}
+
 func (i *dbIter) scanPrev() {
 	cmp := i.cmp
 	it := i.it
@@ -87,16 +204,41 @@ func (i *dbIter) scanPrev() {
 	if it.Valid() {
 		for {
 			key := iKey(it.Key())
-			if seq, t, ok := key.parseNum(); ok && seq <= i.seq {
+			if seq, t, ok := key.parseNum(); ok && seq <= i.seq && t != tRangeDel {
 				if tt != tDel && cmp.Compare(key.ukey(), i.skey) < 0 {
 					break
 				}
+				if i.covered(key.ukey(), seq) {
+					t = tDel
+				}
 
-				if t == tDel {
+				var value []byte
+				t, value = resolveTTL(t, it.Value(), i.now)
+				switch t {
+				case tDel:
 					i.skey = nil
-				} else {
-					i.skey = key.ukey()
-					i.sval = it.Value()
+				case tVal:
+					i.kbuf = copyBytes(i.kbuf, key.ukey())
+					i.vbuf = copyBytes(i.vbuf, value)
+					i.skey, i.sval = i.kbuf, i.vbuf
+				case tMerge:
+					// Entries are visited oldest first, so the operand
+					// applies on top of the entry seen so far
+					var existing []byte
+					if tt != tDel {
+						existing = i.sval
+					}
+					value, err := applyMerge(i.merger, key.ukey(), existing, [][]byte{it.Value()})
+					if err != nil {
+						i.err = err
+						i.valid = false
+						i.clear()
+						i.backward = false
+						return
+					}
+					i.kbuf = copyBytes(i.kbuf, key.ukey())
+					i.vbuf = copyBytes(i.vbuf, value)
+					i.skey, i.sval = i.kbuf, i.vbuf
 				}
 				tt = t
 			}
@@ -166,7 +308,12 @@ func (i *dbIter) Seek(key []byte) bool {
 	i.clear()
 	i.last = false
 	i.backward = false
-	ikey := newIKey(key, i.seq, tSeek)
+	var ikey iKey
+	if i.ts || i.snap.d.hasTs() {
+		ikey = newSeekIKey(key, i.seq)
+	} else {
+		ikey = newIKey(key, i.seq, tSeek)
+	}
 	if i.it.Seek(ikey) {
 		i.scanNext(nil)
 	} else {
@@ -176,6 +323,24 @@ func (i *dbIter) Seek(key []byte) bool {
 	return i.valid
 }
 
+func (i *dbIter) SeekForPrev(key []byte) bool {
+	if !i.isOk() {
+		return false
+	}
+
+	i.clear()
+	i.last = false
+	i.backward = true
+	// Sorts after any entries of given key
+	if i.it.SeekForPrev(newIKey(key, 0, tDel)) {
+		i.scanPrev()
+	} else {
+		i.valid = false
+	}
+	i.last = false
+	return i.valid
+}
+
 func (i *dbIter) Next() bool {
 	if !i.isOk() {
 		return false
@@ -199,8 +364,20 @@ func (i *dbIter) Next() bool {
 		}
 	}
 
-	ikey := iKey(it.Key())
-	i.scanNext(ikey.ukey())
+	var skip []byte
+	if i.merged {
+		// Already positioned past the resolved operands
+		skip = i.skey
+		i.clear()
+		if !it.Valid() {
+			i.valid = false
+			i.last = true
+			return false
+		}
+	} else {
+		skip = iKey(it.Key()).ukey()
+	}
+	i.scanNext(skip)
 	i.last = !i.valid
 	return i.valid
 }
@@ -221,7 +398,18 @@ func (i *dbIter) Prev() bool {
 	}
 
 	if !i.backward {
-		lkey := iKey(it.Key()).ukey()
+		var lkey []byte
+		if i.merged {
+			lkey = i.skey
+			i.merged = false
+			if !it.Valid() && !it.Last() {
+				i.valid = false
+				return false
+			}
+		} else {
+			i.kbuf = copyBytes(i.kbuf, iKey(it.Key()).ukey())
+			lkey = i.kbuf
+		}
 		for {
 			if !it.Prev() {
 				i.valid = false
@@ -239,41 +427,201 @@ func (i *dbIter) Prev() bool {
 	return i.valid
 }
 
+// Return key and value of current entry, without copying.
+func (i *dbIter) key() []byte {
+	if i.backward || i.merged {
+		return i.skey
+	}
+	return iKey(i.it.Key()).ukey()
+}
+
+func (i *dbIter) value() []byte {
+	if i.backward || i.merged {
+		return i.sval
+	}
+	if _, t, ok := iKey(i.it.Key()).parseNum(); ok && t == tTTL {
+		_, value := resolveTTL(t, i.it.Value(), i.now)
+		return value
+	}
+	return i.it.Value()
+}
+
 func (i *dbIter) Key() []byte {
 	if !i.valid || !i.isOk() {
 		return nil
 	}
-	var ret []byte
-	if i.backward {
-		ret = i.skey
-	} else {
-		ret = iKey(i.it.Key()).ukey()
-	}
 	if i.copyBuffer {
-		return dupBytes(ret)
+		return dupBytes(i.key())
 	}
-	return ret
+	return i.key()
 }
 
 func (i *dbIter) Value() []byte {
 	if !i.valid || !i.isOk() {
 		return nil
 	}
-	var ret []byte
-	if i.backward {
-		ret = i.sval
-	} else {
-		ret = i.it.Value()
-	}
 	if i.copyBuffer {
-		return dupBytes(ret)
+		return dupBytes(i.value())
+	}
+	return i.value()
+}
+
+// KeyCopy append the key to dst; it is copied once regardless of
+// RFDontCopyBuffer.
+func (i *dbIter) KeyCopy(dst []byte) []byte {
+	if !i.valid || !i.isOk() {
+		return dst
+	}
+	return append(dst, i.key()...)
+}
+
+func (i *dbIter) ValueCopy(dst []byte) []byte {
+	if !i.valid || !i.isOk() {
+		return dst
+	}
+	return append(dst, i.value()...)
+}
+
+// Release release the underlying iterators, thus their table cache
+// handles, and the releaser; e.g. the snapshot owned by the iterator.
+func (i *dbIter) Release() {
+	if i.released {
+		return
+	}
+	i.released = true
+	i.valid = false
+	i.clear()
+	i.rdels = nil
+	i.it.Release()
+	i.it = &iterator.EmptyIterator{}
+	if i.releaser != nil {
+		i.releaser.Release()
+		i.releaser = nil
+	}
+	if i.d != nil {
+		atomic.AddInt32(&i.d.niters, -1)
+		i.d = nil
 	}
-	return ret
 }
 
 func (i *dbIter) Error() error {
+	if i.released {
+		return errors.ErrIterReleased
+	}
 	if err := i.snap.ok(); err != nil {
 		return err
 	}
+	if i.err != nil {
+		return i.err
+	}
 	return i.it.Error()
 }
+
+// RunIterator iterate over maximal runs of consecutive keys sharing a
+// byte-identical value, as of the snapshot taken on its creation. A key
+// deleted as of that snapshot breaks a run, but only as long as its
+// deletion is still kept by the database; compaction may drop it, so runs
+// over the same data are not stable and may merge after a compaction.
+//
+// Please note that the iterator is not thread-safe, you may not use same
+// iterator instance concurrently without external synchronization.
+type RunIterator struct {
+	snap    *Snapshot
+	it      iterator.Iterator
+	pending bool
+	done    bool
+
+	start, end, value []byte
+	count             int
+}
+
+// NewRunIterator return a RunIterator over the contents of the latest
+// snapshot of database. The result is initially invalid; caller must call
+// Next to move to the first run. The caller should call Release once done
+// with it.
+func (d *DB) NewRunIterator(ro *opt.ReadOptions) *RunIterator {
+	snap, err := d.GetSnapshot()
+	if err != nil {
+		return &RunIterator{it: &iterator.EmptyIterator{Err: err}, done: true}
+	}
+	return &RunIterator{
+		snap: snap,
+		it:   snap.NewIterator(ro),
+	}
+}
+
+// Whether the iterator passed over a deleted key on its last move.
+func (i *RunIterator) passed() bool {
+	di, ok := i.it.(*dbIter)
+	return ok && di.passed
+}
+
+// Next move the iterator to the next run. It returns false if no more run
+// or if an error occurred.
+func (i *RunIterator) Next() bool {
+	i.start, i.end, i.value, i.count = nil, nil, nil, 0
+	if i.done {
+		return false
+	}
+	if !i.pending && !i.it.Next() {
+		i.done = true
+		return false
+	}
+	i.pending = false
+
+	i.start = dupBytes(i.it.Key())
+	i.end = i.start
+	i.value = dupBytes(i.it.Value())
+	i.count = 1
+	for i.it.Next() {
+		if !bytes.Equal(i.it.Value(), i.value) || i.passed() {
+			i.pending = true
+			return true
+		}
+		i.end = dupBytes(i.it.Key())
+		i.count++
+	}
+	i.done = true
+	if i.Error() != nil {
+		i.start, i.end, i.value, i.count = nil, nil, nil, 0
+		return false
+	}
+	return true
+}
+
+// StartKey return the first key of current run.
+func (i *RunIterator) StartKey() []byte {
+	return i.start
+}
+
+// EndKey return the last key of current run, inclusive.
+func (i *RunIterator) EndKey() []byte {
+	return i.end
+}
+
+// Value return the value shared by all keys of current run.
+func (i *RunIterator) Value() []byte {
+	return i.value
+}
+
+// Count return the number of keys of current run.
+func (i *RunIterator) Count() int {
+	return i.count
+}
+
+// Error return any accumulated error.
+func (i *RunIterator) Error() error {
+	return i.it.Error()
+}
+
+// Release release the iterator and its snapshot. The iterator is
+// exhausted afterward.
+func (i *RunIterator) Release() {
+	i.it.Release()
+	if i.snap != nil {
+		i.snap.Release()
+	}
+	i.start, i.end, i.value, i.count = nil, nil, nil, 0
+	i.pending = false
+	i.done = true
+}
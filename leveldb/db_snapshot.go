@@ -8,6 +8,7 @@ package leveldb
 
 import (
 	"container/list"
+	"runtime"
 	"sync"
 	"sync/atomic"
 
@@ -25,6 +26,10 @@ type snapEntry struct {
 type snaps struct {
 	sync.Mutex
 	list.List
+
+	// seq numbers below rseq may no longer be retained, since compaction
+	// may had dropped entries only visible to them
+	rseq uint64
 }
 
 // Create new initaliized snaps object.
@@ -34,6 +39,35 @@ func newSnaps() *snaps {
 	return p
 }
 
+// Insert given seq, which may be older than the newest entry, to the
+// list; return nil if the seq is no longer retained.
+func (p *snaps) acquireAt(seq uint64) (e *snapEntry) {
+	p.Lock()
+	defer p.Unlock()
+	if seq < p.rseq {
+		return nil
+	}
+	elem := p.Back()
+	for ; elem != nil; elem = elem.Prev() {
+		if x := elem.Value.(*snapEntry); x.seq <= seq {
+			if x.seq == seq {
+				e = x
+			}
+			break
+		}
+	}
+	if e == nil {
+		e = &snapEntry{seq: seq}
+		if elem != nil {
+			e.elem = p.InsertAfter(e, elem)
+		} else {
+			e.elem = p.PushFront(e)
+		}
+	}
+	e.ref++
+	return
+}
+
 // Insert given seq to the list.
 func (p *snaps) acquire(seq uint64) (e *snapEntry) {
 	p.Lock()
@@ -59,21 +93,34 @@ func (p *snaps) release(e *snapEntry) {
 	p.Unlock()
 }
 
-// Get smallest sequence or return given seq if list empty.
+// Get smallest sequence or return given seq if list empty. The result is
+// used by compaction to drop obsolete entries, thus seq numbers below it
+// are no longer retained.
 func (p *snaps) seq(seq uint64) uint64 {
 	p.Lock()
 	defer p.Unlock()
-	if back := p.Back(); back != nil {
-		return back.Value.(*snapEntry).seq
+	if front := p.Front(); front != nil {
+		seq = front.Value.(*snapEntry).seq
+	}
+	if seq > p.rseq {
+		p.rseq = seq
 	}
 	return seq
 }
 
+// Set seq number below which are no longer retained.
+func (p *snaps) setRetained(seq uint64) {
+	p.Lock()
+	p.rseq = seq
+	p.Unlock()
+}
+
 // Snapshot represent a database snapshot.
 type Snapshot struct {
 	d        *DB
 	entry    *snapEntry
 	released uint32
+	counted  bool // counted in DB outstanding snapshots
 }
 
 // Create new snapshot object.
@@ -81,6 +128,12 @@ func (d *DB) newSnapshot() *Snapshot {
 	return &Snapshot{d: d, entry: d.snaps.acquire(d.getSeq())}
 }
 
+// Count the snapshot in DB outstanding snapshots, until released.
+func (p *Snapshot) count() {
+	p.counted = true
+	atomic.AddInt32(&p.d.nsnaps, 1)
+}
+
 func (p *Snapshot) isOk() bool {
 	if atomic.LoadUint32(&p.released) != 0 {
 		return false
@@ -108,11 +161,40 @@ func (p *Snapshot) Get(key []byte, ro *opt.ReadOptions) (value []byte, err error
 		return
 	}
 
-	return d.get(key, p.entry.seq, ro)
+	value, _, err = d.get(key, p.entry.seq, ro, false)
+	return
+}
+
+// Has return true if this snapshot of database does contains the given
+// key. See DB.Has.
+func (p *Snapshot) Has(key []byte, ro *opt.ReadOptions) (ret bool, err error) {
+	if atomic.LoadUint32(&p.released) != 0 {
+		return false, errors.ErrSnapshotReleased
+	}
+
+	d := p.d
+
+	err = d.rok()
+	if err != nil {
+		return
+	}
+
+	_, _, err = d.get(key, p.entry.seq, ro, true)
+	switch err {
+	case nil:
+		ret = true
+	case errors.ErrNotFound:
+		err = nil
+	}
+	return
 }
 
 // NewIterator return an iterator over the contents of this snapshot of
-// database.
+// database. The caller should call Release on the iterator once done with
+// it; the snapshot itself is not released.
+//
+// The iterator sees every write up to the snapshot seq number, whether or
+// not it had been flushed from the memdb yet; later writes are never seen.
 //
 // Please note that the iterator is not thread-safe, you may not use same
 // iterator instance concurrently without external synchronization.
@@ -127,19 +209,40 @@ func (p *Snapshot) NewIterator(ro *opt.ReadOptions) iterator.Iterator {
 		return &iterator.EmptyIterator{err}
 	}
 
-	return &dbIter{
+	it, rdels := d.newRawIteratorRd(ro)
+	i := &dbIter{
 		snap:       p,
 		cmp:        d.s.cmp.cmp,
-		it:         d.newRawIterator(ro),
+		it:         it,
 		seq:        p.entry.seq,
+		merger:     d.s.o.GetMerger(),
+		rdels:      rdels,
 		copyBuffer: !ro.HasFlag(opt.RFDontCopyBuffer),
+		now:        ttlNow(),
+		d:          d,
+	}
+	atomic.AddInt32(&d.niters, 1)
+	runtime.SetFinalizer(i, (*dbIter).Release)
+	return i
+}
+
+// Sequence return the seq number this snapshot is pinned at. A snapshot
+// at the same seq number may be re-created by DB.GetSnapshotAt as long as
+// it is still retained.
+func (p *Snapshot) Sequence() uint64 {
+	if atomic.LoadUint32(&p.released) != 0 {
+		return 0
 	}
+	return p.entry.seq
 }
 
 // Release release the snapshot. The caller must not use the snapshot
 // after this call.
 func (p *Snapshot) Release() {
 	if atomic.CompareAndSwapUint32(&p.released, 0, 1) {
+		if p.counted {
+			atomic.AddInt32(&p.d.nsnaps, -1)
+		}
 		p.d.snaps.release(p.entry)
 		p.d = nil
 		p.entry = nil
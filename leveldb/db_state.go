@@ -7,9 +7,11 @@
 package leveldb
 
 import (
+	"sort"
 	"sync/atomic"
 	"unsafe"
 
+	"github.com/syndtr/goleveldb/leveldb/comparer"
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/memdb"
 )
@@ -24,8 +26,113 @@ func (d *DB) addSeq(delta uint64) {
 	atomic.AddUint64(&d.seq, delta)
 }
 
+// Get durable sequence number.
+func (d *DB) getDurableSeq() uint64 {
+	return atomic.LoadUint64(&d.dseq)
+}
+
+// Atomically raises durable seq to given seq, if not already higher;
+// it is kept below writes not journaled that are yet to be flushed.
+func (d *DB) setDurableSeq(seq uint64) {
+	for _, nw := range [...]uint64{atomic.LoadUint64(&d.fnwseq), atomic.LoadUint64(&d.nwseq)} {
+		if nw != 0 && seq >= nw {
+			seq = nw - 1
+		}
+	}
+	for {
+		old := atomic.LoadUint64(&d.dseq)
+		if seq <= old {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&d.dseq, old, seq) {
+			d.durableWake()
+			return
+		}
+	}
+}
+
+// Get channel that will be closed when durable seq advanced.
+func (d *DB) durableWait() chan struct{} {
+	d.dmu.Lock()
+	defer d.dmu.Unlock()
+	return d.dch
+}
+
+// Wake all durable seq waiters.
+func (d *DB) durableWake() {
+	d.dmu.Lock()
+	close(d.dch)
+	d.dch = make(chan struct{})
+	d.dmu.Unlock()
+}
+
+// pinSet is a sorted set of pinned user keys.
+type pinSet struct {
+	cmp  comparer.BasicComparer
+	keys [][]byte
+}
+
+func newPinSet(cmp comparer.BasicComparer, keys [][]byte) *pinSet {
+	p := &pinSet{cmp: cmp}
+	for _, key := range keys {
+		p.keys = append(p.keys, dupBytes(key))
+	}
+	sort.Sort(p)
+	return p
+}
+
+func (p *pinSet) Len() int           { return len(p.keys) }
+func (p *pinSet) Less(i, j int) bool { return p.cmp.Compare(p.keys[i], p.keys[j]) < 0 }
+func (p *pinSet) Swap(i, j int)      { p.keys[i], p.keys[j] = p.keys[j], p.keys[i] }
+
+// Return index of the first pinned key not less than given key.
+func (p *pinSet) search(key []byte) int {
+	return sort.Search(len(p.keys), func(i int) bool {
+		return p.cmp.Compare(p.keys[i], key) >= 0
+	})
+}
+
+// Check whether given key is pinned.
+func (p *pinSet) contains(key []byte) bool {
+	i := p.search(key)
+	return i < len(p.keys) && p.cmp.Compare(p.keys[i], key) == 0
+}
+
+// Check whether any pinned key is within given range.
+func (p *pinSet) overlaps(min, max []byte) bool {
+	i := p.search(min)
+	return i < len(p.keys) && p.cmp.Compare(p.keys[i], max) <= 0
+}
+
+// Check whether given memdb hold any pinned key.
+func (p *pinSet) inMem(mem *memdb.DB) bool {
+	iter := mem.NewIterator()
+	for _, key := range p.keys {
+		if iter.Seek(newSeekIKey(key, kMaxSeq)) && p.cmp.Compare(iKey(iter.Key()).ukey(), key) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Get pinned keys; may be nil.
+func (d *DB) getPins() *pinSet {
+	return (*pinSet)(atomic.LoadPointer(&d.pins))
+}
+
+// Check whether database may contain timestamped keys.
+func (d *DB) hasTs() bool {
+	return atomic.LoadUint32(&d.ts) != 0
+}
+
+// Mark that database may contain timestamped keys.
+func (d *DB) setTs() {
+	atomic.StoreUint32(&d.ts, 1)
+}
+
 type memSet struct {
-	cur, froze *memdb.DB
+	cur, froze     *memdb.DB
+	curRd, frozeRd *memRangeDels
 }
 
 // Create new memdb and froze the old one; need external synchronization.
@@ -38,6 +145,14 @@ func (d *DB) newMem() (m *memdb.DB, err error) {
 		s.reuseFileNum(num)
 		return
 	}
+	if err = w.journal.WriteVersion(); err != nil {
+		w.remove()
+		s.reuseFileNum(num)
+		return
+	}
+	if err := w.preallocate(s.o.GetJournalPreallocSize()); err != nil {
+		s.printf("Journal: preallocation failed, num=%d err=%q", num, err)
+	}
 
 	old := d.journal
 	d.journal = w
@@ -48,16 +163,53 @@ func (d *DB) newMem() (m *memdb.DB, err error) {
 
 	d.fseq = d.seq
 
+	// writes not journaled go along with the frozen mem
+	atomic.StoreUint64(&d.fnwseq, atomic.LoadUint64(&d.nwseq))
+	atomic.StoreUint64(&d.nwseq, 0)
+
 	m = memdb.New(s.cmp)
-	mem := &memSet{cur: m}
+	mem := &memSet{cur: m, curRd: new(memRangeDels)}
 	if old := d.getMem_NB(); old != nil {
-		mem.froze = old.cur
+		mem.froze, mem.frozeRd = old.cur, old.curRd
 	}
 	atomic.StorePointer(&d.mem, unsafe.Pointer(mem))
 
 	return
 }
 
+// Froze current mem so the next compaction will flush it into a table,
+// waiting for the previously frozen mem to be flushed first; need the
+// write lock held.
+func (d *DB) freezeMem() (err error) {
+	for d.hasFrozenMem() {
+		d.cch <- cSched
+		d.cch <- cWait
+		if err = d.geterr(); err != nil {
+			return
+		}
+	}
+	if d.getMem().cur.Len() > 0 {
+		_, err = d.newMem()
+	}
+	return
+}
+
+// Like freezeMem, but also wait for the frozen mem to be flushed; need
+// the write lock held.
+func (d *DB) flushMem() (err error) {
+	if err = d.freezeMem(); err != nil {
+		return
+	}
+	for d.hasFrozenMem() {
+		d.cch <- cSched
+		d.cch <- cWait
+		if err = d.wok(); err != nil {
+			return
+		}
+	}
+	return
+}
+
 // Get mem; no barrier.
 func (d *DB) getMem_NB() *memSet {
 	return (*memSet)(d.mem)
@@ -83,11 +235,12 @@ func (d *DB) getFrozenMem() *memdb.DB {
 
 // Drop frozen mem; assume that mem wasn't nil and frozen mem present.
 func (d *DB) dropFrozenMem() {
-	d.fjournal.remove()
+	d.fjournal.close()
+	d.s.removeFile(d.fjournal.file)
 	d.fjournal = nil
 	for {
 		old := d.mem
-		mem := &memSet{cur: (*memSet)(old).cur}
+		mem := &memSet{cur: (*memSet)(old).cur, curRd: (*memSet)(old).curRd}
 		if atomic.CompareAndSwapPointer(&d.mem, old, unsafe.Pointer(mem)) {
 			break
 		}
@@ -141,5 +294,8 @@ func (d *DB) wok() error {
 	if d.isClosed() {
 		return errors.ErrClosed
 	}
+	if d.readOnly {
+		return errors.ErrReadOnly
+	}
 	return nil
 }
@@ -7,7 +7,11 @@
 package leveldb
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -20,10 +24,15 @@ import (
 	"unsafe"
 
 	"github.com/syndtr/goleveldb/leveldb/cache"
+	"github.com/syndtr/goleveldb/leveldb/comparer"
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/hash"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/journal"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/table"
 )
 
 func tkey(i int) []byte {
@@ -215,7 +224,7 @@ func (h *dbHarness) allEntriesFor(key, want string) {
 	db := h.db
 	ucmp := db.s.cmp.cmp
 
-	ikey := newIKey([]byte(key), kMaxSeq, tVal)
+	ikey := newSeekIKey([]byte(key), kMaxSeq)
 	iter := db.newRawIterator(new(opt.ReadOptions))
 	if !iter.Seek(ikey) && iter.Error() != nil {
 		t.Error("AllEntries: error during seek, err: ", iter.Error())
@@ -238,6 +247,10 @@ func (h *dbHarness) allEntriesFor(key, want string) {
 				res += string(iter.Value())
 			case tDel:
 				res += "DEL"
+			case tMerge:
+				res += "+" + string(iter.Value())
+			case tRangeDel:
+				res += "RDEL:" + string(iter.Value())
 			}
 		} else {
 			if !first {
@@ -267,16 +280,23 @@ func (h *dbHarness) getKeyVal(want string) {
 	if err != nil {
 		t.Fatal("GetSnapshot: got error: ", err)
 	}
+	h.getKeyValr(s, want)
+	s.Release()
+}
+
+func (h *dbHarness) getKeyValr(s *Snapshot, want string) {
+	t := h.t
+
 	res := ""
 	iter := s.NewIterator(new(opt.ReadOptions))
 	for iter.Next() {
 		res += fmt.Sprintf("(%s->%s)", string(iter.Key()), string(iter.Value()))
 	}
+	iter.Release()
 
 	if res != want {
 		t.Errorf("GetKeyVal: invalid key/value pair, got=%q want=%q", res, want)
 	}
-	s.Release()
 }
 
 func (h *dbHarness) compactMem() {
@@ -449,9 +469,13 @@ func testAligned(t *testing.T, name string, offset uintptr) {
 }
 
 func Test_FieldsAligned(t *testing.T) {
-	p1 := new(DB)
-	testAligned(t, "DB.seq", unsafe.Offsetof(p1.seq))
-	testAligned(t, "DB.fseq", unsafe.Offsetof(p1.fseq))
+	p1 := new(dbState)
+	testAligned(t, "dbState.seq", unsafe.Offsetof(p1.seq))
+	testAligned(t, "dbState.fseq", unsafe.Offsetof(p1.fseq))
+	testAligned(t, "dbState.sseq", unsafe.Offsetof(p1.sseq))
+	testAligned(t, "dbState.dseq", unsafe.Offsetof(p1.dseq))
+	testAligned(t, "dbState.nwseq", unsafe.Offsetof(p1.nwseq))
+	testAligned(t, "dbState.fnwseq", unsafe.Offsetof(p1.fnwseq))
 	p2 := new(session)
 	testAligned(t, "session.stFileNum", unsafe.Offsetof(p2.stFileNum))
 	testAligned(t, "session.stJournalNum", unsafe.Offsetof(p2.stJournalNum))
@@ -537,6 +561,36 @@ func TestDb_GetFromFrozen(t *testing.T) {
 	h.close()
 }
 
+func TestDb_GetWithLevel(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{WriteBuffer: 100000})
+
+	levelAssert := func(key string, want int) {
+		_, level, err := h.db.GetWithLevel([]byte(key), h.ro)
+		if err != nil {
+			t.Errorf("GetWithLevel: key '%s' got error: %v", key, err)
+		} else if level != want {
+			t.Errorf("GetWithLevel: key '%s' invalid level, want=%d got=%d", key, want, level)
+		}
+	}
+
+	h.put("foo", "v1")
+	levelAssert("foo", -1)
+
+	h.stor.DelaySync(storage.TypeTable)      // Block sync calls
+	h.put("k1", strings.Repeat("x", 100000)) // Fill memtable
+	h.put("k2", strings.Repeat("y", 100000)) // Trigger compaction
+	levelAssert("foo", -2)
+	levelAssert("k2", -1)
+	h.stor.ReleaseSync(storage.TypeTable) // Release sync calls
+
+	// Journal recovery flush memdb into level-0
+	h.reopenDB()
+	levelAssert("foo", 0)
+	levelAssert("k2", 0)
+
+	h.close()
+}
+
 func TestDb_GetFromTable(t *testing.T) {
 	runAllOpts(t, func(h *dbHarness) {
 		h.put("foo", "v1")
@@ -579,6 +633,33 @@ func TestDb_GetSnapshot(t *testing.T) {
 	})
 }
 
+func TestDb_IterateSnapshot(t *testing.T) {
+	runAllOpts(t, func(h *dbHarness) {
+		h.put("a", "v1")
+		h.put("b", "v1")
+
+		snap, err := h.db.GetSnapshot()
+		if err != nil {
+			t.Fatal("GetSnapshot: got error: ", err)
+		}
+
+		h.put("a", "v2")
+		h.delete("b")
+		h.put("c", "v2")
+
+		// unflushed entries up to the snapshot are visible, newer are not
+		h.getKeyValr(snap, "(a->v1)(b->v1)")
+		h.getKeyVal("(a->v2)(c->v2)")
+
+		h.compactMem()
+
+		h.getKeyValr(snap, "(a->v1)(b->v1)")
+		h.getKeyVal("(a->v2)(c->v2)")
+
+		snap.Release()
+	})
+}
+
 func TestDb_GetLevel0Ordering(t *testing.T) {
 	runAllOpts(t, func(h *dbHarness) {
 		for i := 0; i < 4; i++ {
@@ -712,6 +793,94 @@ func TestDb_IterMultiWithDelete(t *testing.T) {
 	})
 }
 
+func TestDb_IterSeekForPrev(t *testing.T) {
+	runAllOpts(t, func(h *dbHarness) {
+		h.put("a", "va")
+		h.put("c", "vc")
+		h.put("e", "ve")
+		h.compactMem()
+		h.put("b", "vb")
+		h.put("d", "vd")
+		h.put("e", "ve2")
+		h.delete("c")
+
+		iter := h.db.NewIterator(new(opt.ReadOptions))
+		for _, x := range []struct{ key, want string }{
+			{"0", "->"},
+			{"a", "a->va"},
+			{"b", "b->vb"},
+			{"c", "b->vb"},
+			{"cc", "b->vb"},
+			{"d", "d->vd"},
+			{"e", "e->ve2"},
+			{"z", "e->ve2"},
+		} {
+			iter.SeekForPrev([]byte(x.key))
+			testKeyVal(t, iter, x.want)
+		}
+
+		iter.SeekForPrev([]byte("cc"))
+		iter.Next()
+		testKeyVal(t, iter, "d->vd")
+		iter.Prev()
+		testKeyVal(t, iter, "b->vb")
+		iter.Prev()
+		testKeyVal(t, iter, "a->va")
+
+		iter.SeekForPrev([]byte("0"))
+		iter.Next()
+		testKeyVal(t, iter, "a->va")
+	})
+}
+
+func TestDb_SamplingIterator(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	for i := 0; i < 10; i++ {
+		h.put(numKey(i), fmt.Sprintf("v%d", i))
+		if i == 4 {
+			h.compactMem()
+		}
+	}
+
+	collect := func(iter iterator.Iterator, next func() bool) (keys []string) {
+		for next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal("iterator: got error: ", err)
+		}
+		return
+	}
+	check := func(name string, got []string, want ...int) {
+		var wk []string
+		for _, i := range want {
+			wk = append(wk, numKey(i))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(wk) {
+			t.Errorf("%s: want %v, got %v", name, wk, got)
+		}
+	}
+
+	iter := iterator.NewSamplingIterator(h.db.NewIterator(h.ro), 3)
+	check("forward", collect(iter, iter.Next), 0, 3, 6, 9)
+	check("backward from end", collect(iter, iter.Prev), 9, 6, 3, 0)
+
+	iter = iterator.NewSamplingIterator(h.db.NewIterator(h.ro), 4)
+	iter.Seek([]byte(numKey(1)))
+	keys := []string{string(iter.Key())}
+	check("after seek", append(keys, collect(iter, iter.Next)...), 1, 5, 9)
+
+	iter.SeekForPrev([]byte(numKey(8)))
+	keys = []string{string(iter.Key())}
+	check("after seek for prev", append(keys, collect(iter, iter.Prev)...), 8, 4, 0)
+
+	if iter.Seek([]byte("z")) || iter.Next() {
+		t.Errorf("expect invalid iterator past the end, got %q", iter.Key())
+	}
+}
+
 func TestDb_IteratorPinsRef(t *testing.T) {
 	h := newDbHarness(t)
 
@@ -880,7 +1049,7 @@ func TestDb_CompactionsGenerateMultipleFiles(t *testing.T) {
 func TestDb_RepeatedWritesToSameKey(t *testing.T) {
 	h := newDbHarnessWopt(t, &opt.Options{WriteBuffer: 100000})
 
-	maxTables := kNumLevels + kL0_StopWritesTrigger
+	maxTables := opt.DefaultNumLevels + opt.DefaultWriteL0PauseTrigger
 
 	value := strings.Repeat("v", 2*h.o.WriteBuffer)
 	for i := 0; i < 5*maxTables; i++ {
@@ -899,7 +1068,7 @@ func TestDb_RepeatedWritesToSameKeyAfterReopen(t *testing.T) {
 
 	h.reopenDB()
 
-	maxTables := kNumLevels + kL0_StopWritesTrigger
+	maxTables := opt.DefaultNumLevels + opt.DefaultWriteL0PauseTrigger
 
 	value := strings.Repeat("v", 2*h.o.WriteBuffer)
 	for i := 0; i < 5*maxTables; i++ {
@@ -916,7 +1085,7 @@ func TestDb_RepeatedWritesToSameKeyAfterReopen(t *testing.T) {
 func TestDb_SparseMerge(t *testing.T) {
 	h := newDbHarnessWopt(t, &opt.Options{CompressionType: opt.NoCompression})
 
-	h.putMulti(kNumLevels, "A", "Z")
+	h.putMulti(opt.DefaultNumLevels, "A", "Z")
 
 	// Suppose there is:
 	//    small amount of data with prefix A
@@ -948,6 +1117,31 @@ func TestDb_SparseMerge(t *testing.T) {
 	h.close()
 }
 
+func TestDb_ApproximateSizesDiscountDeletions(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{CompressionType: opt.NoCompression})
+	defer h.close()
+
+	const n, size = 100, 1000
+	for i := 0; i < n; i++ {
+		h.put(numKey(i), strings.Repeat("v", size))
+	}
+	h.compactMem()
+	h.compactRange("", "")
+	for i := 0; i < n/2; i++ {
+		h.delete(numKey(i))
+	}
+	h.compactMem()
+
+	// Deletions don't make the raw size shrink.
+	h.sizeAssert("", numKey(n/2), n/2*size, n/2*size*11/10)
+
+	h.oo.SetFlag(opt.OFDiscountDeletions)
+	h.sizeAssert("", numKey(n/2), 0, n/2*size/10)
+	h.sizeAssert(numKey(n/2), numKey(n), n/2*size*9/10, n/2*size*11/10)
+	h.oo.ClearFlag(opt.OFDiscountDeletions)
+	h.sizeAssert("", numKey(n/2), n/2*size, n/2*size*11/10)
+}
+
 func TestDb_ApproximateSizes(t *testing.T) {
 	h := newDbHarnessWopt(t, &opt.Options{
 		CompressionType: opt.NoCompression,
@@ -1037,6 +1231,42 @@ func TestDb_ApproximateSizes_MixOfSmallAndLarge(t *testing.T) {
 	h.close()
 }
 
+func TestDb_Size(t *testing.T) {
+	h := newDbHarness(t)
+
+	size, err := h.db.Size()
+	if err != nil {
+		t.Fatal("Size: got error: ", err)
+	}
+	if size != 0 {
+		t.Errorf("Size: empty database size is not zero, got %d", size)
+	}
+
+	for i := 0; i < 100; i++ {
+		h.put(numKey(i), strings.Repeat("v", 1000))
+	}
+	h.compactMem()
+
+	size, err = h.db.Size()
+	if err != nil {
+		t.Fatal("Size: got error: ", err)
+	}
+	var want uint64
+	for _, tt := range h.db.s.version().tables {
+		for _, t := range tt {
+			n, _ := t.file.Size()
+			want += n
+		}
+	}
+	if size == 0 || size != want {
+		t.Errorf("Size: invalid size, want %d, got %d", want, size)
+	}
+
+	h.closeDB()
+	_, err = h.db.Size()
+	assertErr(t, err, true)
+}
+
 func TestDb_Snapshot(t *testing.T) {
 	runAllOpts(t, func(h *dbHarness) {
 		h.put("foo", "v1")
@@ -1072,7 +1302,7 @@ func TestDb_HiddenValuesAreRemoved(t *testing.T) {
 
 		h.put("foo", "v1")
 		h.compactMem()
-		m := kMaxMemCompactLevel
+		m := opt.DefaultMaxMemCompactLevel
 		num := s.version().tLen(m)
 		if num != 1 {
 			t.Errorf("invalid level-%d len, want=1 got=%d", m, num)
@@ -1112,7 +1342,7 @@ func TestDb_DeletionMarkers2(t *testing.T) {
 
 	h.put("foo", "v1")
 	h.compactMem()
-	m := kMaxMemCompactLevel
+	m := opt.DefaultMaxMemCompactLevel
 	num := s.version().tLen(m)
 	if num != 1 {
 		t.Errorf("invalid level-%d len, want=1 got=%d", m, num)
@@ -1147,7 +1377,7 @@ func TestDb_DeletionMarkers2(t *testing.T) {
 
 func TestDb_OverlapInLevel0(t *testing.T) {
 	runAllOpts(t, func(h *dbHarness) {
-		if kMaxMemCompactLevel != 2 {
+		if opt.DefaultMaxMemCompactLevel != 2 {
 			t.Fatal("fix test to reflect the config")
 		}
 
@@ -1249,7 +1479,7 @@ func TestDb_ManifestWriteError(t *testing.T) {
 		// Mem compaction (will succeed)
 		h.compactMem()
 		h.getVal("foo", "bar")
-		if n := h.db.s.version().tLen(kMaxMemCompactLevel); n != 1 {
+		if n := h.db.s.version().tLen(opt.DefaultMaxMemCompactLevel); n != 1 {
 			t.Errorf("invalid total tables, want=1 got=%d", n)
 		}
 
@@ -1260,7 +1490,7 @@ func TestDb_ManifestWriteError(t *testing.T) {
 		}
 
 		// Merging compaction (will fail)
-		h.compactRangeAtErr(kMaxMemCompactLevel, "", "", true)
+		h.compactRangeAtErr(opt.DefaultMaxMemCompactLevel, "", "", true)
 
 		h.db.Close()
 		h.stor.SetWriteErr(0)
@@ -1355,6 +1585,37 @@ func TestDb_ClosedIsClosed(t *testing.T) {
 	assertErr(t, db.Close(), true)
 }
 
+func TestDb_CloseWithTimeout(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{WriteBuffer: 100000})
+
+	h.put("foo", "v1")
+	h.stor.DelaySync(storage.TypeTable)      // Block sync calls
+	h.put("k1", strings.Repeat("x", 100000)) // Fill memtable
+	h.put("k2", strings.Repeat("y", 100000)) // Trigger compaction
+	<-h.stor.emuCh                           // Wait for a blocked sync
+
+	if err := h.db.CloseWithTimeout(50 * time.Millisecond); err != errors.ErrCloseTimeout {
+		t.Fatalf("expect ErrCloseTimeout while compaction blocked, got: %v", err)
+	}
+	if err := h.db.Put([]byte("bar"), []byte("v1"), h.wo); err != errors.ErrClosed {
+		t.Errorf("expect ErrClosed while closing, got: %v", err)
+	}
+
+	h.stor.ReleaseSync(storage.TypeTable) // Release sync calls
+	if err := h.db.CloseWithTimeout(time.Minute); err != nil {
+		t.Fatal("CloseWithTimeout: got error: ", err)
+	}
+	if err := h.db.CloseWithTimeout(time.Minute); err != errors.ErrClosed {
+		t.Errorf("expect ErrClosed once closed, got: %v", err)
+	}
+
+	h.openDB()
+	h.getVal("foo", "v1")
+	h.get("k1", true)
+	h.get("k2", true)
+	h.close()
+}
+
 type numberComparer struct{}
 
 func (numberComparer) num(x []byte) (n int) {
@@ -1378,6 +1639,82 @@ func (numberComparer) Successor(b []byte) []byte {
 	return b
 }
 
+// Like numberComparer, but shorten separators and successors to
+// canonical decimal form, which is not necessarily a prefix.
+type shortNumberComparer struct {
+	numberComparer
+}
+
+func (shortNumberComparer) Name() string {
+	return "test.ShortNumberComparer"
+}
+
+func (p shortNumberComparer) Separator(a, b []byte) []byte {
+	if n := p.num(a) + 1; n < p.num(b) {
+		return []byte(fmt.Sprintf("[%d]", n))
+	}
+	return a
+}
+
+func (p shortNumberComparer) Successor(b []byte) []byte {
+	return []byte(fmt.Sprintf("[%d]", p.num(b)+1))
+}
+
+// Like numberComparer, but separators and successors are out of range.
+type badNumberComparer struct {
+	numberComparer
+}
+
+func (badNumberComparer) Name() string {
+	return "test.BadNumberComparer"
+}
+
+func (badNumberComparer) Separator(a, b []byte) []byte {
+	return []byte("[0]")
+}
+
+func (badNumberComparer) Successor(b []byte) []byte {
+	return []byte("[0]")
+}
+
+func TestDb_ComparerBoundaries(t *testing.T) {
+	for _, cmp := range []comparer.Comparer{shortNumberComparer{}, badNumberComparer{}} {
+		h := newDbHarnessWopt(t, &opt.Options{
+			Comparer:    cmp,
+			BlockSize:   50,
+			WriteBuffer: 2000,
+		})
+
+		// Keys in hex form are longer than separators in decimal form
+		const n = 300
+		key := func(i int) string {
+			return fmt.Sprintf("[0x%08x]", i*10+1)
+		}
+		for i := 0; i < n; i++ {
+			h.put(key(i), fmt.Sprintf("v%d", i))
+		}
+		h.compactMem()
+		h.compactRange("", "")
+		for i := 0; i < n; i++ {
+			h.getVal(key(i), fmt.Sprintf("v%d", i))
+			h.getVal(fmt.Sprintf("[%d]", i*10+1), fmt.Sprintf("v%d", i))
+			h.get(fmt.Sprintf("[%d]", i*10+2), false)
+		}
+		h.get("[0]", false)
+		h.get(fmt.Sprintf("[%d]", n*10+1), false)
+
+		// Table boundaries are actual keys
+		for _, tt := range h.db.s.version().tables {
+			for _, t := range tt {
+				if t.min.ukey()[1] != '0' || t.max.ukey()[1] != '0' {
+					h.t.Errorf("%s: table boundaries are not actual keys, min=%q max=%q", cmp.Name(), t.min, t.max)
+				}
+			}
+		}
+		h.close()
+	}
+}
+
 func TestDb_CustomComparer(t *testing.T) {
 	h := newDbHarnessWopt(t, &opt.Options{
 		Comparer:    numberComparer{},
@@ -1409,10 +1746,131 @@ func TestDb_CustomComparer(t *testing.T) {
 	h.close()
 }
 
+func TestDb_ComparerMismatch(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{Comparer: numberComparer{}})
+	defer h.close()
+
+	h.put("[10]", "ten")
+	h.reopenDB()
+	h.getVal("[0xa]", "ten")
+	h.closeDB()
+
+	// The comparer name is recorded by the manifest
+	h.o.Comparer = nil
+	_, err := Open(h.stor, h.o)
+	if _, ok := err.(errors.ErrInvalid); !ok || !strings.Contains(err.Error(), "comparer") {
+		t.Errorf("Open with default comparer: got error %v, want invalid comparer", err)
+	}
+
+	h.o.Comparer = numberComparer{}
+	h.openDB()
+	h.getVal("[10]", "ten")
+}
+
+func TestDb_ReverseComparer(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		Comparer:    comparer.Reverse(comparer.DefaultComparer),
+		BlockSize:   100,
+		WriteBuffer: 10000,
+	})
+	defer h.close()
+
+	h.put("a", "va")
+	h.put("ab", "vab")
+	h.put("b", "vb")
+	h.getKeyVal("(b->vb)(ab->vab)(a->va)")
+
+	const n = 1000
+	for i := 0; i < n; i++ {
+		h.put(fmt.Sprintf("key%04d", i), fmt.Sprintf("v%d", i))
+	}
+	h.compactMem()
+	h.compactRange("", "")
+	for i := 0; i < n; i++ {
+		h.getVal(fmt.Sprintf("key%04d", i), fmt.Sprintf("v%d", i))
+	}
+	h.get("key", false)
+	h.get("key00000", false)
+
+	iter := h.db.NewIterator(h.ro)
+	var prev []byte
+	for iter.Next() {
+		if prev != nil && bytes.Compare(prev, iter.Key()) <= 0 {
+			t.Fatalf("keys not in descending order, %q before %q", prev, iter.Key())
+		}
+		prev = append(prev[:0], iter.Key()...)
+	}
+
+	if name := h.db.s.cmp.Name(); name != "reverse(leveldb.BytewiseComparator)" {
+		t.Errorf("got comparer name %q", name)
+	}
+	h.closeDB()
+	h.o.Comparer = nil
+	if _, err := Open(h.stor, h.o); err == nil {
+		t.Error("Open with bytewise comparer: expecting error")
+	}
+	h.o.Comparer = comparer.Reverse(comparer.DefaultComparer)
+	h.openDB()
+	h.getVal("key0500", "v500")
+}
+
+func TestDb_CaseInsensitiveComparer(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		Comparer:    comparer.NewCaseInsensitive(),
+		BlockSize:   100,
+		WriteBuffer: 10000,
+	})
+	defer h.close()
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		h.put(fmt.Sprintf("Key%04d", i), fmt.Sprintf("v%d", i))
+	}
+	h.compactMem()
+	for i := 0; i < n; i += 2 {
+		h.put(fmt.Sprintf("kEY%04d", i), fmt.Sprintf("w%d", i))
+	}
+	h.compactMem()
+	h.compactRange("", "")
+
+	for i := 0; i < n; i++ {
+		want := fmt.Sprintf("v%d", i)
+		if i%2 == 0 {
+			want = fmt.Sprintf("w%d", i)
+		}
+		h.getVal(fmt.Sprintf("key%04d", i), want)
+		h.getVal(fmt.Sprintf("KEY%04d", i), want)
+	}
+	h.get("key", false)
+	h.get("KEY0500", false)
+
+	// Keys differing only in case are the same key, the key is as
+	// written last
+	h.put("@", "v@")
+	h.put("[", "v[")
+	h.put("_", "v_")
+	h.put("A", "vA")
+	h.put("a", "va")
+	h.put("Z", "vZ")
+	h.compactMem()
+	iter := h.db.NewIterator(h.ro)
+	var keys []string
+	for iter.Next() {
+		if k := string(iter.Key()); len(k) == 1 {
+			keys = append(keys, k)
+		}
+	}
+	if got, want := strings.Join(keys, " "), "@ [ _ a Z"; got != want {
+		t.Errorf("got keys %q, want %q", got, want)
+	}
+	h.getVal("a", "va")
+	h.getVal("z", "vZ")
+}
+
 func TestDb_ManualCompaction(t *testing.T) {
 	h := newDbHarness(t)
 
-	if kMaxMemCompactLevel != 2 {
+	if opt.DefaultMaxMemCompactLevel != 2 {
 		t.Fatal("fix test to reflect the config")
 	}
 
@@ -1448,33 +1906,212 @@ func TestDb_ManualCompaction(t *testing.T) {
 	h.close()
 }
 
-func TestDb_BloomFilter(t *testing.T) {
+// Run CompactRangeCtx of given range, cancelling it once the first output
+// table is being synced.
+func (h *dbHarness) compactRangeCancelled(r Range) error {
+	h.stor.DelaySync(storage.TypeTable)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error)
+	go func() {
+		errc <- h.db.CompactRangeCtx(ctx, r)
+	}()
+	<-h.stor.emuCh
+	cancel()
+	h.stor.ReleaseSync(storage.TypeTable)
+	return <-errc
+}
+
+func TestDb_CompactRangeCtx(t *testing.T) {
 	h := newDbHarnessWopt(t, &opt.Options{
-		BlockCache: cache.EmptyCache{},
-		Filter:     filter.NewBloomFilter(10),
+		CompressionType: opt.NoCompression,
+		WriteBuffer:     100000000,
 	})
 
-	key := func(i int) string {
-		return fmt.Sprintf("key%06d", i)
+	n := 80
+	fill := func(r int) {
+		for i := 0; i < n; i++ {
+			h.put(numKey(i), strings.Repeat(fmt.Sprintf("v%d%08d", r, i), 100000/10))
+		}
+		// Journal recovery flush memdb into level-0
+		h.reopenDB()
 	}
 
-	n := 10000
+	fill(1)
+	h.compactRangeAt(0, "", "")
+	h.compactRangeAt(1, "", "")
+	fill(2)
+	h.compactRangeAt(0, "", "")
 
-	// Populate multiple layers
-	for i := 0; i < n; i++ {
-		h.put(key(i), key(i))
+	v := h.db.s.version()
+	t1, t2 := v.tLen(1), v.tLen(2)
+	if t1 < 2 || t2 < 2 {
+		t.Fatalf("need multiple tables at level-1 and level-2, got %d and %d", t1, t2)
 	}
-	h.compactMem()
-	h.compactRange("a", "z")
-	for i := 0; i < n; i += 100 {
-		h.put(key(i), key(i))
+
+	// Already cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := h.db.CompactRangeCtx(ctx, Range{}); err != context.Canceled {
+		t.Errorf("CompactRangeCtx: want %v, got %v", context.Canceled, err)
+	}
+	if got := h.db.s.version().tLen(1); got != t1 {
+		t.Errorf("level-1 tables changed, want %d, got %d", t1, got)
 	}
-	h.compactMem()
 
-	// Prevent auto compactions triggered by seeks
-	h.stor.DelaySync(storage.TypeTable)
+	// Cancelled within first compaction of level-1
+	if err := h.compactRangeCancelled(Range{}); err != context.Canceled {
+		t.Errorf("CompactRangeCtx: want %v, got %v", context.Canceled, err)
+	}
+	if got := h.db.s.version().tLen(1); got == 0 || got >= t1 {
+		t.Errorf("level-1 should be partially compacted, had %d, got %d", t1, got)
+	}
 
-	// Lookup present keys. Should rarely read from small sstable.
+	check := func() {
+		for i := 0; i < n; i++ {
+			h.getVal(numKey(i), strings.Repeat(fmt.Sprintf("v%d%08d", 2, i), 100000/10))
+		}
+	}
+	check()
+	h.reopenDB()
+	check()
+
+	h.compactRange("", "")
+	if got := h.db.s.version().tLen(1); got != 0 {
+		t.Errorf("level-1 tables should be zero, got %d", got)
+	}
+	check()
+
+	h.close()
+}
+
+func TestDb_CompactRangeCtxCancelRunning(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		CompressionType: opt.NoCompression,
+		WriteBuffer:     100000000,
+	})
+	defer h.close()
+
+	// Level-0 tables of disjoint ranges, compacted in one go
+	n := 30
+	value := func(i int) string {
+		return strings.Repeat(fmt.Sprintf("v%09d", i), 100000/10)
+	}
+	for i := 0; i < n; i++ {
+		h.put(numKey(i), value(i))
+		if i == 14 || i == 24 || i == n-1 {
+			// Journal recovery flush memdb into level-0
+			h.reopenDB()
+		}
+	}
+	if t0 := h.db.s.version().tLen(0); t0 != 3 || h.totalTables() != t0 {
+		t.Fatalf("need 3 tables at level-0 only, got %d of %d", t0, h.totalTables())
+	}
+
+	// Cancelled once the first output table is finished, within second
+	// level-0 table; the compaction stops before the third one.
+	if err := h.compactRangeCancelled(Range{}); err != context.Canceled {
+		t.Errorf("CompactRangeCtx: want %v, got %v", context.Canceled, err)
+	}
+	if got := h.db.s.version().tLen(0); got != 1 {
+		t.Errorf("level-0 should be partially compacted, want 1 table, got %d", got)
+	}
+	if got := h.db.s.version().tLen(1); got != 2 {
+		t.Errorf("running compaction should commit its tables, want 2 level-1 tables, got %d", got)
+	}
+
+	check := func() {
+		for i := 0; i < n; i++ {
+			h.getVal(numKey(i), value(i))
+		}
+	}
+	check()
+	h.reopenDB()
+	check()
+	if got := len(h.stor.GetFiles(storage.TypeTable)); got != h.totalTables() {
+		t.Errorf("table files left by cancelled compaction, want %d, got %d", h.totalTables(), got)
+	}
+
+	h.compactRange("", "")
+	if got := h.db.s.version().tLen(0); got != 0 {
+		t.Errorf("level-0 tables should be zero, got %d", got)
+	}
+	check()
+}
+
+func TestDb_MergeTables(t *testing.T) {
+	h := newDbHarness(t)
+
+	if opt.DefaultMaxMemCompactLevel != 2 {
+		t.Fatal("fix test to reflect the config")
+	}
+
+	h.put("a", "va")
+	h.compactMem()
+	h.put("x", "vx")
+	h.compactMem()
+	h.put("f", "vf")
+	h.compactMem()
+	h.tablesPerLevel("0,0,3")
+
+	tt := h.db.s.version().tables[2]
+	a, f, x := tt[0].file.Num(), tt[1].file.Num(), tt[2].file.Num()
+
+	assertErr(t, h.db.MergeTables(0, []uint64{a, f}), true)
+	assertErr(t, h.db.MergeTables(2, []uint64{a}), true)
+	assertErr(t, h.db.MergeTables(2, []uint64{a, x}), true)
+	assertErr(t, h.db.MergeTables(2, []uint64{f, a}), true)
+	assertErr(t, h.db.MergeTables(2, []uint64{x, x + 1000}), true)
+	h.tablesPerLevel("0,0,3")
+
+	assertErr(t, h.db.MergeTables(2, []uint64{a, f}), false)
+	h.tablesPerLevel("0,0,2")
+	h.getVal("a", "va")
+	h.getVal("f", "vf")
+	h.getVal("x", "vx")
+
+	h.reopenDB()
+	h.tablesPerLevel("0,0,2")
+	h.getKeyVal("(a->va)(f->vf)(x->vx)")
+
+	h.close()
+}
+
+func TestDb_BloomFilter(t *testing.T) {
+	testFilter(t, filter.NewBloomFilter(10))
+}
+
+func TestDb_BlockedBloomFilter(t *testing.T) {
+	testFilter(t, filter.NewBlockedBloomFilter(10))
+}
+
+func testFilter(t *testing.T, f filter.Filter) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		BlockCache: cache.EmptyCache{},
+		Filter:     f,
+	})
+
+	key := func(i int) string {
+		return fmt.Sprintf("key%06d", i)
+	}
+
+	n := 10000
+
+	// Populate multiple layers
+	for i := 0; i < n; i++ {
+		h.put(key(i), key(i))
+	}
+	h.compactMem()
+	h.compactRange("a", "z")
+	for i := 0; i < n; i += 100 {
+		h.put(key(i), key(i))
+	}
+	h.compactMem()
+
+	// Prevent auto compactions triggered by seeks
+	h.stor.DelaySync(storage.TypeTable)
+
+	// Lookup present keys. Should rarely read from small sstable.
 	h.stor.SetReadAtCounter(storage.TypeTable)
 	for i := 0; i < n; i++ {
 		h.getVal(key(i), key(i))
@@ -1501,145 +2138,3704 @@ func TestDb_BloomFilter(t *testing.T) {
 	h.close()
 }
 
-func TestDb_Concurrent(t *testing.T) {
-	const n, secs, maxkey = 4, 2, 1000
+func TestDb_SizeOnDisk(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
 
-	runtime.GOMAXPROCS(n)
-	runAllOpts(t, func(h *dbHarness) {
-		var wg sync.WaitGroup
-		var stop uint32
-		var cnt [n]uint32
+	sizeOnDisk := func() uint64 {
+		size, err := h.db.SizeOnDisk()
+		if err != nil {
+			t.Fatal("SizeOnDisk: got error: ", err)
+		}
+		if v, err := h.db.GetProperty("leveldb.total-size"); err != nil || v != fmt.Sprint(size) {
+			t.Errorf("leveldb.total-size: want=%d got=%s err=%v", size, v, err)
+		}
+		return size
+	}
+	filesSize := func() (size uint64) {
+		for _, f := range h.stor.GetFiles(storage.TypeAll) {
+			n, err := f.Size()
+			if err != nil {
+				t.Fatal("Size: got error: ", err)
+			}
+			size += n
+		}
+		return
+	}
 
-		for i := 0; i < n; i++ {
-			wg.Add(1)
-			go func(i int) {
-				var put, get, found uint
-				defer func() {
-					t.Logf("goroutine %d stopped after %d ops, put=%d get=%d found=%d missing=%d",
-						i, cnt[i], put, get, found, get-found)
-					wg.Done()
-				}()
+	empty := sizeOnDisk()
+	for i := 0; i < 1000; i++ {
+		h.put(numKey(i), strings.Repeat("v", 100))
+	}
+	if size := sizeOnDisk(); size <= empty+100*1000 {
+		t.Errorf("SizeOnDisk: expect journal to be counted, got %d", size)
+	}
+	h.compactMem()
+	h.compactRange("", "")
+	if got, want := sizeOnDisk(), filesSize(); got != want {
+		t.Errorf("SizeOnDisk: does not match size of live files, want=%d got=%d", want, got)
+	}
+}
 
-				rnd := rand.New(rand.NewSource(int64(1000 + i)))
-				for atomic.LoadUint32(&stop) == 0 {
-					x := cnt[i]
+func TestDb_KeepObsoleteFiles(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{Flag: opt.OFKeepObsoleteFiles})
+	defer h.close()
 
-					k := rnd.Intn(maxkey)
-					kstr := fmt.Sprintf("%016d", k)
+	numFiles := func(ft storage.FileType) int {
+		return len(h.stor.GetFiles(ft))
+	}
 
-					if (rnd.Int() % 2) > 0 {
-						put++
-						h.put(kstr, fmt.Sprintf("%d.%d.%-1000d", k, i, x))
-					} else {
-						get++
-						v, err := h.db.Get([]byte(kstr), h.ro)
-						if err == nil {
-							found++
-							rk, ri, rx := 0, -1, uint32(0)
-							fmt.Sscanf(string(v), "%d.%d.%d", &rk, &ri, &rx)
-							if rk != k {
-								t.Errorf("invalid key want=%d got=%d", k, rk)
-							}
-							if ri < 0 || ri >= n {
-								t.Error("invalid goroutine number: ", ri)
-							} else {
-								tx := atomic.LoadUint32(&(cnt[ri]))
-								if rx > tx {
-									t.Errorf("invalid seq number, %d > %d ", rx, tx)
-								}
-							}
-						} else if err != errors.ErrNotFound {
-							t.Error("Get: got error: ", err)
-							return
-						}
-					}
-					atomic.AddUint32(&cnt[i], 1)
-				}
-			}(i)
-		}
+	h.put("foo", "v1")
+	h.compactMem()
+	h.put("bar", "v2")
+	h.compactMem()
+	h.reopenDB()
 
-		for i := 0; i < secs; i++ {
-			h.oo.SetBlockCache(cache.NewLRUCache(rand.Int() % (opt.DefaultBlockCacheSize * 2)))
-			time.Sleep(time.Second)
+	if n := numFiles(storage.TypeJournal); n < 2 {
+		t.Errorf("expect obsolete journals to be kept, got %d journals", n)
+	}
+	if n := numFiles(storage.TypeManifest); n < 2 {
+		t.Errorf("expect obsolete manifests to be kept, got %d manifests", n)
+	}
+
+	if err := h.db.PurgeObsoleteFiles(); err != nil {
+		t.Fatal("PurgeObsoleteFiles: got error: ", err)
+	}
+	if n := numFiles(storage.TypeJournal); n != 1 {
+		t.Errorf("expect a single journal after purge, got %d", n)
+	}
+	if n := numFiles(storage.TypeManifest); n != 1 {
+		t.Errorf("expect a single manifest after purge, got %d", n)
+	}
+
+	h.reopenDB()
+	h.getVal("foo", "v1")
+	h.getVal("bar", "v2")
+}
+
+func TestDb_PinTables(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{MaxOpenFiles: 2})
+	defer h.close()
+
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		h.put(k, "v"+k)
+		h.compactMem()
+	}
+	var num uint64
+	for _, tt := range h.db.s.version().tables {
+		for _, f := range tt {
+			if string(f.min.ukey()) == "a" {
+				num = f.file.Num()
+			}
 		}
-		atomic.StoreUint32(&stop, 1)
-		wg.Wait()
-	})
+	}
+	cached := func() bool {
+		c, ok := h.db.s.tops.cachens.Get(num, nil)
+		if ok {
+			c.Release()
+		}
+		return ok
+	}
+	churn := func() {
+		for _, k := range []string{"b", "c", "d", "e"} {
+			h.getVal(k, "v"+k)
+		}
+	}
 
-	runtime.GOMAXPROCS(1)
+	if err := h.db.PinTables(Range{Start: []byte("a"), Limit: []byte("a1")}); err != nil {
+		t.Fatal("PinTables: got error: ", err)
+	}
+	churn()
+	if !cached() {
+		t.Error("pinned table was evicted")
+	}
+	h.getVal("a", "va")
+
+	if err := h.db.UnpinTables(Range{Start: []byte("a"), Limit: []byte("a1")}); err != nil {
+		t.Fatal("UnpinTables: got error: ", err)
+	}
+	churn()
+	if cached() {
+		t.Error("unpinned table was not evicted")
+	}
 }
 
-func TestDb_ModifyingBuffer(t *testing.T) {
+func TestDb_SetMaxOpenFiles(t *testing.T) {
 	h := newDbHarness(t)
 	defer h.close()
 
-	h.put("foo", "hello")
-
-	modifyBuffer := func() {
-		iter := h.db.NewIterator(&opt.ReadOptions{})
-		if !iter.First() {
-			t.Fatal("iter.First failed: ", iter.Error())
+	keys := []string{"a", "b", "c", "d", "e"}
+	for _, k := range keys {
+		h.put(k, "v"+k)
+		h.compactMem()
+	}
+	numCached := func() (n int) {
+		for _, tt := range h.db.s.version().tables {
+			for _, f := range tt {
+				if c, ok := h.db.s.tops.cachens.Get(f.file.Num(), nil); ok {
+					c.Release()
+					n++
+				}
+			}
 		}
-		key, value := iter.Key(), iter.Value()
-		copy(key, []byte("bar"))
-		copy(value, []byte("olleh"))
+		return
+	}
+	for _, k := range keys {
+		h.getVal(k, "v"+k)
+	}
+	if n := numCached(); n != len(keys) {
+		t.Fatalf("expect all tables to be cached, got %d", n)
 	}
 
-	modifyBuffer()
-	h.getKeyVal("(foo->hello)")
-	h.compactMem()
-	if h.totalTables() == 0 {
-		t.Fatal("expecting more than zero table")
+	if err := h.oo.SetMaxOpenFiles(2); err != nil {
+		t.Fatal("SetMaxOpenFiles: got error: ", err)
+	}
+	if n := numCached(); n != 2 {
+		t.Errorf("expect 2 tables to be cached, got %d", n)
+	}
+	for _, k := range keys {
+		h.getVal(k, "v"+k)
+	}
+	if n := numCached(); n > 2 {
+		t.Errorf("expect at most 2 tables to be cached, got %d", n)
+	}
+	if err := h.oo.SetMaxOpenFiles(0); err != opt.ErrInvalid {
+		t.Errorf("SetMaxOpenFiles(0): expect ErrInvalid, got %v", err)
 	}
-	modifyBuffer()
-	h.getKeyVal("(foo->hello)")
 }
 
-func TestDb_CreateReopenDbOnFile(t *testing.T) {
-	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestCreateReopenDbOnFile-%d", os.Getuid()))
-	if err := os.RemoveAll(dbpath); err != nil {
-		t.Fatal("cannot remove old db: ", err)
-	}
-	defer os.RemoveAll(dbpath)
+func TestDb_CacheStats(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
 
-	for i := 0; i < 3; i++ {
-		stor, err := storage.OpenFile(dbpath)
-		if err != nil {
-			t.Fatalf("(%d) cannot open storage: %s", i, err)
-		}
-		db, err := Open(stor, &opt.Options{Flag: opt.OFCreateIfMissing})
+	h.put("foo", "v1")
+	h.compactMem()
+	h.getVal("foo", "v1")
+	h.getVal("foo", "v1")
+
+	for _, prop := range []string{"leveldb.blockcache-stats", "leveldb.tablecache-stats"} {
+		v, err := h.db.GetProperty(prop)
 		if err != nil {
-			t.Fatalf("(%d) cannot open db: %s", i, err)
+			t.Fatalf("GetProperty(%q): got error: %v", prop, err)
 		}
-		if err := db.Put([]byte("foo"), []byte("bar"), &opt.WriteOptions{}); err != nil {
-			t.Fatalf("(%d) cannot write to db: %s", i, err)
-		}
-		if err := db.Close(); err != nil {
-			t.Fatalf("(%d) cannot close db: %s", i, err)
+		var hits, misses, inserts, evictions uint64
+		if n, _ := fmt.Sscanf(v, "hits=%d misses=%d inserts=%d evictions=%d", &hits, &misses, &inserts, &evictions); n != 4 {
+			t.Fatalf("GetProperty(%q): invalid value %q", prop, v)
 		}
-		if err := stor.Close(); err != nil {
-			t.Fatalf("(%d) cannot close storage: %s", i, err)
+		if hits == 0 || inserts == 0 {
+			t.Errorf("GetProperty(%q): expect hits and inserts, got %q", prop, v)
 		}
 	}
-}
 
-func TestDb_CreateReopenDbOnFile2(t *testing.T) {
-	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestCreateReopenDbOnFile2-%d", os.Getuid()))
-	if err := os.RemoveAll(dbpath); err != nil {
-		t.Fatal("cannot remove old db: ", err)
+	h.oo.SetBlockCache(cache.EmptyCache{})
+	if _, err := h.db.GetProperty("leveldb.blockcache-stats"); err == nil {
+		t.Error("expect error for block cache without stats")
 	}
-	defer os.RemoveAll(dbpath)
+}
 
-	for i := 0; i < 3; i++ {
-		db, err := OpenFile(dbpath, &opt.Options{Flag: opt.OFCreateIfMissing})
+func TestDb_OnTableClose(t *testing.T) {
+	var mu sync.Mutex
+	closed := make(map[uint64]int)
+	h := newDbHarnessWopt(t, &opt.Options{
+		MaxOpenFiles: 2,
+		OnTableClose: func(num uint64) {
+			mu.Lock()
+			closed[num]++
+			mu.Unlock()
+		},
+	})
+	defer h.close()
+
+	keys := []string{"a", "b", "c", "d", "e"}
+	for _, k := range keys {
+		h.put(k, "v"+k)
+		h.compactMem()
+	}
+	for _, k := range keys {
+		h.getVal(k, "v"+k)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(closed) < len(keys)-2 {
+		t.Errorf("expect at least %d tables closed, got %v", len(keys)-2, closed)
+	}
+	for num, n := range closed {
+		if n != 1 {
+			t.Errorf("table %d closed %d times", num, n)
+		}
+	}
+}
+
+func TestDb_IteratorRelease(t *testing.T) {
+	var mu sync.Mutex
+	closed := make(map[uint64]int)
+	h := newDbHarnessWopt(t, &opt.Options{
+		MaxOpenFiles: 2,
+		OnTableClose: func(num uint64) {
+			mu.Lock()
+			closed[num]++
+			mu.Unlock()
+		},
+	})
+	defer h.close()
+
+	numClosed := func(num uint64) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return closed[num]
+	}
+
+	keys := []string{"a", "b", "c", "d", "e"}
+	for _, k := range keys {
+		h.put(k, "v"+k)
+		h.compactMem()
+	}
+	var num uint64
+	for _, tt := range h.db.s.version().tables {
+		for _, t := range tt {
+			if string(t.min.ukey()) == "a" {
+				num = t.file.Num()
+			}
+		}
+	}
+
+	// Table of "a" is evicted from the table cache while the iterator
+	// still hold it
+	iter := h.db.NewIterator(h.ro)
+	iter.First()
+	testKeyVal(t, iter, "a->va")
+	for _, k := range keys[1:] {
+		h.getVal(k, "v"+k)
+	}
+	if n := numClosed(num); n != 0 {
+		t.Errorf("expect table held by iterator not closed, closed %d times", n)
+	}
+	iter.Release()
+	if n := numClosed(num); n != 1 {
+		t.Errorf("expect table closed once on iterator release, closed %d times", n)
+	}
+	if iter.Valid() || iter.First() || iter.Key() != nil || iter.Value() != nil {
+		t.Error("expect released iterator to be invalid")
+	}
+	if err := iter.Error(); err != errors.ErrIterReleased {
+		t.Errorf("expect ErrIterReleased, got %v", err)
+	}
+	iter.Release()
+
+	// Snapshot is not owned by its iterators
+	snap, err := h.db.GetSnapshot()
+	if err != nil {
+		t.Fatal("GetSnapshot: got error: ", err)
+	}
+	defer snap.Release()
+	iter = snap.NewIterator(h.ro)
+	iter.First()
+	testKeyVal(t, iter, "a->va")
+	iter.Release()
+	if v, err := snap.Get([]byte("b"), h.ro); err != nil || string(v) != "vb" {
+		t.Errorf("snapshot Get after iterator release: got %q, %v", v, err)
+	}
+}
+
+func TestDb_NumIteratorsSnapshots(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("foo", "v1")
+
+	check := func(iters, snaps int) {
+		for prop, want := range map[string]int{
+			"leveldb.num-iterators": iters,
+			"leveldb.num-snapshots": snaps,
+		} {
+			v, err := h.db.GetProperty(prop)
+			if err != nil {
+				t.Fatalf("GetProperty(%q): got error: %v", prop, err)
+			}
+			if v != fmt.Sprint(want) {
+				t.Errorf("GetProperty(%q): want %d, got %s", prop, want, v)
+			}
+		}
+	}
+
+	check(0, 0)
+	iter1 := h.db.NewIterator(h.ro)
+	snap, err := h.db.GetSnapshot()
+	if err != nil {
+		t.Fatal("GetSnapshot: got error: ", err)
+	}
+	iter2 := snap.NewIterator(h.ro)
+	check(2, 1)
+
+	iter1.Release()
+	iter1.Release()
+	check(1, 1)
+	iter2.Release()
+	check(0, 1)
+	snap.Release()
+	snap.Release()
+	check(0, 0)
+
+	// Leaked iterators are accounted until garbage collected
+	h.db.NewIterator(h.ro)
+	check(1, 0)
+	for i := 0; i < 100; i++ {
+		runtime.GC()
+		if v, _ := h.db.GetProperty("leveldb.num-iterators"); v == "0" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	check(0, 0)
+}
+
+func TestDb_NoCache(t *testing.T) {
+	reads := func(bc cache.Cache) int {
+		h := newDbHarnessWopt(t, &opt.Options{BlockCache: bc})
+		defer h.close()
+
+		h.put("foo", "v1")
+		h.compactMem()
+		h.getVal("foo", "v1")
+
+		h.stor.SetReadAtCounter(storage.TypeTable)
+		for i := 0; i < 100; i++ {
+			h.getVal("foo", "v1")
+		}
+		return int(h.stor.ReadAtCounter())
+	}
+
+	if n := reads(cache.NewNoCache()); n != 100 {
+		t.Errorf("expect a sstable I/O read per lookup without cache, got %d reads", n)
+	}
+	if n := reads(cache.NewLRUCache(opt.DefaultBlockCacheSize)); n != 0 {
+		t.Errorf("expect no sstable I/O read with cache, got %d reads", n)
+	}
+}
+
+func TestDb_CompressedBlockCache(t *testing.T) {
+	reads := func(ct opt.Compression) int {
+		h := newDbHarnessWopt(t, &opt.Options{
+			BlockCache:           cache.NewNoCache(),
+			CompressedBlockCache: cache.NewLRUCache(opt.DefaultBlockCacheSize),
+			CompressionType:      ct,
+		})
+		defer h.close()
+
+		h.put("foo", "v1")
+		h.compactMem()
+		h.getVal("foo", "v1")
+
+		h.stor.SetReadAtCounter(storage.TypeTable)
+		for i := 0; i < 100; i++ {
+			h.getVal("foo", "v1")
+		}
+		return int(h.stor.ReadAtCounter())
+	}
+
+	if n := reads(opt.SnappyCompression); n != 0 {
+		t.Errorf("expect compressed blocks served from compressed cache, got %d reads", n)
+	}
+	if n := reads(opt.NoCompression); n != 100 {
+		t.Errorf("expect uncompressed blocks not cached, got %d reads", n)
+	}
+}
+
+func TestDb_BlockReadAhead(t *testing.T) {
+	scan := func(readAhead int) int {
+		h := newDbHarnessWopt(t, &opt.Options{
+			BlockReadAhead:  readAhead,
+			CompressionType: opt.NoCompression,
+		})
+		defer h.close()
+
+		for i := 0; i < 1000; i++ {
+			h.put(numKey(i), strings.Repeat("v", 100))
+		}
+		h.compactMem()
+		h.reopenDB()
+
+		h.stor.SetReadAtCounter(storage.TypeTable)
+		iter := h.db.NewIterator(h.ro)
+		n := 0
+		for iter.Next() {
+			n++
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal("iterator error: ", err)
+		}
+		if n != 1000 {
+			t.Fatalf("invalid number of keys, want=1000 got=%d", n)
+		}
+		return int(h.stor.ReadAtCounter())
+	}
+
+	without, with := scan(0), scan(64*1024)
+	t.Logf("table scan yield %d sstable I/O reads, %d with read-ahead", without, with)
+	if with*4 > without {
+		t.Errorf("expect read-ahead to coalesce block reads, got %d reads, %d without read-ahead", with, without)
+	}
+}
+
+func TestDb_Concurrent(t *testing.T) {
+	const n, secs, maxkey = 4, 2, 1000
+
+	runtime.GOMAXPROCS(n)
+	runAllOpts(t, func(h *dbHarness) {
+		var wg sync.WaitGroup
+		var stop uint32
+		var cnt [n]uint32
+
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				var put, get, found uint
+				defer func() {
+					t.Logf("goroutine %d stopped after %d ops, put=%d get=%d found=%d missing=%d",
+						i, cnt[i], put, get, found, get-found)
+					wg.Done()
+				}()
+
+				rnd := rand.New(rand.NewSource(int64(1000 + i)))
+				for atomic.LoadUint32(&stop) == 0 {
+					x := cnt[i]
+
+					k := rnd.Intn(maxkey)
+					kstr := fmt.Sprintf("%016d", k)
+
+					if (rnd.Int() % 2) > 0 {
+						put++
+						h.put(kstr, fmt.Sprintf("%d.%d.%-1000d", k, i, x))
+					} else {
+						get++
+						v, err := h.db.Get([]byte(kstr), h.ro)
+						if err == nil {
+							found++
+							rk, ri, rx := 0, -1, uint32(0)
+							fmt.Sscanf(string(v), "%d.%d.%d", &rk, &ri, &rx)
+							if rk != k {
+								t.Errorf("invalid key want=%d got=%d", k, rk)
+							}
+							if ri < 0 || ri >= n {
+								t.Error("invalid goroutine number: ", ri)
+							} else {
+								tx := atomic.LoadUint32(&(cnt[ri]))
+								if rx > tx {
+									t.Errorf("invalid seq number, %d > %d ", rx, tx)
+								}
+							}
+						} else if err != errors.ErrNotFound {
+							t.Error("Get: got error: ", err)
+							return
+						}
+					}
+					atomic.AddUint32(&cnt[i], 1)
+				}
+			}(i)
+		}
+
+		for i := 0; i < secs; i++ {
+			capacity := rand.Int() % (opt.DefaultBlockCacheSize * 2)
+			if i%2 == 0 {
+				h.oo.SetBlockCache(cache.NewLRUCache(capacity))
+			} else {
+				h.oo.SetBlockCache(cache.NewShardedLRUCache(capacity, 8))
+			}
+			time.Sleep(time.Second)
+		}
+		atomic.StoreUint32(&stop, 1)
+		wg.Wait()
+	})
+
+	runtime.GOMAXPROCS(1)
+}
+
+func TestDb_ModifyingBuffer(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("foo", "hello")
+
+	modifyBuffer := func() {
+		iter := h.db.NewIterator(&opt.ReadOptions{})
+		if !iter.First() {
+			t.Fatal("iter.First failed: ", iter.Error())
+		}
+		key, value := iter.Key(), iter.Value()
+		copy(key, []byte("bar"))
+		copy(value, []byte("olleh"))
+	}
+
+	modifyBuffer()
+	h.getKeyVal("(foo->hello)")
+	h.compactMem()
+	if h.totalTables() == 0 {
+		t.Fatal("expecting more than zero table")
+	}
+	modifyBuffer()
+	h.getKeyVal("(foo->hello)")
+}
+
+func TestDb_PutNoCopy(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	value := []byte(strings.Repeat("v", 1000))
+	if err := h.db.PutNoCopy([]byte("foo"), value, h.wo); err != nil {
+		t.Fatal("PutNoCopy: got error: ", err)
+	}
+	h.put("bar", "v1")
+
+	// the memdb holds the value by reference
+	iter := h.db.NewIterator(&opt.ReadOptions{Flag: opt.RFDontCopyBuffer})
+	if !iter.Seek([]byte("foo")) || string(iter.Key()) != "foo" {
+		t.Fatal("Seek failed: ", iter.Error())
+	}
+	if v := iter.Value(); len(v) != len(value) || &v[0] != &value[0] {
+		t.Error("value not held by reference")
+	} else if cap(v) != len(v) {
+		t.Errorf("value not capped, len=%d cap=%d", len(v), cap(v))
+	}
+	iter.Release()
+
+	h.getVal("foo", string(value))
+	h.reopenDB()
+	h.getVal("foo", string(value))
+	h.getVal("bar", "v1")
+	h.compactMem()
+	h.getVal("foo", string(value))
+}
+
+func TestDb_IterKeyValueCopy(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("a", "va")
+	h.put("b", "vb")
+	h.compactMem()
+	h.put("c", "vc")
+
+	iter := h.db.NewIterator(&opt.ReadOptions{Flag: opt.RFDontCopyBuffer})
+	var key, value []byte
+	var keys, values []string
+	for iter.Next() {
+		key = iter.KeyCopy(key[:0])
+		value = iter.ValueCopy(value[:0])
+		keys = append(keys, string(key))
+		values = append(values, string(value))
+	}
+	if got := fmt.Sprint(keys, values); got != "[a b c] [va vb vc]" {
+		t.Errorf("invalid copied keys/values, got %s", got)
+	}
+
+	// Copies are owned by the caller
+	iter.First()
+	key = iter.KeyCopy([]byte("x"))
+	value = iter.ValueCopy(nil)
+	copy(value, "XX")
+	iter.Next()
+	if string(key) != "xa" {
+		t.Errorf("KeyCopy must append to dst, got %q", key)
+	}
+	testKeyVal(t, iter, "b->vb")
+	iter.First()
+	testKeyVal(t, iter, "a->va")
+
+	iter.Last()
+	iter.Next()
+	if dst := iter.KeyCopy([]byte("x")); string(dst) != "x" {
+		t.Errorf("KeyCopy of invalid iterator must return dst as is, got %q", dst)
+	}
+}
+
+func TestDb_ParanoidCheck(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{Flag: opt.OFParanoidCheck})
+	defer h.close()
+
+	for i := 0; i < 100; i++ {
+		h.put(numKey(i), "v")
+	}
+	h.compactMem()
+	h.compactRange("", "")
+	for i := 0; i < 100; i += 2 {
+		h.put(numKey(i), "w")
+	}
+	h.compactMem()
+	h.reopenDB()
+	h.getVal(numKey(1), "v")
+	h.getVal(numKey(2), "w")
+
+	// A manifest edit recording wrong boundaries is rejected.
+	s := h.db.s
+	var tt *tFile
+	var level int
+	for i, x := range s.version().tables {
+		if len(x) > 0 {
+			tt, level = x[0], i
+			break
+		}
+	}
+	rec := new(sessionRecord)
+	rec.deleteTable(level, tt.file.Num())
+	rec.addTable(level, tt.file.Num(), tt.size, tt.max, tt.max)
+	if err := s.commit(rec); !errors.IsCorrupted(err) {
+		t.Errorf("commit of inconsistent edit: got error %v, want corruption", err)
+	}
+	if x := s.version().tables[level][0]; x != tt {
+		t.Error("inconsistent edit applied")
+	}
+
+	// A missing table fails opening the database.
+	h.closeDB()
+	if err := tt.file.Remove(); err != nil {
+		t.Fatal("cannot remove table: ", err)
+	}
+	if _, err := Open(h.stor, h.o); !errors.IsCorrupted(err) || !strings.Contains(err.Error(), "paranoid") {
+		t.Errorf("Open with missing table: got error %v, want paranoid check failure", err)
+	}
+	db, err := Open(h.stor, &opt.Options{})
+	if err != nil {
+		t.Fatal("Open without paranoid check: got error: ", err)
+	}
+	db.Close()
+	// h.close expects an open database
+	h.o = &opt.Options{}
+	h.openDB()
+}
+
+func TestDb_Checkpoint(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("a", "va")
+	h.put("b", "vb")
+	h.compactMem()
+	h.put("c", "vc")
+	h.delete("a")
+
+	dst := storage.NewMemStorage()
+	if err := h.db.Checkpoint(dst); err != nil {
+		t.Fatal("Checkpoint: got error: ", err)
+	}
+	h.put("d", "vd")
+	if err := h.db.Checkpoint(dst); err == nil {
+		t.Error("expect error on checkpoint into a database")
+	}
+	if n := len(dst.GetFiles(storage.TypeJournal)); n != 0 {
+		t.Errorf("expect no journal in checkpoint, got %d", n)
+	}
+
+	db, err := Open(dst, &opt.Options{})
+	if err != nil {
+		t.Fatal("cannot open checkpoint: ", err)
+	}
+	defer db.Close()
+	for key, want := range map[string]string{"a": "", "b": "vb", "c": "vc", "d": ""} {
+		v, err := db.Get([]byte(key), h.ro)
+		if want == "" {
+			if err != errors.ErrNotFound {
+				t.Errorf("key %q: expect not found, got %q, %v", key, v, err)
+			}
+		} else if err != nil || string(v) != want {
+			t.Errorf("key %q: want %q, got %q, %v", key, want, v, err)
+		}
+	}
+	if err := db.Put([]byte("e"), []byte("ve"), h.wo); err != nil {
+		t.Error("cannot write to checkpoint: ", err)
+	}
+}
+
+func TestDb_ExportRange(t *testing.T) {
+	o := &opt.Options{Filter: filter.NewBloomFilter(10)}
+	h := newDbHarnessWopt(t, o)
+	defer h.close()
+
+	h.put("a", "va")
+	h.put("b", "vb")
+	h.put("c", "vc")
+	h.compactMem()
+	h.put("d", "vd")
+	h.put("e", "ve")
+	h.delete("c")
+
+	export := func(start, limit []byte) *table.Reader {
+		f := storage.NewMemStorage().GetFile(1, storage.TypeTable)
+		w, err := f.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.db.ExportRange(start, limit, w); err != nil {
+			t.Fatal("ExportRange: got error: ", err)
+		}
+		w.Close()
+		size, _ := f.Size()
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr, err := table.NewReader(r, size, o, nil)
+		if err != nil {
+			t.Fatal("cannot open exported table: ", err)
+		}
+		return tr
+	}
+
+	tr := export([]byte("b"), []byte("e"))
+	if !tr.HasFilter() {
+		t.Error("expect exported table to have a filter")
+	}
+	iter := tr.NewIterator(&opt.ReadOptions{})
+	var got []string
+	for iter.Next() {
+		got = append(got, string(iter.Key())+"="+string(iter.Value()))
+	}
+	iter.Release()
+	if s := strings.Join(got, ","); s != "b=vb,d=vd" {
+		t.Errorf("invalid exported entries, got %q", s)
+	}
+	if _, v, err := tr.Get([]byte("d"), &opt.ReadOptions{}); err != nil || string(v) != "vd" {
+		t.Errorf("invalid Get result on exported table: %q, %v", v, err)
+	}
+
+	iter = export([]byte("x"), nil).NewIterator(&opt.ReadOptions{})
+	if iter.Next() {
+		t.Errorf("expect empty exported table, got key %q", iter.Key())
+	}
+	iter.Release()
+}
+
+func TestDb_CheckpointOnFile(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestCheckpointOnFile-%d", os.Getuid()))
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dir)
+	srcpath, dstpath := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+
+	db, err := OpenFile(srcpath, &opt.Options{Flag: opt.OFCreateIfMissing})
+	if err != nil {
+		t.Fatal("cannot open db: ", err)
+	}
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte(numKey(i)), []byte("v"), &opt.WriteOptions{}); err != nil {
+			t.Fatal("cannot write to db: ", err)
+		}
+	}
+
+	dst, err := storage.OpenFile(dstpath)
+	if err != nil {
+		t.Fatal("cannot open storage: ", err)
+	}
+	if err := db.Checkpoint(dst); err != nil {
+		t.Fatal("Checkpoint: got error: ", err)
+	}
+	tables := dst.GetFiles(storage.TypeTable)
+	if len(tables) == 0 {
+		t.Fatal("expect tables in checkpoint")
+	}
+	for _, f := range tables {
+		name := fmt.Sprintf("%06d.sst", f.Num())
+		fi1, err1 := os.Stat(filepath.Join(srcpath, name))
+		fi2, err2 := os.Stat(filepath.Join(dstpath, name))
+		if err1 != nil || err2 != nil || !os.SameFile(fi1, fi2) {
+			t.Errorf("expect table %s hard linked, err=%v %v", name, err1, err2)
+		}
+	}
+	dst.Close()
+
+	cdb, err := OpenFile(dstpath, &opt.Options{})
+	if err != nil {
+		t.Fatal("cannot open checkpoint: ", err)
+	}
+	defer cdb.Close()
+	for i := 0; i < 100; i++ {
+		if v, err := cdb.Get([]byte(numKey(i)), &opt.ReadOptions{}); err != nil || string(v) != "v" {
+			t.Errorf("invalid value for key %d: %q, %v", i, v, err)
+		}
+	}
+}
+
+func TestDb_CreateReopenDbOnFile(t *testing.T) {
+	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestCreateReopenDbOnFile-%d", os.Getuid()))
+	if err := os.RemoveAll(dbpath); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	for i := 0; i < 3; i++ {
+		stor, err := storage.OpenFile(dbpath)
+		if err != nil {
+			t.Fatalf("(%d) cannot open storage: %s", i, err)
+		}
+		db, err := Open(stor, &opt.Options{Flag: opt.OFCreateIfMissing})
+		if err != nil {
+			t.Fatalf("(%d) cannot open db: %s", i, err)
+		}
+		if err := db.Put([]byte("foo"), []byte("bar"), &opt.WriteOptions{}); err != nil {
+			t.Fatalf("(%d) cannot write to db: %s", i, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("(%d) cannot close db: %s", i, err)
+		}
+		if err := stor.Close(); err != nil {
+			t.Fatalf("(%d) cannot close storage: %s", i, err)
+		}
+	}
+}
+
+func TestDb_CreateReopenDbOnMemStorage(t *testing.T) {
+	stor := storage.NewMemStorage()
+	for i := 0; i < 3; i++ {
+		db, err := Open(stor, &opt.Options{Flag: opt.OFCreateIfMissing})
+		if err != nil {
+			t.Fatalf("(%d) cannot open db: %s", i, err)
+		}
+		if _, err := Open(stor, &opt.Options{Flag: opt.OFCreateIfMissing}); err != storage.ErrLocked {
+			t.Fatalf("(%d) expect ErrLocked on second open, got: %v", i, err)
+		}
+		for j := 0; j < i; j++ {
+			if v, err := db.Get([]byte(numKey(j)), &opt.ReadOptions{}); err != nil || string(v) != "bar" {
+				t.Errorf("(%d) invalid value for key %d, err=%v", i, j, err)
+			}
+		}
+		if err := db.Put([]byte(numKey(i)), []byte("bar"), &opt.WriteOptions{}); err != nil {
+			t.Fatalf("(%d) cannot write to db: %s", i, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("(%d) cannot close db: %s", i, err)
+		}
+	}
+	if err := stor.Close(); err != nil {
+		t.Fatal("cannot close storage: ", err)
+	}
+}
+
+func TestDb_MmapTablesOnFile(t *testing.T) {
+	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestMmapTablesOnFile-%d", os.Getuid()))
+	if err := os.RemoveAll(dbpath); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	// uncompressed blocks are read in place
+	o := &opt.Options{Flag: opt.OFCreateIfMissing | opt.OFMmapTables, MaxOpenFiles: 1, CompressionType: opt.NoCompression}
+	for i := 0; i < 3; i++ {
+		db, err := OpenFile(dbpath, o)
+		if err != nil {
+			t.Fatalf("(%d) cannot open db: %s", i, err)
+		}
+		for j := 0; j < 100; j++ {
+			key := []byte(fmt.Sprintf("%d.%03d", i, j))
+			if err := db.Put(key, key, &opt.WriteOptions{}); err != nil {
+				t.Fatalf("(%d) cannot write to db: %s", i, err)
+			}
+		}
+		if err := db.CompactRange(Range{}); err != nil {
+			t.Fatalf("(%d) cannot compact db: %s", i, err)
+		}
+		// Cycle tables through the table cache, thus unmapping them;
+		// values got must outlive the mapping.
+		var keys, values [][]byte
+		for k := 0; k <= i; k++ {
+			for j := 0; j < 100; j += 7 {
+				key := []byte(fmt.Sprintf("%d.%03d", k, j))
+				v, err := db.Get(key, &opt.ReadOptions{Flag: opt.RFDontCopyBuffer})
+				if err != nil {
+					t.Errorf("(%d) cannot get key %q: %v", i, key, err)
+				}
+				keys, values = append(keys, key), append(values, v)
+			}
+		}
+		for j, key := range keys {
+			if !bytes.Equal(values[j], key) {
+				t.Errorf("(%d) invalid value for key %q: %q", i, key, values[j])
+			}
+		}
+		values, errs := db.MultiGet(keys, &opt.ReadOptions{Flag: opt.RFDontCopyBuffer})
+		for j, key := range keys {
+			if errs[j] != nil || !bytes.Equal(values[j], key) {
+				t.Errorf("(%d) invalid multi value for key %q: %q, err=%v", i, key, values[j], errs[j])
+			}
+		}
+		iter := db.NewIterator(nil)
+		n := 0
+		for iter.Next() {
+			if !bytes.Equal(iter.Key(), iter.Value()) {
+				t.Errorf("(%d) invalid value for key %q: %q", i, iter.Key(), iter.Value())
+			}
+			n++
+		}
+		for iter.Prev() {
+			if !bytes.Equal(iter.Key(), iter.Value()) {
+				t.Errorf("(%d) invalid value for key %q: %q", i, iter.Key(), iter.Value())
+			}
+			n++
+		}
+		iter.Release()
+		if n != (i+1)*200 {
+			t.Errorf("(%d) iterated %d keys, want %d", i, n, (i+1)*200)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("(%d) cannot close db: %s", i, err)
+		}
+	}
+}
+
+func TestDb_CreateReopenDbOnFile2(t *testing.T) {
+	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestCreateReopenDbOnFile2-%d", os.Getuid()))
+	if err := os.RemoveAll(dbpath); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	for i := 0; i < 3; i++ {
+		db, err := OpenFile(dbpath, &opt.Options{Flag: opt.OFCreateIfMissing})
+		if err != nil {
+			t.Fatalf("(%d) cannot open db: %s", i, err)
+		}
+		if err := db.Put([]byte("foo"), []byte("bar"), &opt.WriteOptions{}); err != nil {
+			t.Fatalf("(%d) cannot write to db: %s", i, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("(%d) cannot close db: %s", i, err)
+		}
+	}
+}
+
+func TestDb_SharedOpenFile(t *testing.T) {
+	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestSharedOpenFile-%d", os.Getuid()))
+	if err := os.RemoveAll(dbpath); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	o := &opt.Options{Flag: opt.OFCreateIfMissing}
+	db1, err := OpenFile(dbpath, o)
+	if err != nil {
+		t.Fatal("cannot open db: ", err)
+	}
+	db2, err := OpenFile(filepath.Join(dbpath, "."), o)
+	if err != nil {
+		t.Fatal("cannot open db again: ", err)
+	}
+	if db1 == db2 || db1.dbState != db2.dbState {
+		t.Fatal("expect a new handle of the same DB on second open")
+	}
+	if n := db1.OpenCount(); n != 2 {
+		t.Errorf("invalid open count, want=2 got=%d", n)
+	}
+	if _, err := OpenFile(dbpath, &opt.Options{Flag: opt.OFErrorIfExist}); err != os.ErrExist {
+		t.Errorf("expect os.ErrExist with OFErrorIfExist, got: %v", err)
+	}
+	for _, xo := range []*opt.Options{
+		{Comparer: numberComparer{}},
+		{Filter: filter.NewBloomFilter(10)},
+	} {
+		if _, err := OpenFile(dbpath, xo); err == nil {
+			t.Error("expect error with mismatched options")
+		} else if _, ok := err.(errors.ErrInvalid); !ok {
+			t.Errorf("expect ErrInvalid with mismatched options, got: %v", err)
+		}
+	}
+
+	if err := db1.Put([]byte("foo"), []byte("bar"), &opt.WriteOptions{}); err != nil {
+		t.Fatal("cannot write to db: ", err)
+	}
+	if err := db1.Close(); err != nil {
+		t.Fatal("cannot release db: ", err)
+	}
+	if err := db1.Close(); err != errors.ErrClosed {
+		t.Errorf("expect ErrClosed on extra release, got: %v", err)
+	}
+	if n := db1.OpenCount(); n != 0 {
+		t.Errorf("invalid open count of released handle, want=0 got=%d", n)
+	}
+	if n := db2.OpenCount(); n != 1 {
+		t.Errorf("invalid open count, want=1 got=%d", n)
+	}
+
+	// unreachable handle is released by the finalizer
+	if _, err := OpenFile(dbpath, o); err != nil {
+		t.Fatal("cannot open db again: ", err)
+	}
+	if n := db2.OpenCount(); n != 2 {
+		t.Errorf("invalid open count, want=2 got=%d", n)
+	}
+	for i := 0; db2.OpenCount() != 1; i++ {
+		if i == 100 {
+			t.Fatal("unreachable handle is not released")
+		}
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	if v, err := db2.Get([]byte("foo"), &opt.ReadOptions{}); err != nil || string(v) != "bar" {
+		t.Errorf("db unusable after releasing a reference, value=%q err=%v", v, err)
+	}
+	if err := db2.Close(); err != nil {
+		t.Fatal("cannot close db: ", err)
+	}
+	if n := db2.OpenCount(); n != 0 {
+		t.Errorf("invalid open count, want=0 got=%d", n)
+	}
+	if err := db2.Close(); err != errors.ErrClosed {
+		t.Errorf("expect ErrClosed on extra close, got: %v", err)
+	}
+
+	db3, err := OpenFile(dbpath, o)
+	if err != nil {
+		t.Fatal("cannot reopen db: ", err)
+	}
+	defer db3.Close()
+	if db3.dbState == db1.dbState {
+		t.Fatal("expect a new DB after the last close")
+	}
+	if v, err := db3.Get([]byte("foo"), &opt.ReadOptions{}); err != nil || string(v) != "bar" {
+		t.Errorf("invalid value after reopen, value=%q err=%v", v, err)
+	}
+}
+
+func TestDb_SharedOpenFileConcurrent(t *testing.T) {
+	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestSharedOpenFileConcurrent-%d", os.Getuid()))
+	if err := os.RemoveAll(dbpath); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	const n = 8
+	o := &opt.Options{Flag: opt.OFCreateIfMissing}
+	dbs := make([]*DB, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range dbs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dbs[i], errs[i] = OpenFile(dbpath, o)
+		}(i)
+	}
+	wg.Wait()
+	for i, db := range dbs {
+		if errs[i] != nil {
+			t.Fatalf("(%d) cannot open db: %v", i, errs[i])
+		}
+		if db.dbState != dbs[0].dbState {
+			t.Fatalf("(%d) expect a handle of the same DB", i)
+		}
+	}
+	if c := dbs[0].OpenCount(); c != n {
+		t.Errorf("invalid open count, want=%d got=%d", n, c)
+	}
+	for i, db := range dbs {
+		if err := db.Close(); err != nil {
+			t.Errorf("(%d) cannot close db: %v", i, err)
+		}
+	}
+	if !dbs[0].isClosed() {
+		t.Error("db is not closed after every handle is closed")
+	}
+}
+
+func TestDb_JournalPreallocOnFile(t *testing.T) {
+	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestJournalPreallocOnFile-%d", os.Getuid()))
+	if err := os.RemoveAll(dbpath); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	const prealloc = 1 << 20
+	o := &opt.Options{Flag: opt.OFCreateIfMissing, JournalPreallocSize: prealloc}
+	for i := 0; i < 3; i++ {
+		db, err := OpenFile(dbpath, o)
+		if err != nil {
+			t.Fatalf("(%d) cannot open db: %s", i, err)
+		}
+		for j := 0; j <= i; j++ {
+			v, err := db.Get([]byte(numKey(j)), &opt.ReadOptions{})
+			if j < i && (err != nil || string(v) != numKey(j)) {
+				t.Errorf("(%d) invalid value for key %d, err=%v", i, j, err)
+			}
+		}
+		if err := db.Put([]byte(numKey(i)), []byte(numKey(i)), &opt.WriteOptions{}); err != nil {
+			t.Fatalf("(%d) cannot write to db: %s", i, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("(%d) cannot close db: %s", i, err)
+		}
+
+		journals, _ := filepath.Glob(filepath.Join(dbpath, "*.log"))
+		for _, name := range journals {
+			fi, err := os.Stat(name)
+			if err != nil {
+				t.Fatalf("(%d) cannot stat journal: %s", i, err)
+			}
+			if fi.Size() >= prealloc {
+				t.Errorf("(%d) journal %s was not truncated, size=%d", i, name, fi.Size())
+			}
+		}
+	}
+}
+
+func TestDb_DurableSequence(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	if seq := h.db.DurableSequence(); seq != h.db.getSeq() {
+		t.Errorf("durable seq after open: want %d, got %d", h.db.getSeq(), seq)
+	}
+
+	h.put("foo", "v1")
+	dseq := h.db.DurableSequence()
+	if dseq >= h.db.getSeq() {
+		t.Errorf("unsynced write is durable, seq=%d dseq=%d", h.db.getSeq(), dseq)
+	}
+
+	wo := &opt.WriteOptions{Flag: opt.WFSync}
+	if err := h.db.Put([]byte("bar"), []byte("v1"), wo); err != nil {
+		t.Fatal("Put: got error: ", err)
+	}
+	dseq = h.db.DurableSequence()
+	if dseq != h.db.getSeq() {
+		t.Errorf("synced write is not durable, seq=%d dseq=%d", h.db.getSeq(), dseq)
+	}
+
+	h.put("foo", "v2")
+	h.put("baz", "v1")
+	if seq := h.db.DurableSequence(); seq != dseq {
+		t.Errorf("durable seq advanced by unsynced write, want %d, got %d", dseq, seq)
+	}
+
+	// emulate power loss
+	h.closeDB()
+	h.stor.DropUnsynced(storage.TypeJournal)
+	h.openDB()
+
+	h.getVal("foo", "v1")
+	h.getVal("bar", "v1")
+	h.get("baz", false)
+
+	h.put("foo", "v3")
+	h.compactMem()
+	if seq := h.db.DurableSequence(); seq != h.db.getSeq() {
+		t.Errorf("durable seq after mem compaction: want %d, got %d", h.db.getSeq(), seq)
+	}
+}
+
+func TestDb_DurableSequenceNoWAL(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	sync := &opt.WriteOptions{Flag: opt.WFSync}
+	nowal := &opt.WriteOptions{Flag: opt.WFNoWAL}
+	put := func(key string, wo *opt.WriteOptions) uint64 {
+		if err := h.db.Put([]byte(key), []byte("v"+key), wo); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+		return h.db.getSeq()
+	}
+
+	dseq := put("a", sync)
+	nwseq := put("b", nowal)
+	seq := put("c", sync)
+	if got := h.db.DurableSequence(); got != nwseq-1 {
+		t.Errorf("durable seq covers write not journaled, want %d, got %d", nwseq-1, got)
+	}
+	if nwseq-1 != dseq {
+		t.Fatalf("unexpected seq, want %d, got %d", dseq, nwseq-1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	err := h.db.WaitForDurable(ctx, seq)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("WaitForDurable: want %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// flushed, but later write not journaled holds it back again
+	h.compactMem()
+	if got := h.db.DurableSequence(); got != seq {
+		t.Errorf("durable seq after mem compaction: want %d, got %d", seq, got)
+	}
+	nwseq = put("d", nowal)
+	put("e", sync)
+	if got := h.db.DurableSequence(); got != nwseq-1 {
+		t.Errorf("durable seq covers write not journaled, want %d, got %d", nwseq-1, got)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- h.db.WaitForDurable(context.Background(), nwseq)
+	}()
+	select {
+	case err := <-done:
+		t.Fatal("WaitForDurable: returned before mem compaction, err: ", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	h.compactMem()
+	if err := <-done; err != nil {
+		t.Error("WaitForDurable: got error: ", err)
+	}
+	if got, want := h.db.DurableSequence(), h.db.getSeq(); got != want {
+		t.Errorf("durable seq after mem compaction: want %d, got %d", want, got)
+	}
+}
+
+func TestDb_PinKeys(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	checkLevel := func(key, value string, want int) {
+		v, level, err := h.db.GetWithLevel([]byte(key), h.ro)
+		if err != nil {
+			t.Fatalf("GetWithLevel %q: got error: %v", key, err)
+		}
+		if string(v) != value {
+			t.Errorf("GetWithLevel %q: want value %q, got %q", key, value, v)
+		}
+		if level != want {
+			t.Errorf("GetWithLevel %q: want level %d, got %d", key, want, level)
+		}
+	}
+
+	if err := h.db.PinKeys([][]byte{[]byte("hot"), []byte("zzz")}); err != nil {
+		t.Fatal("PinKeys: got error: ", err)
+	}
+
+	h.put("a", "v1")
+	h.put("hot", "v1")
+	h.put("z", "v1")
+	h.compactMem()
+	h.tablesPerLevel("1")
+	checkLevel("hot", "v1", 0)
+
+	h.compactRangeAt(0, "", "")
+	h.tablesPerLevel("0,1")
+	checkLevel("hot", "v1", 1)
+
+	for i := 0; i < 3; i++ {
+		h.compactRangeAt(1, "", "")
+		h.tablesPerLevel("0,1,1")
+		checkLevel("hot", "v1", 1)
+		checkLevel("a", "v1", 2)
+		checkLevel("z", "v1", 2)
+	}
+
+	// Pinned keys are still overwritten and deleted by newer writes.
+	h.put("hot", "v2")
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.compactRangeAt(1, "", "")
+	checkLevel("hot", "v2", 1)
+	h.delete("hot")
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.compactRangeAt(1, "", "")
+	h.get("hot", false)
+
+	// Unpinned keys are pushed down again.
+	h.put("hot", "v3")
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	if err := h.db.PinKeys(nil); err != nil {
+		t.Fatal("PinKeys: got error: ", err)
+	}
+	h.compactRangeAt(1, "", "")
+	checkLevel("hot", "v3", 2)
+	h.tablesPerLevel("0,0,1")
+}
+
+func TestDb_ExportKeyFilter(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	const n = 1000
+	for i := 0; i < n; i++ {
+		h.put(numKey(i), "v")
+	}
+	h.compactMem()
+	for i := 0; i < n; i += 2 {
+		h.delete(numKey(i))
+	}
+	for i := n; i < n+100; i++ {
+		h.put(numKey(i), "v")
+	}
+
+	if _, err := h.db.ExportKeyFilter(0); err == nil {
+		t.Error("ExportKeyFilter: expecting error for zero bits per key")
+	}
+
+	f, err := h.db.ExportKeyFilter(10)
+	if err != nil {
+		t.Fatal("ExportKeyFilter: got error: ", err)
+	}
+	bf := filter.NewBloomFilter(10)
+	for i := 1; i < n; i += 2 {
+		if !bf.KeyMayMatch([]byte(numKey(i)), f) {
+			t.Errorf("live key %q is missing from filter", numKey(i))
+		}
+	}
+	for i := n; i < n+100; i++ {
+		if !bf.KeyMayMatch([]byte(numKey(i)), f) {
+			t.Errorf("live key %q is missing from filter", numKey(i))
+		}
+	}
+
+	fp := 0
+	for i := 0; i < n; i++ {
+		if bf.KeyMayMatch([]byte(fmt.Sprintf("absent%d", i)), f) {
+			fp++
+		}
+	}
+	if fp > n/20 {
+		t.Errorf("false positive rate too high, %d of %d", fp, n)
+	}
+}
+
+func TestDb_Timestamp(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	putTs := func(key, value string, ts uint64) {
+		b := new(Batch)
+		b.PutWithTs([]byte(key), []byte(value), ts)
+		if err := h.db.Write(b, h.wo); err != nil {
+			t.Fatal("Write: got error: ", err)
+		}
+	}
+	deleteTs := func(key string, ts uint64) {
+		b := new(Batch)
+		b.DeleteWithTs([]byte(key), ts)
+		if err := h.db.Write(b, h.wo); err != nil {
+			t.Fatal("Write: got error: ", err)
+		}
+	}
+
+	// Out-of-order writes within memdb.
+	putTs("a", "v10", 10)
+	putTs("a", "v5", 5)
+	h.getVal("a", "v10")
+	h.put("a", "plain")
+	h.getVal("a", "v10")
+	putTs("a", "v10b", 10)
+	h.getVal("a", "v10b")
+	deleteTs("a", 7)
+	h.getVal("a", "v10b")
+	snap := h.getSnapshot()
+	deleteTs("a", 20)
+	h.get("a", false)
+	h.getValr(snap, "a", "v10b")
+	snap.Release()
+	putTs("a", "v30", 30)
+	h.getVal("a", "v30")
+
+	// Newer timestamp in deeper level wins over late write in memdb.
+	putTs("b", "new", 100)
+	h.put("c", "v1")
+	h.compactMem()
+	h.compactRange("", "")
+	putTs("b", "old", 50)
+	h.put("c", "v2")
+	h.getVal("b", "new")
+	h.getVal("c", "v2")
+	h.getKeyVal("(a->v30)(b->new)(c->v2)")
+
+	// Resolution survives reopen and compaction.
+	h.reopenDB()
+	h.getVal("a", "v30")
+	h.getVal("b", "new")
+	h.compactMem()
+	h.compactRange("", "")
+	h.getVal("a", "v30")
+	h.getVal("b", "new")
+	h.getVal("c", "v2")
+	h.getKeyVal("(a->v30)(b->new)(c->v2)")
+	h.allEntriesFor("b", "[ new ]")
+}
+
+func TestDb_WaitForDurable(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	base := h.db.getSeq()
+	if err := h.db.WaitForDurable(context.Background(), base); err != nil {
+		t.Fatal("WaitForDurable: got error: ", err)
+	}
+
+	const n = 10
+	errc := make(chan error, n)
+	for i := 1; i <= n; i++ {
+		go func(seq uint64) {
+			errc <- h.db.WaitForDurable(context.Background(), seq)
+		}(base + uint64(i))
+	}
+
+	for i := 0; i < n-1; i++ {
+		h.put(numKey(i), "v")
+	}
+	select {
+	case err := <-errc:
+		t.Fatal("WaitForDurable: returned before write is durable, err: ", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	wo := &opt.WriteOptions{Flag: opt.WFSync}
+	if err := h.db.Put([]byte(numKey(n)), []byte("v"), wo); err != nil {
+		t.Fatal("Put: got error: ", err)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errc; err != nil {
+			t.Error("WaitForDurable: got error: ", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := h.db.WaitForDurable(ctx, base+n+1); err != context.DeadlineExceeded {
+		t.Errorf("WaitForDurable: want %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	go func() {
+		errc <- h.db.WaitForDurable(context.Background(), base+n+1)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	h.closeDB()
+	if err := <-errc; err != errors.ErrClosed {
+		t.Errorf("WaitForDurable: want %v, got %v", errors.ErrClosed, err)
+	}
+	h.openDB()
+}
+
+func TestDb_MaxMemCompactLevel(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{MaxMemCompactLevel: 4})
+	defer h.close()
+
+	// Non-overlapping flushes land at the deepest allowed level.
+	h.put("a", "v1")
+	h.compactMem()
+	h.tablesPerLevel("0,0,0,0,1")
+	h.put("m", "v1")
+	h.compactMem()
+	h.tablesPerLevel("0,0,0,0,2")
+
+	// Overlapping flushes stop above the overlapping level.
+	h.put("a", "v2")
+	h.compactMem()
+	h.tablesPerLevel("0,0,0,1,2")
+	h.put("a", "v3")
+	h.compactMem()
+	h.tablesPerLevel("0,0,1,1,2")
+	h.getVal("a", "v3")
+
+	h.oo.SetMaxMemCompactLevel(-1)
+	h.put("z", "v1")
+	h.compactMem()
+	h.tablesPerLevel("1,0,1,1,2")
+
+	h.oo.SetMaxMemCompactLevel(0)
+	h.put("x", "v1")
+	h.compactMem()
+	h.tablesPerLevel("1,0,2,1,2")
+}
+
+func TestDb_RunIterator(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	runs := func() string {
+		iter := h.db.NewRunIterator(h.ro)
+		res := ""
+		for iter.Next() {
+			res += fmt.Sprintf("(%s-%s:%s:%d)", iter.StartKey(), iter.EndKey(), iter.Value(), iter.Count())
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal("RunIterator: got error: ", err)
+		}
+		if iter.Next() {
+			t.Error("RunIterator: Next after exhausted returned true")
+		}
+		iter.Release()
+		return res
+	}
+	check := func(want string) {
+		if got := runs(); got != want {
+			t.Errorf("runs: want %q, got %q", want, got)
+		}
+	}
+
+	check("")
+
+	h.put("a", "x")
+	check("(a-a:x:1)")
+
+	h.put("b", "x")
+	h.put("c", "x")
+	h.put("d", "y")
+	h.put("e", "x")
+	h.put("f", "xx")
+	h.put("g", "xx")
+	h.compactMem()
+	h.put("h", "")
+	h.put("i", "")
+	check("(a-c:x:3)(d-d:y:1)(e-e:x:1)(f-g:xx:2)(h-i::2)")
+
+	// Deleting the odd one out doesn't merge the neighbour runs.
+	h.delete("d")
+	check("(a-c:x:3)(e-e:x:1)(f-g:xx:2)(h-i::2)")
+
+	// Deletion in between equal values breaks a run, whether flushed
+	// or not.
+	h.delete("g")
+	check("(a-c:x:3)(e-e:x:1)(f-f:xx:1)(h-i::2)")
+	h.compactMem()
+	check("(a-c:x:3)(e-e:x:1)(f-f:xx:1)(h-i::2)")
+
+	// Overwriting in the middle splits a run.
+	h.put("b", "z")
+	check("(a-a:x:1)(b-b:z:1)(c-c:x:1)(e-e:x:1)(f-f:xx:1)(h-i::2)")
+
+	// Writes after the iterator creation are not seen.
+	iter := h.db.NewRunIterator(h.ro)
+	h.delete("i")
+	h.put("j", "")
+	res := ""
+	for iter.Next() {
+		res += fmt.Sprintf("(%s-%s)", iter.StartKey(), iter.EndKey())
+	}
+	iter.Release()
+	if want := "(a-a)(b-b)(c-c)(e-e)(f-f)(h-i)"; res != want {
+		t.Errorf("runs of snapshot: want %q, got %q", want, res)
+	}
+	if iter.Next() {
+		t.Error("RunIterator: Next after released returned true")
+	}
+
+	// Once compaction drops the deletion of "d", runs are no longer
+	// broken by it.
+	h.compactRange("", "")
+	check("(a-a:x:1)(b-b:z:1)(c-e:x:2)(f-f:xx:1)(h-h::1)(j-j::1)")
+
+	if v, err := h.db.GetProperty("leveldb.num-iterators"); err != nil || v != "0" {
+		t.Errorf("num-iterators: got %q, want %q, err=%v", v, "0", err)
+	}
+}
+
+func TestDb_SnapshotGetVersions(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("a", "v0")
+	h.put("z", "v0")
+
+	for _, where := range []string{"mem", "level-0", "level-n"} {
+		key := "k-" + where
+		s0 := h.getSnapshot()
+		h.put(key, "v1")
+		s1 := h.getSnapshot()
+		h.put(key, "v2")
+		s2 := h.getSnapshot()
+		h.delete(key)
+		s3 := h.getSnapshot()
+		h.put(key, "v3")
+
+		switch where {
+		case "level-0":
+			h.compactMem()
+		case "level-n":
+			h.compactMem()
+			h.compactRange("", "")
+		}
+
+		check := func(ts bool) {
+			desc := where
+			if ts {
+				desc += "/ts"
+			}
+			for i, x := range []struct {
+				s   *Snapshot
+				val string
+			}{{s0, ""}, {s1, "v1"}, {s2, "v2"}, {s3, ""}} {
+				v, err := x.s.Get([]byte(key), h.ro)
+				if x.val == "" {
+					if err != errors.ErrNotFound {
+						t.Errorf("%s: snapshot %d: got (%q, %v), want not found", desc, i, v, err)
+					}
+				} else if err != nil || string(v) != x.val {
+					t.Errorf("%s: snapshot %d: got (%q, %v), want %q", desc, i, v, err, x.val)
+				}
+			}
+			h.getVal(key, "v3")
+		}
+		check(false)
+		// Timestamp-aware lookups must honor sequence bounds for plain
+		// keys too.
+		h.db.setTs()
+		check(true)
+		atomic.StoreUint32(&h.db.ts, 0)
+
+		s0.Release()
+		s1.Release()
+		s2.Release()
+		s3.Release()
+	}
+}
+
+type testKvIter struct {
+	iterator.EmptyIterator
+	kv  [][2]string
+	pos int
+}
+
+func (i *testKvIter) Next() bool {
+	i.pos++
+	return i.pos <= len(i.kv)
+}
+
+func (i *testKvIter) Key() []byte   { return []byte(i.kv[i.pos-1][0]) }
+func (i *testKvIter) Value() []byte { return []byte(i.kv[i.pos-1][1]) }
+
+func TestDb_BulkLoadSorted(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	journalSize := func() (n uint64) {
+		for _, f := range h.stor.GetFiles(storage.TypeJournal) {
+			size, err := f.Size()
+			if err != nil {
+				t.Fatal("Size: got error: ", err)
+			}
+			n += size
+		}
+		return
+	}
+
+	h.put("k00001", "old")
+	h.put("zzz", "old")
+	s := h.getSnapshot()
+	h.compactMem()
+	journal := journalSize()
+
+	const n = 30000
+	value := strings.Repeat("v", 100)
+	src := &testKvIter{}
+	for i := 0; i < n; i++ {
+		src.kv = append(src.kv, [2]string{fmt.Sprintf("k%05d", i), value})
+	}
+	count, err := h.db.BulkLoadSorted(src)
+	if err != nil {
+		t.Fatal("BulkLoadSorted: got error: ", err)
+	}
+	if count != n {
+		t.Errorf("BulkLoadSorted: got count %d, want %d", count, n)
+	}
+	if x := journalSize(); x != journal {
+		t.Errorf("journal written by bulk load: size %d, want %d", x, journal)
+	}
+	if x := h.totalTables(); x < 3 {
+		t.Errorf("expect loaded data split into multiple tables, got %d tables", x)
+	}
+
+	check := func() {
+		for _, i := range []int{0, 1, n / 2, n - 1} {
+			h.getVal(fmt.Sprintf("k%05d", i), value)
+		}
+		h.getVal("zzz", "old")
+		// The loaded entries are newer than existing snapshots.
+		h.getValr(s, "k00001", "old")
+	}
+	check()
+	s.Release()
+
+	h.put("k00002", "new")
+	h.getVal("k00002", "new")
+
+	h.reopenDB()
+	h.getVal("k00001", value)
+	h.getVal("k00002", "new")
+	h.getVal(fmt.Sprintf("k%05d", n-1), value)
+
+	// Out of order and duplicate keys are rejected, nothing is loaded.
+	tables := h.totalTables()
+	for _, kv := range [][][2]string{
+		{{"x1", "a"}, {"x3", "a"}, {"x2", "a"}},
+		{{"x1", "a"}, {"x1", "b"}},
+	} {
+		_, err = h.db.BulkLoadSorted(&testKvIter{kv: kv})
+		if _, ok := err.(errors.ErrInvalid); !ok {
+			t.Errorf("BulkLoadSorted: got error %v, want ErrInvalid", err)
+		}
+		h.get("x1", false)
+	}
+	if x := h.totalTables(); x != tables {
+		t.Errorf("tables left by rejected bulk load: got %d, want %d", x, tables)
+	}
+}
+
+func TestDb_BulkLoadSortedOverMemdb(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	// Level-0 tables overlapping the loaded range.
+	for i := 0; h.db.s.version().tLen(0) == 0; i++ {
+		h.put("k5", fmt.Sprint("older", i))
+		h.compactMem()
+	}
+
+	// Unflushed entries are older than the loaded ones.
+	h.put("k5", "old")
+	h.put("k7", "old")
+	src := &testKvIter{kv: [][2]string{{"k0", "new"}, {"k5", "new"}, {"k9", "new"}}}
+	if _, err := h.db.BulkLoadSorted(src); err != nil {
+		t.Fatal("BulkLoadSorted: got error: ", err)
+	}
+	check := func() {
+		h.getVal("k0", "new")
+		h.getVal("k5", "new")
+		h.getVal("k7", "old")
+		h.getVal("k9", "new")
+		h.getKeyVal("(k0->new)(k5->new)(k7->old)(k9->new)")
+	}
+	check()
+	h.reopenDB()
+	check()
+}
+
+func TestDb_IngestSST(t *testing.T) {
+	src := newDbHarness(t)
+	defer src.close()
+	src.put("b", "new")
+	src.put("c", "vc")
+	src.put("d", "vd")
+
+	f := storage.NewMemStorage().GetFile(1, storage.TypeTable)
+	w, err := f.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.db.ExportRange(nil, nil, w); err != nil {
+		t.Fatal("ExportRange: got error: ", err)
+	}
+	w.Close()
+
+	h := newDbHarness(t)
+	defer h.close()
+	// level-0 tables overlapping the ingested range
+	for i := 0; h.db.s.version().tLen(0) == 0; i++ {
+		h.put("c", fmt.Sprint("older", i))
+		h.compactMem()
+	}
+	h.put("a", "va")
+	h.put("b", "old")
+	h.put("c", "old")
+	s := h.getSnapshot()
+	defer s.Release()
+
+	if err := h.db.IngestSST(f); err != nil {
+		t.Fatal("IngestSST: got error: ", err)
+	}
+	h.getVal("a", "va")
+	h.getVal("b", "new")
+	h.getVal("c", "vc")
+	h.getVal("d", "vd")
+	// The ingested entries are newer than existing snapshots.
+	h.getValr(s, "b", "old")
+	h.getValr(s, "c", "old")
+
+	h.reopenDB()
+	h.getVal("a", "va")
+	h.getVal("b", "new")
+	h.getVal("c", "vc")
+	h.getVal("d", "vd")
+
+	// A file which isn't a table is rejected.
+	f = storage.NewMemStorage().GetFile(2, storage.TypeTable)
+	w, _ = f.Create()
+	w.Write([]byte("not a table file"))
+	w.Close()
+	if err := h.db.IngestSST(f); err == nil {
+		t.Error("IngestSST: invalid table accepted")
+	}
+}
+
+func TestDb_Partition(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	if _, err := h.db.Partition(0); err == nil {
+		t.Error("Partition: zero target size accepted")
+	}
+	if rs, err := h.db.Partition(1); err != nil || rs != nil {
+		t.Errorf("Partition: empty database got (%v, %v), want (nil, nil)", rs, err)
+	}
+
+	const n = 20000
+	value := strings.Repeat("v", 100)
+	for i := 0; i < n; i++ {
+		h.put(numKey(i), value)
+		if i == n/2 {
+			h.compactMem()
+			h.compactRange("", "")
+		}
+	}
+	s := h.getSnapshot()
+	defer s.Release()
+	for i := 0; i < n; i += 10 {
+		h.delete(numKey(i))
+		h.put(numKey(i+1), "new")
+	}
+
+	const target = 256 << 10
+	rs, err := h.db.Partition(target)
+	if err != nil {
+		t.Fatal("Partition: got error: ", err)
+	}
+
+	v := h.db.s.version()
+	tt := v.tables[opt.DefaultNumLevels-1]
+	h.tablesPerLevel(fmt.Sprintf("0,0,0,0,0,0,%d", len(tt)))
+	if len(tt) < 4 || len(rs) != len(tt) {
+		t.Fatalf("got %d ranges for %d tables", len(rs), len(tt))
+	}
+	if rs[0].Start != nil || rs[len(rs)-1].Limit != nil {
+		t.Error("ranges don't cover the key space ends")
+	}
+	for i, t0 := range tt {
+		r := rs[i]
+		if i > 0 && !bytes.Equal(rs[i-1].Limit, r.Start) {
+			t.Errorf("range %d: gap or overlap between %q and %q", i, rs[i-1].Limit, r.Start)
+		}
+		if r.Start != nil && string(t0.min.ukey()) != string(r.Start) {
+			t.Errorf("range %d: start %q, table min %q", i, r.Start, t0.min.ukey())
+		}
+		if r.Limit != nil && bytes.Compare(t0.max.ukey(), r.Limit) >= 0 {
+			t.Errorf("range %d: limit %q, table max %q", i, r.Limit, t0.max.ukey())
+		}
+		if i < len(tt)-1 && (t0.size < target || t0.size > target*5/4) {
+			t.Errorf("range %d: table size %d out of tolerance", i, t0.size)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		switch i % 10 {
+		case 0:
+			h.get(numKey(i), false)
+			h.getValr(s, numKey(i), value)
+		case 1:
+			h.getVal(numKey(i), "new")
+			h.getValr(s, numKey(i), value)
+		default:
+			h.getVal(numKey(i), value)
+		}
+	}
+}
+
+func TestDb_Has(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	has := func(r interface {
+		Has([]byte, *opt.ReadOptions) (bool, error)
+	}, key string, want bool) {
+		ret, err := r.Has([]byte(key), h.ro)
+		if err != nil {
+			t.Errorf("Has: key %q got error: %v", key, err)
+		} else if ret != want {
+			t.Errorf("Has: key %q got %v, want %v", key, ret, want)
+		}
+	}
+
+	h.put("foo", strings.Repeat("v", 100000))
+	h.put("bar", "v")
+	s := h.getSnapshot()
+	defer s.Release()
+	h.delete("bar")
+	h.put("baz", "v")
+
+	check := func() {
+		has(h.db, "foo", true)
+		has(h.db, "bar", false)
+		has(h.db, "baz", true)
+		has(h.db, "qux", false)
+		has(s, "bar", true)
+		has(s, "baz", false)
+	}
+	check()
+	h.compactMem()
+	check()
+	h.compactRange("", "")
+	check()
+
+	s.Release()
+	if _, err := s.Has([]byte("foo"), h.ro); err != errors.ErrSnapshotReleased {
+		t.Errorf("Has: released snapshot got error %v", err)
+	}
+}
+
+func TestDb_IteratorRange(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	for _, k := range []string{"a", "c", "e", "g"} {
+		h.put(k, "v"+k)
+	}
+	h.compactMem()
+	h.compactRange("", "")
+	for _, k := range []string{"b", "d"} {
+		h.put(k, "v"+k)
+	}
+	h.compactMem()
+	for _, k := range []string{"f", "h"} {
+		h.put(k, "v"+k)
+	}
+	h.delete("e")
+
+	scan := func(start, limit string) (fwd, bwd, seek string) {
+		ro := &opt.ReadOptions{}
+		if start != "" {
+			ro.Start = []byte(start)
+		}
+		if limit != "" {
+			ro.Limit = []byte(limit)
+		}
+		iter := h.db.NewIterator(ro)
+		for ok := iter.First(); ok; ok = iter.Next() {
+			fwd += string(iter.Key())
+		}
+		for ok := iter.Last(); ok; ok = iter.Prev() {
+			bwd += string(iter.Key())
+		}
+		for _, k := range []string{"", "a", "d", "z"} {
+			if iter.Seek([]byte(k)) {
+				seek += string(iter.Key())
+			} else {
+				seek += "-"
+			}
+		}
+		if err := iter.Error(); err != nil {
+			t.Error("iterator: got error: ", err)
+		}
+		return
+	}
+
+	for _, x := range []struct {
+		start, limit, fwd, bwd, seek string
+	}{
+		{"", "", "abcdfgh", "hgfdcba", "aad-"},
+		{"c", "g", "cdf", "fdc", "ccd-"},
+		{"b", "bb", "b", "b", "bb--"},
+		{"", "d", "abc", "cba", "aa--"},
+		{"e", "", "fgh", "hgf", "fff-"},
+		{"e", "f", "", "", "----"},
+		{"x", "a", "", "", "----"},
+	} {
+		fwd, bwd, seek := scan(x.start, x.limit)
+		if fwd != x.fwd || bwd != x.bwd || seek != x.seek {
+			t.Errorf("range [%q, %q): got (%q, %q, %q), want (%q, %q, %q)",
+				x.start, x.limit, fwd, bwd, seek, x.fwd, x.bwd, x.seek)
+		}
+	}
+}
+
+func TestDb_PrefixIterator(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	for _, k := range []string{"a", "ab", "abc", "abd", "ac", "b", "\xff", "\xff\xff", "\xff\xff\x01"} {
+		h.put(k, "v")
+	}
+	h.compactMem()
+	h.put("ab\xff", "v")
+	h.put("abz", "v")
+
+	scan := func(prefix string, ro *opt.ReadOptions) (fwd, bwd string) {
+		iter := h.db.NewPrefixIterator([]byte(prefix), ro)
+		for ok := iter.First(); ok; ok = iter.Next() {
+			fwd += fmt.Sprintf("%q ", iter.Key())
+		}
+		for ok := iter.Last(); ok; ok = iter.Prev() {
+			bwd = fmt.Sprintf("%q ", iter.Key()) + bwd
+		}
+		if err := iter.Error(); err != nil {
+			t.Error("iterator: got error: ", err)
+		}
+		return
+	}
+
+	for _, x := range []struct {
+		prefix string
+		ro     *opt.ReadOptions
+		want   string
+	}{
+		{"ab", nil, `"ab" "abc" "abd" "abz" "ab\xff" `},
+		{"abc", nil, `"abc" `},
+		{"abe", nil, ``},
+		{"ab\xff", nil, `"ab\xff" `},
+		{"\xff", nil, `"\xff" "\xff\xff" "\xff\xff\x01" `},
+		{"\xff\xff", nil, `"\xff\xff" "\xff\xff\x01" `},
+		{"", nil, `"a" "ab" "abc" "abd" "abz" "ab\xff" "ac" "b" "\xff" "\xff\xff" "\xff\xff\x01" `},
+		{"ab", &opt.ReadOptions{Start: []byte("abd"), Limit: []byte("b")}, `"abd" "abz" "ab\xff" `},
+	} {
+		fwd, bwd := scan(x.prefix, x.ro)
+		if fwd != x.want || bwd != x.want {
+			t.Errorf("prefix %q: got (%s, %s), want %s", x.prefix, fwd, bwd, x.want)
+		}
+	}
+}
+
+func TestDb_GetSnapshotAt(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("foo", "v1")
+	s := h.getSnapshot()
+	seq := s.Sequence()
+	h.put("foo", "v2")
+	latest := h.getSnapshot()
+	s.Release()
+	if x := s.Sequence(); x != 0 {
+		t.Errorf("Sequence: released snapshot got %d", x)
+	}
+
+	// The latest snapshot doesn't retain older seq numbers, but nothing
+	// has been compacted yet.
+	s, err := h.db.GetSnapshotAt(seq)
+	if err != nil {
+		t.Fatal("GetSnapshotAt: got error: ", err)
+	}
+	if x := s.Sequence(); x != seq {
+		t.Errorf("Sequence: got %d, want %d", x, seq)
+	}
+	h.put("foo", "v3")
+	h.compactMem()
+	h.compactRange("", "")
+	h.getValr(s, "foo", "v1")
+	h.getValr(latest, "foo", "v2")
+	h.getVal("foo", "v3")
+
+	// Retained by the pinned snapshot.
+	s2, err := h.db.GetSnapshotAt(seq)
+	if err != nil {
+		t.Fatal("GetSnapshotAt: got error: ", err)
+	}
+	h.getValr(s2, "foo", "v1")
+	s2.Release()
+	s.Release()
+	latest.Release()
+
+	h.put("foo", "v4")
+	h.compactMem()
+	h.compactRange("", "")
+	if _, err := h.db.GetSnapshotAt(seq); err != errors.ErrSnapshotNotRetained {
+		t.Errorf("GetSnapshotAt: compacted seq got error %v", err)
+	}
+	if _, err := h.db.GetSnapshotAt(h.db.getSeq() + 1); err == nil {
+		t.Error("GetSnapshotAt: future seq accepted")
+	}
+
+	h.reopenDB()
+	if _, err := h.db.GetSnapshotAt(h.db.getSeq() - 1); err != errors.ErrSnapshotNotRetained {
+		t.Errorf("GetSnapshotAt: seq of previous session got error %v", err)
+	}
+	s, err = h.db.GetSnapshotAt(h.db.getSeq())
+	if err != nil {
+		t.Fatal("GetSnapshotAt: got error: ", err)
+	}
+	h.getValr(s, "foo", "v4")
+	s.Release()
+}
+
+func TestDb_MultiGet(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	for i := 0; i < 100; i++ {
+		h.put(numKey(i), fmt.Sprintf("v%d", i))
+		if i%30 == 29 {
+			h.compactMem()
+		}
+	}
+	h.compactRangeAt(0, "", "")
+	h.delete(numKey(5))
+	h.put(numKey(6), "new")
+
+	keys := [][]byte{
+		[]byte(numKey(99)), []byte(numKey(5)), []byte("missing"),
+		[]byte(numKey(0)), []byte(numKey(6)), []byte(numKey(50)), []byte(numKey(0)),
+	}
+	values, errs := h.db.MultiGet(keys, h.ro)
+	if len(values) != len(keys) || len(errs) != len(keys) {
+		t.Fatalf("MultiGet: got %d values and %d errors for %d keys", len(values), len(errs), len(keys))
+	}
+	for i, key := range keys {
+		want, wantErr := h.db.Get(key, h.ro)
+		if errs[i] != wantErr || string(values[i]) != string(want) {
+			t.Errorf("MultiGet: key %q got (%q, %v), want (%q, %v)", key, values[i], errs[i], want, wantErr)
+		}
+	}
+	if errs[1] != errors.ErrNotFound || values[1] != nil {
+		t.Errorf("MultiGet: deleted key got (%q, %v)", values[1], errs[1])
+	}
+
+	if values, errs := h.db.MultiGet(nil, h.ro); len(values) != 0 || len(errs) != 0 {
+		t.Error("MultiGet: non-empty result for no keys")
+	}
+}
+
+// appendMerger join merge operands to the existing value with commas.
+type appendMerger struct{}
+
+func (appendMerger) Merge(key, existing, operand []byte) ([]byte, bool) {
+	if string(operand) == "bad" {
+		return nil, false
+	}
+	if existing == nil {
+		return append([]byte{}, operand...), true
+	}
+	v := append([]byte{}, existing...)
+	v = append(v, ',')
+	return append(v, operand...), true
+}
+
+func TestDb_Merge(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{Merger: appendMerger{}})
+	defer h.close()
+
+	merge := func(key, operand string) {
+		if err := h.db.Merge([]byte(key), []byte(operand), h.wo); err != nil {
+			t.Error("Merge: got error: ", err)
+		}
+	}
+
+	merge("a", "1")
+	merge("a", "2")
+	h.put("b", "x")
+	merge("b", "y")
+	h.put("c", "v")
+	merge("d", "1")
+	h.delete("d")
+	merge("d", "2")
+	h.getVal("a", "1,2")
+	h.getVal("b", "x,y")
+	h.getVal("d", "2")
+	h.getKeyVal("(a->1,2)(b->x,y)(c->v)(d->2)")
+
+	snap := h.getSnapshot()
+	iter := snap.NewIterator(h.ro)
+	var res string
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		res += fmt.Sprintf("(%s->%s)", iter.Key(), iter.Value())
+	}
+	if want := "(d->2)(c->v)(b->x,y)(a->1,2)"; res != want {
+		t.Errorf("Prev: got %q, want %q", res, want)
+	}
+	if !iter.Seek([]byte("a")) || !iter.Next() || string(iter.Key()) != "b" ||
+		!iter.Prev() || string(iter.Key()) != "a" || string(iter.Value()) != "1,2" {
+		t.Error("Seek/Next/Prev: got wrong entry across merged keys")
+	}
+	snap.Release()
+
+	s := h.getSnapshot()
+	merge("a", "3")
+	h.compactMem()
+	h.getVal("a", "1,2,3")
+	h.getValr(s, "a", "1,2")
+	h.allEntriesFor("a", "[ +3, 1,2 ]")
+	s.Release()
+
+	// Operands are collapsed once no snapshot need them
+	merge("a", "4")
+	h.compactMem()
+	h.compactRange("", "")
+	h.allEntriesFor("a", "[ 1,2,3,4 ]")
+	h.allEntriesFor("b", "[ x,y ]")
+	h.getVal("a", "1,2,3,4")
+
+	merge("a", "5")
+	h.reopenDB()
+	h.getVal("a", "1,2,3,4,5")
+
+	merge("e", "bad")
+	if _, err := h.db.Get([]byte("e"), h.ro); err == nil {
+		t.Error("Get: failed merge got no error")
+	}
+	h.compactMem()
+	h.allEntriesFor("e", "[ +bad ]")
+
+	h.closeDB()
+	h.o = &opt.Options{}
+	h.openDB()
+	if err := h.db.Merge([]byte("a"), []byte("6"), h.wo); err == nil {
+		t.Error("Merge: got no error without merger")
+	}
+	if _, err := h.db.Get([]byte("e"), h.ro); err == nil {
+		t.Error("Get: merge operand without merger got no error")
+	}
+}
+
+func TestDb_DeleteRange(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	deleteRange := func(start, limit string) {
+		if err := h.db.DeleteRange([]byte(start), []byte(limit), h.wo); err != nil {
+			t.Error("DeleteRange: got error: ", err)
+		}
+	}
+	prev := func(db Reader, want string) {
+		iter := db.NewIterator(h.ro)
+		var res string
+		for ok := iter.Last(); ok; ok = iter.Prev() {
+			res += fmt.Sprintf("(%s->%s)", iter.Key(), iter.Value())
+		}
+		if res != want {
+			t.Errorf("Prev: got %q, want %q", res, want)
+		}
+	}
+
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		h.put(k, "v"+k)
+	}
+	s := h.getSnapshot()
+	deleteRange("b", "d")
+	deleteRange("x", "a")
+	h.getVal("a", "va")
+	h.get("b", false)
+	h.get("c", false)
+	h.getVal("d", "vd")
+	h.getKeyVal("(a->va)(d->vd)(e->ve)")
+	s2 := h.getSnapshot()
+	prev(s2, "(e->ve)(d->vd)(a->va)")
+	s2.Release()
+	h.getValr(s, "b", "vb")
+
+	// Entries written afterwards are kept
+	h.put("c", "vc2")
+	h.getVal("c", "vc2")
+	h.getKeyVal("(a->va)(c->vc2)(d->vd)(e->ve)")
+
+	b := new(Batch)
+	b.DeleteRange([]byte("c"), []byte("e"))
+	r := h.db.NewOverlayReader(b, h.ro)
+	h.getValr(r, "a", "va")
+	h.getValr(r, "e", "ve")
+	if _, err := r.Get([]byte("d"), h.ro); err != errors.ErrNotFound {
+		t.Error("Overlay: got covered entry, err: ", err)
+	}
+	prev(r, "(e->ve)(a->va)")
+
+	h.reopenDB()
+	h.getKeyVal("(a->va)(c->vc2)(d->vd)(e->ve)")
+	h.compactMem()
+	h.getKeyVal("(a->va)(c->vc2)(d->vd)(e->ve)")
+	h.reopenDB()
+	h.getKeyVal("(a->va)(c->vc2)(d->vd)(e->ve)")
+	s2 = h.getSnapshot()
+	prev(s2, "(e->ve)(d->vd)(c->vc2)(a->va)")
+	s2.Release()
+
+	// Tombstones are dropped once no table holds entries they cover
+	s.Release()
+	h.compactRange("", "")
+	h.allEntriesFor("b", "[ ]")
+	h.allEntriesFor("c", "[ vc2 ]")
+	h.getKeyVal("(a->va)(c->vc2)(d->vd)(e->ve)")
+	if n := len(h.db.s.version().rdels); n != 0 {
+		t.Errorf("got %d range tombstones after compaction, want 0", n)
+	}
+}
+
+func TestDb_ReadOnly(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("a", "va")
+	h.put("b", "vb")
+	h.compactMem()
+	h.put("b", "vb2")
+	h.put("c", "vc")
+	h.delete("a")
+	h.closeDB()
+
+	nfiles := len(h.stor.GetFiles(storage.TypeAll))
+
+	h.o = &opt.Options{Flag: opt.OFReadOnly}
+	h.openDB()
+	h.get("a", false)
+	h.getVal("b", "vb2")
+	h.getVal("c", "vc")
+	h.getKeyVal("(b->vb2)(c->vc)")
+
+	snap := h.getSnapshot()
+	h.getValr(snap, "b", "vb2")
+	snap.Release()
+
+	if err := h.db.Put([]byte("d"), []byte("vd"), h.wo); err != errors.ErrReadOnly {
+		t.Error("Put: got error: ", err)
+	}
+	if err := h.db.Delete([]byte("b"), h.wo); err != errors.ErrReadOnly {
+		t.Error("Delete: got error: ", err)
+	}
+	b := new(Batch)
+	b.Put([]byte("d"), []byte("vd"))
+	if err := h.db.Write(b, h.wo); err != errors.ErrReadOnly {
+		t.Error("Write: got error: ", err)
+	}
+	if err := h.db.CompactRange(Range{}); err != errors.ErrReadOnly {
+		t.Error("CompactRange: got error: ", err)
+	}
+	if err := h.oo.ClearFlag(opt.OFReadOnly); err != opt.ErrNotAllowed {
+		t.Error("ClearFlag: got error: ", err)
+	}
+	h.get("d", false)
+
+	h.closeDB()
+
+	if n := len(h.stor.GetFiles(storage.TypeAll)); n != nfiles {
+		t.Errorf("got %d files after read-only session, want %d", n, nfiles)
+	}
+
+	h.o = &opt.Options{}
+	h.openDB()
+	h.getKeyVal("(b->vb2)(c->vc)")
+}
+
+func TestDb_GetStats(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("a", "va")
+	h.put("z", "vz")
+	h.compactMem()
+	h.put("a", "va2")
+	h.put("z", "vz2")
+	h.compactMem()
+	h.tablesPerLevel("0,1,1")
+
+	stats, err := h.db.GetStats()
+	if err != nil {
+		t.Fatal("GetStats: got error: ", err)
+	}
+	v := h.db.s.version()
+	for level, tt := range v.tables {
+		if stats.LevelTables[level] != len(tt) || stats.LevelSizes[level] != tt.size() {
+			t.Errorf("level %d: got tables=%d size=%d, want tables=%d size=%d",
+				level, stats.LevelTables[level], stats.LevelSizes[level], len(tt), tt.size())
+		}
+	}
+	if stats.LevelWrite[1] == 0 || stats.LevelWrite[2] == 0 {
+		t.Errorf("got zero bytes written by mem compactions: %v", stats.LevelWrite)
+	}
+
+	// Missing keys within range of both tables trigger a seek compaction
+	for i := 0; i < 1000; i++ {
+		h.get("m", false)
+	}
+	var seeks uint64
+	for i := 0; i < 100 && seeks == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if stats, err = h.db.GetStats(); err != nil {
+			t.Fatal("GetStats: got error: ", err)
+		}
+		seeks = 0
+		for _, n := range stats.LevelSeekCompactions {
+			seeks += n
+		}
+	}
+	if seeks == 0 {
+		t.Error("got no seek-triggered compaction")
+	}
+	if stats.LevelSeekCompactions[2] != seeks {
+		t.Errorf("got seek compactions %v, want all at level 2", stats.LevelSeekCompactions)
+	}
+	h.getVal("a", "va2")
+}
+
+func TestDb_SeekCompactionOptions(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		Flag:                       opt.OFDisableSeekCompaction,
+		SeekCompactionBytesPerSeek: 1,
+	})
+	defer h.close()
+
+	h.put("a", strings.Repeat("v", 200))
+	h.put("z", "vz")
+	h.compactMem()
+	h.put("a", "va2")
+	h.put("z", "vz2")
+	h.compactMem()
+	h.tablesPerLevel("0,1,1")
+
+	for _, tt := range h.db.s.version().tables {
+		for _, f := range tt {
+			want := int32(f.size)
+			if want < 100 {
+				want = 100
+			}
+			if f.seekLeft != want {
+				t.Errorf("table %d: got %d seeks allowed, want %d", f.file.Num(), f.seekLeft, want)
+			}
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		h.get("m", false)
+	}
+	time.Sleep(50 * time.Millisecond)
+	stats, err := h.db.GetStats()
+	if err != nil {
+		t.Fatal("GetStats: got error: ", err)
+	}
+	for level, n := range stats.LevelSeekCompactions {
+		if n != 0 {
+			t.Errorf("level %d: got %d seek compactions while disabled", level, n)
+		}
+	}
+	h.tablesPerLevel("0,1,1")
+}
+
+func TestDb_TieredCompaction(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		CompactionStyle:    opt.TieredCompaction,
+		MaxMemCompactLevel: -1,
+	})
+	defer h.close()
+
+	// Each flush overwrites the previous one and deletes a key.
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 10; j++ {
+			h.put(numKey(j), fmt.Sprintf("v%d", i))
+		}
+		h.delete(numKey(i))
+		h.compactMem()
+	}
+	h.tablesPerLevel("1")
+	stats, err := h.db.GetStats()
+	if err != nil {
+		t.Fatal("GetStats: got error: ", err)
+	}
+	if stats.LevelWrite[0] == 0 || stats.LevelRead[0] == 0 {
+		t.Errorf("got no level-0 compaction: read=%v write=%v", stats.LevelRead, stats.LevelWrite)
+	}
+
+	check := func() {
+		h.get(numKey(3), false)
+		for j := 4; j < 10; j++ {
+			h.getVal(numKey(j), "v3")
+		}
+		h.getVal(numKey(0), "v3")
+	}
+	check()
+
+	// Newer tables are looked up before the merged one.
+	h.put(numKey(5), "v4")
+	h.compactMem()
+	h.tablesPerLevel("2")
+	h.getVal(numKey(5), "v4")
+	h.reopenDB()
+	h.getVal(numKey(5), "v4")
+	h.getVal(numKey(6), "v3")
+
+	// Leveled style pushes level-0 tables down.
+	h.oo.SetCompactionStyle(opt.LeveledCompaction)
+	for i := 0; i < 4; i++ {
+		h.put(numKey(20+i), "v")
+		h.compactMem()
+	}
+	if v := h.db.s.version(); v.tLen(0) >= 4 || v.tLen(1) == 0 {
+		t.Errorf("got %d level-0 and %d level-1 tables with leveled compaction", v.tLen(0), v.tLen(1))
+	}
+	h.getVal(numKey(5), "v4")
+	h.get(numKey(3), false)
+}
+
+func TestDb_GetStatsEntries(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	sum := func() (entries, dels uint64) {
+		stats, err := h.db.GetStats()
+		if err != nil {
+			t.Fatal("GetStats: got error: ", err)
+		}
+		for level := range stats.LevelEntries {
+			entries += stats.LevelEntries[level]
+			dels += stats.LevelDeletions[level]
+		}
+		return
+	}
+
+	for i := 0; i < 10; i++ {
+		h.put(numKey(i), "v")
+	}
+	h.compactMem()
+	for i := 0; i < 3; i++ {
+		h.delete(numKey(i))
+	}
+	h.compactMem()
+	if entries, dels := sum(); entries != 13 || dels != 3 {
+		t.Errorf("got %d entries, %d deletions; want 13, 3", entries, dels)
+	}
+
+	// Counts are read from the tables once reopened.
+	h.reopenDB()
+	if entries, dels := sum(); entries != 13 || dels != 3 {
+		t.Errorf("after reopen: got %d entries, %d deletions; want 13, 3", entries, dels)
+	}
+
+	h.compactRange("", "")
+	if entries, dels := sum(); entries != 7 || dels != 0 {
+		t.Errorf("after compaction: got %d entries, %d deletions; want 7, 0", entries, dels)
+	}
+}
+
+func TestDb_NoWAL(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	journalSize := func() (n uint64) {
+		for _, f := range h.stor.GetFiles(storage.TypeJournal) {
+			size, err := f.Size()
+			if err != nil {
+				t.Fatal("Size: got error: ", err)
+			}
+			n += size
+		}
+		return
+	}
+
+	h.put("a", "va")
+	size := journalSize()
+
+	wo := &opt.WriteOptions{Flag: opt.WFNoWAL}
+	for i := 0; i < 100; i++ {
+		if err := h.db.Put([]byte(fmt.Sprintf("k%03d", i)), []byte("v"), wo); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+	if n := journalSize(); n != size {
+		t.Errorf("journal grown by writes without journal, got=%d want=%d", n, size)
+	}
+	h.getVal("k000", "v")
+	h.getVal("k099", "v")
+
+	wo.Flag |= opt.WFSync
+	if err := h.db.Put([]byte("b"), []byte("vb"), wo); err == nil {
+		t.Error("Put: WFSync with WFNoWAL got no error")
+	}
+	h.get("b", false)
+
+	// Flushed on close
+	h.reopenDB()
+	h.getVal("a", "va")
+	h.getVal("k050", "v")
+	h.put("k050", "v2")
+	h.reopenDB()
+	h.getVal("k050", "v2")
+}
+
+func TestDb_WriteSyncJournal(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	put := func(key string, wo *opt.WriteOptions, errc chan error) {
+		errc <- h.db.Put([]byte(key), []byte("v"+key), wo)
+	}
+	wo := &opt.WriteOptions{Flag: opt.WFSync}
+	errc := make(chan error, 3)
+
+	h.stor.DelaySync(storage.TypeJournal)
+	go put("a", wo, errc)
+	select {
+	case err := <-errc:
+		t.Fatal("Put: returned before journal is synced, err: ", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Writers queued meanwhile may be committed together, the group
+	// returns only after the combined record is synced
+	go put("b", h.wo, errc)
+	go put("c", wo, errc)
+	select {
+	case err := <-errc:
+		t.Fatal("Put: returned before journal is synced, err: ", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	h.stor.ReleaseSync(storage.TypeJournal)
+	for i := 0; i < 3; i++ {
+		if err := <-errc; err != nil {
+			t.Error("Put: got error: ", err)
+		}
+	}
+
+	// emulate power loss
+	h.closeDB()
+	h.stor.DropUnsynced(storage.TypeJournal)
+	h.openDB()
+	h.getVal("a", "va")
+	h.getVal("c", "vc")
+}
+
+func TestDb_WriteAsync(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	const n = 100
+	var mu sync.Mutex
+	var order []int
+	done := make(chan struct{})
+	h.stor.DelaySync(storage.TypeJournal)
+	for i := 0; i < n; i++ {
+		b := new(Batch)
+		b.Put([]byte(numKey(i)), []byte(fmt.Sprint(i)))
+		wo := h.wo
+		if i == n/2 {
+			wo = &opt.WriteOptions{Flag: opt.WFSync}
+		}
+		i := i
+		h.db.WriteAsync(b, wo, func(err error) {
+			if err != nil {
+				t.Errorf("write %d: got error: %v", i, err)
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			if i == n-1 {
+				close(done)
+			}
+		})
+	}
+
+	// callbacks past the synced write wait for the sync
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	if len(order) != n/2 {
+		t.Errorf("got %d callbacks before journal is synced, want %d", len(order), n/2)
+	}
+	mu.Unlock()
+	h.stor.ReleaseSync(storage.TypeJournal)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for async writes")
+	}
+	for i, x := range order {
+		if x != i {
+			t.Fatalf("callbacks out of order: %v", order)
+		}
+	}
+	for i := 0; i < n; i++ {
+		h.getVal(numKey(i), fmt.Sprint(i))
+	}
+
+	h.closeDB()
+	errc := make(chan error, 1)
+	b := new(Batch)
+	b.Put([]byte("a"), []byte("v"))
+	h.db.WriteAsync(b, h.wo, func(err error) { errc <- err })
+	if err := <-errc; err != errors.ErrClosed {
+		t.Errorf("write on closed DB: got error %v, want ErrClosed", err)
+	}
+	h.openDB()
+}
+
+func TestDb_RotateWAL(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	// An empty journal holds only the version marker.
+	empty := h.db.WALSize()
+	h.put("a", "va")
+	n := h.db.WALSize()
+	if n <= empty {
+		t.Errorf("WALSize: got %d after write, empty journal is %d", n, empty)
+	}
+	h.put("b", "vb")
+	if x := h.db.WALSize(); x <= n {
+		t.Errorf("WALSize: got %d, want more than %d", x, n)
+	}
+	journals := h.stor.GetFiles(storage.TypeJournal)
+
+	if err := h.db.RotateWAL(); err != nil {
+		t.Fatal("RotateWAL: got error: ", err)
+	}
+	if n := h.db.WALSize(); n != empty {
+		t.Errorf("WALSize: got %d after rotation, want %d", n, empty)
+	}
+	if h.totalTables() != 1 {
+		t.Errorf("expect the memdb flushed into a table, got %d tables", h.totalTables())
+	}
+	for _, f := range journals {
+		if f.Exist() {
+			t.Errorf("journal %d not removed after rotation", f.Num())
+		}
+	}
+	h.put("c", "vc")
+
+	h.reopenDB()
+	h.getVal("a", "va")
+	h.getVal("b", "vb")
+	h.getVal("c", "vc")
+}
+
+func TestDb_WALSyncInterval(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{WALSyncInterval: 5 * time.Millisecond})
+	defer h.close()
+
+	if err := h.oo.SetWALSyncInterval(time.Second); err != opt.ErrNotAllowed {
+		t.Errorf("SetWALSyncInterval: got error %v, want ErrNotAllowed", err)
+	}
+
+	h.put("a", "va")
+	h.put("b", "vb")
+	seq := h.db.getSeq()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.db.WaitForDurable(ctx, seq); err != nil {
+		t.Fatal("WaitForDurable: got error: ", err)
+	}
+
+	// A write made while the sync is delayed is not durable.
+	h.stor.DelaySync(storage.TypeJournal)
+	h.put("c", "vc")
+	time.Sleep(20 * time.Millisecond)
+	if x := h.db.DurableSequence(); x != seq {
+		t.Errorf("DurableSequence: got %d, want %d", x, seq)
+	}
+	h.stor.ReleaseSync(storage.TypeJournal)
+
+	// emulate power loss
+	h.closeDB()
+	h.stor.DropUnsynced(storage.TypeJournal)
+	h.openDB()
+	h.getVal("a", "va")
+	h.getVal("b", "vb")
+}
+
+func TestDb_L0Triggers(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		MaxMemCompactLevel:  -1,
+		CompactionL0Trigger: 100,
+	})
+	defer h.close()
+
+	for i := 0; i < 2*opt.DefaultCompactionL0Trigger; i++ {
+		h.put("a", fmt.Sprintf("v%d", i))
+		h.put("z", fmt.Sprintf("v%d", i))
+		h.compactMem()
+	}
+	h.tablesPerLevel(fmt.Sprint(2 * opt.DefaultCompactionL0Trigger))
+
+	if err := h.oo.SetCompactionL0Trigger(0); err != opt.ErrInvalid {
+		t.Error("SetCompactionL0Trigger: got error: ", err)
+	}
+	if err := h.oo.SetCompactionL0Trigger(2); err != nil {
+		t.Fatal("SetCompactionL0Trigger: got error: ", err)
+	}
+	h.put("a", "va")
+	h.compactMem()
+	if n := h.db.s.version().tLen(0); n >= 2 {
+		t.Errorf("level-0 not compacted, got %d tables", n)
+	}
+	h.getVal("a", "va")
+}
+
+func TestDb_OnWriteStall(t *testing.T) {
+	type stall struct {
+		reason   string
+		l0Tables int
+		dur      time.Duration
+	}
+	stallc := make(chan stall, 10)
+	h := newDbHarnessWopt(t, &opt.Options{
+		WriteBuffer:            10000,
+		MaxMemCompactLevel:     -1,
+		CompactionL0Trigger:    100,
+		WriteL0SlowdownTrigger: 1,
+		OnWriteStall: func(reason string, l0Tables int, dur time.Duration) {
+			stallc <- stall{reason, l0Tables, dur}
+		},
+	})
+	defer h.close()
+
+	h.put("a", "va")
+	h.compactMem()
+	h.put("b", "vb")
+	select {
+	case st := <-stallc:
+		if st.reason != opt.WriteStallL0Slowdown || st.l0Tables != 1 || st.dur <= 0 {
+			t.Errorf("got stall %+v, want %s with 1 level-0 table", st, opt.WriteStallL0Slowdown)
+		}
+	default:
+		t.Fatal("got no slowdown stall")
+	}
+
+	// Writes are paused once mem is full, until the trigger is raised
+	if err := h.oo.SetWriteL0PauseTrigger(1); err != nil {
+		t.Fatal("SetWriteL0PauseTrigger: got error: ", err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		h.oo.SetWriteL0PauseTrigger(100)
+	}()
+	value := strings.Repeat("v", 20000)
+	h.put("c", value)
+	h.put("d", "vd")
+	var paused bool
+	for len(stallc) > 0 {
+		st := <-stallc
+		if st.reason == opt.WriteStallL0Pause {
+			paused = true
+			if st.l0Tables != 1 || st.dur < 10*time.Millisecond {
+				t.Errorf("got stall %+v, want paused for a while with 1 level-0 table", st)
+			}
+		}
+	}
+	if !paused {
+		t.Error("got no pause stall")
+	}
+	h.getVal("c", value)
+}
+
+func TestDb_NumLevels(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{NumLevels: 3})
+	defer h.close()
+
+	// Flushed mem is pushed at most to the last level
+	h.put("foo", "v1")
+	h.compactMem()
+	h.tablesPerLevel("0,0,1")
+	if err := h.oo.SetNumLevels(5); err != opt.ErrNotAllowed {
+		t.Error("SetNumLevels: got error: ", err)
+	}
+	stats, err := h.db.GetStats()
+	if err != nil {
+		t.Fatal("GetStats: got error: ", err)
+	}
+	if n := len(stats.LevelTables); n != 3 {
+		t.Errorf("GetStats: got %d levels, want 3", n)
+	}
+
+	h.reopenDB()
+	h.getVal("foo", "v1")
+	h.tablesPerLevel("0,0,1")
+	h.closeDB()
+
+	for _, n := range []int{0, 2, opt.DefaultNumLevels} {
+		h.o.NumLevels = n
+		_, err := Open(h.stor, h.o)
+		if _, ok := err.(errors.ErrInvalid); !ok {
+			t.Errorf("Open with %d levels: got error %v, want invalid", n, err)
+		}
+	}
+	h.o.NumLevels = 3
+	h.openDB()
+
+	// A database created with the default number of levels must not be
+	// opened with another number of levels
+	h2 := newDbHarness(t)
+	defer h2.close()
+	h2.put("foo", "v1")
+	h2.closeDB()
+	h2.o.NumLevels = 5
+	if _, err := Open(h2.stor, h2.o); err == nil {
+		t.Error("Open with 5 levels: expecting error")
+	}
+	h2.o.NumLevels = 0
+	h2.openDB()
+	h2.getVal("foo", "v1")
+}
+
+func TestDb_Flush(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	if err := h.db.Flush(); err != nil {
+		t.Fatal("Flush: got error: ", err)
+	}
+	if n := h.totalTables(); n != 0 {
+		t.Errorf("Flush of empty memdb created %d tables", n)
+	}
+
+	h.put("foo", "v1")
+	h.put("bar", "v2")
+	if err := h.db.Flush(); err != nil {
+		t.Fatal("Flush: got error: ", err)
+	}
+	if n := h.totalTables(); n != 1 {
+		t.Errorf("got %d tables after flush, want 1", n)
+	}
+	if mem := h.db.getMem(); mem.cur.Len() != 0 || mem.froze != nil {
+		t.Error("memdb not empty after flush")
+	}
+	if err := h.db.Flush(); err != nil {
+		t.Fatal("Flush: got error: ", err)
+	}
+	if n := h.totalTables(); n != 1 {
+		t.Errorf("got %d tables after second flush, want 1", n)
+	}
+
+	h.reopenDB()
+	h.getVal("foo", "v1")
+	h.getVal("bar", "v2")
+}
+
+func TestDb_CompactRangeAt(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{MaxMemCompactLevel: -1})
+	defer h.close()
+
+	h.put("a", "va")
+	h.compactMem()
+	h.put("z", "vz")
+	h.compactMem()
+	h.tablesPerLevel("2")
+
+	if err := h.db.CompactRangeAt(0, Range{}); err != nil {
+		t.Fatal("CompactRangeAt: got error: ", err)
+	}
+	h.tablesPerLevel("0,1")
+	if err := h.db.CompactRangeAt(1, Range{Start: []byte("zz")}); err != nil {
+		t.Fatal("CompactRangeAt: got error: ", err)
+	}
+	h.tablesPerLevel("0,1")
+	if err := h.db.CompactRangeAt(1, Range{Limit: []byte("b")}); err != nil {
+		t.Fatal("CompactRangeAt: got error: ", err)
+	}
+	h.tablesPerLevel("0,0,1")
+
+	for _, level := range []int{-1, opt.DefaultNumLevels - 1, opt.DefaultNumLevels} {
+		if _, ok := h.db.CompactRangeAt(level, Range{}).(errors.ErrInvalid); !ok {
+			t.Errorf("CompactRangeAt: level %d: expecting invalid error", level)
+		}
+	}
+	h.getVal("a", "va")
+	h.getVal("z", "vz")
+}
+
+func TestDb_CompactRangeAsync(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{MaxMemCompactLevel: -1})
+	defer h.close()
+
+	h.put("a", "va")
+	h.compactMem()
+	h.put("z", "vz")
+	h.compactMem()
+	h.tablesPerLevel("2")
+
+	var dones []<-chan error
+	for i := 0; i < 3; i++ {
+		done, err := h.db.CompactRangeAsync(Range{})
+		if err != nil {
+			t.Fatal("CompactRangeAsync: got error: ", err)
+		}
+		dones = append(dones, done)
+	}
+	for _, done := range dones {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error("CompactRangeAsync: got error: ", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("CompactRangeAsync: timeout")
+		}
+	}
+	h.tablesPerLevel("0,1")
+	h.getVal("a", "va")
+
+	// Pending compactions must be answered once closed
+	h.put("b", "vb")
+	h.compactMem()
+	done, err := h.db.CompactRangeAsync(Range{})
+	if err != nil {
+		t.Fatal("CompactRangeAsync: got error: ", err)
+	}
+	h.closeDB()
+	select {
+	case err := <-done:
+		if err != nil && err != errors.ErrClosed {
+			t.Error("CompactRangeAsync: got error: ", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("CompactRangeAsync: no result after close")
+	}
+	if _, err := h.db.CompactRangeAsync(Range{}); err != errors.ErrClosed {
+		t.Error("CompactRangeAsync: got error: ", err, ", want ErrClosed")
+	}
+	h.openDB()
+}
+
+func TestDb_GetApproximateMemSize(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	if n := h.db.GetApproximateMemSize(); n != 0 {
+		t.Errorf("got mem size %d on empty database", n)
+	}
+
+	value := strings.Repeat("v", 1000)
+	for i := 0; i < 10; i++ {
+		h.put(numKey(i), value)
+	}
+	size := h.db.GetApproximateMemSize()
+	if size < 10*1000 || size > 11*1000 {
+		t.Errorf("got mem size %d, want around %d", size, 10*1000)
+	}
+
+	// Frozen memdb is accounted until flushed
+	if _, err := h.db.newMem(); err != nil {
+		t.Fatal("newMem: got error: ", err)
+	}
+	if n := h.db.GetApproximateMemSize(); n != size {
+		t.Errorf("got mem size %d with frozen memdb, want %d", n, size)
+	}
+	h.put("foo", "bar")
+	if n := h.db.GetApproximateMemSize(); n <= size {
+		t.Errorf("got mem size %d, want more than %d", n, size)
+	}
+	if err := h.db.Flush(); err != nil {
+		t.Fatal("Flush: got error: ", err)
+	}
+	if n := h.db.GetApproximateMemSize(); n != 0 {
+		t.Errorf("got mem size %d after flush", n)
+	}
+}
+
+func TestDb_MixedCompression(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{CompressionType: opt.SnappyCompression})
+	defer h.close()
+
+	value := strings.Repeat("v", 1000)
+	h.put("a", value)
+	h.compactMem()
+	if err := h.oo.SetCompressionType(opt.NoCompression); err != nil {
+		t.Fatal("SetCompressionType: got error: ", err)
+	}
+	h.put("b", value)
+	h.compactMem()
+	if n := h.totalTables(); n != 2 {
+		t.Fatalf("got %d tables, want 2", n)
+	}
+
+	// Each block records its own compression type
+	h.o.CompressionType = opt.NoCompression
+	h.reopenDB()
+	h.getVal("a", value)
+	h.getVal("b", value)
+	h.o.CompressionType = opt.SnappyCompression
+	h.reopenDB()
+	h.getVal("a", value)
+	h.getVal("b", value)
+	h.compactRange("", "")
+	h.getVal("a", value)
+	h.getVal("b", value)
+}
+
+func TestDb_CompressionPerLevel(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		MaxMemCompactLevel:  -1,
+		CompressionPerLevel: []opt.Compression{opt.NoCompression, opt.DefaultCompression, opt.SnappyCompression},
+	})
+	defer h.close()
+
+	o := h.db.s.o
+	for level, want := range []opt.Compression{opt.NoCompression, opt.DefaultCompressionType, opt.SnappyCompression, opt.DefaultCompressionType} {
+		if got := o.GetLevelCompressionType(level); got != want {
+			t.Errorf("level %d: got compression %v, want %v", level, got, want)
+		}
+	}
+	if err := h.oo.SetCompressionType(opt.NoCompression); err != nil {
+		t.Fatal("SetCompressionType: got error: ", err)
+	}
+	if got := o.GetLevelCompressionType(3); got != opt.NoCompression {
+		t.Errorf("got compression %v beyond per-level slice, want %v", got, opt.NoCompression)
+	}
+
+	value := strings.Repeat("v", 1000)
+	h.put("a", value)
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.compactRangeAt(1, "", "")
+	h.put("b", value)
+	h.compactMem()
+	h.tablesPerLevel("1,0,1")
+	h.reopenDB()
+	h.getVal("a", value)
+	h.getVal("b", value)
+
+	if err := h.oo.SetCompressionPerLevel([]opt.Compression{100}); err != opt.ErrInvalid {
+		t.Error("SetCompressionPerLevel: got error: ", err)
+	}
+}
+
+func TestDb_FilterStats(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{Filter: filter.NewBloomFilter(10)})
+	defer h.close()
+
+	filterStats := func() (checks, absent, confirmed int) {
+		v, err := h.db.GetProperty("leveldb.filter-stats")
 		if err != nil {
-			t.Fatalf("(%d) cannot open db: %s", i, err)
+			t.Fatal("GetProperty: got error: ", err)
 		}
-		if err := db.Put([]byte("foo"), []byte("bar"), &opt.WriteOptions{}); err != nil {
-			t.Fatalf("(%d) cannot write to db: %s", i, err)
+		if _, err := fmt.Sscanf(v, "checks=%d predicted-absent=%d confirmed-absent=%d", &checks, &absent, &confirmed); err != nil {
+			t.Fatalf("invalid filter stats %q: %v", v, err)
 		}
-		if err := db.Close(); err != nil {
-			t.Fatalf("(%d) cannot close db: %s", i, err)
+		return
+	}
+
+	const n = 1000
+	key := func(i int) string {
+		return fmt.Sprintf("key%06d", i)
+	}
+	for i := 0; i < n; i++ {
+		h.put(key(i), "v")
+	}
+	h.compactMem()
+	if checks, _, _ := filterStats(); checks != 0 {
+		t.Errorf("got %d filter checks before lookups", checks)
+	}
+
+	for i := 0; i < n; i++ {
+		h.getVal(key(i), "v")
+	}
+	checks, absent, confirmed := filterStats()
+	if checks != n || absent != 0 || confirmed != 0 {
+		t.Errorf("present keys: got checks=%d predicted-absent=%d confirmed-absent=%d, want %d, 0, 0",
+			checks, absent, confirmed, n)
+	}
+
+	for i := 0; i < n-1; i++ {
+		h.get(key(i)+".missing", false)
+	}
+	checks, absent, confirmed = filterStats()
+	if checks != 2*n-1 || absent+confirmed != n-1 {
+		t.Errorf("missing keys: got checks=%d predicted-absent=%d confirmed-absent=%d",
+			checks, absent, confirmed)
+	}
+	if max := 2 * n / 100; confirmed > max {
+		t.Errorf("got %d false positives, want at most %d", confirmed, max)
+	}
+}
+
+func TestDb_JournalVersion(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("foo", "v1")
+	h.closeDB()
+
+	files := h.stor.GetFiles(storage.TypeJournal)
+	if len(files) != 1 {
+		t.Fatalf("got %d journals, want 1", len(files))
+	}
+	file := files[0]
+	r, err := newJournalReader(file, true, nil)
+	if err != nil {
+		t.Fatal("newJournalReader: got error: ", err)
+	}
+	if !r.journal.Next() {
+		t.Fatal("journal has no record: ", r.journal.Error())
+	}
+	if v := r.journal.Version(); v != journal.Version {
+		t.Errorf("journal version: got %d, want %d", v, journal.Version)
+	}
+	r.close()
+
+	// Bump the version marker, which is the first record, as a newer
+	// binary would.
+	rd, err := file.Open()
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	buf, err := ioutil.ReadAll(rd)
+	rd.Close()
+	if err != nil {
+		t.Fatal("ReadAll: got error: ", err)
+	}
+	rewrite := func(b []byte) {
+		w, err := file.Create()
+		if err != nil {
+			t.Fatal("Create: got error: ", err)
+		}
+		w.Write(b)
+		w.Close()
+	}
+	newer := append([]byte{}, buf...)
+	newer[7] = journal.Version + 1
+	crc := hash.NewCRC32C()
+	crc.Write(newer[6:8])
+	binary.LittleEndian.PutUint32(newer, hash.MaskCRC32(crc.Sum32()))
+	rewrite(newer)
+
+	_, err = Open(h.stor, h.o)
+	if _, ok := err.(*journal.ErrVersion); !ok {
+		t.Fatalf("open with newer journal: got error %v, want ErrVersion", err)
+	}
+
+	rewrite(buf)
+	h.openDB()
+	h.getVal("foo", "v1")
+}
+
+func TestDb_CompactManifest(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{MaxManifestSize: -1})
+	defer h.close()
+
+	manifest := func() (num, size uint64) {
+		files := h.stor.GetFiles(storage.TypeManifest)
+		if len(files) != 1 {
+			t.Fatalf("got %d manifests, want 1", len(files))
+		}
+		size, err := files[0].Size()
+		if err != nil {
+			t.Fatal("Size: got error: ", err)
+		}
+		return files[0].Num(), size
+	}
+
+	for i := 0; i < 50; i++ {
+		h.put(fmt.Sprintf("k%02d", i), "v")
+		h.compactMem()
+	}
+	num, size := manifest()
+
+	if err := h.db.CompactManifest(); err != nil {
+		t.Fatal("CompactManifest: got error: ", err)
+	}
+	num2, size2 := manifest()
+	if num2 <= num {
+		t.Errorf("manifest not rotated, num=%d was %d", num2, num)
+	}
+	if size2 >= size {
+		t.Errorf("rotated manifest not smaller, size=%d was %d", size2, size)
+	}
+	h.reopenDB()
+	h.getVal("k00", "v")
+	h.getVal("k49", "v")
+
+	// Automatic rotation.
+	num, _ = manifest()
+	h.oo.SetMaxManifestSize(1)
+	h.put("foo", "v1")
+	h.compactMem()
+	if num2, _ := manifest(); num2 <= num {
+		t.Errorf("manifest not rotated automatically, num=%d was %d", num2, num)
+	}
+	h.oo.SetMaxManifestSize(-1)
+
+	// A rotation interrupted before CURRENT was switched leaves a newer
+	// manifest behind.
+	h.closeDB()
+	num, _ = manifest()
+	w, err := h.stor.GetFile(num+100, storage.TypeManifest).Create()
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	w.Write([]byte("partial"))
+	w.Close()
+	h.openDB()
+	if num2, _ := manifest(); num2 <= num || num2 == num+100 {
+		t.Errorf("unexpected manifest after recovery, num=%d was %d", num2, num)
+	}
+	h.getVal("k49", "v")
+	h.getVal("foo", "v1")
+
+	h.closeDB()
+	h.o.Flag |= opt.OFReadOnly
+	h.openDB()
+	if err := h.db.CompactManifest(); err != errors.ErrReadOnly {
+		t.Errorf("CompactManifest: got error %v on read-only DB, want ErrReadOnly", err)
+	}
+}
+
+func TestDb_CompactManifestCrash(t *testing.T) {
+	open := func(fs *crashFS, o *opt.Options) (*storage.FSStorage, *DB) {
+		stor, err := storage.NewFSStorage(fs)
+		if err != nil {
+			t.Fatal("NewFSStorage: got error: ", err)
+		}
+		db, err := Open(stor, o)
+		if err != nil {
+			stor.Close()
+			t.Fatal("Open: got error: ", err)
+		}
+		return stor, db
+	}
+
+	// crash after each step of the rotation, until it is done
+	for n := 1; ; n++ {
+		fs := newCrashFS()
+		stor, db := open(fs, &opt.Options{Flag: opt.OFCreateIfMissing, MaxManifestSize: -1})
+		for i := 0; i < 10; i++ {
+			if err := db.Put([]byte(numKey(i)), []byte("v"), &opt.WriteOptions{}); err != nil {
+				t.Fatal("Put: got error: ", err)
+			}
+			if err := db.Flush(); err != nil {
+				t.Fatal("Flush: got error: ", err)
+			}
+		}
+		fs.crashAfter(n)
+		if err := db.CompactManifest(); err != nil {
+			t.Fatal("CompactManifest: got error: ", err)
+		}
+		image := fs.crashImage()
+		db.Close()
+		stor.Close()
+		if image == nil {
+			if n == 1 {
+				t.Fatal("CompactManifest did nothing")
+			}
+			break
+		}
+
+		stor, db = open(image, &opt.Options{MaxManifestSize: -1})
+		for i := 0; i < 10; i++ {
+			if v, err := db.Get([]byte(numKey(i)), nil); err != nil || string(v) != "v" {
+				t.Errorf("(%d) invalid value of key %d after crash, value=%q err=%v", n, i, v, err)
+			}
+		}
+		db.Close()
+		stor.Close()
+	}
+}
+
+func TestDb_CompactionRateLimit(t *testing.T) {
+	const rate = 40 << 10
+	h := newDbHarnessWopt(t, &opt.Options{
+		CompactionRateLimit: rate,
+		MaxMemCompactLevel:  -1,
+	})
+	defer h.close()
+
+	value := strings.Repeat("x", 1000)
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 50; j++ {
+			h.put(numKey(j), value)
+		}
+		h.compactMem()
+	}
+	h.tablesPerLevel("2")
+
+	// Input beyond the one second burst is throttled.
+	start := time.Now()
+	h.compactRangeAt(0, "", "")
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("compaction of ~100KB at %d bytes/sec took only %v", rate, elapsed)
+	}
+	h.tablesPerLevel("0,1")
+	h.getVal(numKey(10), value)
+
+	// Lifting the limiter releases a throttled waiter.
+	done := make(chan struct{})
+	go func() {
+		h.db.climit.wait(100*rate, rate)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	h.db.climit.lift(true)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("throttled waiter was not released by lift")
+	}
+	h.db.climit.lift(false)
+}
+
+func TestDb_ParallelCompactions(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		WriteBuffer:    256 << 10,
+		MaxCompactions: 4,
+	})
+	defer h.close()
+
+	rnd := rand.New(rand.NewSource(0x1073))
+	value := func(i, round int) string {
+		return fmt.Sprintf("%d:%d:", i, round) + strings.Repeat("v", 2000+i%100)
+	}
+	const n = 8000
+	want := make(map[int]int)
+	for round := 0; round < 2; round++ {
+		for _, i := range rnd.Perm(n)[:2*n/3] {
+			h.put(numKey(i), value(i, round))
+			want[i] = round
+		}
+		h.delete(numKey(round))
+		delete(want, round)
+	}
+	h.compactMem()
+
+	check := func() {
+		for i := 0; i < n; i++ {
+			if round, ok := want[i]; ok {
+				h.getVal(numKey(i), value(i, round))
+			} else {
+				h.get(numKey(i), false)
+			}
+		}
+	}
+	check()
+
+	// Compactions reading level-0 or overlapping ranges of a shared
+	// level conflict, of disjoint ranges don't.
+	s := h.db.s
+	v := s.version()
+	level := 1
+	for i := range v.tables[1 : len(v.tables)-1] {
+		if len(v.tables[i+1]) > len(v.tables[level]) {
+			level = i + 1
+		}
+	}
+	tt := v.tables[level]
+	if len(tt) < 2 {
+		t.Fatalf("got %d level-%d tables, want at least 2", len(tt), level)
+	}
+	mk := func(level int, t0 tFiles) *compaction {
+		c := newCompaction(s, v, level)
+		c.tables[0] = t0
+		c.expand()
+		return c
+	}
+	first, last := mk(level, tt[:1]), mk(level, tt[len(tt)-1:])
+	if !first.conflicts(first) {
+		t.Error("compaction does not conflict with itself")
+	}
+	_, fmax := first.ukeyRange()
+	lmin, _ := last.ukeyRange()
+	if disjoint := s.cmp.cmp.Compare(fmax, lmin) < 0; first.conflicts(last) == disjoint {
+		t.Errorf("compactions of first and last level-%d tables: disjoint=%v conflicts=%v", level, disjoint, !disjoint)
+	}
+	if l0 := newCompaction(s, v, 0); !l0.conflicts(newCompaction(s, v, 0)) {
+		t.Error("level-0 compactions do not conflict")
+	}
+
+	h.reopenDB()
+	check()
+}
+
+func TestDb_DeletionTriggeredCompaction(t *testing.T) {
+	for _, percent := range []int{0, 50} {
+		h := newDbHarnessWopt(t, &opt.Options{CompactionDeletionPercent: percent})
+
+		for i := 0; i < 100; i++ {
+			h.put(numKey(i), "v")
+		}
+		h.compactMem()
+		for i := 0; i < 80; i++ {
+			h.delete(numKey(i))
+		}
+		h.compactMem()
+
+		stats, err := h.db.GetStats()
+		if err != nil {
+			t.Fatal("GetStats: got error: ", err)
+		}
+		var dels uint64
+		for _, n := range stats.LevelDeletions {
+			dels += n
+		}
+		if percent == 0 && dels != 80 {
+			t.Errorf("percent=%d: got %d deletions, want 80", percent, dels)
+		}
+		if percent > 0 && dels != 0 {
+			t.Errorf("percent=%d: got %d deletions, want 0", percent, dels)
+		}
+		h.get(numKey(10), false)
+		h.getVal(numKey(90), "v")
+		h.close()
+	}
+}
+
+func TestDb_RawIterator(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("a", "v1")
+	h.put("a", "v2")
+	h.delete("a")
+	h.put("b", "v3")
+
+	type entry struct {
+		ukey  string
+		seq   uint64
+		t     KeyType
+		value string
+	}
+	want := []entry{
+		{"a", 3, KeyTypeDeletion, ""},
+		{"a", 2, KeyTypeValue, "v2"},
+		{"a", 1, KeyTypeValue, "v1"},
+		{"b", 4, KeyTypeValue, "v3"},
+	}
+	check := func(ro *opt.ReadOptions, want []entry) {
+		iter := h.db.NewRawIterator(ro)
+		defer iter.Release()
+		var got []entry
+		for ok := iter.Seek(InternalSeekKey([]byte("a"))); ok; ok = iter.Next() {
+			ukey, seq, kt, ok := ParseInternalKey(iter.Key())
+			if !ok {
+				t.Fatalf("invalid internal key %q", iter.Key())
+			}
+			got = append(got, entry{string(ukey), seq, kt, string(iter.Value())})
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal("RawIterator: got error: ", err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("got entries %v, want %v", got, want)
+		}
+	}
+	check(nil, want)
+	check(&opt.ReadOptions{Limit: []byte("b")}, want[:3])
+
+	// Shadowed entries visible to a snapshot survive compaction.
+	snap, err := h.db.GetSnapshot()
+	if err != nil {
+		t.Fatal("GetSnapshot: got error: ", err)
+	}
+	defer snap.Release()
+	h.compactMem()
+	check(nil, want)
+
+	if _, _, _, ok := ParseInternalKey([]byte("short")); ok {
+		t.Error("malformed internal key parsed")
+	}
+}
+
+func TestDb_TTL(t *testing.T) {
+	now := time.Now().UnixNano()
+	defer func(f func() int64) { ttlNow = f }(ttlNow)
+	ttlNow = func() int64 { return now }
+
+	h := newDbHarness(t)
+	defer h.close()
+
+	if err := h.db.PutWithTTL([]byte("a"), []byte("va"), 10*time.Second, h.wo); err != nil {
+		t.Fatal("PutWithTTL: got error: ", err)
+	}
+	h.put("b", "vb")
+	if err := h.db.PutWithTTL([]byte("c"), []byte("vc"), time.Minute, h.wo); err != nil {
+		t.Fatal("PutWithTTL: got error: ", err)
+	}
+	h.compactMem()
+
+	has := func(key string, want bool) {
+		if ret, err := h.db.Has([]byte(key), h.ro); err != nil || ret != want {
+			t.Errorf("Has(%q): got %v, %v; want %v", key, ret, err, want)
+		}
+	}
+	rawTypes := func(key string) (types []KeyType) {
+		iter := h.db.NewRawIterator(nil)
+		defer iter.Release()
+		for ok := iter.Seek(InternalSeekKey([]byte(key))); ok; ok = iter.Next() {
+			ukey, _, kt, _ := ParseInternalKey(iter.Key())
+			if string(ukey) != key {
+				break
+			}
+			types = append(types, kt)
+		}
+		return
+	}
+
+	h.getVal("a", "va")
+	has("a", true)
+	h.getKeyVal("(a->va)(b->vb)(c->vc)")
+	if got := rawTypes("a"); len(got) != 1 || got[0] != KeyTypeTTL {
+		t.Errorf("got raw types %v of unexpired key", got)
+	}
+
+	// Expired values read as deleted.
+	now += int64(20 * time.Second)
+	h.get("a", false)
+	has("a", false)
+	h.getVal("c", "vc")
+	h.getKeyVal("(b->vb)(c->vc)")
+	iter := h.db.NewIterator(h.ro)
+	if !iter.Last() || string(iter.Key()) != "c" || string(iter.Value()) != "vc" {
+		t.Errorf("Last: got %q=%q, want c=vc", iter.Key(), iter.Value())
+	}
+	if !iter.Prev() || string(iter.Key()) != "b" || iter.Prev() {
+		t.Errorf("Prev: got %q, want b then none", iter.Key())
+	}
+	iter.Release()
+
+	// Compaction drops them.
+	h.tablesPerLevel("0,0,1")
+	h.compactRangeAt(2, "", "")
+	h.tablesPerLevel("0,0,0,1")
+	if got := rawTypes("a"); len(got) != 0 {
+		t.Errorf("got raw types %v of expired key after compaction", got)
+	}
+	if got := rawTypes("c"); len(got) != 1 || got[0] != KeyTypeTTL {
+		t.Errorf("got raw types %v of unexpired key after compaction", got)
+	}
+	h.getVal("c", "vc")
+
+	now += int64(time.Minute)
+	h.reopenDB()
+	h.get("c", false)
+	h.getVal("b", "vb")
+}
+
+func TestDb_CompactionProgressProperties(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		MaxMemCompactLevel:  -1,
+		CompactionL0Trigger: 10,
+	})
+	defer h.close()
+
+	prop := func(name string) string {
+		value, err := h.db.GetProperty(name)
+		if err != nil {
+			t.Fatalf("GetProperty(%q): got error: %v", name, err)
+		}
+		return value
+	}
+
+	value := strings.Repeat("x", 1000)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 20; j++ {
+			h.put(numKey(j), value)
 		}
+		h.compactMem()
+	}
+	h.tablesPerLevel("3")
+	if got := prop("leveldb.compaction-pending"); got != "0" {
+		t.Errorf("got %s bytes pending below level-0 trigger, want 0", got)
+	}
+	h.oo.SetCompactionL0Trigger(2)
+	if got, want := prop("leveldb.compaction-pending"), fmt.Sprint(h.db.s.version().tables[0].size()); got != want {
+		t.Errorf("got %s bytes pending above level-0 trigger, want %s", got, want)
+	}
+	if got := prop("leveldb.running-compaction"); got != "" {
+		t.Errorf("got running compaction %q while idle", got)
+	}
+
+	// Throttle the compaction so that it can be observed.
+	h.oo.SetCompactionRateLimit(10 << 10)
+	done := make(chan struct{})
+	go func() {
+		h.compactRangeAt(0, "", "")
+		close(done)
+	}()
+	var running string
+	for deadline := time.Now().Add(5 * time.Second); running == "" && time.Now().Before(deadline); {
+		running = prop("leveldb.running-compaction")
+		time.Sleep(time.Millisecond)
+	}
+	h.oo.SetCompactionRateLimit(0)
+	<-done
+
+	var level, tables int
+	var size, processed uint64
+	if _, err := fmt.Sscanf(running, "level=%d tables=%d size=%d processed=%d\n", &level, &tables, &size, &processed); err != nil {
+		t.Fatalf("got running compaction %q: %v", running, err)
+	}
+	if level != 0 || tables != 3 || size == 0 {
+		t.Errorf("got running compaction %q, want level 0 with 3 tables", running)
+	}
+	if got := prop("leveldb.running-compaction"); got != "" {
+		t.Errorf("got running compaction %q once done", got)
+	}
+	if got := prop("leveldb.compaction-pending"); got != "0" {
+		t.Errorf("got %s bytes pending once compacted, want 0", got)
 	}
 }
@@ -7,6 +7,8 @@
 package leveldb
 
 import (
+	"time"
+
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/storage"
@@ -30,6 +32,29 @@ type Range struct {
 
 type Sizes []uint64
 
+// DBStats hold per-level statistics of a database, as returned by
+// DB.GetStats. Each slice is indexed by level. Compaction statistics are
+// accounted to the level the compaction writes to, and are kept in memory
+// only, i.e. they start from zero on each open.
+type DBStats struct {
+	// Number of tables and total size of tables, in bytes.
+	LevelTables []int
+	LevelSizes  []uint64
+
+	// Time spent on compaction, and bytes read and written by it.
+	LevelDurations []time.Duration
+	LevelRead      []uint64
+	LevelWrite     []uint64
+
+	// Number of compactions triggered by seeks.
+	LevelSeekCompactions []uint64
+
+	// Number of entries and of deletion entries of tables, as recorded
+	// by the tables; tables written by older versions are not counted.
+	LevelEntries   []uint64
+	LevelDeletions []uint64
+}
+
 // Sum return sum of the sizes.
 func (p Sizes) Sum() (n uint64) {
 	for _, s := range p {
@@ -54,7 +79,9 @@ func (d *DB) cleanFiles() {
 		keep := true
 		switch f.Type() {
 		case storage.TypeManifest:
-			keep = !s.manifest.closed() && f.Num() >= s.manifest.file.Num()
+			// a newer manifest is left by a rotation interrupted
+			// before CURRENT was switched
+			keep = f.Num() == s.manifest.file.Num()
 		case storage.TypeJournal:
 			if d.fjournal != nil && !d.fjournal.closed() {
 				keep = f.Num() >= d.fjournal.file.Num()
@@ -66,7 +93,7 @@ func (d *DB) cleanFiles() {
 		}
 
 		if !keep {
-			f.Remove()
+			s.removeFile(f)
 		}
 	}
 }
@@ -7,14 +7,18 @@
 package leveldb
 
 import (
+	"sync/atomic"
 	"time"
 
+	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/memdb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
+var errWriteSyncNoWAL = errors.ErrInvalid("WFSync and WFNoWAL are mutually exclusive")
+
 func (d *DB) doWriteJournal(b *Batch) error {
-	err := d.journal.journal.Append(b.encode())
+	err := d.journal.journal.AppendParts(b.encode(), b.vref)
 	if err == nil && b.sync {
 		err = d.journal.writer.Sync()
 	}
@@ -36,22 +40,80 @@ func (d *DB) writeJournal() {
 	d.ewg.Done()
 }
 
+// Sync the journal every given interval, until the DB is closed.
+func (d *DB) syncJournal(interval time.Duration) {
+	defer d.swg.Done()
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	var last uint64
+	for {
+		select {
+		case <-tick.C:
+		case <-d.closeC:
+			return
+		}
+
+		// hold the writer mutex, so that the journal is neither written
+		// nor rotated meanwhile
+		select {
+		case d.wlock <- struct{}{}:
+		case <-d.closeC:
+			return
+		}
+		seq := d.getSeq()
+		if seq != last && atomic.LoadUint64(&d.sseq) < seq {
+			if err := d.journal.writer.Sync(); err != nil {
+				d.s.printf("Journal: background sync failed, num=%d err=%q", d.journal.file.Num(), err)
+			} else {
+				last = seq
+				atomic.StoreUint64(&d.sseq, seq)
+				// the frozen journal may still hold unsynced writes
+				if !d.hasFrozenMem() {
+					d.setDurableSeq(seq)
+				}
+			}
+		}
+		<-d.wlock
+	}
+}
+
 func (d *DB) flush() (m *memdb.DB, err error) {
 	s := d.s
 
-	delayed, cwait := false, false
+	delayed, cwait, lifted := false, false, false
+	var paused time.Time
+	var pausedL0 int
+	defer func() {
+		if !paused.IsZero() {
+			d.writeStall(opt.WriteStallL0Pause, pausedL0, time.Since(paused))
+		}
+		if lifted {
+			d.climit.lift(false)
+		}
+	}()
+	// stalled writes wait on compaction, which must not be throttled
+	stalled := func() {
+		if !lifted {
+			lifted = true
+			d.climit.lift(true)
+		}
+	}
 	for {
 		v := s.version()
 		mem := d.getMem()
 		switch {
-		case v.tLen(0) >= kL0_SlowdownWritesTrigger && !delayed:
+		case v.tLen(0) >= s.o.GetWriteL0SlowdownTrigger() && !delayed:
 			delayed = true
+			start := time.Now()
 			time.Sleep(time.Millisecond)
+			d.writeStall(opt.WriteStallL0Slowdown, v.tLen(0), time.Since(start))
 			continue
 		case mem.cur.Size() <= s.o.GetWriteBuffer():
 			// still room
 			return mem.cur, nil
 		case mem.froze != nil:
+			stalled()
 			if cwait {
 				if err = d.geterr(); err != nil {
 					return
@@ -62,7 +124,11 @@ func (d *DB) flush() (m *memdb.DB, err error) {
 				d.cch <- cWait
 			}
 			continue
-		case v.tLen(0) >= kL0_StopWritesTrigger:
+		case v.tLen(0) >= s.o.GetWriteL0PauseTrigger():
+			if paused.IsZero() {
+				paused, pausedL0 = time.Now(), v.tLen(0)
+			}
+			stalled()
 			d.cch <- cSched
 			continue
 		}
@@ -83,14 +149,29 @@ func (d *DB) flush() (m *memdb.DB, err error) {
 	return
 }
 
+// Report a write stall to opt.Options.OnWriteStall, if set.
+func (d *DB) writeStall(reason string, l0Tables int, dur time.Duration) {
+	if f := d.s.o.GetOnWriteStall(); f != nil {
+		f(reason, l0Tables, dur)
+	}
+}
+
 // Write apply the specified batch to the database.
+//
+// Concurrent writes may be committed together as a single journal record.
+// If opt.WFSync flag is set the journal is synced after the record is
+// appended, and before Write returns; a group that holds a synced write
+// is synced as a whole.
 func (d *DB) Write(b *Batch, wo *opt.WriteOptions) (err error) {
 	err = d.wok()
 	if err != nil || b == nil || b.len() == 0 {
 		return
 	}
+	if wo.HasFlag(opt.WFSync) && wo.HasFlag(opt.WFNoWAL) {
+		return errWriteSyncNoWAL
+	}
 
-	b.init(wo.HasFlag(opt.WFSync))
+	b.init(wo.HasFlag(opt.WFSync), wo.HasFlag(opt.WFNoWAL))
 
 	select {
 	case d.wqueue <- b:
@@ -117,9 +198,10 @@ func (d *DB) Write(b *Batch, wo *opt.WriteOptions) (err error) {
 		m = x + (128 << 10)
 	}
 
-	// merge with other batch
+	// merge with other batch; writers queued behind a synced write share
+	// its journal sync
 drain:
-	for b.size() <= m && !b.sync {
+	for b.size() <= m {
 		select {
 		case nb := <-d.wqueue:
 			b.append(nb)
@@ -132,8 +214,18 @@ drain:
 	// set batch first seq number relative from last seq
 	b.seq = d.seq + 1
 
-	// write journal concurrently if it is large enough
-	if b.size() >= (128 << 10) {
+	// reads must resolve timestamps before they could see this batch
+	if b.hasTs {
+		d.setTs()
+	}
+
+	if b.noWAL {
+		// must be flushed on close
+		atomic.StoreUint32(&d.nowal, 1)
+		atomic.CompareAndSwapUint64(&d.nwseq, 0, b.seq)
+		b.memReplay(mem)
+	} else if b.size() >= (128 << 10) {
+		// write journal concurrently if it is large enough
 		d.jch <- b
 		b.memReplay(mem)
 		err = <-d.jack
@@ -149,12 +241,73 @@ drain:
 		b.memReplay(mem)
 	}
 
+	// reads look up range tombstones of the memdb out of band
+	if b.hasRangeDel {
+		rdels, _ := b.rangeDels()
+		d.getMem_NB().curRd.add(rdels)
+	}
+
 	// set last seq number
 	d.addSeq(uint64(b.len()))
 
+	if b.sync {
+		seq := d.getSeq()
+		atomic.StoreUint64(&d.sseq, seq)
+		// the frozen journal may still hold unsynced writes
+		if !d.hasFrozenMem() {
+			d.setDurableSeq(seq)
+		}
+	}
+
 	return
 }
 
+type asyncWrite struct {
+	b  *Batch
+	wo *opt.WriteOptions
+	cb func(error)
+}
+
+// WriteAsync is like Write but returns immediately; cb, if not nil, is
+// invoked with the result once the batch is applied, and synced if
+// opt.WFSync flag is set. Async writes are applied one at a time in
+// submission order, by a goroutine running while any is pending, thus
+// callbacks are invoked in submission order as well, and a callback
+// blocks the async writes submitted after it. The batch must not be
+// modified until the callback is invoked.
+//
+// Writes submitted once the DB is closed, or pending when it is closed,
+// fail with errors.ErrClosed.
+func (d *DB) WriteAsync(b *Batch, wo *opt.WriteOptions, cb func(error)) {
+	d.amu.Lock()
+	d.aqueue = append(d.aqueue, &asyncWrite{b, wo, cb})
+	if !d.arunning {
+		d.arunning = true
+		go d.asyncWriter()
+	}
+	d.amu.Unlock()
+}
+
+func (d *DB) asyncWriter() {
+	for {
+		d.amu.Lock()
+		if len(d.aqueue) == 0 {
+			d.arunning = false
+			d.amu.Unlock()
+			return
+		}
+		w := d.aqueue[0]
+		d.aqueue[0] = nil
+		d.aqueue = d.aqueue[1:]
+		d.amu.Unlock()
+
+		err := d.Write(w.b, w.wo)
+		if w.cb != nil {
+			w.cb(err)
+		}
+	}
+}
+
 // Put set the database entry for "key" to "value".
 func (d *DB) Put(key, value []byte, wo *opt.WriteOptions) error {
 	b := new(Batch)
@@ -162,6 +315,27 @@ func (d *DB) Put(key, value []byte, wo *opt.WriteOptions) error {
 	return d.Write(b, wo)
 }
 
+// PutNoCopy is like Put, but value is not copied into the memdb, which
+// holds it by reference instead; the key is copied as usual. The caller
+// must not modify value after this call until the memdb is flushed to a
+// table, e.g. by Flush; values read back from the memdb alias it, capped
+// to its length. The value is still copied if the write is merged with
+// concurrent writes into a single journal record.
+func (d *DB) PutNoCopy(key, value []byte, wo *opt.WriteOptions) error {
+	b := new(Batch)
+	b.putNoCopy(key, value)
+	return d.Write(b, wo)
+}
+
+// PutWithTTL set the database entry for "key" to "value", expiring once
+// given duration has passed. An expired entry reads as deleted, and is
+// dropped by compaction.
+func (d *DB) PutWithTTL(key, value []byte, ttl time.Duration, wo *opt.WriteOptions) error {
+	b := new(Batch)
+	b.PutWithTTL(key, value, ttl)
+	return d.Write(b, wo)
+}
+
 // Delete remove the database entry (if any) for "key". It is not an error
 // if "key" did not exist in the database.
 func (d *DB) Delete(key []byte, wo *opt.WriteOptions) error {
@@ -169,3 +343,30 @@ func (d *DB) Delete(key []byte, wo *opt.WriteOptions) error {
 	b.Delete(key)
 	return d.Write(b, wo)
 }
+
+// DeleteRange remove the database entries (if any) for every key within
+// [start, limit), as of this write; entries written afterwards are kept.
+// Only a single range tombstone is recorded regardless of the number of
+// keys within the range. Compaction drops the covered entries, and then
+// the tombstone itself once compacted into the deepest level overlapping
+// the range. It is not an error if the range is empty.
+func (d *DB) DeleteRange(start, limit []byte, wo *opt.WriteOptions) error {
+	if d.s.cmp.cmp.Compare(start, limit) >= 0 {
+		return nil
+	}
+	b := new(Batch)
+	b.DeleteRange(start, limit)
+	return d.Write(b, wo)
+}
+
+// Merge combine given operand with the database entry (if any) for "key",
+// using opt.Merger of the database. The operand is resolved lazily, on
+// read or compaction. It is an error if no merger is set.
+func (d *DB) Merge(key, operand []byte, wo *opt.WriteOptions) error {
+	if d.s.o.GetMerger() == nil {
+		return errNoMerger
+	}
+	b := new(Batch)
+	b.Merge(key, operand)
+	return d.Write(b, wo)
+}
@@ -31,6 +31,7 @@
 //		...
 //	}
 //	err = iter.Error()
+//	iter.Release()
 //	...
 //
 // Batch writes:
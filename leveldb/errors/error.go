@@ -7,12 +7,19 @@
 // Package errors implements functions to manipulate errors.
 package errors
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
-	ErrNotFound         = errors.New("not found")
-	ErrClosed           = ErrInvalid("database closed")
-	ErrSnapshotReleased = ErrInvalid("snapshot released")
+	ErrNotFound            = errors.New("not found")
+	ErrClosed              = ErrInvalid("database closed")
+	ErrSnapshotReleased    = ErrInvalid("snapshot released")
+	ErrIterReleased        = ErrInvalid("iterator released")
+	ErrSnapshotNotRetained = ErrInvalid("snapshot seq no longer retained")
+	ErrReadOnly            = ErrInvalid("database is read-only")
+	ErrCloseTimeout        = errors.New("database close timed out")
 )
 
 type ErrInvalid string
@@ -32,3 +39,30 @@ func (e ErrCorrupt) Error() string {
 	}
 	return "leveldb corrupted: " + string(e)
 }
+
+// ErrCorrupted is a corruption found in a table file. It identifies the
+// table file and the block, thus the corrupt table may be dealt with
+// individually rather than the whole database.
+type ErrCorrupted struct {
+	File   uint64 // number of the table file
+	Offset uint64 // offset of the corrupt block within the file
+	Err    error  // the corruption, an ErrCorrupt
+}
+
+func (e *ErrCorrupted) Error() string {
+	return fmt.Sprintf("table %d, block at offset %d: %v", e.File, e.Offset, e.Err)
+}
+
+func (e *ErrCorrupted) Unwrap() error {
+	return e.Err
+}
+
+// IsCorrupted return true if given error is either an ErrCorrupt or an
+// ErrCorrupted.
+func IsCorrupted(err error) bool {
+	switch err.(type) {
+	case ErrCorrupt, *ErrCorrupted:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package filter
+
+import (
+	"io"
+
+	"github.com/syndtr/goleveldb/leveldb/hash"
+)
+
+// Number of bits of a block; a block spans a single 64 bytes cache line.
+const blockedBloomBlockBits = 512
+
+// Return offset of the block for given key, in bits, and the hash value
+// probes within the block are derived from. The block is selected by the
+// bloom hash and probes by another hash, so they are not correlated.
+func blockedBloomProbe(key []byte, blocks uint32) (base, h uint32) {
+	base = uint32(uint64(bloomHash(key)) * uint64(blocks) >> 32)
+	return base * blockedBloomBlockBits, hash.Hash(key, 0x6ec3a1f5)
+}
+
+// BlockedBloomFilter filter represent a blocked bloom filter. All probes
+// for a key land within a single cache-line-sized block, thus a lookup
+// touches only one cache line, at the cost of a slightly higher false
+// positive rate than BloomFilter with the same bitsPerKey.
+type BlockedBloomFilter struct {
+	bitsPerKey, k uint32
+}
+
+// NewBlockedBloomFilter creates a new initialized blocked bloom filter
+// for given bitsPerKey.
+//
+// Like BloomFilter, the number of probes is persisted within each
+// serialized filter, so changing bitsPerKey does not prevent reading
+// filters created with another bitsPerKey.
+func NewBlockedBloomFilter(bitsPerKey int) *BlockedBloomFilter {
+	k := uint32(bitsPerKey) * 69 / 100 // 0.69 =~ ln(2)
+	if k < 1 {
+		k = 1
+	} else if k > 30 {
+		k = 30
+	}
+	return &BlockedBloomFilter{uint32(bitsPerKey), k}
+}
+
+// Name return the name of this filter. i.e.
+// "leveldb.BuiltinBlockedBloomFilter".
+func (*BlockedBloomFilter) Name() string {
+	return "leveldb.BuiltinBlockedBloomFilter"
+}
+
+// CreateFilter generates a filter for given set of keys and writes it
+// to the given buffer.
+func (p *BlockedBloomFilter) CreateFilter(keys [][]byte, buf io.Writer) {
+	bits := uint32(len(keys)) * p.bitsPerKey
+	blocks := (bits + blockedBloomBlockBits - 1) / blockedBloomBlockBits
+	if blocks < 1 {
+		blocks = 1
+	}
+
+	array := make([]byte, blocks*blockedBloomBlockBits/8)
+
+	for _, key := range keys {
+		base, h := blockedBloomProbe(key, blocks)
+		delta := (h >> 17) | (h << 15) // Rotate right 17 bits
+		for i := uint32(0); i < p.k; i++ {
+			h += delta
+			bitpos := base + h%blockedBloomBlockBits
+			array[bitpos/8] |= (1 << (bitpos % 8))
+		}
+	}
+
+	buf.Write(array)
+	buf.Write([]byte{byte(p.k)})
+}
+
+// KeyMayMatch test whether given key on the list.
+func (p *BlockedBloomFilter) KeyMayMatch(key, filter []byte) bool {
+	l := uint32(len(filter))
+	if l < 2 {
+		return false
+	}
+	if (l-1)%(blockedBloomBlockBits/8) != 0 {
+		// Not a blocked bloom filter encoding. Consider it a match.
+		return true
+	}
+
+	blocks := (l - 1) / (blockedBloomBlockBits / 8)
+
+	// Use the encoded k so that we can read filters generated by
+	// filters created using different parameters.
+	k := uint32(filter[l-1])
+	if k > 30 {
+		// Reserved for potentially new encodings. Consider it a match.
+		return true
+	}
+
+	base, h := blockedBloomProbe(key, blocks)
+	delta := (h >> 17) | (h << 15) // Rotate right 17 bits
+	for i := uint32(0); i < k; i++ {
+		h += delta
+		bitpos := base + h%blockedBloomBlockBits
+		if (uint32(filter[bitpos/8]) & (1 << (bitpos % 8))) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
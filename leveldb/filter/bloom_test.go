@@ -15,7 +15,7 @@ import (
 type harness struct {
 	t *testing.T
 
-	bloom  *BloomFilter
+	bloom  Filter
 	filter []byte
 	keys   [][]byte
 }
@@ -24,6 +24,10 @@ func newHarness(t *testing.T) *harness {
 	return &harness{t: t, bloom: NewBloomFilter(10)}
 }
 
+func newBlockedHarness(t *testing.T) *harness {
+	return &harness{t: t, bloom: NewBlockedBloomFilter(10)}
+}
+
 func (h *harness) add(key []byte) {
 	h.keys = append(h.keys, key)
 }
@@ -136,3 +140,61 @@ func TestBloomFilter_VaryingLengths(t *testing.T) {
 		t.Error("mediocre false positive rate is more than expected")
 	}
 }
+
+func TestBlockedBloomFilter_Empty(t *testing.T) {
+	h := newBlockedHarness(t)
+	h.build()
+	h.assert([]byte("hello"), false, false)
+	h.assert([]byte("world"), false, false)
+}
+
+func TestBlockedBloomFilter_Small(t *testing.T) {
+	h := newBlockedHarness(t)
+	h.add([]byte("hello"))
+	h.add([]byte("world"))
+	h.build()
+	h.assert([]byte("hello"), true, false)
+	h.assert([]byte("world"), true, false)
+	h.assert([]byte("x"), false, false)
+	h.assert([]byte("foo"), false, false)
+}
+
+func TestBlockedBloomFilter_VaryingLengths(t *testing.T) {
+	h := newBlockedHarness(t)
+	var worst float32
+	for n := 1; n < 10000; n = nextN(n) {
+		h.reset()
+		for i := 0; i < n; i++ {
+			h.addNum(uint32(i))
+		}
+		h.build()
+
+		got := h.filterLen()
+		want := (n * 10 / 8) + 65
+		if got > want {
+			t.Errorf("filter len test failed, '%d' > '%d'", got, want)
+		}
+		if (got-1)%64 != 0 {
+			t.Errorf("filter len %d is not a multiple of block size", got-1)
+		}
+
+		for i := 0; i < n; i++ {
+			h.assertNum(uint32(i), true, false)
+		}
+
+		var rate float32
+		for i := 0; i < 10000; i++ {
+			if h.assertNum(uint32(i+1000000000), true, true) {
+				rate++
+			}
+		}
+		rate /= 10000
+		if rate > 0.02 {
+			t.Errorf("false positive rate is more than 2%%, got %v, at len %d", rate, n)
+		}
+		if rate > worst {
+			worst = rate
+		}
+	}
+	t.Logf("worst false positive rate: %v", worst)
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package hash
+
+import (
+	"encoding/binary"
+	"hash"
+)
+
+const (
+	xxPrime1 uint32 = 2654435761
+	xxPrime2 uint32 = 2246822519
+	xxPrime3 uint32 = 3266489917
+	xxPrime4 uint32 = 668265263
+	xxPrime5 uint32 = 374761393
+)
+
+type xxHash32 struct {
+	seed           uint32
+	v1, v2, v3, v4 uint32
+	total          uint64
+	buf            [16]byte
+	n              int // bytes buffered in buf
+}
+
+// NewXXHash32 creates a new hash.Hash32 computing the 32-bit xxHash
+// checksum with given seed.
+func NewXXHash32(seed uint32) hash.Hash32 {
+	x := &xxHash32{seed: seed}
+	x.Reset()
+	return x
+}
+
+func xxRotl(x uint32, r uint) uint32 {
+	return (x << r) | (x >> (32 - r))
+}
+
+func xxRound(v, input uint32) uint32 {
+	return xxRotl(v+input*xxPrime2, 13) * xxPrime1
+}
+
+func (x *xxHash32) Reset() {
+	x.v1 = x.seed + xxPrime1 + xxPrime2
+	x.v2 = x.seed + xxPrime2
+	x.v3 = x.seed
+	x.v4 = x.seed - xxPrime1
+	x.total = 0
+	x.n = 0
+}
+
+func (x *xxHash32) Size() int { return 4 }
+
+func (x *xxHash32) BlockSize() int { return 16 }
+
+func (x *xxHash32) stripe(b []byte) {
+	x.v1 = xxRound(x.v1, binary.LittleEndian.Uint32(b))
+	x.v2 = xxRound(x.v2, binary.LittleEndian.Uint32(b[4:]))
+	x.v3 = xxRound(x.v3, binary.LittleEndian.Uint32(b[8:]))
+	x.v4 = xxRound(x.v4, binary.LittleEndian.Uint32(b[12:]))
+}
+
+func (x *xxHash32) Write(b []byte) (int, error) {
+	n := len(b)
+	x.total += uint64(n)
+
+	if x.n > 0 {
+		m := copy(x.buf[x.n:], b)
+		x.n += m
+		b = b[m:]
+		if x.n < len(x.buf) {
+			return n, nil
+		}
+		x.stripe(x.buf[:])
+		x.n = 0
+	}
+	for ; len(b) >= 16; b = b[16:] {
+		x.stripe(b)
+	}
+	x.n = copy(x.buf[:], b)
+	return n, nil
+}
+
+func (x *xxHash32) Sum32() uint32 {
+	var h uint32
+	if x.total >= 16 {
+		h = xxRotl(x.v1, 1) + xxRotl(x.v2, 7) + xxRotl(x.v3, 12) + xxRotl(x.v4, 18)
+	} else {
+		h = x.seed + xxPrime5
+	}
+	h += uint32(x.total)
+
+	b := x.buf[:x.n]
+	for ; len(b) >= 4; b = b[4:] {
+		h += binary.LittleEndian.Uint32(b) * xxPrime3
+		h = xxRotl(h, 17) * xxPrime4
+	}
+	for _, c := range b {
+		h += uint32(c) * xxPrime5
+		h = xxRotl(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 15
+	h *= xxPrime2
+	h ^= h >> 13
+	h *= xxPrime3
+	h ^= h >> 16
+	return h
+}
+
+func (x *xxHash32) Sum(b []byte) []byte {
+	s := x.Sum32()
+	return append(b, byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
+}
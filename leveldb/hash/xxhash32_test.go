@@ -0,0 +1,44 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package hash
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestXXHash32(t *testing.T) {
+	for _, x := range []struct {
+		data string
+		sum  uint32
+	}{
+		{"", 0x02cc5d05},
+		{"a", 0x550d7456},
+		{"abc", 0x32d153ff},
+		{"Nobody inspects the spammish repetition", 0xe2293b2f},
+	} {
+		h := NewXXHash32(0)
+		h.Write([]byte(x.data))
+		if got := h.Sum32(); got != x.sum {
+			t.Errorf("%q: got %08x, want %08x", x.data, got, x.sum)
+		}
+	}
+
+	// Writes split at any point yield the same sum.
+	data := bytes.Repeat([]byte("0123456789abcdefghij"), 5)
+	h := NewXXHash32(7)
+	h.Write(data)
+	want := h.Sum32()
+	for i := 0; i <= len(data); i++ {
+		h.Reset()
+		h.Write(data[:i])
+		h.Write(data[i:])
+		if got := h.Sum32(); got != want {
+			t.Errorf("split at %d: got %08x, want %08x", i, got, want)
+		}
+	}
+}
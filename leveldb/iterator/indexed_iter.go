@@ -18,9 +18,10 @@ type IteratorIndexer interface {
 // IndexedIterator represent an indexed interator. IndexedIterator can be used
 // to access an indexed data, which the index is a pointer to actual data.
 type IndexedIterator struct {
-	index IteratorIndexer
-	data  Iterator
-	err   error
+	index    IteratorIndexer
+	data     Iterator
+	err      error
+	releaser Releaser
 }
 
 // NewIndexedIterator create new initialized indexed iterator.
@@ -28,6 +29,12 @@ func NewIndexedIterator(index IteratorIndexer) *IndexedIterator {
 	return &IndexedIterator{index: index}
 }
 
+// SetReleaser set releaser to be released along with the iterator, e.g.
+// the cache handle of the indexed data.
+func (i *IndexedIterator) SetReleaser(r Releaser) {
+	i.releaser = r
+}
+
 func (i *IndexedIterator) Valid() bool {
 	return i.data != nil && i.data.Valid()
 }
@@ -38,7 +45,7 @@ func (i *IndexedIterator) First() bool {
 	}
 
 	if !i.index.First() || !i.setData() {
-		i.data = nil
+		i.clearData()
 		return false
 	}
 	return i.Next()
@@ -50,12 +57,15 @@ func (i *IndexedIterator) Last() bool {
 	}
 
 	if !i.index.Last() || !i.setData() {
-		i.data = nil
+		i.clearData()
 		return false
 	}
 	if !i.data.Last() {
+		if !i.dataOk() {
+			return false
+		}
 		// empty data block, try prev block
-		i.data = nil
+		i.clearData()
 		return i.Prev()
 	}
 	return true
@@ -67,23 +77,58 @@ func (i *IndexedIterator) Seek(key []byte) bool {
 	}
 
 	if !i.index.Seek(key) || !i.setData() {
-		i.data = nil
+		i.clearData()
 		return false
 	}
 	if !i.data.Seek(key) {
+		if !i.dataOk() {
+			return false
+		}
 		return i.Next()
 	}
 	return true
 }
 
+func (i *IndexedIterator) SeekForPrev(key []byte) bool {
+	if i.err != nil {
+		return false
+	}
+
+	// The index entry at or past key points to the only data that may
+	// hold keys both before and past key.
+	if !i.index.Seek(key) {
+		if i.index.Error() != nil {
+			i.clearData()
+			return false
+		}
+		return i.Last()
+	}
+	if !i.setData() {
+		i.clearData()
+		return false
+	}
+	if !i.data.SeekForPrev(key) {
+		if i.data.Error() != nil {
+			return false
+		}
+		// all keys of data are past key, try prev data
+		i.clearData()
+		return i.Prev()
+	}
+	return true
+}
+
 func (i *IndexedIterator) Next() bool {
 	if i.err != nil {
 		return false
 	}
 
 	if i.data == nil || !i.data.Next() {
+		if i.data != nil && !i.dataOk() {
+			return false
+		}
 		if !i.index.Next() || !i.setData() {
-			i.data = nil
+			i.clearData()
 			return false
 		}
 		return i.Next()
@@ -97,13 +142,19 @@ func (i *IndexedIterator) Prev() bool {
 	}
 
 	if i.data == nil || !i.data.Prev() {
+		if i.data != nil && !i.dataOk() {
+			return false
+		}
 		if !i.index.Prev() || !i.setData() {
-			i.data = nil
+			i.clearData()
 			return false
 		}
 		if !i.data.Last() {
+			if !i.dataOk() {
+				return false
+			}
 			// empty data block, try prev block
-			i.data = nil
+			i.clearData()
 			return i.Prev()
 		}
 		return true
@@ -123,6 +174,18 @@ func (i *IndexedIterator) Value() []byte {
 	}
 	return i.data.Value()
 }
+func (i *IndexedIterator) KeyCopy(dst []byte) []byte {
+	if i.data == nil {
+		return dst
+	}
+	return i.data.KeyCopy(dst)
+}
+func (i *IndexedIterator) ValueCopy(dst []byte) []byte {
+	if i.data == nil {
+		return dst
+	}
+	return i.data.ValueCopy(dst)
+}
 func (i *IndexedIterator) Error() error {
 	if i.err != nil {
 		return i.err
@@ -134,7 +197,38 @@ func (i *IndexedIterator) Error() error {
 	return nil
 }
 
+// Release release current data iterator, the index if it is a Releaser,
+// and the releaser set by SetReleaser.
+func (i *IndexedIterator) Release() {
+	i.clearData()
+	if r, ok := i.index.(Releaser); ok {
+		r.Release()
+	}
+	if i.releaser != nil {
+		i.releaser.Release()
+		i.releaser = nil
+	}
+}
+
 func (i *IndexedIterator) setData() bool {
+	i.clearData()
 	i.data, i.err = i.index.Get()
 	return i.err == nil
 }
+
+// Abort the iteration if the data iterator failed, rather than moving on
+// to the next data; return false if so.
+func (i *IndexedIterator) dataOk() bool {
+	if err := i.data.Error(); err != nil {
+		i.err = err
+		return false
+	}
+	return true
+}
+
+func (i *IndexedIterator) clearData() {
+	if i.data != nil {
+		i.data.Release()
+		i.data = nil
+	}
+}
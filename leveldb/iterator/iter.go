@@ -26,6 +26,11 @@ type IteratorSeeker interface {
 	// an entry that comes at or past given 'key'.
 	Seek(key []byte) bool
 
+	// Position at the last key in the source that at or before given
+	// 'key'. The iterator is Valid() after this call if the source
+	// contains an entry that comes at or before given 'key'.
+	SeekForPrev(key []byte) bool
+
 	// Moves to the next entry in the source.  After this call, Valid() is
 	// true if the iterator was not positioned at the last entry in the source.
 	// REQUIRES: Valid()
@@ -40,32 +45,61 @@ type IteratorSeeker interface {
 	Error() error
 }
 
+// Releaser is the interface that wraps the basic Release method.
+type Releaser interface {
+	// Release release associated resources. Release can be called
+	// multiple times without causing error.
+	Release()
+}
+
 type Iterator interface {
 	IteratorSeeker
 
 	// Return the key for the current entry.  The underlying storage for
 	// the returned slice is valid only until the next modification of
-	// the iterator.
+	// the iterator, i.e. the next call of First, Last, Seek, SeekForPrev,
+	// Next or Prev; it may be shared with the source, thus must not be
+	// modified.
 	// REQUIRES: Valid()
 	Key() []byte
 
 	// Return the value for the current entry.  The underlying storage for
 	// the returned slice is valid only until the next modification of
-	// the iterator.
-	// REQUIRES: !AtEnd() && !AtStart()
+	// the iterator, same as Key; it must not be modified.
+	// REQUIRES: Valid()
 	Value() []byte
+
+	// Append the key for the current entry to dst and return the extended
+	// buffer, which is owned by the caller; pass dst[:0] to reuse dst.
+	// The key is copied only once, straight from the source.
+	// Return dst as is if the iterator is not valid.
+	KeyCopy(dst []byte) []byte
+
+	// Append the value for the current entry to dst and return the
+	// extended buffer, same as KeyCopy.
+	ValueCopy(dst []byte) []byte
+
+	// Release release associated resources, e.g. table cache handles,
+	// rather than waiting for the iterator to be garbage collected. The
+	// iterator is not valid after this call and can't be repositioned.
+	// Release can be called multiple times.
+	Release()
 }
 
 type EmptyIterator struct {
 	Err error
 }
 
-func (*EmptyIterator) Valid() bool          { return false }
-func (*EmptyIterator) First() bool          { return false }
-func (*EmptyIterator) Last() bool           { return false }
-func (*EmptyIterator) Seek(key []byte) bool { return false }
-func (*EmptyIterator) Next() bool           { return false }
-func (*EmptyIterator) Prev() bool           { return false }
-func (*EmptyIterator) Key() []byte          { return nil }
-func (*EmptyIterator) Value() []byte        { return nil }
-func (i *EmptyIterator) Error() error       { return i.Err }
+func (*EmptyIterator) Valid() bool                 { return false }
+func (*EmptyIterator) First() bool                 { return false }
+func (*EmptyIterator) Last() bool                  { return false }
+func (*EmptyIterator) Seek(key []byte) bool        { return false }
+func (*EmptyIterator) SeekForPrev(key []byte) bool { return false }
+func (*EmptyIterator) Next() bool                  { return false }
+func (*EmptyIterator) Prev() bool                  { return false }
+func (*EmptyIterator) Key() []byte                 { return nil }
+func (*EmptyIterator) Value() []byte               { return nil }
+func (*EmptyIterator) KeyCopy(dst []byte) []byte   { return dst }
+func (*EmptyIterator) ValueCopy(dst []byte) []byte { return dst }
+func (*EmptyIterator) Release()                    {}
+func (i *EmptyIterator) Error() error              { return i.Err }
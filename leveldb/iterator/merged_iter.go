@@ -6,13 +6,22 @@
 
 package iterator
 
-import "github.com/syndtr/goleveldb/leveldb/comparer"
+import (
+	"container/heap"
+
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+)
 
 // MergedIterator represent a merged iterators. MergedIterator can be used
 // to merge multiple iterators into one.
+//
+// Valid iterators are kept in a heap ordered by their current key, with
+// the smallest key on top when moving forward and the largest when moving
+// backward, thus each step costs O(log k) for k iterators.
 type MergedIterator struct {
 	cmp   comparer.Comparer
 	iters []Iterator
+	heap  mergedHeap
 
 	iter     Iterator
 	backward bool
@@ -22,7 +31,11 @@ type MergedIterator struct {
 
 // NewMergedIterator create new initialized merged iterators.
 func NewMergedIterator(iters []Iterator, cmp comparer.Comparer) *MergedIterator {
-	return &MergedIterator{iters: iters, cmp: cmp}
+	return &MergedIterator{
+		iters: iters,
+		cmp:   cmp,
+		heap:  mergedHeap{iters: iters, cmp: cmp, idx: make([]int, 0, len(iters))},
+	}
 }
 
 func (i *MergedIterator) Valid() bool {
@@ -80,6 +93,25 @@ func (i *MergedIterator) Seek(key []byte) bool {
 	return !i.last
 }
 
+// SeekForPrev position each iterator at its last key at or before given
+// key, and pick the largest of them.
+func (i *MergedIterator) SeekForPrev(key []byte) bool {
+	if i.err != nil {
+		return false
+	}
+
+	for _, p := range i.iters {
+		if !p.SeekForPrev(key) && p.Error() != nil {
+			i.err = p.Error()
+			return false
+		}
+	}
+	i.largest()
+	i.backward = true
+	i.last = false
+	return i.iter != nil
+}
+
 func (i *MergedIterator) Next() bool {
 	if i.err != nil {
 		return false
@@ -107,10 +139,12 @@ func (i *MergedIterator) Next() bool {
 			}
 		}
 		i.backward = false
+		i.iter.Next()
+		i.smallest()
+	} else {
+		i.iter.Next()
+		i.fix()
 	}
-
-	i.iter.Next()
-	i.smallest()
 	i.last = i.iter == nil
 	return !i.last
 }
@@ -144,10 +178,12 @@ func (i *MergedIterator) Prev() bool {
 			}
 		}
 		i.backward = true
+		i.iter.Prev()
+		i.largest()
+	} else {
+		i.iter.Prev()
+		i.fix()
 	}
-
-	i.iter.Prev()
-	i.largest()
 	return i.iter != nil
 }
 
@@ -165,30 +201,112 @@ func (i *MergedIterator) Value() []byte {
 	return i.iter.Value()
 }
 
+func (i *MergedIterator) KeyCopy(dst []byte) []byte {
+	if i.iter == nil || i.err != nil {
+		return dst
+	}
+	return i.iter.KeyCopy(dst)
+}
+
+func (i *MergedIterator) ValueCopy(dst []byte) []byte {
+	if i.iter == nil || i.err != nil {
+		return dst
+	}
+	return i.iter.ValueCopy(dst)
+}
+
+// Release release all merged iterators.
+func (i *MergedIterator) Release() {
+	for _, p := range i.iters {
+		p.Release()
+	}
+	i.iters = nil
+	i.heap = mergedHeap{}
+	i.iter = nil
+}
+
 func (i *MergedIterator) Error() error {
 	return i.err
 }
 
+// Rebuild the heap of valid iterators, with the smallest key on top.
 func (i *MergedIterator) smallest() {
-	i.iter = nil
-	for _, p := range i.iters {
-		if !p.Valid() {
-			continue
-		}
-		if i.iter == nil || i.cmp.Compare(p.Key(), i.iter.Key()) < 0 {
-			i.iter = p
-		}
-	}
+	i.heap.backward = false
+	i.rebuild()
 }
 
+// Rebuild the heap of valid iterators, with the largest key on top.
 func (i *MergedIterator) largest() {
-	i.iter = nil
-	for _, p := range i.iters {
-		if !p.Valid() {
-			continue
-		}
-		if i.iter == nil || i.cmp.Compare(p.Key(), i.iter.Key()) > 0 {
-			i.iter = p
+	i.heap.backward = true
+	i.rebuild()
+}
+
+func (i *MergedIterator) rebuild() {
+	h := &i.heap
+	h.idx = h.idx[:0]
+	for x, p := range i.iters {
+		if p.Valid() {
+			h.idx = append(h.idx, x)
 		}
 	}
+	heap.Init(h)
+	i.top()
+}
+
+// Restore the heap after the top iterator has moved in the heap
+// direction.
+func (i *MergedIterator) fix() {
+	if i.iter.Valid() {
+		heap.Fix(&i.heap, 0)
+	} else {
+		heap.Pop(&i.heap)
+	}
+	i.top()
+}
+
+func (i *MergedIterator) top() {
+	if len(i.heap.idx) == 0 {
+		i.iter = nil
+	} else {
+		i.iter = i.iters[i.heap.idx[0]]
+	}
+}
+
+// mergedHeap implement heap.Interface over indexes of iterators; ties are
+// broken by index, so the first iterator holding a key is picked.
+type mergedHeap struct {
+	iters    []Iterator
+	cmp      comparer.Comparer
+	idx      []int
+	backward bool
+}
+
+func (h *mergedHeap) Len() int {
+	return len(h.idx)
+}
+
+func (h *mergedHeap) Less(a, b int) bool {
+	x, y := h.idx[a], h.idx[b]
+	r := h.cmp.Compare(h.iters[x].Key(), h.iters[y].Key())
+	if r == 0 {
+		return x < y
+	}
+	if h.backward {
+		return r > 0
+	}
+	return r < 0
+}
+
+func (h *mergedHeap) Swap(a, b int) {
+	h.idx[a], h.idx[b] = h.idx[b], h.idx[a]
+}
+
+func (h *mergedHeap) Push(x interface{}) {
+	h.idx = append(h.idx, x.(int))
+}
+
+func (h *mergedHeap) Pop() interface{} {
+	x := h.idx[len(h.idx)-1]
+	h.idx = h.idx[:len(h.idx)-1]
+	return x
 }
@@ -0,0 +1,122 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package iterator
+
+import "github.com/syndtr/goleveldb/leveldb/comparer"
+
+// RangeIterator represent an iterator bounded to a key range. Keys outside
+// of [start, limit) are never yielded; First and Last are clamped to the
+// range and seeking before start positions at the first key of the range.
+// A nil start or limit means the range is unbounded on that side.
+type RangeIterator struct {
+	iter         Iterator
+	cmp          comparer.BasicComparer
+	start, limit []byte
+
+	valid bool
+}
+
+// NewRangeIterator create new iterator bounding given iterator to key range
+// [start, limit), keys are compared using given comparer.
+func NewRangeIterator(iter Iterator, start, limit []byte, cmp comparer.BasicComparer) *RangeIterator {
+	return &RangeIterator{iter: iter, cmp: cmp, start: start, limit: limit}
+}
+
+func (i *RangeIterator) check(ok bool) bool {
+	if ok {
+		key := i.iter.Key()
+		ok = (i.start == nil || i.cmp.Compare(key, i.start) >= 0) &&
+			(i.limit == nil || i.cmp.Compare(key, i.limit) < 0)
+	}
+	i.valid = ok
+	return ok
+}
+
+func (i *RangeIterator) Valid() bool {
+	return i.valid
+}
+
+func (i *RangeIterator) First() bool {
+	if i.start != nil {
+		return i.check(i.iter.Seek(i.start))
+	}
+	return i.check(i.iter.First())
+}
+
+func (i *RangeIterator) Last() bool {
+	if i.limit != nil {
+		if i.iter.Seek(i.limit) {
+			return i.check(i.iter.Prev())
+		}
+		if i.iter.Error() != nil {
+			return i.check(false)
+		}
+	}
+	return i.check(i.iter.Last())
+}
+
+func (i *RangeIterator) Seek(key []byte) bool {
+	if i.start != nil && i.cmp.Compare(key, i.start) < 0 {
+		key = i.start
+	}
+	return i.check(i.iter.Seek(key))
+}
+
+func (i *RangeIterator) SeekForPrev(key []byte) bool {
+	if i.limit != nil && i.cmp.Compare(key, i.limit) >= 0 {
+		return i.Last()
+	}
+	return i.check(i.iter.SeekForPrev(key))
+}
+
+// Next moves to the next key; once the underlying iterator is positioned
+// out of the range the iterator is not valid, but it still can move back
+// into the range.
+func (i *RangeIterator) Next() bool {
+	return i.check(i.iter.Next())
+}
+
+func (i *RangeIterator) Prev() bool {
+	return i.check(i.iter.Prev())
+}
+
+func (i *RangeIterator) Key() []byte {
+	if !i.valid {
+		return nil
+	}
+	return i.iter.Key()
+}
+
+func (i *RangeIterator) Value() []byte {
+	if !i.valid {
+		return nil
+	}
+	return i.iter.Value()
+}
+
+func (i *RangeIterator) KeyCopy(dst []byte) []byte {
+	if !i.valid {
+		return dst
+	}
+	return i.iter.KeyCopy(dst)
+}
+
+func (i *RangeIterator) ValueCopy(dst []byte) []byte {
+	if !i.valid {
+		return dst
+	}
+	return i.iter.ValueCopy(dst)
+}
+
+func (i *RangeIterator) Release() {
+	i.iter.Release()
+	i.valid = false
+}
+
+func (i *RangeIterator) Error() error {
+	return i.iter.Error()
+}
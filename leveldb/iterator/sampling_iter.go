@@ -0,0 +1,99 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package iterator
+
+// SamplingIterator represent an iterator that yield every nth key of
+// another iterator. Each Next or Prev moves the underlying iterator n
+// times, thus entries are visited in order with a fixed stride starting
+// from wherever the iterator was positioned by First, Last, Seek or
+// SeekForPrev. Moving past either end of the underlying iterator makes
+// the iterator invalid, even if the last stride was partial.
+type SamplingIterator struct {
+	iter Iterator
+	n    int
+}
+
+// NewSamplingIterator create new iterator yielding every nth key of given
+// iterator; n less than one is one.
+func NewSamplingIterator(iter Iterator, n int) *SamplingIterator {
+	if n < 1 {
+		n = 1
+	}
+	return &SamplingIterator{iter: iter, n: n}
+}
+
+func (i *SamplingIterator) Valid() bool {
+	return i.iter.Valid()
+}
+
+func (i *SamplingIterator) First() bool {
+	return i.iter.First()
+}
+
+func (i *SamplingIterator) Last() bool {
+	return i.iter.Last()
+}
+
+func (i *SamplingIterator) Seek(key []byte) bool {
+	return i.iter.Seek(key)
+}
+
+func (i *SamplingIterator) SeekForPrev(key []byte) bool {
+	return i.iter.SeekForPrev(key)
+}
+
+// Next moves n entries forward; if the iterator is not positioned yet,
+// it moves to the first entry instead.
+func (i *SamplingIterator) Next() bool {
+	if !i.iter.Valid() {
+		return i.iter.Next()
+	}
+	for j := 0; j < i.n; j++ {
+		if !i.iter.Next() {
+			return false
+		}
+	}
+	return true
+}
+
+// Prev moves n entries backward; if the iterator is past the last entry,
+// it moves to the last entry instead.
+func (i *SamplingIterator) Prev() bool {
+	if !i.iter.Valid() {
+		return i.iter.Prev()
+	}
+	for j := 0; j < i.n; j++ {
+		if !i.iter.Prev() {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *SamplingIterator) Key() []byte {
+	return i.iter.Key()
+}
+
+func (i *SamplingIterator) Value() []byte {
+	return i.iter.Value()
+}
+
+func (i *SamplingIterator) KeyCopy(dst []byte) []byte {
+	return i.iter.KeyCopy(dst)
+}
+
+func (i *SamplingIterator) ValueCopy(dst []byte) []byte {
+	return i.iter.ValueCopy(dst)
+}
+
+func (i *SamplingIterator) Release() {
+	i.iter.Release()
+}
+
+func (i *SamplingIterator) Error() error {
+	return i.iter.Error()
+}
@@ -87,3 +87,128 @@ func TestJournalSimpleRandomLong(t *testing.T) {
 	}
 	h.Test()
 }
+
+func TestJournalPreallocated(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	var records [][]byte
+	w := NewWriter(buf)
+	for i := 0; i < 50; i++ {
+		v := randomString(rand.Intn(BlockSize / 4))
+		if err := w.Append(v); err != nil {
+			t.Fatalf("error when adding record: '%d': %v", i, err)
+		}
+		records = append(records, v)
+	}
+	if w.Size() != int64(buf.Len()) {
+		t.Errorf("invalid writer size, want %d, got %d", buf.Len(), w.Size())
+	}
+
+	// Emulate preallocated space that was never written.
+	buf.Write(make([]byte, BlockSize*3+BlockSize/2))
+
+	dropf := func(n int, reason string) {
+		t.Errorf("unexpected drop of %d bytes: %s", n, reason)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), 0, true, dropf)
+	if err != nil {
+		t.Fatalf("cannot create reader: %s", err)
+	}
+	for i, v := range records {
+		if !r.Next() {
+			t.Fatalf("early eof on record: '%d'", i)
+		}
+		if !bytes.Equal(v, r.Record()) {
+			t.Errorf("record '%d' is not equal", i)
+		}
+	}
+	if r.Next() {
+		t.Error("expecting eof")
+	}
+	if r.Error() != nil {
+		t.Error("got error: ", r.Error())
+	}
+}
+
+func TestJournalAppendParts(t *testing.T) {
+	buf1, buf2 := new(bytes.Buffer), new(bytes.Buffer)
+	w1, w2 := NewWriter(buf1), NewWriter(buf2)
+	for i := 0; i < 20; i++ {
+		var parts [][]byte
+		var v []byte
+		for j := rand.Intn(4); j >= 0; j-- {
+			p := randomString(rand.Intn(BlockSize * 2))
+			parts = append(parts, p)
+			v = append(v, p...)
+		}
+		if err := w1.Append(v); err != nil {
+			t.Fatalf("error when adding record: '%d': %v", i, err)
+		}
+		if err := w2.AppendParts(parts...); err != nil {
+			t.Fatalf("error when adding record parts: '%d': %v", i, err)
+		}
+	}
+	if !bytes.Equal(buf1.Bytes(), buf2.Bytes()) {
+		t.Error("journal written by parts differ")
+	}
+	if w1.Size() != w2.Size() {
+		t.Errorf("invalid writer size, want %d, got %d", w1.Size(), w2.Size())
+	}
+}
+
+func TestJournalVersion(t *testing.T) {
+	read := func(b []byte) (*Reader, [][]byte) {
+		r, err := NewReader(bytes.NewReader(b), 0, true, func(n int, reason string) {
+			t.Errorf("unexpected drop of %d bytes: %s", n, reason)
+		})
+		if err != nil {
+			t.Fatalf("cannot create reader: %s", err)
+		}
+		var records [][]byte
+		for r.Next() {
+			records = append(records, append([]byte{}, r.Record()...))
+		}
+		return r, records
+	}
+
+	// Unversioned journal.
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	w.Append([]byte("foo"))
+	r, records := read(buf.Bytes())
+	if r.Error() != nil || len(records) != 1 || r.Version() != 0 {
+		t.Errorf("unversioned: got error %v, %d records, version %d", r.Error(), len(records), r.Version())
+	}
+
+	// Current version.
+	buf.Reset()
+	w = NewWriter(buf)
+	if err := w.WriteVersion(); err != nil {
+		t.Fatal("WriteVersion: got error: ", err)
+	}
+	w.Append([]byte("foo"))
+	w.Append(randomString(BlockSize * 2))
+	if w.Size() != int64(buf.Len()) {
+		t.Errorf("invalid writer size, want %d, got %d", buf.Len(), w.Size())
+	}
+	r, records = read(buf.Bytes())
+	if r.Error() != nil || len(records) != 2 || r.Version() != Version {
+		t.Errorf("versioned: got error %v, %d records, version %d", r.Error(), len(records), r.Version())
+	}
+	if !bytes.Equal(records[0], []byte("foo")) {
+		t.Errorf("versioned: first record is %q", records[0])
+	}
+
+	// Newer version.
+	buf.Reset()
+	w = NewWriter(buf)
+	w.write(tVersion, []byte{Version + 1})
+	w.Append([]byte("foo"))
+	r, records = read(buf.Bytes())
+	if len(records) != 0 {
+		t.Errorf("newer version: got %d records", len(records))
+	}
+	if err, ok := r.Error().(*ErrVersion); !ok || err.Version != Version+1 {
+		t.Errorf("newer version: got error %v, want ErrVersion", r.Error())
+	}
+}
@@ -10,6 +10,7 @@ package journal
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"os"
 
@@ -18,12 +19,23 @@ import (
 
 type DropFunc func(n int, reason string)
 
+// ErrVersion is returned by the reader if the journal was written in a
+// format newer than supported by this package.
+type ErrVersion struct {
+	Version int
+}
+
+func (e *ErrVersion) Error() string {
+	return fmt.Sprintf("journal: unsupported format version %d, max supported is %d", e.Version, Version)
+}
+
 // Reader represent a journal reader.
 type Reader struct {
 	r        io.ReadSeeker
 	checksum bool
 	dropf    DropFunc
 
+	version   int
 	eof       bool
 	rbuf, buf []byte
 	record    []byte
@@ -114,6 +126,16 @@ func (r *Reader) Next() bool {
 			} else {
 				r.drop(len(rec), "missing start of fragmented record; tag=last")
 			}
+		case tVersion:
+			if len(rec) != 1 {
+				r.drop(len(rec), "bad version record")
+				continue
+			}
+			if v := int(rec[0]); v > Version {
+				r.err = &ErrVersion{Version: v}
+				return false
+			}
+			r.version = int(rec[0])
 		case tEof:
 			if inFragment {
 				r.drop(buf.Len(), "partial record without end; tag=eof")
@@ -135,6 +157,12 @@ func (r *Reader) Record() []byte {
 	return r.record
 }
 
+// Version return the format version of the journal, as found so far by
+// Next; zero if the journal has no version marker.
+func (r *Reader) Version() int {
+	return r.version
+}
+
 // Error return any record produced by previous operation.
 func (r *Reader) Error() error {
 	return r.err
@@ -178,15 +206,34 @@ retry:
 	rtype = uint(r.buf[6])
 
 	// check whether the header is sane
-	if len(r.buf) < kHeaderSize+recLen || rtype > tLast {
+	if len(r.buf) < kHeaderSize+recLen && r.eof {
+		// The last record was not fully written before a crash; drop
+		// the torn tail and treat it as end of file.
+		r.drop(len(r.buf), "truncated record at end of file")
+		r.buf = nil
+		rtype = tEof
+		return
+	} else if len(r.buf) < kHeaderSize+recLen || rtype > tVersion {
 		rtype = tCorrupt
 		r.drop(len(r.buf), "header corrupted")
+	} else if rtype == tZero && recLen == 0 {
+		// Skip zero length record without reporting any drops since
+		// such records are produced by preallocated journal file.
+		rtype = tCorrupt
 	} else if r.checksum {
 		// decode the checksum
 		recCrc := hash.UnmaskCRC32(binary.LittleEndian.Uint32(r.buf))
 		crc := hash.NewCRC32C()
 		crc.Write(r.buf[6 : kHeaderSize+recLen])
 		if crc.Sum32() != recCrc {
+			if r.eof && kHeaderSize+recLen == len(r.buf) {
+				// A mismatch on the very last record of the file is
+				// a torn write rather than corruption.
+				r.drop(len(r.buf), "truncated record at end of file")
+				r.buf = nil
+				rtype = tEof
+				return
+			}
 			// Drop the rest of the buffer since "length" itself may have
 			// been corrupted and if we trust it, we could find some
 			// fragment of a real journal record that just happens to look
@@ -10,6 +10,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"os"
 
 	"github.com/syndtr/goleveldb/leveldb/hash"
 )
@@ -21,6 +22,7 @@ const (
 	tFirst
 	tMiddle
 	tLast
+	tVersion
 
 	// Internal use
 	tCorrupt
@@ -33,6 +35,10 @@ const (
 
 	// Header is checksum (4 bytes), length (2 bytes), type (1 byte).
 	kHeaderSize = 4 + 2 + 1
+
+	// Journal format version written by WriteVersion. Journals without
+	// a version marker are version 0.
+	Version = 1
 )
 
 var sixZero [6]byte
@@ -43,6 +49,7 @@ type Writer struct {
 	buf bytes.Buffer
 
 	boff int
+	size int64
 }
 
 // NewWriter create new initialized journal writer.
@@ -50,8 +57,34 @@ func NewWriter(w io.Writer) *Writer {
 	return &Writer{w: w}
 }
 
+// WriteVersion write the format version marker, it should be the first
+// record of the journal.
+func (w *Writer) WriteVersion() error {
+	if w.boff+kHeaderSize+1 > BlockSize {
+		return os.ErrInvalid
+	}
+	if err := w.write(tVersion, []byte{Version}); err != nil {
+		return err
+	}
+	w.boff += kHeaderSize + 1
+	return nil
+}
+
 // Append append record to the journal.
-func (w *Writer) Append(record []byte) (err error) {
+func (w *Writer) Append(record []byte) error {
+	return w.AppendParts(record)
+}
+
+// AppendParts append a record made of given parts, concatenated, to the
+// journal; the parts are written out as is, without being concatenated
+// first.
+func (w *Writer) AppendParts(parts ...[]byte) (err error) {
+	rem := 0
+	for _, p := range parts {
+		rem += len(p)
+	}
+	var frag [][]byte
+	var pi, poff int
 	begin := true
 	for {
 		leftover := BlockSize - w.boff
@@ -62,12 +95,13 @@ func (w *Writer) Append(record []byte) (err error) {
 				if err != nil {
 					return
 				}
+				w.size += int64(leftover)
 			}
 			w.boff = 0
 		}
 
 		avail := BlockSize - w.boff - kHeaderSize
-		fragLen := len(record)
+		fragLen := rem
 		end := true
 		if fragLen > avail {
 			fragLen = avail
@@ -83,31 +117,51 @@ func (w *Writer) Append(record []byte) (err error) {
 			rtype = tLast
 		}
 
-		err = w.write(rtype, record[:fragLen])
+		// Gather fragment from the parts
+		frag = frag[:0]
+		for n := fragLen; n > 0; {
+			p := parts[pi][poff:]
+			if len(p) > n {
+				p = p[:n]
+				poff += n
+			} else {
+				pi++
+				poff = 0
+			}
+			frag = append(frag, p)
+			n -= len(p)
+		}
+
+		err = w.writeFrag(rtype, fragLen, frag)
 		if err != nil {
 			return
 		}
 
-		record = record[fragLen:]
+		rem -= fragLen
 		begin = false
 
 		w.boff += kHeaderSize + fragLen
 
-		if len(record) <= 0 {
+		if rem <= 0 {
 			break
 		}
 	}
 	return
 }
 
-func (w *Writer) write(rtype uint, record []byte) (err error) {
-	rlen := len(record)
+func (w *Writer) write(rtype uint, record []byte) error {
+	return w.writeFrag(rtype, len(record), [][]byte{record})
+}
+
+func (w *Writer) writeFrag(rtype uint, rlen int, frag [][]byte) (err error) {
 	buf := &w.buf
 	buf.Reset()
 
 	crc := hash.NewCRC32C()
 	crc.Write([]byte{byte(rtype)})
-	crc.Write(record)
+	for _, p := range frag {
+		crc.Write(p)
+	}
 	binary.Write(buf, binary.LittleEndian, hash.MaskCRC32(crc.Sum32()))
 
 	buf.WriteByte(byte(rlen & 0xff))
@@ -115,8 +169,19 @@ func (w *Writer) write(rtype uint, record []byte) (err error) {
 	buf.WriteByte(byte(rtype))
 
 	_, err = buf.WriteTo(w.w)
+	for _, p := range frag {
+		if err != nil {
+			break
+		}
+		_, err = w.w.Write(p)
+	}
 	if err == nil {
-		_, err = w.w.Write(record)
+		w.size += int64(kHeaderSize + rlen)
 	}
 	return err
 }
+
+// Size return the number of bytes written so far.
+func (w *Writer) Size() int64 {
+	return w.size
+}
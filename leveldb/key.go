@@ -19,10 +19,21 @@ func (t vType) String() string {
 		return "d"
 	case tVal:
 		return "v"
+	case tMerge:
+		return "m"
+	case tRangeDel:
+		return "r"
+	case tTTL:
+		return "t"
 	}
 	return "x"
 }
 
+// Check whether t is a valid value type, without flags.
+func (t vType) valid() bool {
+	return t == tDel || t == tVal || t == tMerge || t == tRangeDel || t == tTTL
+}
+
 // Value types encoded as the last component of internal keys.
 // Don't modify; this value are saved to disk.
 const (
@@ -30,12 +41,31 @@ const (
 	tVal
 )
 
+// tTs flags that an internal key carries a user-defined timestamp. Such
+// internal keys are laid out as user key, 8-bytes timestamp and 8-bytes
+// packed sequence number and type.
+const tTs vType = 2
+
+// tMerge is the value type of merge operands, which are combined with
+// the older entries of the same user key by opt.Merger. Its bit doesn't
+// overlap with tTs.
+const tMerge vType = 4
+
+// tRangeDel is the value type of range tombstones; the user key is the
+// start of the deleted range and the value is its exclusive limit.
+const tRangeDel vType = 5
+
+// tTTL is the value type of values with an expiry; the value is prefixed
+// by 8-bytes expiry time in Unix nanoseconds. Expired values read as
+// deleted.
+const tTTL vType = 8
+
 // tSeek defines the vType that should be passed when constructing an
 // internal key for seeking to a particular sequence number (since we
 // sort sequence numbers in decreasing order and the value type is
 // embedded as the low 8 bits in the sequence number in internal keys,
 // we need to use the highest-numbered ValueType, not the lowest).
-const tSeek = tVal
+const tSeek = tTTL
 
 const (
 	// Maximum value possible for sequence number; the 8-bits are
@@ -44,6 +74,8 @@ const (
 	kMaxSeq uint64 = (uint64(1) << 56) - 1
 	// Maximum value possible for packed sequence number and type.
 	kMaxNum uint64 = (kMaxSeq << 8) | uint64(tSeek)
+	// Maximum value possible for timestamp.
+	kMaxTs uint64 = ^uint64(0)
 )
 
 // Maximum number encoded in bytes.
@@ -56,7 +88,7 @@ func init() {
 type iKey []byte
 
 func newIKey(ukey []byte, seq uint64, t vType) iKey {
-	if seq > kMaxSeq || t > tVal {
+	if seq > kMaxSeq || !t.valid() {
 		panic("invalid seq number or value type")
 	}
 
@@ -66,6 +98,29 @@ func newIKey(ukey []byte, seq uint64, t vType) iKey {
 	return b
 }
 
+// newIKeyTs create internal key with given timestamp; zero timestamp
+// means no timestamp.
+func newIKeyTs(ukey []byte, ts, seq uint64, t vType) iKey {
+	if ts == 0 {
+		return newIKey(ukey, seq, t)
+	}
+	if seq > kMaxSeq || !t.valid() {
+		panic("invalid seq number or value type")
+	}
+
+	b := make(iKey, len(ukey)+16)
+	copy(b, ukey)
+	binary.LittleEndian.PutUint64(b[len(ukey):], ts)
+	binary.LittleEndian.PutUint64(b[len(ukey)+8:], (seq<<8)|uint64(t|tTs))
+	return b
+}
+
+// newSeekIKey create internal key that sorts before any entries of given
+// user key visible at given seq number, including timestamped ones.
+func newSeekIKey(ukey []byte, seq uint64) iKey {
+	return newIKeyTs(ukey, kMaxTs, seq, tSeek)
+}
+
 func (p iKey) assert() {
 	if p == nil {
 		panic("nil iKey")
@@ -75,11 +130,26 @@ func (p iKey) assert() {
 	}
 }
 
+func (p iKey) hasTs() bool {
+	return len(p) >= 16 && vType(p[len(p)-8])&tTs != 0
+}
+
 func (p iKey) ukey() []byte {
 	p.assert()
+	if p.hasTs() {
+		return p[:len(p)-16]
+	}
 	return p[:len(p)-8]
 }
 
+// Return timestamp of the internal key; zero if it has none.
+func (p iKey) ts() uint64 {
+	if p.hasTs() {
+		return binary.LittleEndian.Uint64(p[len(p)-16:])
+	}
+	return 0
+}
+
 func (p iKey) num() uint64 {
 	p.assert()
 	return binary.LittleEndian.Uint64(p[len(p)-8:])
@@ -94,7 +164,13 @@ func (p iKey) parseNum() (seq uint64, t vType, ok bool) {
 	}
 	num := p.num()
 	seq, t = uint64(num>>8), vType(num&0xff)
-	if t > tVal {
+	if t&tTs != 0 {
+		if len(p) < 16 {
+			return 0, 0, false
+		}
+		t &^= tTs
+	}
+	if !t.valid() {
 		return 0, 0, false
 	}
 	ok = true
@@ -106,7 +182,68 @@ func (p iKey) String() string {
 		return "<nil>"
 	}
 	if seq, t, ok := p.parseNum(); ok {
+		if p.hasTs() {
+			return fmt.Sprintf("%s@%d:%s:%d", shorten(string(p.ukey())), p.ts(), t, seq)
+		}
 		return fmt.Sprintf("%s:%s:%d", shorten(string(p.ukey())), t, seq)
 	}
 	return "<invalid>"
 }
+
+// KeyType is the type of an internal key, as iterated by DB.NewRawIterator.
+type KeyType int
+
+// Types of internal keys.
+const (
+	KeyTypeDeletion      = KeyType(tDel)
+	KeyTypeValue         = KeyType(tVal)
+	KeyTypeMerge         = KeyType(tMerge)
+	KeyTypeRangeDeletion = KeyType(tRangeDel)
+
+	// Value prefixed by its 8-bytes little-endian expiry time in Unix
+	// nanoseconds, as written by PutWithTTL.
+	KeyTypeTTL = KeyType(tTTL)
+)
+
+func (t KeyType) String() string {
+	switch t {
+	case KeyTypeDeletion:
+		return "deletion"
+	case KeyTypeValue:
+		return "value"
+	case KeyTypeMerge:
+		return "merge"
+	case KeyTypeRangeDeletion:
+		return "range-deletion"
+	case KeyTypeTTL:
+		return "ttl-value"
+	}
+	return fmt.Sprintf("KeyType(%d)", int(t))
+}
+
+// ParseInternalKey parse given internal key into its user key, sequence
+// number and type; ok is false if the key is malformed. The returned user
+// key share the backing array of given key.
+func ParseInternalKey(ikey []byte) (ukey []byte, seq uint64, t KeyType, ok bool) {
+	if ikey == nil {
+		return
+	}
+	p := iKey(ikey)
+	seq, vt, ok := p.parseNum()
+	if !ok {
+		return
+	}
+	return p.ukey(), seq, KeyType(vt), true
+}
+
+// InternalKeyTimestamp return the user-defined timestamp of given internal
+// key; zero if it has none.
+func InternalKeyTimestamp(ikey []byte) uint64 {
+	return iKey(ikey).ts()
+}
+
+// InternalSeekKey return an internal key that sort before every internal
+// key of given user key, thus may be passed to Seek of a raw iterator.
+func InternalSeekKey(ukey []byte) []byte {
+	return newSeekIKey(ukey, kMaxSeq)
+}
@@ -63,6 +63,34 @@ func TestIKey_EncodeDecode(t *testing.T) {
 	}
 }
 
+func TestIKey_Timestamp(t *testing.T) {
+	ik := newIKeyTs([]byte("hello"), 42, 7, tDel)
+	if !bytes.Equal(ik.ukey(), []byte("hello")) {
+		t.Errorf("user key does not equal, got %q", ik.ukey())
+	}
+	if ts := ik.ts(); ts != 42 {
+		t.Errorf("timestamp does not equal, got %d, want 42", ts)
+	}
+	if seq, vt, ok := ik.parseNum(); !ok || seq != 7 || vt != tDel {
+		t.Errorf("invalid seq and type, got %d %v %v", seq, vt, ok)
+	}
+
+	// Higher timestamp first, then higher seq number first
+	ordered := []iKey{
+		newSeekIKey([]byte("a"), kMaxSeq),
+		newIKeyTs([]byte("a"), 10, 1, tVal),
+		newIKeyTs([]byte("a"), 5, 3, tVal),
+		newIKeyTs([]byte("a"), 5, 2, tVal),
+		ikey("a", 4, tVal),
+		ikey("b", 9, tVal),
+	}
+	for i := 1; i < len(ordered); i++ {
+		if icmp.Compare(ordered[i-1], ordered[i]) >= 0 {
+			t.Errorf("invalid order, %v should sort before %v", ordered[i-1], ordered[i])
+		}
+	}
+}
+
 func assertBytes(t *testing.T, want, got []byte) {
 	if !bytes.Equal(got, want) {
 		t.Errorf("assert failed, got %v, want %v", got, want)
@@ -22,10 +22,22 @@ type mNode struct {
 	key   []byte
 	value []byte
 	next  []unsafe.Pointer
+
+	// value is owned by the caller, see PutRef
+	ref bool
 }
 
 func newNode(key, value []byte, height int32) *mNode {
-	return &mNode{key, value, make([]unsafe.Pointer, height)}
+	return &mNode{key: key, value: value, next: make([]unsafe.Pointer, height)}
+}
+
+// Return value of the node; a value owned by the caller is capped to its
+// length, so that appending to it never writes into caller memory.
+func (p *mNode) getValue() []byte {
+	if p.ref {
+		return p.value[:len(p.value):len(p.value)]
+	}
+	return p.value
 }
 
 func (p *mNode) getNext(n int) *mNode {
@@ -71,9 +83,21 @@ func New(cmp comparer.BasicComparer) *DB {
 // Put insert given key and value to the database. Need external synchronization.
 // Key and value will not be copied; and should not modified after this point.
 func (p *DB) Put(key []byte, value []byte) {
+	p.put(key, value, false)
+}
+
+// PutRef is like Put, but the value is flagged as owned by the caller;
+// values so flagged are only handed out capped to their length. Need
+// external synchronization.
+func (p *DB) PutRef(key []byte, value []byte) {
+	p.put(key, value, true)
+}
+
+func (p *DB) put(key []byte, value []byte, ref bool) {
 	if m, exact := p.findGE_NB(key, true); exact {
 		h := int32(len(m.next))
 		x := newNode(key, value, h)
+		x.ref = ref
 		for i, n := range p.prev[:h] {
 			x.setNext_NB(i, m.getNext_NB(i))
 			n.setNext(i, x)
@@ -91,6 +115,7 @@ func (p *DB) Put(key []byte, value []byte) {
 	}
 
 	x := newNode(key, value, h)
+	x.ref = ref
 	for i, n := range p.prev[:h] {
 		x.setNext_NB(i, n.getNext_NB(i))
 		n.setNext(i, x)
@@ -125,7 +150,7 @@ func (p *DB) Contains(key []byte) bool {
 // Get return value for the given key.
 func (p *DB) Get(key []byte) (value []byte, err error) {
 	if x, exact := p.findGE(key, false); exact {
-		return x.value, nil
+		return x.getValue(), nil
 	}
 	return nil, errors.ErrNotFound
 }
@@ -133,7 +158,7 @@ func (p *DB) Get(key []byte) (value []byte, err error) {
 // Find return key/value equal or greater than given key.
 func (p *DB) Find(key []byte) (rkey, value []byte, err error) {
 	if x, _ := p.findGE(key, false); x != nil {
-		return x.key, x.value, nil
+		return x.key, x.getValue(), nil
 	}
 	return nil, nil, errors.ErrNotFound
 }
@@ -267,20 +292,42 @@ func (i *Iterator) Valid() bool {
 }
 
 func (i *Iterator) First() bool {
+	if i.p == nil {
+		return false
+	}
 	i.node = i.p.head.getNext(0)
 	return i.Valid()
 }
 
 func (i *Iterator) Last() bool {
+	if i.p == nil {
+		return false
+	}
 	i.node = i.p.findLast()
 	return i.Valid()
 }
 
 func (i *Iterator) Seek(key []byte) (r bool) {
+	if i.p == nil {
+		return false
+	}
 	i.node, _ = i.p.findGE(key, false)
 	return i.Valid()
 }
 
+func (i *Iterator) SeekForPrev(key []byte) bool {
+	if i.p == nil {
+		return false
+	}
+	var exact bool
+	i.node, exact = i.p.findGE(key, false)
+	if !exact {
+		i.node = i.p.findLT(key)
+	}
+	i.onLast = false
+	return i.Valid()
+}
+
 func (i *Iterator) Next() bool {
 	if i.node == nil {
 		return i.First()
@@ -315,7 +362,28 @@ func (i *Iterator) Value() []byte {
 	if !i.Valid() {
 		return nil
 	}
-	return i.node.value
+	return i.node.getValue()
+}
+
+func (i *Iterator) KeyCopy(dst []byte) []byte {
+	if !i.Valid() {
+		return dst
+	}
+	return append(dst, i.node.key...)
+}
+
+func (i *Iterator) ValueCopy(dst []byte) []byte {
+	if !i.Valid() {
+		return dst
+	}
+	return append(dst, i.node.value...)
+}
+
+// Release drop the reference to the database.
+func (i *Iterator) Release() {
+	i.p = nil
+	i.node = nil
+	i.onLast = false
 }
 
 func (i *Iterator) Error() error { return nil }
@@ -172,3 +172,65 @@ func BenchmarkGetRandom(b *testing.B) {
 		p.Get(buf[rand.Int()%b.N][:])
 	}
 }
+
+func TestIteratorSeekForPrev(t *testing.T) {
+	p := New(comparer.BytesComparer{})
+	for _, key := range []string{"b", "d", "f"} {
+		p.Put([]byte(key), nil)
+	}
+
+	iter := p.NewIterator()
+	for _, x := range []struct{ key, want string }{
+		{"a", ""},
+		{"b", "b"},
+		{"c", "b"},
+		{"d", "d"},
+		{"e", "d"},
+		{"f", "f"},
+		{"g", "f"},
+	} {
+		ok := iter.SeekForPrev([]byte(x.key))
+		if got := string(iter.Key()); ok != (x.want != "") || got != x.want {
+			t.Errorf("SeekForPrev(%q): want=%q got=%q", x.key, x.want, got)
+		}
+	}
+
+	// Before first key, Next start over from first key
+	iter.SeekForPrev([]byte("a"))
+	if !iter.Next() || string(iter.Key()) != "b" {
+		t.Errorf("Next after SeekForPrev before first key: want=%q got=%q", "b", iter.Key())
+	}
+}
+
+func TestPutRef(t *testing.T) {
+	p := New(comparer.BytesComparer{})
+	buf := []byte("foovaluebarvalue")
+	p.Put([]byte("bar"), buf[8:16])
+	p.PutRef([]byte("foo"), buf[:8])
+
+	if v, err := p.Get([]byte("foo")); err != nil || string(v) != "foovalue" {
+		t.Fatalf("Get: invalid value, got=%q err=%v", v, err)
+	} else if cap(v) != len(v) {
+		t.Errorf("Get: value not capped, len=%d cap=%d", len(v), cap(v))
+	} else {
+		_ = append(v, "xxx"...)
+	}
+	if string(buf) != "foovaluebarvalue" {
+		t.Errorf("caller buffer modified by append to value: %q", buf)
+	}
+
+	iter := p.NewIterator()
+	for iter.Next() {
+		v := iter.Value()
+		if string(iter.Key()) == "foo" && cap(v) != len(v) {
+			t.Errorf("Iterator: value not capped, len=%d cap=%d", len(v), cap(v))
+		}
+	}
+	iter.Release()
+
+	// replaced entry is no longer owned by the caller
+	p.Put([]byte("foo"), buf[:3])
+	if _, v, err := p.Find([]byte("foo")); err != nil || cap(v) == len(v) {
+		t.Errorf("Find: invalid value after replace, len=%d cap=%d err=%v", len(v), cap(v), err)
+	}
+}
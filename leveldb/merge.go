@@ -0,0 +1,285 @@
+// Copyright (c) 2013, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var (
+	errNoMerger     = errors.ErrInvalid("merge operand found but no merger set")
+	errMergeFailed  = errors.ErrCorrupt("merger cannot apply merge operand")
+	errMergeOperand = errors.ErrInvalid("merge operand must be resolved")
+)
+
+// Apply given merge operands, given newest first, on top of given base
+// value; nil base means the key has no value.
+func applyMerge(merger opt.Merger, key, base []byte, ops [][]byte) (value []byte, err error) {
+	if merger == nil {
+		return nil, errNoMerger
+	}
+	value = base
+	for i := len(ops) - 1; i >= 0; i-- {
+		var ok bool
+		value, ok = merger.Merge(key, value, ops[i])
+		if !ok {
+			return nil, errMergeFailed
+		}
+	}
+	return
+}
+
+// getMerge lookup given key at given seq number within given mem and
+// version, whose newest visible entry is a merge operand; the operands
+// are resolved against older entries of the key.
+func (d *DB) getMerge(mem *memSet, v *version, key []byte, seq uint64, ro *opt.ReadOptions) (value []byte, err error) {
+	s := d.s
+	ucmp := s.cmp.cmp
+
+	// point lookups ignore the key range of read options
+	xro := &opt.ReadOptions{}
+	if ro != nil {
+		xro.Flag = ro.Flag
+	}
+	ii := []iterator.Iterator{mem.cur.NewIterator()}
+	if mem.froze != nil {
+		ii = append(ii, mem.froze.NewIterator())
+	}
+	ii = append(ii, v.getIterators(xro)...)
+	iter := iterator.NewMergedIterator(ii, s.cmp)
+	defer iter.Release()
+
+	// entries below floor are deleted by a range tombstone
+	var floor uint64
+	if rdels := getRangeDels(mem, v); rdels != nil {
+		floor = rdels.coverSeq(key, seq, ucmp)
+	}
+
+	var ops [][]byte
+	now := ttlNow()
+	for ok := iter.Seek(newSeekIKey(key, seq)); ok; ok = iter.Next() {
+		k := iKey(iter.Key())
+		if ucmp.Compare(k.ukey(), key) != 0 {
+			break
+		}
+		kseq, t, ok := k.parseNum()
+		if !ok || kseq > seq {
+			continue
+		}
+		if kseq < floor {
+			break
+		}
+		value := iter.Value()
+		t, value = resolveTTL(t, value, now)
+		switch t {
+		case tMerge:
+			ops = append(ops, dupBytes(iter.Value()))
+			continue
+		case tVal:
+			// the merger may return the value as is, which must
+			// outlive the iterator
+			return applyMerge(s.o.GetMerger(), key, dupBytes(value), ops)
+		}
+		break
+	}
+	if err = iter.Error(); err != nil {
+		return
+	}
+	if len(ops) == 0 {
+		return nil, errors.ErrNotFound
+	}
+	return applyMerge(s.o.GetMerger(), key, nil, ops)
+}
+
+// mergeCompactIter is a forward-only internal key iterator used by
+// compaction. It collapses merge operands which are visible to every
+// snapshot into a single value, whenever the operands can be fully
+// resolved: i.e. an older value or deletion of the key is found, or
+// isBase reports that no older entry of the key may exist elsewhere.
+// The value or deletion the operands are resolved against is consumed,
+// while operands on top of a TTL value are kept, as the value may expire.
+// Any other entry is passed through as is.
+type mergeCompactIter struct {
+	src    iterator.Iterator
+	merger opt.Merger
+	ucmp   comparer.BasicComparer
+	minSeq uint64
+	isBase func(ukey []byte) bool
+
+	ukey    []byte
+	hasUkey bool
+	visible bool // an entry of ukey visible at minSeq was passed
+	peeked  bool // src is positioned at an entry not yet returned
+	eoi     bool // src is exhausted
+	pending [][2][]byte
+
+	valid      bool
+	key, value []byte
+	err        error
+}
+
+func newMergeCompactIter(src iterator.Iterator, merger opt.Merger, ucmp comparer.BasicComparer, minSeq uint64, isBase func(ukey []byte) bool) *mergeCompactIter {
+	return &mergeCompactIter{src: src, merger: merger, ucmp: ucmp, minSeq: minSeq, isBase: isBase}
+}
+
+func (i *mergeCompactIter) set(key, value []byte) bool {
+	i.key, i.value = key, value
+	i.valid = true
+	return true
+}
+
+func (i *mergeCompactIter) Valid() bool {
+	return i.valid
+}
+
+func (i *mergeCompactIter) unsupported() bool {
+	i.valid = false
+	i.err = errors.ErrInvalid("merge compaction iterator is forward only")
+	return false
+}
+
+func (i *mergeCompactIter) First() bool                 { return i.unsupported() }
+func (i *mergeCompactIter) Last() bool                  { return i.unsupported() }
+func (i *mergeCompactIter) Seek(key []byte) bool        { return i.unsupported() }
+func (i *mergeCompactIter) SeekForPrev(key []byte) bool { return i.unsupported() }
+func (i *mergeCompactIter) Prev() bool                  { return i.unsupported() }
+
+func (i *mergeCompactIter) Next() bool {
+	if i.err != nil {
+		return false
+	}
+	if len(i.pending) > 0 {
+		kv := i.pending[0]
+		i.pending = i.pending[1:]
+		return i.set(kv[0], kv[1])
+	}
+	if i.eoi || (!i.peeked && !i.src.Next()) {
+		i.eoi = true
+		i.valid = false
+		return false
+	}
+	i.peeked = false
+
+	key := iKey(i.src.Key())
+	seq, t, ok := key.parseNum()
+	if !ok {
+		i.hasUkey = false
+		return i.set(key, i.src.Value())
+	}
+	if !i.hasUkey || i.ucmp.Compare(key.ukey(), i.ukey) != 0 {
+		i.ukey = append(i.ukey[:0], key.ukey()...)
+		i.hasUkey = true
+		i.visible = false
+	}
+	if seq > i.minSeq || i.visible || t != tMerge {
+		if seq <= i.minSeq {
+			i.visible = true
+		}
+		return i.set(key, i.src.Value())
+	}
+	i.visible = true
+
+	// Collect this and older operands of the key
+	kvs := [][2][]byte{{dupBytes(key), dupBytes(i.src.Value())}}
+	ops := [][]byte{kvs[0][1]}
+	var base []byte
+	done, atBase, blocked := false, false, false
+	for i.src.Next() {
+		k := iKey(i.src.Key())
+		seq, t, ok := k.parseNum()
+		if !ok || i.ucmp.Compare(k.ukey(), i.ukey) != 0 {
+			i.peeked = true
+			break
+		}
+		if seq > i.minSeq {
+			// Older by timestamp but not visible to every snapshot
+			i.peeked, blocked = true, true
+			break
+		}
+		if t == tMerge {
+			v := dupBytes(i.src.Value())
+			kvs = append(kvs, [2][]byte{dupBytes(k), v})
+			ops = append(ops, v)
+			continue
+		}
+		if t == tTTL {
+			i.peeked, blocked = true, true
+			break
+		}
+		if t == tRangeDel {
+			// Resolved as deleted, but the tombstone cover other keys too
+			i.peeked, done = true, true
+			break
+		}
+		if t == tVal {
+			base = i.src.Value()
+		}
+		done, atBase = true, true
+		break
+	}
+	i.eoi = !i.peeked && !atBase
+	if !done && !i.peeked && i.src.Error() != nil {
+		i.pending = kvs[1:]
+		return i.set(kvs[0][0], kvs[0][1])
+	}
+	if !done && !blocked && i.isBase != nil {
+		done = i.isBase(i.ukey)
+	}
+
+	if done {
+		if value, err := applyMerge(i.merger, i.ukey, base, ops); err == nil {
+			// Reuse internal key of the newest operand
+			k := kvs[0][0]
+			k[len(k)-8] = byte(tVal) | k[len(k)-8]&byte(tTs)
+			return i.set(k, value)
+		}
+	}
+
+	// Cannot resolve; operands and the base are kept
+	i.peeked = i.peeked || atBase
+	i.pending = kvs[1:]
+	return i.set(kvs[0][0], kvs[0][1])
+}
+
+func (i *mergeCompactIter) Key() []byte {
+	if !i.valid {
+		return nil
+	}
+	return i.key
+}
+
+func (i *mergeCompactIter) Value() []byte {
+	if !i.valid {
+		return nil
+	}
+	return i.value
+}
+
+func (i *mergeCompactIter) KeyCopy(dst []byte) []byte {
+	return append(dst, i.Key()...)
+}
+
+func (i *mergeCompactIter) ValueCopy(dst []byte) []byte {
+	return append(dst, i.Value()...)
+}
+
+func (i *mergeCompactIter) Release() {
+	i.src.Release()
+	i.pending = nil
+	i.valid = false
+	i.eoi = true
+}
+
+func (i *mergeCompactIter) Error() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.src.Error()
+}
@@ -0,0 +1,351 @@
+// Copyright (c) 2013, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// Namespaced present multiple logical databases over a single database.
+// Each logical database is identified by a namespace id, all of its keys
+// are transparently prefixed by the length-prefixed namespace id; thus
+// keys of different namespaces never collide. All logical databases share
+// the same memdb, journal, cache and compaction goroutine of the
+// underlying database.
+//
+// The underlying database must use a comparer that orders keys sharing a
+// common prefix contiguously, e.g. the default bytewise comparer.
+type Namespaced struct {
+	db *DB
+}
+
+// NewNamespaced create new Namespaced over given database.
+func NewNamespaced(db *DB) *Namespaced {
+	return &Namespaced{db: db}
+}
+
+func nsPrefix(id []byte) []byte {
+	b := make([]byte, binary.MaxVarintLen32+len(id))
+	n := binary.PutUvarint(b, uint64(len(id)))
+	return append(b[:n], id...)
+}
+
+// Namespace return logical database handle for given namespace id.
+func (n *Namespaced) Namespace(id []byte) *Namespace {
+	prefix := nsPrefix(id)
+	return &Namespace{db: n.db, prefix: prefix, limit: prefixLimit(prefix)}
+}
+
+// DeleteNamespace delete all keys of given namespace, by a single range
+// tombstone.
+func (n *Namespaced) DeleteNamespace(id []byte, wo *opt.WriteOptions) error {
+	return n.Namespace(id).deleteAll(wo)
+}
+
+// Namespace represent a logical database within a Namespaced.
+type Namespace struct {
+	db     *DB
+	prefix []byte
+	limit  []byte
+}
+
+func (p *Namespace) key(key []byte) []byte {
+	k := make([]byte, len(p.prefix)+len(key))
+	copy(k, p.prefix)
+	copy(k[len(p.prefix):], key)
+	return k
+}
+
+// Get get value for given key of the latest snapshot of the namespace.
+func (p *Namespace) Get(key []byte, ro *opt.ReadOptions) (value []byte, err error) {
+	return p.db.Get(p.key(key), ro)
+}
+
+// NewIterator return an iterator over the contents of the latest snapshot
+// of the namespace. The iterator never reach keys of other namespaces and
+// the returned keys are stripped from the namespace prefix.
+func (p *Namespace) NewIterator(ro *opt.ReadOptions) iterator.Iterator {
+	return &nsIter{it: p.db.NewIterator(ro), ns: p}
+}
+
+// Put set the namespace entry for "key" to "value".
+func (p *Namespace) Put(key, value []byte, wo *opt.WriteOptions) error {
+	return p.db.Put(p.key(key), value, wo)
+}
+
+// Delete remove the namespace entry (if any) for "key".
+func (p *Namespace) Delete(key []byte, wo *opt.WriteOptions) error {
+	return p.db.Delete(p.key(key), wo)
+}
+
+// Write apply the specified batch to the namespace.
+func (p *Namespace) Write(b *Batch, wo *opt.WriteOptions) error {
+	if b == nil || b.len() == 0 {
+		return p.db.Write(b, wo)
+	}
+	nb, err := p.batch(b)
+	if err != nil {
+		return err
+	}
+	return p.db.Write(nb, wo)
+}
+
+// Return copy of given batch with keys prefixed by the namespace prefix.
+func (p *Namespace) batch(b *Batch) (*Batch, error) {
+	nb := new(Batch)
+	err := b.decodeRec(func(i int, t vType, key, value []byte, ts uint64) {
+		// the limit of a range tombstone is a key as well
+		if t == tRangeDel {
+			value = p.key(value)
+		}
+		nb.appendRec(t, p.key(key), value, ts)
+		nb.rLen++
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nb, nil
+}
+
+// Delete all keys of the namespace by a single range tombstone. The limit
+// is never nil, as the length prefix ends with a byte below 0x80.
+func (p *Namespace) deleteAll(wo *opt.WriteOptions) error {
+	return p.db.DeleteRange(p.prefix, p.limit, wo)
+}
+
+// Keys of namespace sequence numbers start with a non-canonical varint,
+// thus never collide with keys of a namespace.
+var nsSeqKeyPrefix = []byte("\x80\x00seq")
+
+// NamespaceDB is a logical database handle scoped to a namespace, as
+// returned by DB.GetNamespaceDB. Besides the keys, each NamespaceDB has its
+// own sequence number, counting the operations applied to it; the counter
+// is persisted along with the written operations.
+type NamespaceDB struct {
+	ns     *Namespace
+	seqKey []byte
+
+	mu  sync.Mutex
+	seq uint64
+	err error
+}
+
+// GetNamespaceDB return logical database handle for namespace with given
+// name; keys of the namespace are those of NewNamespaced(d).Namespace(name).
+// The same handle is returned for the same name, for as long as the DB is
+// open. Only operations applied through the handle are accounted by its
+// sequence number.
+func (d *DB) GetNamespaceDB(name string) *NamespaceDB {
+	d.nsMu.Lock()
+	defer d.nsMu.Unlock()
+	if p, ok := d.nsdbs[name]; ok {
+		return p
+	}
+
+	// the handle is kept along with the DB, thus must not keep the
+	// handle of the caller reachable
+	ns := NewNamespaced(&DB{dbState: d.dbState}).Namespace([]byte(name))
+	p := &NamespaceDB{ns: ns, seqKey: append(append([]byte{}, nsSeqKeyPrefix...), ns.prefix...)}
+	v, err := d.Get(p.seqKey, nil)
+	switch {
+	case err == errors.ErrNotFound:
+	case err != nil:
+		// not cached, the error may be transient
+		p.err = err
+		return p
+	case len(v) != 8:
+		p.err = errors.ErrCorrupt("invalid namespace sequence number")
+	default:
+		p.seq = binary.LittleEndian.Uint64(v)
+	}
+	if d.nsdbs == nil {
+		d.nsdbs = make(map[string]*NamespaceDB)
+	}
+	d.nsdbs[name] = p
+	return p
+}
+
+// Seq return the sequence number of the namespace, i.e. the number of
+// operations applied to it.
+func (p *NamespaceDB) Seq() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.seq
+}
+
+// Get get value for given key of the latest snapshot of the namespace.
+func (p *NamespaceDB) Get(key []byte, ro *opt.ReadOptions) (value []byte, err error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.ns.Get(key, ro)
+}
+
+// NewIterator return an iterator over the contents of the latest snapshot
+// of the namespace, see Namespace.NewIterator.
+func (p *NamespaceDB) NewIterator(ro *opt.ReadOptions) iterator.Iterator {
+	if p.err != nil {
+		return &iterator.EmptyIterator{Err: p.err}
+	}
+	return p.ns.NewIterator(ro)
+}
+
+// Put set the namespace entry for "key" to "value".
+func (p *NamespaceDB) Put(key, value []byte, wo *opt.WriteOptions) error {
+	b := new(Batch)
+	b.Put(key, value)
+	return p.Write(b, wo)
+}
+
+// Delete remove the namespace entry (if any) for "key".
+func (p *NamespaceDB) Delete(key []byte, wo *opt.WriteOptions) error {
+	b := new(Batch)
+	b.Delete(key)
+	return p.Write(b, wo)
+}
+
+// Write apply the specified batch to the namespace; the sequence number
+// of the namespace is advanced by the batch length, atomically.
+func (p *NamespaceDB) Write(b *Batch, wo *opt.WriteOptions) error {
+	if p.err != nil {
+		return p.err
+	}
+	if b == nil || b.len() == 0 {
+		return p.ns.db.Write(b, wo)
+	}
+	nb, err := p.ns.batch(b)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	seq := p.seq + uint64(b.len())
+	var v [8]byte
+	binary.LittleEndian.PutUint64(v[:], seq)
+	nb.Put(p.seqKey, v[:])
+	if err := p.ns.db.Write(nb, wo); err != nil {
+		return err
+	}
+	p.seq = seq
+	return nil
+}
+
+const (
+	nsIterInit = iota
+	nsIterValid
+	nsIterSOI // start of iteration
+	nsIterEOI // end of iteration
+)
+
+// nsIter bound an iterator to a namespace.
+type nsIter struct {
+	it    iterator.Iterator
+	ns    *Namespace
+	state int
+}
+
+func (i *nsIter) check(ok bool, fail int) bool {
+	if ok && bytes.HasPrefix(i.it.Key(), i.ns.prefix) {
+		i.state = nsIterValid
+		return true
+	}
+	i.state = fail
+	return false
+}
+
+func (i *nsIter) Valid() bool {
+	return i.state == nsIterValid && i.it.Valid()
+}
+
+func (i *nsIter) First() bool {
+	return i.check(i.it.Seek(i.ns.prefix), nsIterEOI)
+}
+
+func (i *nsIter) Last() bool {
+	var ok bool
+	if i.ns.limit != nil && i.it.Seek(i.ns.limit) {
+		ok = i.it.Prev()
+	} else if i.it.Error() == nil {
+		ok = i.it.Last()
+	}
+	return i.check(ok, nsIterSOI)
+}
+
+func (i *nsIter) Seek(key []byte) bool {
+	return i.check(i.it.Seek(i.ns.key(key)), nsIterEOI)
+}
+
+func (i *nsIter) SeekForPrev(key []byte) bool {
+	return i.check(i.it.SeekForPrev(i.ns.key(key)), nsIterSOI)
+}
+
+func (i *nsIter) Next() bool {
+	switch i.state {
+	case nsIterInit, nsIterSOI:
+		return i.First()
+	case nsIterEOI:
+		return false
+	}
+	return i.check(i.it.Next(), nsIterEOI)
+}
+
+func (i *nsIter) Prev() bool {
+	switch i.state {
+	case nsIterInit, nsIterEOI:
+		return i.Last()
+	case nsIterSOI:
+		return false
+	}
+	return i.check(i.it.Prev(), nsIterSOI)
+}
+
+func (i *nsIter) Key() []byte {
+	if !i.Valid() {
+		return nil
+	}
+	return i.it.Key()[len(i.ns.prefix):]
+}
+
+func (i *nsIter) Value() []byte {
+	if !i.Valid() {
+		return nil
+	}
+	return i.it.Value()
+}
+
+func (i *nsIter) KeyCopy(dst []byte) []byte {
+	if !i.Valid() {
+		return dst
+	}
+	// strip the prefix in place
+	n := len(dst)
+	dst = i.it.KeyCopy(dst)
+	return append(dst[:n], dst[n+len(i.ns.prefix):]...)
+}
+
+func (i *nsIter) ValueCopy(dst []byte) []byte {
+	if !i.Valid() {
+		return dst
+	}
+	return i.it.ValueCopy(dst)
+}
+
+func (i *nsIter) Release() {
+	i.it.Release()
+	i.state = nsIterEOI
+}
+
+func (i *nsIter) Error() error {
+	return i.it.Error()
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2013, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/errors"
+)
+
+func TestNamespaced(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	n := NewNamespaced(h.db)
+	a := n.Namespace([]byte("a"))
+	ab := n.Namespace([]byte("ab"))
+
+	// Keys of "a" that look like the prefix of "ab" must not collide.
+	h.put("raw", "v")
+	for i := 0; i < 5; i++ {
+		if err := a.Put([]byte(fmt.Sprintf("bk%d", i)), []byte("a"), h.wo); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+		if err := ab.Put([]byte(fmt.Sprintf("k%d", i)), []byte("ab"), h.wo); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+
+	b := new(Batch)
+	b.Put([]byte("k9"), []byte("ab"))
+	b.Delete([]byte("k0"))
+	if err := ab.Write(b, h.wo); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+
+	if _, err := a.Get([]byte("k1"), h.ro); err != errors.ErrNotFound {
+		t.Errorf("Get: want ErrNotFound, got %v", err)
+	}
+	if v, err := ab.Get([]byte("k9"), h.ro); err != nil || string(v) != "ab" {
+		t.Errorf("Get: got %q, %v", v, err)
+	}
+
+	checkIter := func(ns *Namespace, want ...string) {
+		iter := ns.NewIterator(h.ro)
+		var got []string
+		for iter.Next() {
+			got = append(got, string(iter.Key()))
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal("iterator: got error: ", err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("forward iteration: want %v, got %v", want, got)
+		}
+		got = got[:0]
+		for ok := iter.Last(); ok; ok = iter.Prev() {
+			got = append([]string{string(iter.Key())}, got...)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("backward iteration: want %v, got %v", want, got)
+		}
+	}
+
+	checkIter(a, "bk0", "bk1", "bk2", "bk3", "bk4")
+	checkIter(ab, "k1", "k2", "k3", "k4", "k9")
+
+	iter := ab.NewIterator(h.ro)
+	if !iter.Seek([]byte("k3")) || string(iter.Key()) != "k3" {
+		t.Errorf("Seek: got %q", iter.Key())
+	}
+	if iter.Seek([]byte("z")) {
+		t.Errorf("Seek: leaked key %q", iter.Key())
+	}
+	if !iter.SeekForPrev([]byte("k5")) || string(iter.Key()) != "k4" {
+		t.Errorf("SeekForPrev: got %q", iter.Key())
+	}
+	if key := iter.KeyCopy([]byte("x")); string(key) != "xk4" {
+		t.Errorf("KeyCopy: got %q", key)
+	}
+
+	// A sibling namespace sorting right after must not hide the last keys.
+	if err := n.Namespace([]byte("ac")).Put([]byte("k0"), []byte("ac"), h.wo); err != nil {
+		t.Fatal("Put: got error: ", err)
+	}
+	checkIter(ab, "k1", "k2", "k3", "k4", "k9")
+
+	mlen := h.db.getMem().cur.Len()
+	if err := n.DeleteNamespace([]byte("a"), h.wo); err != nil {
+		t.Fatal("DeleteNamespace: got error: ", err)
+	}
+	if x := h.db.getMem().cur.Len() - mlen; x != 1 {
+		t.Errorf("DeleteNamespace: want a single tombstone, got %d entries", x)
+	}
+	checkIter(a)
+	checkIter(ab, "k1", "k2", "k3", "k4", "k9")
+	h.getVal("raw", "v")
+}
+
+func TestNamespaced_DeleteRange(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	n := NewNamespaced(h.db)
+	a := n.Namespace([]byte("a"))
+	b := n.Namespace([]byte("b"))
+	for i := 0; i < 5; i++ {
+		key := []byte(fmt.Sprintf("k%d", i))
+		if err := a.Put(key, []byte("a"), h.wo); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+		if err := b.Put(key, []byte("b"), h.wo); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+	h.put("k1", "raw")
+
+	batch := new(Batch)
+	batch.DeleteRange([]byte("k0"), []byte("k9"))
+	if err := a.Write(batch, h.wo); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+
+	check := func() {
+		for i := 0; i < 5; i++ {
+			key := []byte(fmt.Sprintf("k%d", i))
+			if _, err := a.Get(key, h.ro); err != errors.ErrNotFound {
+				t.Errorf("Get %s of range-deleted namespace: want ErrNotFound, got %v", key, err)
+			}
+			if v, err := b.Get(key, h.ro); err != nil || string(v) != "b" {
+				t.Errorf("Get %s of sibling namespace: got %q, %v", key, v, err)
+			}
+		}
+		h.getVal("k1", "raw")
+	}
+	check()
+	h.compactMem()
+	h.compactRange("", "")
+	check()
+}
+
+func TestDb_NamespaceDB(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	a := h.db.GetNamespaceDB("a")
+	if h.db.GetNamespaceDB("a") != a {
+		t.Error("GetNamespaceDB: want the same handle for the same name")
+	}
+	b := h.db.GetNamespaceDB("b")
+
+	checkSeq := func(p *NamespaceDB, want uint64) {
+		if seq := p.Seq(); seq != want {
+			t.Errorf("Seq: want %d, got %d", want, seq)
+		}
+	}
+	checkIter := func(p *NamespaceDB, want string) {
+		iter := p.NewIterator(h.ro)
+		res := ""
+		for iter.Next() {
+			res += fmt.Sprintf("(%s->%s)", iter.Key(), iter.Value())
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal("iterator: got error: ", err)
+		}
+		iter.Release()
+		if res != want {
+			t.Errorf("iterator: want %q, got %q", want, res)
+		}
+	}
+
+	checkSeq(a, 0)
+	if err := a.Put([]byte("k1"), []byte("a1"), h.wo); err != nil {
+		t.Fatal("Put: got error: ", err)
+	}
+	if err := a.Put([]byte("k2"), []byte("a2"), h.wo); err != nil {
+		t.Fatal("Put: got error: ", err)
+	}
+	batch := new(Batch)
+	batch.Put([]byte("k1"), []byte("b1"))
+	batch.Put([]byte("k3"), []byte("b3"))
+	batch.Delete([]byte("k9"))
+	if err := b.Write(batch, h.wo); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+	if err := a.Delete([]byte("k2"), h.wo); err != nil {
+		t.Fatal("Delete: got error: ", err)
+	}
+	checkSeq(a, 3)
+	checkSeq(b, 3)
+
+	check := func() {
+		checkIter(a, "(k1->a1)")
+		checkIter(b, "(k1->b1)(k3->b3)")
+		if v, err := b.Get([]byte("k1"), h.ro); err != nil || string(v) != "b1" {
+			t.Errorf("Get: got %q, %v", v, err)
+		}
+		if _, err := a.Get([]byte("k3"), h.ro); err != errors.ErrNotFound {
+			t.Errorf("Get: want ErrNotFound, got %v", err)
+		}
+	}
+	check()
+
+	// sequence numbers survive reopen
+	h.reopenDB()
+	a, b = h.db.GetNamespaceDB("a"), h.db.GetNamespaceDB("b")
+	checkSeq(a, 3)
+	checkSeq(b, 3)
+	check()
+	if err := b.Put([]byte("k4"), []byte("b4"), h.wo); err != nil {
+		t.Fatal("Put: got error: ", err)
+	}
+	checkSeq(b, 4)
+	checkSeq(h.db.GetNamespaceDB("c"), 0)
+}
@@ -10,6 +10,7 @@ package opt
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb/cache"
 	"github.com/syndtr/goleveldb/leveldb/comparer"
@@ -23,12 +24,51 @@ var (
 )
 
 const (
-	DefaultWriteBuffer          = 4 << 20
-	DefaultMaxOpenFiles         = 1000
-	DefaultBlockCacheSize       = 8 << 20
-	DefaultBlockSize            = 4096
-	DefaultBlockRestartInterval = 16
-	DefaultCompressionType      = SnappyCompression
+	DefaultWriteBuffer                = 4 << 20
+	DefaultMaxOpenFiles               = 1000
+	DefaultBlockCacheSize             = 8 << 20
+	DefaultBlockSize                  = 4096
+	DefaultBlockRestartInterval       = 16
+	DefaultMaxMemCompactLevel         = 2
+	DefaultCompressionType            = SnappyCompression
+	DefaultChecksumType               = CRC32CChecksum
+	DefaultCompactionStyle            = LeveledCompaction
+	DefaultCompactionL0Trigger        = 4
+	DefaultMaxCompactions             = 1
+	DefaultWriteL0SlowdownTrigger     = 8
+	DefaultWriteL0PauseTrigger        = 12
+	DefaultNumLevels                  = 7
+	DefaultMaxManifestSize            = 64 << 20
+	DefaultSeekCompactionBytesPerSeek = 16 << 10
+)
+
+// Reasons of write stalls, as passed to Options.OnWriteStall.
+const (
+	// The write slept once since the number of level-0 tables reached
+	// WriteL0SlowdownTrigger.
+	WriteStallL0Slowdown = "l0-slowdown"
+
+	// The write was blocked until the number of level-0 tables fell below
+	// WriteL0PauseTrigger.
+	WriteStallL0Pause = "l0-pause"
+)
+
+// Table format versions.
+const (
+	// The original LevelDB table format, readable by any LevelDB
+	// implementation.
+	TableFormatV0 = 0
+
+	// Add a versioned footer, which allows readers to reject tables
+	// written in a format newer than they understand.
+	TableFormatV1 = 1
+
+	// Record the block checksum type in the footer, which allows
+	// checksums other than CRC32C.
+	TableFormatV2 = 2
+
+	// The newest table format version known by this package.
+	MaxTableFormatVersion = TableFormatV2
 )
 
 type OptionsFlag uint
@@ -45,9 +85,69 @@ const (
 	// errors.  This may have unforeseen ramifications: for example, a
 	// corruption of one DB entry may cause a large number of entries to
 	// become unreadable or for the entire DB to become unopenable.
+	//
+	// The version is checked for consistency on open, and after each
+	// manifest edit: tables of levels above 0 must be sorted and not
+	// overlap, and every table must exist, open, and have first and last
+	// keys matching those recorded by the manifest. An edit failing the
+	// check is not applied. Tables are only opened on open and when added
+	// by an edit.
 	OFParanoidCheck
+
+	// If set, the database is opened read-only: journals are replayed
+	// into memory but never flushed, the manifest is read but never
+	// appended to, no compaction is ever run and no file is created or
+	// removed. Writes and compactions fail with errors.ErrReadOnly. The
+	// database must exist.
+	//
+	// OpenFile opens the path with storage.OpenFileReadOnly, which
+	// allows several read-only databases on the same path, e.g. from
+	// multiple processes.
+	OFReadOnly
+
+	// If set, table files are memory-mapped when opened, thus blocks are
+	// read in place from the mapping rather than by read syscalls. Blocks
+	// read in place are not held by the block cache, nor is the compressed
+	// block cache used, as a table is unmapped once evicted from the table
+	// cache and released by every iterator using it; keys and values of
+	// an iterator must not be used after its release.
+	// Tables are read as usual if the platform or the storage does not
+	// support mmap. Applies to tables opened after being set.
+	OFMmapTables
+
+	// If set, obsolete files, i.e. tables, journals and manifests no
+	// longer used by the database, are kept until DB.PurgeObsoleteFiles
+	// is called, e.g. once an external backup of the files completed.
+	// Obsolete files found when the database is opened are kept as well.
+	OFKeepObsoleteFiles
+
+	// If set, DB.GetApproximateSizes discount the size of each level by
+	// the fraction of its entries estimated to be shadowed by deletions
+	// in higher levels, as counted by table metadata. Tables written by
+	// older versions lack such counts and are never discounted.
+	OFDiscountDeletions
+
+	// If set, seeks through tables never trigger a compaction. Seek
+	// compaction merges a table which lookups repeatedly pass through
+	// into the next level; read-mostly datasets which are already laid
+	// out may prefer to avoid such churn.
+	OFDisableSeekCompaction
 )
 
+// Merger is the interface that wraps the Merge method. A merger combines
+// a merge operand written by DB.Merge with the existing value of a key.
+type Merger interface {
+	// Merge apply given operand on top of the existing value of given
+	// key; existing is nil if the key has no value. It returns the new
+	// value, or false if the operand cannot be applied, in which case
+	// reading the key fails with a corruption error.
+	//
+	// Merge must be deterministic and must not retain or modify any of
+	// the given slices; it may be called any number of times for the
+	// same operands, e.g. by reads and by compaction.
+	Merge(key, existing, operand []byte) ([]byte, bool)
+}
+
 // Database compression type
 type Compression uint
 
@@ -70,6 +170,50 @@ const (
 	nCompression
 )
 
+// Compaction style
+type CompactionStyle uint
+
+func (c CompactionStyle) String() string {
+	switch c {
+	case DefaultCompaction:
+		return "default"
+	case LeveledCompaction:
+		return "leveled"
+	case TieredCompaction:
+		return "tiered"
+	}
+	return "unknown"
+}
+
+const (
+	DefaultCompaction CompactionStyle = iota
+	LeveledCompaction
+	TieredCompaction
+	nCompactionStyle
+)
+
+// Table block checksum type
+type Checksum uint
+
+func (c Checksum) String() string {
+	switch c {
+	case DefaultChecksum:
+		return "default"
+	case CRC32CChecksum:
+		return "crc32c"
+	case XXHash32Checksum:
+		return "xxhash32"
+	}
+	return "unknown"
+}
+
+const (
+	DefaultChecksum Checksum = iota
+	CRC32CChecksum
+	XXHash32Checksum
+	nChecksum
+)
+
 // Options represent sets of LevelDB options.
 type Options struct {
 	// Comparer used to define the order of keys in the table.
@@ -87,6 +231,18 @@ type Options struct {
 	// Specify the database flag.
 	Flag OptionsFlag
 
+	// Merger used to combine merge operands written by DB.Merge with
+	// existing values. Reading a key which has merge operands fails if
+	// no merger is set.
+	//
+	// REQUIRES: The client must ensure that the merger supplied here
+	// combines operands *exactly* the same as the merger provided to
+	// previous open calls on the same DB, since operands may already
+	// have been merged by compaction.
+	//
+	// Default: NULL
+	Merger Merger
+
 	// Amount of data to build up in memory (backed by an unsorted journal
 	// on disk) before converting to a sorted on-disk file.
 	//
@@ -99,13 +255,148 @@ type Options struct {
 	// Default: 4MB
 	WriteBuffer int
 
+	// Number of bytes to preallocate for each newly created journal file.
+	// Preallocating journal reduce file-system fragmentation and metadata
+	// updates caused by small appends. The unused preallocated space is
+	// truncated when the journal is closed. This option has no effect if
+	// the storage does not support preallocation.
+	//
+	// Default: 0, which disables preallocation
+	JournalPreallocSize int64
+
+	// Interval of the background sync of the journal. If non-zero, the
+	// journal is synced periodically by a background goroutine, bounding
+	// the window of writes lost on power failure to about the interval,
+	// without the cost of WFSync on each write. Writes with WFSync are
+	// still synced before they return. The durable sequence number
+	// advances as the journal is synced. This parameter is read when the
+	// database is opened.
+	//
+	// Default: 0, which disables the background sync
+	WALSyncInterval time.Duration
+
+	// Size of the manifest beyond which it is rotated: a new manifest
+	// holding the current version as a single record is written and the
+	// old one is removed. The manifest can be rotated explicitly with
+	// DB.CompactManifest.
+	//
+	// Default: 64MB. Set to a negative value to disable automatic rotation.
+	MaxManifestSize int64
+
+	// Maximum level to which a flushed memdb is pushed if it does not
+	// overlap with existing tables and does not overlap too much data in
+	// the grandparent level. Pushing deeper avoids the relatively
+	// expensive level 0=>1 compactions, but pushing all the way to the
+	// largest level can waste disk space if the same key space is being
+	// repeatedly overwritten. This parameter can be changed dynamically.
+	//
+	// Default: 2. Set to a negative value to always flush to level 0.
+	MaxMemCompactLevel int
+
+	// Number of levels of the database. More levels allow larger
+	// databases before the last level grows unbounded, fewer levels
+	// suit small embedded uses. The number of levels is recorded at
+	// creation and an existing database must be opened with the same
+	// value. Must be at least 2.
+	//
+	// Default: 7
+	NumLevels int
+
+	// Number of level-0 tables that triggers a level-0 compaction.
+	// This parameter can be changed dynamically.
+	//
+	// Default: 4
+	CompactionL0Trigger int
+
+	// Number of level-0 tables at which writes are slowed down, giving
+	// compaction a chance to catch up. This parameter can be changed
+	// dynamically.
+	//
+	// Default: 8
+	WriteL0SlowdownTrigger int
+
+	// Number of level-0 tables at which writes are paused until
+	// compaction reduces it. This parameter can be changed dynamically.
+	//
+	// Default: 12
+	WriteL0PauseTrigger int
+
+	// Table bytes per allowed seek: a table is compacted once lookups
+	// passed through it without finding the key, thus reading the next
+	// table too, about size/SeekCompactionBytesPerSeek times, and at
+	// least 100 times. Larger values trigger seek compaction sooner.
+	// Applies to tables loaded or written after being set. Seek
+	// compaction is disabled by OFDisableSeekCompaction.
+	//
+	// Default: 16K
+	SeekCompactionBytesPerSeek int
+
+	// Compaction style of level-0 tables. With LeveledCompaction level-0
+	// tables are merged into level-1 once there are CompactionL0Trigger
+	// of them. With TieredCompaction the newest level-0 tables of
+	// similar size are merged together into a single level-0 table
+	// instead, which writes less for write-heavy ingest at the cost of
+	// reads going through more tables; level-0 tables are merged into
+	// level-1 once they grow as large as level-1 is allowed to be, or
+	// no such tables are found. Deeper levels are always leveled. This
+	// parameter can be changed dynamically.
+	//
+	// Default: LeveledCompaction
+	CompactionStyle CompactionStyle
+
+	// Limit of table compaction IO, in bytes per second of input read
+	// and output written. Memdb flushes are not limited, and the limit
+	// is lifted while writes are stalled waiting on compaction. This
+	// parameter can be changed dynamically.
+	//
+	// Default: 0, which means no limit
+	CompactionRateLimit int
+
+	// Maximum number of table compactions run concurrently. Concurrent
+	// compactions work on different levels or disjoint key ranges, while
+	// their results are still applied to the manifest one at a time.
+	// This parameter can be changed dynamically.
+	//
+	// Default: 1
+	MaxCompactions int
+
+	// Percentage of deletion entries at which a table is compacted into
+	// the next level, even when its level is within size, so that
+	// tombstones don't pile up and slow down scans. Only tables whose
+	// entry and deletion counts are known are considered, that is those
+	// written or looked up by this session. This parameter can be
+	// changed dynamically, taking effect for the next compaction.
+	//
+	// Default: 0, which means disabled
+	CompactionDeletionPercent int
+
+	// If non-NULL, called whenever a write is stalled by level-0 tables:
+	// reason is WriteStallL0Slowdown or WriteStallL0Pause, l0Tables is
+	// the number of level-0 tables when the stall began, and dur is how
+	// long the write was held up. It is called from the write path, thus
+	// must return quickly. This parameter can be changed dynamically.
+	//
+	// Default: NULL
+	OnWriteStall func(reason string, l0Tables int, dur time.Duration)
+
 	// Number of open files that can be used by the DB.  You may need to
 	// increase this if your database has a large working set (budget
-	// one open file per 2MB of working set).
+	// one open file per 2MB of working set).  This parameter can be
+	// changed dynamically, lowering it closes the least recently used
+	// tables down to the new limit.
 	//
 	// Default: 1000
 	MaxOpenFiles int
 
+	// If non-NULL, called with the file number of each table closed by
+	// the table cache, either evicted to stay within MaxOpenFiles or
+	// removed as obsolete. It may be called with locks held, thus must
+	// return quickly and must not call into the DB. This parameter can be
+	// changed dynamically.
+	//
+	// Default: NULL
+	OnTableClose func(num uint64)
+
 	// Control over blocks (user data is stored in a set of blocks, and
 	// a block is the unit of reading from disk).
 
@@ -114,21 +405,47 @@ type Options struct {
 	// Default: NULL
 	BlockCache cache.Cache
 
+	// If non-NULL, use the specified cache for compressed blocks, as a
+	// second tier behind BlockCache: a block missing from BlockCache is
+	// looked up here before being read from disk, then decompressed into
+	// BlockCache. Holding blocks compressed, it may hold more blocks
+	// than BlockCache for the same capacity. Blocks stored uncompressed
+	// are not cached here.
+	// Default: NULL
+	CompressedBlockCache cache.Cache
+
 	// Approximate size of user data packed per block.  Note that the
 	// block size specified here corresponds to uncompressed data.  The
 	// actual size of the unit read from disk may be smaller if
 	// compression is enabled.  This parameter can be changed dynamically.
+	// Larger blocks generally compress better, at the cost of reading more
+	// data per lookup.
 	//
 	// Default: 4K
 	BlockSize int
 
 	// Number of keys between restart points for delta encoding of keys.
 	// This parameter can be changed dynamically.  Most clients should
-	// leave this parameter alone.
+	// leave this parameter alone.  A smaller interval speed up seeks
+	// within a block, at the cost of a larger block.
+	//
+	// Both BlockSize and BlockRestartInterval only affect tables written
+	// afterwards; they are encoded within each block, thus tables remain
+	// readable whatever the settings in effect.
 	//
 	// Default: 16
 	BlockRestartInterval int
 
+	// Number of bytes read ahead when loading a table block. Reads served
+	// from the read-ahead buffer coalesce sequential block loads, such as
+	// compaction scans, into fewer and larger reads, while random point
+	// lookups pay for the extra bytes read. Applies to tables opened
+	// after being set. Memory-mapped tables, see OFMmapTables, are not
+	// read ahead.
+	//
+	// Default: 0, which disables read-ahead
+	BlockReadAhead int
+
 	// Compress blocks using the specified compression algorithm.  This
 	// parameter can be changed dynamically.
 	//
@@ -145,9 +462,40 @@ type Options struct {
 	// efficiently detect that and will switch to uncompressed mode.
 	CompressionType Compression
 
+	// Compression of tables written to each level by compaction, indexed
+	// by level. Levels beyond the slice, and levels set to
+	// DefaultCompression, use CompressionType. Tables flushed from memdb
+	// or bulk loaded use the level-0 compression, since their level is
+	// picked after they are written. This parameter can be changed
+	// dynamically.
+	//
+	// Default: NULL
+	CompressionPerLevel []Compression
+
+	// Table format version of newly written tables. Tables of any format
+	// version up to MaxTableFormatVersion can be read regardless of this
+	// option. Operators may pin this to an older version during a rolling
+	// upgrade, so that older readers can still read newly written tables.
+	// This parameter can be changed dynamically.
+	//
+	// Default: TableFormatV0, which is compatible with other LevelDB
+	// implementations
+	TableFormatVersion int
+
+	// Checksum type of blocks of newly written tables. The checksum type
+	// is recorded in the table footer, thus tables are verified using the
+	// checksum they were written with regardless of this option. Any type
+	// other than CRC32CChecksum requires TableFormatV2, which newly
+	// written tables are then upgraded to. This parameter can be changed
+	// dynamically.
+	//
+	// Default: CRC32CChecksum
+	ChecksumType Checksum
+
 	// If non-NULL, use the specified filter policy to reduce disk reads.
 	// Many applications will benefit from passing the result of
-	// NewBloomFilter() here.
+	// NewBloomFilter() here, or NewBlockedBloomFilter() which trades a
+	// slightly higher false positive rate for better cache locality.
 	//
 	// As long as the same filter (name) was used as last time the
 	// database was opened, the previous filter is reused. That is,
@@ -165,6 +513,11 @@ type Options struct {
 	// filter into AltFilters. Also, rewriting every single key/value
 	// will force introduction of the new filter.
 	//
+	// Each sstable records the name of the filter it was written with,
+	// and reads pick the filter by that name, never assuming the current
+	// filter. A sstable whose filter is unknown is read as if it had no
+	// filter, rather than risking wrong negatives.
+	//
 	// Default: NULL
 	Filter filter.Filter
 
@@ -182,12 +535,33 @@ type Options struct {
 type OptionsGetter interface {
 	GetComparer() comparer.Comparer
 	HasFlag(flag OptionsFlag) bool
+	GetMerger() Merger
 	GetWriteBuffer() int
+	GetJournalPreallocSize() int64
+	GetWALSyncInterval() time.Duration
+	GetMaxManifestSize() int64
+	GetMaxMemCompactLevel() int
+	GetNumLevels() int
+	GetCompactionL0Trigger() int
+	GetSeekCompactionBytesPerSeek() int
+	GetCompactionStyle() CompactionStyle
+	GetCompactionRateLimit() int
+	GetMaxCompactions() int
+	GetCompactionDeletionPercent() int
+	GetWriteL0SlowdownTrigger() int
+	GetWriteL0PauseTrigger() int
+	GetOnWriteStall() func(reason string, l0Tables int, dur time.Duration)
 	GetMaxOpenFiles() int
+	GetOnTableClose() func(num uint64)
 	GetBlockCache() cache.Cache
+	GetCompressedBlockCache() cache.Cache
 	GetBlockSize() int
 	GetBlockRestartInterval() int
+	GetBlockReadAhead() int
 	GetCompressionType() Compression
+	GetLevelCompressionType(level int) Compression
+	GetTableFormatVersion() int
+	GetChecksumType() Checksum
 	GetFilter() filter.Filter
 	GetAltFilter(name string) filter.Filter
 	GetAltFilters() []filter.Filter
@@ -198,13 +572,34 @@ type OptionsSetter interface {
 	SetComparer(cmp comparer.Comparer) error
 	SetFlag(flag OptionsFlag) error
 	ClearFlag(flag OptionsFlag) error
+	SetMerger(merger Merger) error
 	SetWriteBuffer(size int) error
+	SetJournalPreallocSize(size int64) error
+	SetWALSyncInterval(interval time.Duration) error
+	SetMaxManifestSize(size int64) error
+	SetMaxMemCompactLevel(level int) error
+	SetNumLevels(n int) error
+	SetCompactionL0Trigger(n int) error
+	SetSeekCompactionBytesPerSeek(size int) error
+	SetCompactionStyle(style CompactionStyle) error
+	SetCompactionRateLimit(rate int) error
+	SetMaxCompactions(n int) error
+	SetCompactionDeletionPercent(percent int) error
+	SetWriteL0SlowdownTrigger(n int) error
+	SetWriteL0PauseTrigger(n int) error
+	SetOnWriteStall(f func(reason string, l0Tables int, dur time.Duration)) error
 	SetMaxOpenFiles(max int) error
+	SetOnTableClose(f func(num uint64)) error
 	SetBlockCache(cache cache.Cache) error
+	SetCompressedBlockCache(cache cache.Cache) error
 	SetBlockCacheCapacity(capacity int) error
 	SetBlockSize(size int) error
 	SetBlockRestartInterval(interval int) error
+	SetBlockReadAhead(size int) error
 	SetCompressionType(compression Compression) error
+	SetCompressionPerLevel(compressions []Compression) error
+	SetTableFormatVersion(version int) error
+	SetChecksumType(checksum Checksum) error
 	SetFilter(p filter.Filter) error
 	InsertAltFilter(p filter.Filter) error
 	RemoveAltFilter(name string) error
@@ -233,6 +628,15 @@ func (o *Options) HasFlag(flag OptionsFlag) bool {
 	return (o.Flag & flag) != 0
 }
 
+func (o *Options) GetMerger() Merger {
+	if o == nil {
+		return nil
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.Merger
+}
+
 func (o *Options) GetWriteBuffer() int {
 	if o == nil {
 		return DefaultWriteBuffer
@@ -245,6 +649,175 @@ func (o *Options) GetWriteBuffer() int {
 	return o.WriteBuffer
 }
 
+func (o *Options) GetJournalPreallocSize() int64 {
+	if o == nil {
+		return 0
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.JournalPreallocSize <= 0 {
+		return 0
+	}
+	return o.JournalPreallocSize
+}
+
+func (o *Options) GetWALSyncInterval() time.Duration {
+	if o == nil {
+		return 0
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.WALSyncInterval <= 0 {
+		return 0
+	}
+	return o.WALSyncInterval
+}
+
+func (o *Options) GetMaxManifestSize() int64 {
+	if o == nil {
+		return DefaultMaxManifestSize
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.MaxManifestSize < 0 {
+		return 0
+	} else if o.MaxManifestSize == 0 {
+		return DefaultMaxManifestSize
+	}
+	return o.MaxManifestSize
+}
+
+func (o *Options) GetMaxMemCompactLevel() int {
+	if o == nil {
+		return DefaultMaxMemCompactLevel
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.MaxMemCompactLevel < 0 {
+		return 0
+	} else if o.MaxMemCompactLevel == 0 {
+		return DefaultMaxMemCompactLevel
+	}
+	return o.MaxMemCompactLevel
+}
+
+func (o *Options) GetNumLevels() int {
+	if o == nil {
+		return DefaultNumLevels
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.NumLevels <= 0 {
+		return DefaultNumLevels
+	}
+	return o.NumLevels
+}
+
+func (o *Options) GetSeekCompactionBytesPerSeek() int {
+	if o == nil {
+		return DefaultSeekCompactionBytesPerSeek
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.SeekCompactionBytesPerSeek <= 0 {
+		return DefaultSeekCompactionBytesPerSeek
+	}
+	return o.SeekCompactionBytesPerSeek
+}
+
+func (o *Options) GetCompactionStyle() CompactionStyle {
+	if o == nil {
+		return DefaultCompactionStyle
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.CompactionStyle <= DefaultCompaction || o.CompactionStyle >= nCompactionStyle {
+		return DefaultCompactionStyle
+	}
+	return o.CompactionStyle
+}
+
+func (o *Options) GetCompactionRateLimit() int {
+	if o == nil {
+		return 0
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.CompactionRateLimit <= 0 {
+		return 0
+	}
+	return o.CompactionRateLimit
+}
+
+func (o *Options) GetMaxCompactions() int {
+	if o == nil {
+		return DefaultMaxCompactions
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.MaxCompactions <= 0 {
+		return DefaultMaxCompactions
+	}
+	return o.MaxCompactions
+}
+
+func (o *Options) GetCompactionDeletionPercent() int {
+	if o == nil {
+		return 0
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.CompactionDeletionPercent <= 0 {
+		return 0
+	}
+	return o.CompactionDeletionPercent
+}
+
+func (o *Options) GetCompactionL0Trigger() int {
+	if o == nil {
+		return DefaultCompactionL0Trigger
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.CompactionL0Trigger <= 0 {
+		return DefaultCompactionL0Trigger
+	}
+	return o.CompactionL0Trigger
+}
+
+func (o *Options) GetWriteL0SlowdownTrigger() int {
+	if o == nil {
+		return DefaultWriteL0SlowdownTrigger
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.WriteL0SlowdownTrigger <= 0 {
+		return DefaultWriteL0SlowdownTrigger
+	}
+	return o.WriteL0SlowdownTrigger
+}
+
+func (o *Options) GetWriteL0PauseTrigger() int {
+	if o == nil {
+		return DefaultWriteL0PauseTrigger
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.WriteL0PauseTrigger <= 0 {
+		return DefaultWriteL0PauseTrigger
+	}
+	return o.WriteL0PauseTrigger
+}
+
+func (o *Options) GetOnWriteStall() func(reason string, l0Tables int, dur time.Duration) {
+	if o == nil {
+		return nil
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.OnWriteStall
+}
+
 func (o *Options) GetMaxOpenFiles() int {
 	if o == nil {
 		return DefaultMaxOpenFiles
@@ -257,6 +830,15 @@ func (o *Options) GetMaxOpenFiles() int {
 	return o.MaxOpenFiles
 }
 
+func (o *Options) GetOnTableClose() func(num uint64) {
+	if o == nil {
+		return nil
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.OnTableClose
+}
+
 func (o *Options) GetBlockCache() cache.Cache {
 	if o == nil {
 		return nil
@@ -266,6 +848,15 @@ func (o *Options) GetBlockCache() cache.Cache {
 	return o.BlockCache
 }
 
+func (o *Options) GetCompressedBlockCache() cache.Cache {
+	if o == nil {
+		return nil
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.CompressedBlockCache
+}
+
 func (o *Options) GetBlockSize() int {
 	if o == nil {
 		return DefaultBlockSize
@@ -290,6 +881,18 @@ func (o *Options) GetBlockRestartInterval() int {
 	return o.BlockRestartInterval
 }
 
+func (o *Options) GetBlockReadAhead() int {
+	if o == nil {
+		return 0
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.BlockReadAhead <= 0 {
+		return 0
+	}
+	return o.BlockReadAhead
+}
+
 func (o *Options) GetCompressionType() Compression {
 	if o == nil {
 		return DefaultCompressionType
@@ -302,6 +905,46 @@ func (o *Options) GetCompressionType() Compression {
 	return o.CompressionType
 }
 
+func (o *Options) GetLevelCompressionType(level int) Compression {
+	if o == nil {
+		return DefaultCompressionType
+	}
+	o.mu.RLock()
+	if level >= 0 && level < len(o.CompressionPerLevel) {
+		c := o.CompressionPerLevel[level]
+		if c > DefaultCompression && c < nCompression {
+			o.mu.RUnlock()
+			return c
+		}
+	}
+	o.mu.RUnlock()
+	return o.GetCompressionType()
+}
+
+func (o *Options) GetTableFormatVersion() int {
+	if o == nil {
+		return TableFormatV0
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.TableFormatVersion <= TableFormatV0 || o.TableFormatVersion > MaxTableFormatVersion {
+		return TableFormatV0
+	}
+	return o.TableFormatVersion
+}
+
+func (o *Options) GetChecksumType() Checksum {
+	if o == nil {
+		return DefaultChecksumType
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.ChecksumType <= DefaultChecksum || o.ChecksumType >= nChecksum {
+		return DefaultChecksumType
+	}
+	return o.ChecksumType
+}
+
 func (o *Options) GetFilter() filter.Filter {
 	if o == nil {
 		return nil
@@ -370,6 +1013,26 @@ func (o *Options) ClearFlag(flag OptionsFlag) error {
 	return nil
 }
 
+func (o *Options) SetMerger(merger Merger) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	o.mu.Lock()
+	o.Merger = merger
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *Options) SetOnWriteStall(f func(reason string, l0Tables int, dur time.Duration)) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	o.mu.Lock()
+	o.OnWriteStall = f
+	o.mu.Unlock()
+	return nil
+}
+
 func (o *Options) SetWriteBuffer(size int) error {
 	if o == nil {
 		return ErrNotSet
@@ -383,6 +1046,169 @@ func (o *Options) SetWriteBuffer(size int) error {
 	return nil
 }
 
+func (o *Options) SetWALSyncInterval(interval time.Duration) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	if interval < 0 {
+		return ErrInvalid
+	}
+	o.mu.Lock()
+	o.WALSyncInterval = interval
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *Options) SetJournalPreallocSize(size int64) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	if size < 0 {
+		return ErrInvalid
+	}
+	o.mu.Lock()
+	o.JournalPreallocSize = size
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *Options) SetMaxManifestSize(size int64) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	o.mu.Lock()
+	o.MaxManifestSize = size
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *Options) SetMaxMemCompactLevel(level int) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	o.mu.Lock()
+	o.MaxMemCompactLevel = level
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *Options) SetNumLevels(n int) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	if n < 2 {
+		return ErrInvalid
+	}
+	o.mu.Lock()
+	o.NumLevels = n
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *Options) SetSeekCompactionBytesPerSeek(size int) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	if size <= 0 {
+		return ErrInvalid
+	}
+	o.mu.Lock()
+	o.SeekCompactionBytesPerSeek = size
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *Options) SetCompactionStyle(style CompactionStyle) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	if style >= nCompactionStyle {
+		return ErrInvalid
+	}
+	o.mu.Lock()
+	o.CompactionStyle = style
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *Options) SetCompactionRateLimit(rate int) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	if rate < 0 {
+		return ErrInvalid
+	}
+	o.mu.Lock()
+	o.CompactionRateLimit = rate
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *Options) SetMaxCompactions(n int) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	if n <= 0 {
+		return ErrInvalid
+	}
+	o.mu.Lock()
+	o.MaxCompactions = n
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *Options) SetCompactionDeletionPercent(percent int) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	if percent < 0 || percent > 100 {
+		return ErrInvalid
+	}
+	o.mu.Lock()
+	o.CompactionDeletionPercent = percent
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *Options) SetCompactionL0Trigger(n int) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	if n <= 0 {
+		return ErrInvalid
+	}
+	o.mu.Lock()
+	o.CompactionL0Trigger = n
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *Options) SetWriteL0SlowdownTrigger(n int) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	if n <= 0 {
+		return ErrInvalid
+	}
+	o.mu.Lock()
+	o.WriteL0SlowdownTrigger = n
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *Options) SetWriteL0PauseTrigger(n int) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	if n <= 0 {
+		return ErrInvalid
+	}
+	o.mu.Lock()
+	o.WriteL0PauseTrigger = n
+	o.mu.Unlock()
+	return nil
+}
+
 func (o *Options) SetMaxOpenFiles(max int) error {
 	if o == nil {
 		return ErrNotSet
@@ -396,6 +1222,16 @@ func (o *Options) SetMaxOpenFiles(max int) error {
 	return nil
 }
 
+func (o *Options) SetOnTableClose(f func(num uint64)) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	o.mu.Lock()
+	o.OnTableClose = f
+	o.mu.Unlock()
+	return nil
+}
+
 func (o *Options) SetBlockCache(cache cache.Cache) error {
 	if o == nil {
 		return ErrNotSet
@@ -406,6 +1242,16 @@ func (o *Options) SetBlockCache(cache cache.Cache) error {
 	return nil
 }
 
+func (o *Options) SetCompressedBlockCache(cache cache.Cache) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	o.mu.Lock()
+	o.CompressedBlockCache = cache
+	o.mu.Unlock()
+	return nil
+}
+
 func (o *Options) SetBlockCacheCapacity(capacity int) error {
 	if o == nil {
 		return ErrNotSet
@@ -445,6 +1291,19 @@ func (o *Options) SetBlockRestartInterval(interval int) error {
 	return nil
 }
 
+func (o *Options) SetBlockReadAhead(size int) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	if size < 0 {
+		return ErrInvalid
+	}
+	o.mu.Lock()
+	o.BlockReadAhead = size
+	o.mu.Unlock()
+	return nil
+}
+
 func (o *Options) SetCompressionType(compression Compression) error {
 	if o == nil {
 		return ErrNotSet
@@ -458,6 +1317,47 @@ func (o *Options) SetCompressionType(compression Compression) error {
 	return nil
 }
 
+func (o *Options) SetCompressionPerLevel(compressions []Compression) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	for _, c := range compressions {
+		if c >= nCompression {
+			return ErrInvalid
+		}
+	}
+	o.mu.Lock()
+	o.CompressionPerLevel = append([]Compression(nil), compressions...)
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *Options) SetTableFormatVersion(version int) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	if version < TableFormatV0 || version > MaxTableFormatVersion {
+		return ErrInvalid
+	}
+	o.mu.Lock()
+	o.TableFormatVersion = version
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *Options) SetChecksumType(checksum Checksum) error {
+	if o == nil {
+		return ErrNotSet
+	}
+	if checksum >= nChecksum {
+		return ErrInvalid
+	}
+	o.mu.Lock()
+	o.ChecksumType = checksum
+	o.mu.Unlock()
+	return nil
+}
+
 func (o *Options) SetFilter(p filter.Filter) error {
 	if o == nil {
 		return ErrNotSet
@@ -527,6 +1427,15 @@ const (
 	// buffer will not be copied before returned, so altering the
 	// buffer will causing unexpected result.
 	RFDontCopyBuffer
+
+	// If set, an iterator which finds a table corrupt skips the rest of
+	// the table and goes on with the other tables, rather than aborting
+	// with the corruption error. Skipped tables are logged, and may be
+	// enumerated afterward with DB.SkippedTables. Entries of a skipped
+	// table are missing from the iteration, thus older versions of their
+	// keys, or deleted keys, may show up instead. Point lookups ignore
+	// this flag.
+	RFSkipCorrupt
 )
 
 // ReadOptions represent sets of options used by LevelDB during read
@@ -534,6 +1443,13 @@ const (
 type ReadOptions struct {
 	// Specify the read flag.
 	Flag ReadOptionsFlag
+
+	// Start and Limit bound iterators to the key range [Start, Limit);
+	// keys outside of the range are never yielded in either direction.
+	// A nil Start or Limit means the range is unbounded on that side.
+	// Point lookups ignore the range.
+	Start []byte
+	Limit []byte
 }
 
 type ReadOptionsGetter interface {
@@ -565,6 +1481,17 @@ const (
 	// with sync==true has similar crash semantics to a "write()"
 	// system call followed by "fsync()".
 	WFSync WriteOptionsFlag = 1 << iota
+
+	// If set, the write is applied to the memdb only and is not appended
+	// to the journal. Such writes are visible to reads immediately and
+	// are flushed to a table by memdb compaction as usual, or on Close,
+	// but are lost if the process crashes before that. Intended for bulk
+	// loads that can be re-run on failure.
+	//
+	// WFNoWAL and WFSync are mutually exclusive; setting both is an
+	// error. A batch written with WFNoWAL may still be journaled when
+	// merged with concurrent writes that are not.
+	WFNoWAL
 )
 
 // WriteOptions represent sets of options used by LevelDB during write
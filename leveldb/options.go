@@ -8,6 +8,7 @@ package leveldb
 
 import (
 	"sync"
+	"time"
 
 	"github.com/syndtr/goleveldb/leveldb/cache"
 	"github.com/syndtr/goleveldb/leveldb/comparer"
@@ -49,6 +50,32 @@ func (o *iOptions) SetComparer(cmp comparer.Comparer) error {
 	return opt.ErrNotAllowed
 }
 
+func (o *iOptions) SetMerger(merger opt.Merger) error {
+	return opt.ErrNotAllowed
+}
+
+func (o *iOptions) SetNumLevels(n int) error {
+	return opt.ErrNotAllowed
+}
+
+func (o *iOptions) SetWALSyncInterval(interval time.Duration) error {
+	return opt.ErrNotAllowed
+}
+
+func (o *iOptions) SetFlag(flag opt.OptionsFlag) error {
+	if flag&opt.OFReadOnly != 0 {
+		return opt.ErrNotAllowed
+	}
+	return o.Options.SetFlag(flag)
+}
+
+func (o *iOptions) ClearFlag(flag opt.OptionsFlag) error {
+	if flag&opt.OFReadOnly != 0 {
+		return opt.ErrNotAllowed
+	}
+	return o.Options.ClearFlag(flag)
+}
+
 func (o *iOptions) SetMaxOpenFiles(max int) error {
 	o.mu.Lock()
 	defer o.mu.Unlock()
@@ -56,7 +83,7 @@ func (o *iOptions) SetMaxOpenFiles(max int) error {
 	if err != nil {
 		return err
 	}
-	o.s.tops.cache.SetCapacity(max)
+	o.s.tops.setCapacity(max)
 	return nil
 }
 
@@ -75,6 +102,21 @@ func (o *iOptions) SetBlockCache(cache cache.Cache) error {
 	return nil
 }
 
+func (o *iOptions) SetCompressedBlockCache(cache cache.Cache) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	oldcache := o.Options.GetCompressedBlockCache()
+	err := o.Options.SetCompressedBlockCache(cache)
+	if err != nil {
+		return err
+	}
+	if oldcache != nil {
+		oldcache.Purge(nil)
+	}
+	o.s.tops.cache.Purge(nil)
+	return nil
+}
+
 func (o *iOptions) SetFilter(p filter.Filter) error {
 	if p != nil {
 		p = &iFilter{p}
@@ -88,3 +130,21 @@ func (o *iOptions) InsertAltFilter(p filter.Filter) error {
 	}
 	return o.Options.InsertAltFilter(&iFilter{p})
 }
+
+// uOptions is like iOptions but expose the user comparer and filter, for
+// tables holding user keys rather than internal keys.
+type uOptions struct {
+	*iOptions
+}
+
+func (o uOptions) GetComparer() comparer.Comparer {
+	return o.s.cmp.cmp
+}
+
+func (o uOptions) GetFilter() filter.Filter {
+	p := o.iOptions.GetFilter()
+	if f, ok := p.(*iFilter); ok {
+		return f.filter
+	}
+	return p
+}
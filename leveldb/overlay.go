@@ -0,0 +1,215 @@
+// Copyright (c) 2013, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"runtime"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/memdb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// overlayReader is a read-only view of a database snapshot with pending
+// writes applied on top of it.
+type overlayReader struct {
+	snap *Snapshot
+	mem  *memdb.DB
+	seq  uint64 // seq of the last overlay entry
+	ts   bool
+
+	// range tombstones of the overlay
+	rdels rangeDels
+	ro    *opt.ReadOptions
+	err   error
+}
+
+// NewOverlayReader return a Reader over the latest snapshot of database
+// with writes of the given overlay batch applied on top of it, as if the
+// batch were committed: overlay puts override database values and overlay
+// deletes hide database keys. Nothing is written to the database; the
+// overlay is copied, so later modification of the batch doesn't affect
+// the returned Reader. The given read options are used by reads that
+// given nil read options.
+//
+// Timestamped entries are resolved by timestamp order, as with committed
+// writes.
+func (d *DB) NewOverlayReader(overlay *Batch, ro *opt.ReadOptions) Reader {
+	r := &overlayReader{ro: ro}
+	if r.err = d.rok(); r.err != nil {
+		return r
+	}
+
+	r.snap = d.newSnapshot()
+	runtime.SetFinalizer(r.snap, (*Snapshot).Release)
+
+	// overlay entries are newer than any entry of the snapshot
+	b := new(Batch)
+	if overlay != nil {
+		b.append(overlay)
+	}
+	b.seq = r.snap.entry.seq + 1
+	r.mem = memdb.New(d.s.cmp)
+	if r.err = b.memReplay(r.mem); r.err != nil {
+		return r
+	}
+	r.seq = b.seq + uint64(b.len())
+	r.ts = b.hasTs || d.hasTs()
+	if b.hasRangeDel {
+		r.rdels, r.err = b.rangeDels()
+	}
+	return r
+}
+
+func (r *overlayReader) Get(key []byte, ro *opt.ReadOptions) (value []byte, err error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if ro == nil {
+		ro = r.ro
+	}
+	if err = r.snap.ok(); err != nil {
+		return
+	}
+
+	ucmp := r.snap.d.s.cmp.cmp
+
+	// timestamped entries and overlay range tombstones must be resolved
+	// across overlay and database
+	if r.ts || len(r.rdels) > 0 {
+		return r.seekGet(key, ro)
+	}
+
+	k, value, err := r.mem.Find(newIKey(key, kMaxSeq, tSeek))
+	if err == nil {
+		ik := iKey(k)
+		if ucmp.Compare(ik.ukey(), key) == 0 {
+			if _, t, ok := ik.parseNum(); ok {
+				t, value = resolveTTL(t, value, ttlNow())
+				switch t {
+				case tDel:
+					return nil, errors.ErrNotFound
+				case tMerge:
+					// merge operands must be resolved across overlay and
+					// database
+					return r.seekGet(key, ro)
+				}
+				return
+			}
+		}
+	}
+	return r.snap.Get(key, ro)
+}
+
+// Get given key by seeking an iterator of the reader.
+func (r *overlayReader) seekGet(key []byte, ro *opt.ReadOptions) (value []byte, err error) {
+	iter := r.NewIterator(ro)
+	defer iter.Release()
+	if iter.Seek(key) && r.snap.d.s.cmp.cmp.Compare(iter.Key(), key) == 0 {
+		// the value must outlive the iterator
+		return dupBytes(iter.Value()), nil
+	}
+	if err = iter.Error(); err == nil {
+		err = errors.ErrNotFound
+	}
+	return
+}
+
+func (r *overlayReader) NewIterator(ro *opt.ReadOptions) iterator.Iterator {
+	if r.err != nil {
+		return &iterator.EmptyIterator{Err: r.err}
+	}
+	if ro == nil {
+		ro = r.ro
+	}
+	if err := r.snap.ok(); err != nil {
+		return &iterator.EmptyIterator{Err: err}
+	}
+
+	d := r.snap.d
+	it, brdels := d.newRawIteratorRd(ro)
+	base := &seqIter{Iterator: it, seq: r.snap.entry.seq}
+	ii := []iterator.Iterator{boundIter(r.mem.NewIterator(), ro, d.s.cmp), base}
+
+	// database tombstones newer than the snapshot are not part of the view
+	rdels := append(rangeDels{}, r.rdels...)
+	for _, rd := range brdels {
+		if rd.seq <= r.snap.entry.seq {
+			rdels = append(rdels, rd)
+		}
+	}
+	i := &dbIter{
+		snap:       r.snap,
+		cmp:        d.s.cmp.cmp,
+		it:         iterator.NewMergedIterator(ii, d.s.cmp),
+		seq:        r.seq,
+		ts:         r.ts,
+		merger:     d.s.o.GetMerger(),
+		rdels:      rdels,
+		copyBuffer: !ro.HasFlag(opt.RFDontCopyBuffer),
+		now:        ttlNow(),
+		d:          d,
+	}
+	atomic.AddInt32(&d.niters, 1)
+	runtime.SetFinalizer(i, (*dbIter).Release)
+	return i
+}
+
+// seqIter is an internal key iterator that skip entries newer than seq.
+type seqIter struct {
+	iterator.Iterator
+	seq uint64
+}
+
+func (i *seqIter) visible() bool {
+	seq, _, ok := iKey(i.Key()).parseNum()
+	return !ok || seq <= i.seq
+}
+
+func (i *seqIter) skipForward() bool {
+	for !i.visible() {
+		if !i.Iterator.Next() {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *seqIter) skipBackward() bool {
+	for !i.visible() {
+		if !i.Iterator.Prev() {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *seqIter) First() bool {
+	return i.Iterator.First() && i.skipForward()
+}
+
+func (i *seqIter) Last() bool {
+	return i.Iterator.Last() && i.skipBackward()
+}
+
+func (i *seqIter) Seek(key []byte) bool {
+	return i.Iterator.Seek(key) && i.skipForward()
+}
+
+func (i *seqIter) SeekForPrev(key []byte) bool {
+	return i.Iterator.SeekForPrev(key) && i.skipBackward()
+}
+
+func (i *seqIter) Next() bool {
+	return i.Iterator.Next() && i.skipForward()
+}
+
+func (i *seqIter) Prev() bool {
+	return i.Iterator.Prev() && i.skipBackward()
+}
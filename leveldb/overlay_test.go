@@ -0,0 +1,107 @@
+// Copyright (c) 2013, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"testing"
+
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+func TestDb_OverlayReader(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("a", "db")
+	h.put("c", "db")
+	h.compactMem()
+	h.put("b", "db")
+	h.put("e", "db")
+
+	b := new(Batch)
+	b.Put([]byte("b"), []byte("ov"))
+	b.Delete([]byte("c"))
+	b.Put([]byte("d"), []byte("ov"))
+	b.Delete([]byte("x"))
+	r := h.db.NewOverlayReader(b, nil)
+
+	// Neither later writes nor modification of the overlay are visible.
+	b.Put([]byte("f"), []byte("ov"))
+	h.put("a", "new")
+	h.put("g", "new")
+
+	scan := func(iter iterator.Iterator, first, next func() bool) (res string) {
+		for ok := first(); ok; ok = next() {
+			res += string(iter.Key()) + "=" + string(iter.Value()) + " "
+		}
+		if err := iter.Error(); err != nil {
+			t.Error("iterator: got error: ", err)
+		}
+		return
+	}
+	check := func() {
+		h.getValr(r, "a", "db")
+		h.getValr(r, "b", "ov")
+		h.getr(r, "c", false)
+		h.getValr(r, "d", "ov")
+		h.getValr(r, "e", "db")
+		h.getr(r, "f", false)
+		h.getr(r, "g", false)
+		h.getr(r, "x", false)
+
+		iter := r.NewIterator(nil)
+		if res, want := scan(iter, iter.First, iter.Next), "a=db b=ov d=ov e=db "; res != want {
+			t.Errorf("forward: got %q, want %q", res, want)
+		}
+		if res, want := scan(iter, iter.Last, iter.Prev), "e=db d=ov b=ov a=db "; res != want {
+			t.Errorf("backward: got %q, want %q", res, want)
+		}
+		if !iter.Seek([]byte("c")) || string(iter.Key()) != "d" {
+			t.Errorf("Seek: got %q, want \"d\"", iter.Key())
+		}
+	}
+	check()
+	h.compactMem()
+	h.compactRange("", "")
+	check()
+
+	// Timestamped overlay entries are resolved by timestamp order.
+	b = new(Batch)
+	b.PutWithTs([]byte("t"), []byte("db"), 5)
+	b.PutWithTs([]byte("u"), []byte("db"), 5)
+	if err := h.db.Write(b, h.wo); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+	b = new(Batch)
+	b.PutWithTs([]byte("t"), []byte("old"), 1)
+	b.PutWithTs([]byte("u"), []byte("new"), 9)
+	r = h.db.NewOverlayReader(b, nil)
+	h.getValr(r, "t", "db")
+	h.getValr(r, "u", "new")
+	h.getr(r, "v", false)
+}
+
+func TestDb_OverlayReaderMerge(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{Merger: appendMerger{}})
+	defer h.close()
+
+	h.put("a", "db")
+	h.compactMem()
+
+	b := new(Batch)
+	b.Merge([]byte("a"), []byte("ov"))
+	r := h.db.NewOverlayReader(b, nil)
+	for i := 0; i < 3; i++ {
+		h.getValr(r, "a", "db,ov")
+	}
+
+	// merged reads must not leave iterators behind
+	if v, err := h.db.GetProperty("leveldb.num-iterators"); err != nil || v != "0" {
+		t.Errorf("num-iterators: got %q, want %q, err=%v", v, "0", err)
+	}
+}
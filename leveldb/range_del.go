@@ -0,0 +1,177 @@
+// Copyright (c) 2013, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+)
+
+// rangeDel is a range tombstone; it deletes entries of user keys within
+// [start, limit) which seq number is lower than its own.
+type rangeDel struct {
+	start, limit []byte
+	seq          uint64
+}
+
+// Check whether given user key is within range of the tombstone.
+func (r *rangeDel) contains(ukey []byte, ucmp comparer.BasicComparer) bool {
+	return ucmp.Compare(ukey, r.start) >= 0 && ucmp.Compare(ukey, r.limit) < 0
+}
+
+type rangeDels []*rangeDel
+
+// Check whether each of the tombstones ends at or before given user key.
+func (p rangeDels) before(ukey []byte, ucmp comparer.BasicComparer) bool {
+	for _, r := range p {
+		if ucmp.Compare(r.limit, ukey) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the highest seq number of tombstones covering given user key and
+// visible at given seq number; zero if none. Entries of the user key with
+// lower seq number are deleted.
+func (p rangeDels) coverSeq(ukey []byte, seq uint64, ucmp comparer.BasicComparer) (max uint64) {
+	for _, r := range p {
+		if r.seq <= seq && r.seq > max && r.contains(ukey, ucmp) {
+			max = r.seq
+		}
+	}
+	return
+}
+
+// memRangeDels hold range tombstones written to a memdb, so reads need not
+// scan the memdb for them.
+type memRangeDels struct {
+	mu   sync.RWMutex
+	list rangeDels
+}
+
+func (p *memRangeDels) add(rdels rangeDels) {
+	p.mu.Lock()
+	p.list = append(p.list, rdels...)
+	p.mu.Unlock()
+}
+
+func (p *memRangeDels) get() rangeDels {
+	if p == nil {
+		return nil
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.list
+}
+
+// Return range tombstones within given mem and version; nil if none.
+func getRangeDels(mem *memSet, v *version) (rdels rangeDels) {
+	cur, froze := mem.curRd.get(), mem.frozeRd.get()
+	n := len(cur) + len(froze) + len(v.rdels)
+	if n == 0 {
+		return nil
+	}
+	rdels = make(rangeDels, 0, n)
+	rdels = append(rdels, cur...)
+	rdels = append(rdels, froze...)
+	return append(rdels, v.rdels...)
+}
+
+// rangeDelIter is a forward-only internal key iterator used by compaction.
+// It drops entries covered by range tombstones which are visible to every
+// snapshot, i.e. at minSeq. Range tombstone entries of the source are
+// passed through and collected into rdels, they apply to the following
+// entries as well.
+type rangeDelIter struct {
+	iterator.Iterator
+	ucmp   comparer.BasicComparer
+	minSeq uint64
+	active rangeDels // tombstones that may cover upcoming entries
+	rdels  rangeDels // tombstones found within the source
+	err    error
+}
+
+func newRangeDelIter(src iterator.Iterator, ucmp comparer.BasicComparer, rdels rangeDels, minSeq uint64) *rangeDelIter {
+	i := &rangeDelIter{Iterator: src, ucmp: ucmp, minSeq: minSeq}
+	for _, r := range rdels {
+		if r.seq <= minSeq {
+			i.active = append(i.active, r)
+		}
+	}
+	return i
+}
+
+func (i *rangeDelIter) unsupported() bool {
+	i.err = errors.ErrInvalid("range tombstone compaction iterator is forward only")
+	return false
+}
+
+func (i *rangeDelIter) First() bool                 { return i.unsupported() }
+func (i *rangeDelIter) Last() bool                  { return i.unsupported() }
+func (i *rangeDelIter) Seek(key []byte) bool        { return i.unsupported() }
+func (i *rangeDelIter) SeekForPrev(key []byte) bool { return i.unsupported() }
+func (i *rangeDelIter) Prev() bool                  { return i.unsupported() }
+
+func (i *rangeDelIter) Next() bool {
+	if i.err != nil {
+		return false
+	}
+	for i.Iterator.Next() {
+		key := iKey(i.Key())
+		seq, t, ok := key.parseNum()
+		if !ok {
+			// Don't drop error keys
+			return true
+		}
+		ukey := key.ukey()
+		if t == tRangeDel {
+			r := &rangeDel{start: dupBytes(ukey), limit: dupBytes(i.Value()), seq: seq}
+			i.rdels = append(i.rdels, r)
+			if seq <= i.minSeq {
+				i.active = append(i.active, r)
+			}
+			return true
+		}
+		if len(i.active) > 0 {
+			// Source is sorted, tombstones ending before this key are done
+			n := 0
+			for _, r := range i.active {
+				if i.ucmp.Compare(ukey, r.limit) < 0 {
+					i.active[n] = r
+					n++
+				}
+			}
+			i.active = i.active[:n]
+			if i.active.coverSeq(ukey, i.minSeq, i.ucmp) > seq {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (i *rangeDelIter) Error() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.Iterator.Error()
+}
+
+// Return seq number that tables written at given minSeq are cleaned up to:
+// entries covered by tombstones with seq number at or below it were
+// dropped. Tombstones of memdb are not applied by table compaction.
+func (d *DB) cleanSeq(minSeq uint64) uint64 {
+	if seq := d.s.stSeq; seq < minSeq {
+		return seq
+	}
+	return minSeq
+}
@@ -7,7 +7,9 @@
 package leveldb
 
 import (
+	"fmt"
 	"os"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 
@@ -24,6 +26,7 @@ type session struct {
 	stJournalNum     uint64 // current journal file number; need external synchronization
 	stPrevJournalNum uint64 // prev journal file number; no longer used; for compatibility with older version of leveldb
 	stSeq            uint64 // last mem compacted seq; need external synchronization
+	stTs             bool   // whether database may contain timestamped keys; need external synchronization
 
 	stor     storage.Storage
 	storLock storage.Locker
@@ -32,15 +35,22 @@ type session struct {
 	tops     *tOps
 
 	manifest *journalWriter
+	cmu      sync.Mutex // serializes commits of concurrent compactions
 
-	stCPtrs   [kNumLevels]iKey // compact pointers; need external synchronization
-	stVersion unsafe.Pointer   // current version
+	obsMu    sync.Mutex
+	obsolete []storage.File // obsolete files kept until purged
+
+	stCPtrs   []iKey         // compact pointers; need external synchronization
+	stVersion unsafe.Pointer // current version
 }
 
 func openSession(stor storage.Storage, o *opt.Options) (s *session, err error) {
 	if stor == nil || o == nil {
 		return nil, os.ErrInvalid
 	}
+	if o.GetNumLevels() < 2 {
+		return nil, errors.ErrInvalid("invalid number of levels")
+	}
 	storLock, err := stor.Lock()
 	if err != nil {
 		return
@@ -51,7 +61,8 @@ func openSession(stor storage.Storage, o *opt.Options) (s *session, err error) {
 	s.cmp = &iComparer{o.GetComparer()}
 	s.o = newIOptions(s, *o)
 	s.tops = newTableOps(s, s.o.GetMaxOpenFiles())
-	s.setVersion(&version{s: s})
+	s.stCPtrs = make([]iKey, s.o.GetNumLevels())
+	s.setVersion(newVersion(s))
 	return
 }
 
@@ -92,6 +103,8 @@ func (s *session) recover() (err error) {
 	defer r.close()
 
 	cmp := s.cmp.cmp.Name()
+	numLevels := s.o.GetNumLevels()
+	hasNumLevels := false
 	staging := s.version_NB().newStaging()
 	srec := new(sessionRecord)
 
@@ -108,6 +121,16 @@ func (s *session) recover() (err error) {
 				"got '" + rec.comparer + "'")
 		}
 
+		if rec.hasNumLevels {
+			if rec.numLevels != numLevels {
+				return errNumLevels(numLevels, rec.numLevels)
+			}
+			hasNumLevels = true
+		}
+		if level := rec.maxLevel(); level >= numLevels {
+			return errNumLevels(numLevels, level+1)
+		}
+
 		// save compact pointers
 		for _, rp := range rec.compactPointers {
 			s.stCPtrs[rp.level] = iKey(rp.key)
@@ -128,6 +151,9 @@ func (s *session) recover() (err error) {
 		if rec.hasSeq {
 			srec.setSeq(rec.seq)
 		}
+		if rec.hasTs {
+			srec.setTs()
+		}
 	}
 
 	// check for error in journal reader
@@ -136,6 +162,11 @@ func (s *session) recover() (err error) {
 		return
 	}
 
+	// a database without recorded number of levels has the default
+	if !hasNumLevels && numLevels != opt.DefaultNumLevels {
+		return errNumLevels(numLevels, opt.DefaultNumLevels)
+	}
+
 	switch false {
 	case srec.hasNextNum:
 		err = errors.ErrCorrupt("manifest missing next file number")
@@ -148,22 +179,53 @@ func (s *session) recover() (err error) {
 		return
 	}
 
+	v := staging.finish()
+	if s.o.HasFlag(opt.OFParanoidCheck) {
+		if err = v.check(nil); err != nil {
+			return
+		}
+	}
+
 	s.manifest = &journalWriter{file: file}
-	s.setVersion(staging.finish())
+	s.setVersion(v)
 	s.setFileNum(srec.nextNum)
 	s.recordCommited(srec)
 
 	return
 }
 
-// Commit session; need external synchronization.
+func errNumLevels(want, got int) error {
+	return errors.ErrInvalid(fmt.Sprintf("invalid number of levels, want %d, got %d", want, got))
+}
+
+// Commit session; need external synchronization, except against commits
+// of concurrent compactions.
 func (s *session) commit(r *sessionRecord) (err error) {
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+
 	// spawn new version based on current version
 	nv := s.version_NB().spawn(r)
 
+	if s.o.HasFlag(opt.OFParanoidCheck) && len(r.newTables) > 0 {
+		// tables of the current version were checked already
+		nums := make(map[uint64]bool)
+		for _, t := range r.newTables {
+			nums[t.num] = true
+		}
+		if err = nv.check(nums); err != nil {
+			s.printf("Commit: %v", err)
+			return
+		}
+	}
+
 	if s.manifest.closed() {
 		// manifest journal writer not yet created, create one
 		err = s.createManifest(s.allocFileNum(), r, nv)
+	} else if max := s.o.GetMaxManifestSize(); max > 0 && s.manifest.journal.Size() >= max {
+		// manifest grown too large, start a new one from a snapshot
+		s.printf("Manifest: rotating, num=%d size=%d", s.manifest.file.Num(), s.manifest.journal.Size())
+		err = s.createManifest(s.allocFileNum(), r, nv)
 	} else {
 		err = s.flushManifest(r)
 	}
@@ -183,9 +245,20 @@ func (s *session) pickCompaction() (c *compaction) {
 
 	v := s.version_NB()
 
+	if v.cScore >= 1 && v.cLevel == 0 && s.o.GetCompactionStyle() == opt.TieredCompaction {
+		if c = s.pickTier(v); c != nil {
+			return
+		}
+	}
+
 	var level int
 	var t0 tFiles
-	if v.cScore >= 1 {
+	var seek bool
+	if v.cScore >= 1 && v.cDel != nil {
+		// compact the table holding too many deletions
+		level = v.cLevel
+		t0 = append(t0, v.cDel)
+	} else if v.cScore >= 1 {
 		level = v.cLevel
 		cp := s.stCPtrs[level]
 		tt := v.tables[level]
@@ -203,12 +276,14 @@ func (s *session) pickCompaction() (c *compaction) {
 			ts := (*tSet)(p)
 			level = ts.level
 			t0 = append(t0, ts.table)
+			seek = true
 		} else {
 			return
 		}
 	}
 
-	c = &compaction{s: s, version: v, level: level}
+	c = newCompaction(s, v, level)
+	c.seek = seek
 	if level == 0 {
 		min, max := t0.getRange(icmp)
 		t0 = nil
@@ -220,6 +295,98 @@ func (s *session) pickCompaction() (c *compaction) {
 	return
 }
 
+// Pick up to n compactions that may run concurrently, the first one being
+// the one picked by pickCompaction; need external synchronization.
+func (s *session) pickCompactions(n int) (cs []*compaction) {
+	c := s.pickCompaction()
+	if c == nil {
+		return
+	}
+	cs = append(cs, c)
+	if c.tier {
+		// tables flushed meanwhile must be newer than the merged one
+		return
+	}
+
+	v := c.version
+	add := func(c *compaction) {
+		for _, x := range cs {
+			if c.conflicts(x) {
+				return
+			}
+		}
+		cs = append(cs, c)
+	}
+	for level := range v.tables[:len(v.tables)-1] {
+		if len(cs) >= n {
+			break
+		}
+		if v.levelScore(level) < 1 {
+			continue
+		}
+		tt := v.tables[level]
+		if level == 0 {
+			c := newCompaction(s, v, 0)
+			min, max := tt.getRange(s.cmp)
+			tt.getOverlaps(min.ukey(), max.ukey(), &c.tables[0], false, s.cmp.cmp)
+			c.expand()
+			add(c)
+			continue
+		}
+		// start after the compact pointer, as pickCompaction would
+		start := 0
+		if cp := s.stCPtrs[level]; cp != nil {
+			for start < len(tt) && s.cmp.Compare(tt[start].max, cp) <= 0 {
+				start++
+			}
+		}
+		for i := range tt {
+			c := newCompaction(s, v, level)
+			c.tables[0] = tFiles{tt[(start+i)%len(tt)]}
+			c.expand()
+			add(c)
+			if len(cs) >= n {
+				break
+			}
+		}
+	}
+	return
+}
+
+// Pick a tiered compaction merging the newest level-0 tables of similar
+// size into a single level-0 table; nil if there are no such tables or
+// level-0 has grown large enough to be merged into level-1. Only the
+// newest tables are picked, thus the merged table, which gets the highest
+// file number, is rightly looked up before the remaining older ones.
+func (s *session) pickTier(v *version) *compaction {
+	tt := v.tables[0]
+	if float64(tt.size()) >= levelMaxSize(1) {
+		return nil
+	}
+
+	newest := append(tFiles{}, tt...)
+	newest.sort(tFileSorterNewest(nil))
+	var tier tFiles
+	var size uint64
+	for _, t := range newest {
+		// a table joins the tier unless much larger than its tables
+		if len(tier) > 0 && t.size > 2*size/uint64(len(tier)) {
+			break
+		}
+		tier = append(tier, t)
+		size += t.size
+	}
+	if len(tier) < 2 {
+		return nil
+	}
+
+	c := newCompaction(s, v, 0)
+	c.tier = true
+	c.tables[0] = tier
+	c.min, c.max = tier.getRange(s.cmp)
+	return c
+}
+
 // Create compaction from given level and range; need external synchronization.
 func (s *session) getCompactionRange(level int, min, max []byte) (c *compaction) {
 	v := s.version_NB()
@@ -230,7 +397,22 @@ func (s *session) getCompactionRange(level int, min, max []byte) (c *compaction)
 		return nil
 	}
 
-	c = &compaction{s: s, version: v, level: level}
+	// Avoid compacting too much in one shot in case the range is large.
+	// But we cannot do this for level-0 since level-0 files can overlap
+	// and we must not pick one file and drop another older file if the
+	// two files overlap.
+	if level > 0 {
+		var total uint64
+		for i, t := range t0 {
+			total += t.size
+			if total >= kMaxTableSize {
+				t0 = t0[:i+1]
+				break
+			}
+		}
+	}
+
+	c = newCompaction(s, v, level)
 	c.tables[0] = t0
 	c.expand()
 	return
@@ -250,7 +432,26 @@ type compaction struct {
 	overlappedBytes uint64
 	min, max        iKey
 
-	tPtrs [kNumLevels]int
+	tPtrs []int
+
+	seek   bool // triggered by seeks
+	tier   bool // tiered compaction, merging level-0 tables into level-0
+	worker bool // run by a worker, concurrently with other compactions
+
+	// closed if the compaction should be abandoned, if set
+	cancel <-chan struct{}
+}
+
+// Level the compaction output tables are written into.
+func (c *compaction) outLevel() int {
+	if c.tier {
+		return c.level
+	}
+	return c.level + 1
+}
+
+func newCompaction(s *session, v *version, level int) *compaction {
+	return &compaction{s: s, version: v, level: level, tPtrs: make([]int, len(v.tables))}
 }
 
 // Expand compacted tables; need external synchronization.
@@ -292,7 +493,7 @@ func (c *compaction) expand() {
 
 	// Compute the set of grandparent files that overlap this compaction
 	// (parent == level+1; grandparent == level+2)
-	if level+2 < kNumLevels {
+	if level+2 < len(v.tables) {
 		v.tables[level+2].getOverlaps(amin.ukey(), amax.ukey(), &c.gp, true, ucmp)
 	}
 
@@ -300,12 +501,48 @@ func (c *compaction) expand() {
 	c.min, c.max = min, max
 }
 
+// Get user key range covered by compacted tables of both levels.
+func (c *compaction) ukeyRange() (min, max []byte) {
+	tt := append(append(tFiles{}, c.tables[0]...), c.tables[1]...)
+	imin, imax := tt.getRange(c.s.cmp)
+	return imin.ukey(), imax.ukey()
+}
+
+// Check whether compaction must not run concurrently with given one;
+// that is when both read level-0, or when they share a level within
+// overlapping key ranges.
+func (c *compaction) conflicts(x *compaction) bool {
+	if c.level == 0 && x.level == 0 {
+		return true
+	}
+	levels := func(c *compaction) [2]int { return [2]int{c.level, c.outLevel()} }
+	shared := false
+	for _, a := range levels(c) {
+		for _, b := range levels(x) {
+			if a == b {
+				shared = true
+			}
+		}
+	}
+	if !shared {
+		return false
+	}
+	ucmp := c.s.cmp.cmp
+	cmin, cmax := c.ukeyRange()
+	xmin, xmax := x.ukeyRange()
+	return ucmp.Compare(cmin, xmax) <= 0 && ucmp.Compare(xmin, cmax) <= 0
+}
+
 // Check whether compaction is trivial.
 func (c *compaction) trivial() bool {
 	return len(c.tables[0]) == 1 && len(c.tables[1]) == 0 && c.gp.size() <= kMaxGrandParentOverlapBytes
 }
 
 func (c *compaction) isBaseLevelForKey(key []byte) bool {
+	if c.tier {
+		// older level-0 tables and every deeper level may have the key
+		return false
+	}
 	s := c.s
 	v := c.version
 	ucmp := s.cmp.cmp
@@ -326,6 +563,55 @@ func (c *compaction) isBaseLevelForKey(key []byte) bool {
 	return true
 }
 
+// Check whether given range tombstone may be dropped by the compaction:
+// output level is the bottommost level overlapping the tombstone, and
+// overlapping tables not being compacted had dropped entries it cover.
+func (c *compaction) isBaseLevelForRangeDel(r *rangeDel) bool {
+	if c.tier {
+		return false
+	}
+	ucmp := c.s.cmp.cmp
+	compacted := func(level int, t *tFile) bool {
+		if n := level - c.level; n == 0 || n == 1 {
+			for _, x := range c.tables[n] {
+				if x == t {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for level, tt := range c.version.tables {
+		for _, t := range tt {
+			if t.isAfter(r.start, ucmp) || ucmp.Compare(t.min.ukey(), r.limit) >= 0 {
+				continue
+			}
+			if level > c.outLevel() {
+				return false
+			}
+			if t.cleanSeq < r.seq && !compacted(level, t) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Check whether compacted tables may be split before given user key; that
+// is, whether each of them lies either wholly before or wholly at or after
+// it.
+func (c *compaction) isCleanCut(ukey []byte) bool {
+	ucmp := c.s.cmp.cmp
+	for _, tt := range c.tables {
+		for _, t := range tt {
+			if ucmp.Compare(t.min.ukey(), ukey) < 0 && ucmp.Compare(t.max.ukey(), ukey) >= 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func (c *compaction) shouldStopBefore(key iKey) bool {
 	icmp := c.s.cmp
 	for ; c.gpidx < len(c.gp); c.gpidx++ {
@@ -10,6 +10,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"sync/atomic"
+	"unsafe"
 )
 
 // These numbers are written to disk and should not be changed.
@@ -22,10 +24,14 @@ const (
 	tagDeletedTable   = 6
 	tagNewTable       = 7
 	// 8 was used for large value refs
-	tagPrevJournalNum = 9
+	tagPrevJournalNum  = 9
+	tagTs              = 10
+	tagRangeDel        = 11
+	tagDeletedRangeDel = 12
+	tagNumLevels       = 13
 )
 
-const tagMax = tagPrevJournalNum
+const tagMax = tagNumLevels
 
 var tagBytesCache [tagMax + 1][]byte
 
@@ -50,10 +56,17 @@ type ntRecord struct {
 	size  uint64
 	min   iKey
 	max   iKey
+
+	// not written to disk
+	cleanSeq uint64
+	stats    unsafe.Pointer // *tStats
 }
 
 func (r ntRecord) makeFile(s *session) *tFile {
-	return newTFile(s.getTableFile(r.num), r.size, r.min, r.max)
+	t := newTFile(s.getTableFile(r.num), r.size, r.min, r.max, s.o.GetSeekCompactionBytesPerSeek())
+	t.cleanSeq = r.cleanSeq
+	t.stats = r.stats
+	return t
 }
 
 type dtRecord struct {
@@ -77,9 +90,19 @@ type sessionRecord struct {
 	hasSeq bool
 	seq    uint64
 
+	// whether database may contain timestamped keys
+	hasTs bool
+
+	// only written if not the default number of levels
+	hasNumLevels bool
+	numLevels    int
+
 	compactPointers []cpRecord
 	newTables       []ntRecord
 	deletedTables   []dtRecord
+
+	rangeDels        rangeDels
+	deletedRangeDels []uint64
 }
 
 func (p *sessionRecord) setComparer(name string) {
@@ -107,22 +130,63 @@ func (p *sessionRecord) setSeq(seq uint64) {
 	p.seq = seq
 }
 
+func (p *sessionRecord) setTs() {
+	p.hasTs = true
+}
+
+func (p *sessionRecord) setNumLevels(n int) {
+	p.hasNumLevels = true
+	p.numLevels = n
+}
+
 func (p *sessionRecord) addCompactPointer(level int, key iKey) {
 	p.compactPointers = append(p.compactPointers, cpRecord{level, key})
 }
 
 func (p *sessionRecord) addTable(level int, num, size uint64, min, max iKey) {
-	p.newTables = append(p.newTables, ntRecord{level, num, size, min, max})
+	p.newTables = append(p.newTables, ntRecord{level: level, num: num, size: size, min: min, max: max})
 }
 
 func (p *sessionRecord) addTableFile(level int, t *tFile) {
 	p.addTable(level, t.file.Num(), t.size, t.min, t.max)
+	p.newTables[len(p.newTables)-1].cleanSeq = t.cleanSeq
+	p.newTables[len(p.newTables)-1].stats = atomic.LoadPointer(&t.stats)
 }
 
 func (p *sessionRecord) deleteTable(level int, num uint64) {
 	p.deletedTables = append(p.deletedTables, dtRecord{level, num})
 }
 
+func (p *sessionRecord) addRangeDel(r *rangeDel) {
+	p.rangeDels = append(p.rangeDels, r)
+}
+
+// Range tombstones are identified by their seq number.
+func (p *sessionRecord) deleteRangeDel(seq uint64) {
+	p.deletedRangeDels = append(p.deletedRangeDels, seq)
+}
+
+// Return the highest level referenced by the record, or -1 if none.
+func (p *sessionRecord) maxLevel() (level int) {
+	level = -1
+	for _, r := range p.compactPointers {
+		if r.level > level {
+			level = r.level
+		}
+	}
+	for _, r := range p.newTables {
+		if r.level > level {
+			level = r.level
+		}
+	}
+	for _, r := range p.deletedTables {
+		if r.level > level {
+			level = r.level
+		}
+	}
+	return
+}
+
 func (p *sessionRecord) encodeTo(w io.Writer) (err error) {
 	tmp := make([]byte, binary.MaxVarintLen64)
 
@@ -188,6 +252,24 @@ func (p *sessionRecord) encodeTo(w io.Writer) (err error) {
 		}
 	}
 
+	if p.hasTs {
+		_, err = w.Write(tagBytesCache[tagTs])
+		if err != nil {
+			return
+		}
+	}
+
+	if p.hasNumLevels {
+		_, err = w.Write(tagBytesCache[tagNumLevels])
+		if err != nil {
+			return
+		}
+		err = putUvarint(uint64(p.numLevels))
+		if err != nil {
+			return
+		}
+	}
+
 	for _, p := range p.compactPointers {
 		_, err = w.Write(tagBytesCache[tagCompactPointer])
 		if err != nil {
@@ -245,6 +327,36 @@ func (p *sessionRecord) encodeTo(w io.Writer) (err error) {
 		}
 	}
 
+	for _, seq := range p.deletedRangeDels {
+		_, err = w.Write(tagBytesCache[tagDeletedRangeDel])
+		if err != nil {
+			return
+		}
+		err = putUvarint(seq)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, r := range p.rangeDels {
+		_, err = w.Write(tagBytesCache[tagRangeDel])
+		if err != nil {
+			return
+		}
+		err = putUvarint(r.seq)
+		if err != nil {
+			return
+		}
+		err = putBytes(r.start)
+		if err != nil {
+			return
+		}
+		err = putBytes(r.limit)
+		if err != nil {
+			return
+		}
+	}
+
 	return
 }
 
@@ -295,6 +407,14 @@ func (p *sessionRecord) decodeFrom(r readByteReader) (err error) {
 				p.seq = seq
 				p.hasSeq = true
 			}
+		case tagTs:
+			p.hasTs = true
+		case tagNumLevels:
+			var n uint64
+			n, err = binary.ReadUvarint(r)
+			if err == nil {
+				p.setNumLevels(int(n))
+			}
 		case tagCompactPointer:
 			var level uint64
 			var b []byte
@@ -344,6 +464,28 @@ func (p *sessionRecord) decodeFrom(r readByteReader) (err error) {
 				break
 			}
 			p.deleteTable(int(level), num)
+		case tagRangeDel:
+			rd := new(rangeDel)
+			rd.seq, err = binary.ReadUvarint(r)
+			if err != nil {
+				break
+			}
+			rd.start, err = readBytes(r)
+			if err != nil {
+				break
+			}
+			rd.limit, err = readBytes(r)
+			if err != nil {
+				break
+			}
+			p.addRangeDel(rd)
+		case tagDeletedRangeDel:
+			var seq uint64
+			seq, err = binary.ReadUvarint(r)
+			if err != nil {
+				break
+			}
+			p.deleteRangeDel(seq)
 		}
 	}
 
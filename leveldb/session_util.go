@@ -8,10 +8,12 @@ package leveldb
 
 import (
 	"fmt"
+	"os"
 	"sync/atomic"
 	"unsafe"
 
 	"github.com/syndtr/goleveldb/leveldb/journal"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/storage"
 )
 
@@ -45,6 +47,34 @@ func (s *session) getFiles(t storage.FileType) []storage.File {
 	return s.stor.GetFiles(t)
 }
 
+// Remove given obsolete file, or keep it until purged if
+// opt.OFKeepObsoleteFiles is set.
+func (s *session) removeFile(f storage.File) {
+	if !s.o.HasFlag(opt.OFKeepObsoleteFiles) {
+		f.Remove()
+		return
+	}
+	s.obsMu.Lock()
+	s.obsolete = append(s.obsolete, f)
+	s.obsMu.Unlock()
+}
+
+// Remove obsolete files kept so far; return the first error.
+func (s *session) purgeFiles() (err error) {
+	s.obsMu.Lock()
+	ff := s.obsolete
+	s.obsolete = nil
+	s.obsMu.Unlock()
+
+	for _, f := range ff {
+		if err1 := f.Remove(); err1 != nil && !os.IsNotExist(err1) && err == nil {
+			err = err1
+		}
+	}
+	s.printf("PurgeFiles: done, files=%d", len(ff))
+	return
+}
+
 // session state
 
 // Get current version.
@@ -124,7 +154,7 @@ func (s *session) fillRecord(r *sessionRecord, snapshot bool) {
 			r.setJournalNum(s.stJournalNum)
 		}
 
-		if !r.hasJournalNum {
+		if !r.hasSeq {
 			r.setSeq(s.stSeq)
 		}
 
@@ -134,7 +164,15 @@ func (s *session) fillRecord(r *sessionRecord, snapshot bool) {
 			}
 		}
 
+		if s.stTs {
+			r.setTs()
+		}
+
 		r.setComparer(s.cmp.cmp.Name())
+
+		if n := len(s.stCPtrs); n != opt.DefaultNumLevels {
+			r.setNumLevels(n)
+		}
 	}
 }
 
@@ -153,6 +191,10 @@ func (s *session) recordCommited(r *sessionRecord) {
 		s.stSeq = r.seq
 	}
 
+	if r.hasTs {
+		s.stTs = true
+	}
+
 	for _, p := range r.compactPointers {
 		s.stCPtrs[p.level] = iKey(p.key)
 	}
@@ -179,7 +221,8 @@ func (s *session) createManifest(num uint64, r *sessionRecord, v *version) (err
 		if err == nil {
 			s.recordCommited(r)
 			if s.manifest != nil {
-				s.manifest.remove()
+				s.manifest.close()
+				s.removeFile(s.manifest.file)
 			}
 			s.manifest = w
 		} else {
@@ -200,6 +243,16 @@ func (s *session) createManifest(num uint64, r *sessionRecord, v *version) (err
 	return s.stor.SetManifest(w.file)
 }
 
+// Rotate the manifest: write the current version as a single record into
+// a new manifest, switch CURRENT to it and remove the old one. The new
+// manifest is synced before CURRENT is switched, and the switch is durable
+// before the old one is removed, thus a crash at any point leaves either
+// manifest in use; need external synchronization.
+func (s *session) rotateManifest() error {
+	s.printf("Manifest: rotating, num=%d", s.manifest.file.Num())
+	return s.createManifest(s.allocFileNum(), nil, nil)
+}
+
 // Flush record to disk.
 func (s *session) flushManifest(r *sessionRecord) (err error) {
 	s.fillRecord(r, false)
@@ -556,3 +556,79 @@ func TestSorted_GeneratedLong(t *testing.T) {
 	}
 	h.testAll()
 }
+
+// Return merged iterator over n memdbs holding keys spread at random
+// among them, and the sorted keys.
+func newMergedMemDBIter(n, nkeys int) (iterator.Iterator, []string) {
+	rnd := rand.New(rand.NewSource(0xdeadbeef))
+	mem := make([]*memdb.DB, n)
+	for i := range mem {
+		mem[i] = memdb.New(comparer.BytesComparer{})
+	}
+	keys := make([]string, nkeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%08d", i)
+		mem[rnd.Intn(n)].Put([]byte(keys[i]), []byte(keys[i]))
+	}
+	its := make([]iterator.Iterator, n)
+	for i, m := range mem {
+		its[i] = m.NewIterator()
+	}
+	return iterator.NewMergedIterator(its, comparer.BytesComparer{}), keys
+}
+
+func TestSorted_MergedDirectionSwitch(t *testing.T) {
+	it, keys := newMergedMemDBIter(12, 500)
+	rnd := rand.New(rand.NewSource(0xbeefface))
+
+	// pos of -1 and len(keys) stand for before first and past last key
+	pos := -1
+	for n := 0; n < 5000; n++ {
+		var ok bool
+		switch op := rnd.Intn(10); {
+		case op < 4:
+			ok = it.Next()
+			if pos < len(keys) {
+				pos++
+			}
+		case op < 8:
+			ok = it.Prev()
+			if pos == len(keys) {
+				pos = len(keys) - 1
+			} else if pos >= 0 {
+				pos--
+			}
+		default:
+			k := rnd.Intn(len(keys))
+			ok = it.Seek([]byte(keys[k]))
+			pos = k
+		}
+		want := pos >= 0 && pos < len(keys)
+		if ok != want {
+			t.Fatalf("step %d: want valid=%v, got %v", n, want, ok)
+		}
+		if want && string(it.Key()) != keys[pos] {
+			t.Fatalf("step %d: want key %q, got %q", n, keys[pos], it.Key())
+		}
+	}
+}
+
+func BenchmarkSorted_MergedNext12(b *testing.B) {
+	it, _ := newMergedMemDBIter(12, 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !it.Next() {
+			it.First()
+		}
+	}
+}
+
+func BenchmarkSorted_MergedPrev12(b *testing.B) {
+	it, _ := newMergedMemDBIter(12, 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !it.Prev() {
+			it.Last()
+		}
+	}
+}
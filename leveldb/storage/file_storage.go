@@ -7,309 +7,131 @@
 package storage
 
 import (
-	"bytes"
-	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
-	"sync"
-	"time"
-
-	"github.com/syndtr/goleveldb/leveldb/errors"
 )
 
 type fileLock interface {
 	release() error
 }
 
-type fileStorageLock struct {
-	stor *FileStorage
+type osFileLock struct {
+	fileLock
 }
 
-func (lock *fileStorageLock) Release() error {
-	stor := lock.stor
-	stor.mu.Lock()
-	defer stor.mu.Unlock()
-	if stor.slock == nil {
-		return ErrNotLocked
-	}
-	if stor.slock != lock {
-		return ErrInvalidLock
-	}
-	stor.slock = nil
-	return nil
+func (fl osFileLock) Release() error {
+	return fl.release()
 }
 
-// FileStorage provide implementation of file-system backed storage.
-type FileStorage struct {
-	path  string
-	flock fileLock
-	slock *fileStorageLock
-	log   *os.File
-	buf   []byte
-	mu    sync.Mutex
+type fileWriter struct {
+	*os.File
 }
 
-// OpenFile creates new initialized FileStorage for given path. This will also
-// hold file lock; thus any subsequent attempt to open same file path will
-// fail.
-func OpenFile(dbpath string) (d *FileStorage, err error) {
-	err = os.MkdirAll(dbpath, 0755)
-	if err != nil {
-		return
-	}
-
-	flock, err := newFileLock(filepath.Join(dbpath, "LOCK"))
-	if err != nil {
-		return
-	}
-
-	defer func() {
-		if err != nil {
-			flock.release()
-		}
-	}()
-
-	rename(filepath.Join(dbpath, "LOG"), filepath.Join(dbpath, "LOG.old"))
-	log, err := os.OpenFile(filepath.Join(dbpath, "LOG"), os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		return
-	}
-
-	d = &FileStorage{path: dbpath, flock: flock, log: log}
-	runtime.SetFinalizer(d, (*FileStorage).Close)
-
-	return
+func (w fileWriter) Preallocate(size int64) error {
+	return fallocate(w.File, size)
 }
 
-// Lock lock the storage.
-func (d *FileStorage) Lock() (l Locker, err error) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	if d.slock != nil {
-		return nil, ErrLocked
-	}
-	d.slock = &fileStorageLock{stor: d}
-	return d.slock, nil
+// osFS implements FS, FSLocker and FSSyncer on top of the os package,
+// rooted at path. A read-only osFS takes shared locks.
+type osFS struct {
+	path     string
+	readOnly bool
 }
 
-// Cheap integer to fixed-width decimal ASCII.  Give a negative width to avoid zero-padding.
-// Knows the buffer has capacity.
-func itoa(buf *[]byte, i int, wid int) {
-	var u uint = uint(i)
-	if u == 0 && wid <= 1 {
-		*buf = append(*buf, '0')
-		return
-	}
+func (fs osFS) Open(name string) (Reader, error) {
+	return os.OpenFile(filepath.Join(fs.path, name), os.O_RDONLY, 0)
+}
 
-	// Assemble decimal in reverse order.
-	var b [32]byte
-	bp := len(b)
-	for ; u > 0 || wid > 0; u /= 10 {
-		bp--
-		wid--
-		b[bp] = byte(u%10) + '0'
+func (fs osFS) Create(name string) (Writer, error) {
+	f, err := os.OpenFile(filepath.Join(fs.path, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
 	}
-	*buf = append(*buf, b[bp:]...)
+	return fileWriter{f}, nil
 }
 
-// Print write given str to the log file.
-func (d *FileStorage) Print(str string) {
-	t := time.Now()
-	year, month, day := t.Date()
-	hour, min, sec := t.Clock()
-	msec := t.Nanosecond() / 1e3
-	d.mu.Lock()
-	d.buf = d.buf[:0]
-
-	// date
-	itoa(&d.buf, year, 4)
-	d.buf = append(d.buf, '/')
-	itoa(&d.buf, int(month), 2)
-	d.buf = append(d.buf, '/')
-	itoa(&d.buf, day, 4)
-	d.buf = append(d.buf, ' ')
-
-	// time
-	itoa(&d.buf, hour, 2)
-	d.buf = append(d.buf, ':')
-	itoa(&d.buf, min, 2)
-	d.buf = append(d.buf, ':')
-	itoa(&d.buf, sec, 2)
-	d.buf = append(d.buf, '.')
-	itoa(&d.buf, msec, 6)
-	d.buf = append(d.buf, ' ')
-
-	// write
-	d.log.Write(d.buf)
-	d.log.WriteString(str)
-	d.log.WriteString("\n")
-
-	d.mu.Unlock()
+func (fs osFS) Remove(name string) error {
+	return os.Remove(filepath.Join(fs.path, name))
 }
 
-// GetFile get file with given number and type.
-func (d *FileStorage) GetFile(number uint64, t FileType) File {
-	return &file{stor: d, num: number, t: t}
+func (fs osFS) Rename(oldname, newname string) error {
+	return rename(filepath.Join(fs.path, oldname), filepath.Join(fs.path, newname))
 }
 
-// GetFiles get all files that match given file types; multiple file
-// type may OR'ed together.
-func (d *FileStorage) GetFiles(t FileType) (r []File) {
-	dir, err := os.Open(d.path)
-	if err != nil {
-		return
-	}
-	names, err := dir.Readdirnames(0)
-	dir.Close()
-	if err != nil {
-		return
-	}
-	p := &file{stor: d}
-	for _, name := range names {
-		if p.parse(name) && (p.t&t) != 0 {
-			r = append(r, p)
-			p = &file{stor: d}
-		}
-	}
-	return
+func (fs osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(filepath.Join(fs.path, name))
 }
 
-// GetManifest get manifest file.
-func (d *FileStorage) GetManifest() (f File, err error) {
-	pth := filepath.Join(d.path, "CURRENT")
-	rw, err := os.OpenFile(pth, os.O_RDONLY, 0)
+func (fs osFS) List() ([]string, error) {
+	dir, err := os.Open(fs.path)
 	if err != nil {
-		err = err.(*os.PathError).Err
-		return
+		return nil, err
 	}
-	defer rw.Close()
-	buf := new(bytes.Buffer)
-	_, err = buf.ReadFrom(rw)
-	if err != nil {
-		return
-	}
-	b := buf.Bytes()
-	p := &file{stor: d}
-	if len(b) < 1 || b[len(b)-1] != '\n' || !p.parse(string(b[:len(b)-1])) {
-		return nil, errors.ErrCorrupt("invalid CURRENT file")
-	}
-	return p, nil
+	defer dir.Close()
+	return dir.Readdirnames(0)
 }
 
-// SetManifest set manifest to given file.
-func (d *FileStorage) SetManifest(f File) (err error) {
-	p, ok := f.(*file)
+func (fs osFS) Link(src FS, oldname, newname string) error {
+	s, ok := src.(osFS)
 	if !ok {
 		return ErrInvalidFile
 	}
-	pth := filepath.Join(d.path, "CURRENT")
-	pthTmp := fmt.Sprintf("%s.%d", pth, p.num)
-	rw, err := os.OpenFile(pthTmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		return
-	}
-	_, err = fmt.Fprintln(rw, p.name())
-	if err != nil {
-		rw.Close()
-		return
-	}
-	rw.Close()
-	return rename(pthTmp, pth)
-}
-
-// Close closes the storage and release the lock.
-func (d *FileStorage) Close() error {
-	d.log.Close()
-	return d.flock.release()
+	return os.Link(filepath.Join(s.path, oldname), filepath.Join(fs.path, newname))
 }
 
-type file struct {
-	stor *FileStorage
-	num  uint64
-	t    FileType
+func (fs osFS) SyncDir() error {
+	return syncDir(fs.path)
 }
 
-func (p *file) Open() (r Reader, err error) {
-	return os.OpenFile(p.path(), os.O_RDONLY, 0)
-}
-
-func (p *file) Create() (w Writer, err error) {
-	return os.OpenFile(p.path(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+func (fs osFS) Lock(name string) (Locker, error) {
+	fl, err := newFileLock(filepath.Join(fs.path, name), fs.readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return osFileLock{fl}, nil
 }
 
-func (p *file) Rename(num uint64, t FileType) error {
-	oldPth := p.path()
-	p.num = num
-	p.t = t
-	return rename(oldPth, p.path())
+// FileStorage provide implementation of file-system backed storage.
+type FileStorage struct {
+	*FSStorage
 }
 
-func (p *file) Exist() bool {
-	_, err := os.Stat(p.path())
-	return err == nil
-}
+// OpenFile creates new initialized FileStorage for given path. This will also
+// hold file lock; thus any subsequent attempt to open same file path will
+// fail with ErrLockHeld. The lock is an OS advisory lock, released once the
+// process exits, so a LOCK file left by a crashed process does not prevent
+// opening the path.
+func OpenFile(dbpath string) (d *FileStorage, err error) {
+	err = os.MkdirAll(dbpath, 0755)
+	if err != nil {
+		return
+	}
 
-func (p *file) Type() FileType {
-	return p.t
-}
+	stor, err := newFSStorage(osFS{path: dbpath}, false)
+	if err != nil {
+		return
+	}
 
-func (p *file) Num() uint64 {
-	return p.num
-}
+	d = &FileStorage{stor}
+	runtime.SetFinalizer(d, (*FileStorage).Close)
 
-func (p *file) Size() (size uint64, err error) {
-	fi, err := os.Stat(p.path())
-	if err == nil {
-		size = uint64(fi.Size())
-	}
 	return
 }
 
-func (p *file) Remove() error {
-	return os.Remove(p.path())
-}
-
-func (p *file) name() string {
-	switch p.t {
-	case TypeManifest:
-		return fmt.Sprintf("MANIFEST-%06d", p.num)
-	case TypeJournal:
-		return fmt.Sprintf("%06d.log", p.num)
-	case TypeTable:
-		return fmt.Sprintf("%06d.sst", p.num)
-	default:
-		panic("invalid file type")
+// OpenFileReadOnly creates new read-only FileStorage for given path. It
+// holds a shared file lock, thus any number of read-only storages may be
+// opened on the same path, while OpenFile on the path fails. Nothing is
+// written to the path; the log is discarded and any attempt to create,
+// rename or remove a file, or to set the manifest, returns ErrReadOnly.
+func OpenFileReadOnly(dbpath string) (d *FileStorage, err error) {
+	stor, err := newFSStorage(osFS{path: dbpath, readOnly: true}, true)
+	if err != nil {
+		return
 	}
-	return ""
-}
-
-func (p *file) path() string {
-	return filepath.Join(p.stor.path, p.name())
-}
 
-func (p *file) parse(name string) bool {
-	var num uint64
-	var tail string
-	_, err := fmt.Sscanf(name, "%d.%s", &num, &tail)
-	if err == nil {
-		switch tail {
-		case "log":
-			p.t = TypeJournal
-		case "sst":
-			p.t = TypeTable
-		default:
-			return false
-		}
-		p.num = num
-		return true
-	}
-	n, _ := fmt.Sscanf(name, "MANIFEST-%d%s", &num, &tail)
-	if n == 1 {
-		p.t = TypeManifest
-		p.num = num
-		return true
-	}
+	d = &FileStorage{stor}
+	runtime.SetFinalizer(d, (*FileStorage).Close)
 
-	return false
+	return
 }
@@ -104,8 +104,11 @@ func TestFileStorage_Locking(t *testing.T) {
 	defer os.RemoveAll(pth)
 
 	p2, err := OpenFile(pth)
-	if err != nil {
+	if err == ErrLockHeld {
 		t.Logf("OpenFile(2): got error: %s (expected)", err)
+	} else if err != nil {
+		p1.Close()
+		t.Fatal("OpenFile(2): expect ErrLockHeld, got: ", err)
 	} else {
 		p2.Close()
 		p1.Close()
@@ -139,3 +142,98 @@ func TestFileStorage_Locking(t *testing.T) {
 		t.Fatal("storage lock failed(2): ", err)
 	}
 }
+
+func TestFileStorage_StaleLock(t *testing.T) {
+	pth := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbteststale-%d", os.Getuid()))
+	if err := os.RemoveAll(pth); err != nil {
+		t.Fatal("RemoveAll: got error: ", err)
+	}
+	if err := os.MkdirAll(pth, 0755); err != nil {
+		t.Fatal("MkdirAll: got error: ", err)
+	}
+	defer os.RemoveAll(pth)
+
+	// A LOCK file left behind by a crashed process.
+	f, err := os.Create(filepath.Join(pth, "LOCK"))
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	f.Close()
+
+	p, err := OpenFile(pth)
+	if err != nil {
+		t.Fatal("OpenFile: got error on stale lock: ", err)
+	}
+	p.Close()
+}
+
+func TestFileStorage_LockError(t *testing.T) {
+	pth := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestlockerr-%d", os.Getuid()))
+	if err := os.RemoveAll(pth); err != nil {
+		t.Fatal("RemoveAll: got error: ", err)
+	}
+
+	p, err := OpenFileReadOnly(pth)
+	if err == nil {
+		p.Close()
+		t.Fatal("OpenFileReadOnly: expect error for missing path")
+	}
+	if _, ok := err.(*LockError); !ok {
+		t.Fatalf("OpenFileReadOnly: expect *LockError, got %T: %v", err, err)
+	}
+}
+
+func TestFileStorage_ReadOnlyLocking(t *testing.T) {
+	pth := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestro-%d", os.Getuid()))
+
+	_, err := os.Stat(pth)
+	if err == nil {
+		err = os.RemoveAll(pth)
+		if err != nil {
+			t.Fatal("RemoveAll: got error: ", err)
+		}
+	}
+
+	if p, err := OpenFileReadOnly(pth); err == nil {
+		p.Close()
+		t.Fatal("OpenFileReadOnly: expect error for missing path")
+	}
+
+	p1, err := OpenFile(pth)
+	if err != nil {
+		t.Fatal("OpenFile(1): got error: ", err)
+	}
+
+	defer os.RemoveAll(pth)
+
+	if p, err := OpenFileReadOnly(pth); err == nil {
+		p.Close()
+		p1.Close()
+		t.Fatal("OpenFileReadOnly(1): expect error while locked exclusively")
+	}
+	p1.Close()
+
+	p2, err := OpenFileReadOnly(pth)
+	if err != nil {
+		t.Fatal("OpenFileReadOnly(2): got error: ", err)
+	}
+	p3, err := OpenFileReadOnly(pth)
+	if err != nil {
+		p2.Close()
+		t.Fatal("OpenFileReadOnly(3): got error: ", err)
+	}
+	if p, err := OpenFile(pth); err == nil {
+		p.Close()
+		t.Error("OpenFile(2): expect error while locked shared")
+	}
+
+	if _, err := p2.GetFile(1, TypeJournal).Create(); err != ErrReadOnly {
+		t.Error("Create: got error: ", err)
+	}
+	if err := p2.SetManifest(p2.GetFile(2, TypeManifest)); err != ErrReadOnly {
+		t.Error("SetManifest: got error: ", err)
+	}
+	p2.Print("discarded")
+	p2.Close()
+	p3.Close()
+}
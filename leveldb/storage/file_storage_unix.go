@@ -18,30 +18,41 @@ type unixFileLock struct {
 }
 
 func (fl *unixFileLock) release() error {
-	if err := setFileLock(fl.f, false); err != nil {
+	if err := setFileLock(fl.f, false, false); err != nil {
 		return err
 	}
 	return fl.f.Close()
 }
 
-func newFileLock(path string) (fl fileLock, err error) {
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
+	var f *os.File
+	if readOnly {
+		f, err = os.Open(path)
+	} else {
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	}
 	if err != nil {
-		return
+		return nil, &LockError{Path: path, Err: err}
 	}
-	err = setFileLock(f, true)
+	err = setFileLock(f, true, readOnly)
 	if err != nil {
 		f.Close()
-		return
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLockHeld
+		}
+		return nil, &LockError{Path: path, Err: err}
 	}
 	fl = &unixFileLock{f: f}
 	return
 }
 
-func setFileLock(f *os.File, lock bool) (err error) {
+func setFileLock(f *os.File, lock, shared bool) (err error) {
 	how := syscall.LOCK_UN
 	if lock {
 		how = syscall.LOCK_EX
+		if shared {
+			how = syscall.LOCK_SH
+		}
 	}
 	return syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
 }
@@ -49,3 +60,12 @@ func setFileLock(f *os.File, lock bool) (err error) {
 func rename(oldpath, newpath string) (err error) {
 	return os.Rename(oldpath, newpath)
 }
+
+func syncDir(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
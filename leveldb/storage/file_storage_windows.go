@@ -19,6 +19,8 @@ var (
 
 const (
 	_MOVEFILE_REPLACE_EXISTING = 1
+
+	_ERROR_SHARING_VIOLATION syscall.Errno = 32
 )
 
 type windowsFileLock struct {
@@ -29,14 +31,22 @@ func (fl *windowsFileLock) release() error {
 	return syscall.Close(fl.fd)
 }
 
-func newFileLock(path string) (fl fileLock, err error) {
+func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
 	pathp, err := syscall.UTF16PtrFromString(path)
 	if err != nil {
-		return
+		return nil, &LockError{Path: path, Err: err}
+	}
+	var fd syscall.Handle
+	if readOnly {
+		fd, err = syscall.CreateFile(pathp, syscall.GENERIC_READ, syscall.FILE_SHARE_READ, nil, syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	} else {
+		fd, err = syscall.CreateFile(pathp, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.CREATE_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
 	}
-	fd, err := syscall.CreateFile(pathp, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.CREATE_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
 	if err != nil {
-		return
+		if err == _ERROR_SHARING_VIOLATION {
+			return nil, ErrLockHeld
+		}
+		return nil, &LockError{Path: path, Err: err}
 	}
 	wl := &windowsFileLock{fd: fd}
 	return wl, nil
@@ -65,3 +75,8 @@ func rename(oldpath, newpath string) (err error) {
 	}
 	return moveFileEx(from, to, _MOVEFILE_REPLACE_EXISTING)
 }
+
+// Directories cannot be synced on windows.
+func syncDir(path string) error {
+	return nil
+}
@@ -0,0 +1,409 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/errors"
+)
+
+// FS is the interface that wraps the filesystem operations needed by
+// FSStorage. All names are relative to the database directory, which
+// holds no subdirectories.
+type FS interface {
+	// Open opens the named file for reading.
+	Open(name string) (r Reader, err error)
+
+	// Create creates or truncates the named file for writing.
+	Create(name string) (w Writer, err error)
+
+	// Remove removes the named file.
+	Remove(name string) error
+
+	// Rename renames a file, replacing newname if it exists.
+	Rename(oldname, newname string) error
+
+	// Stat returns the FileInfo of the named file.
+	Stat(name string) (fi os.FileInfo, err error)
+
+	// List returns names of all files within the database directory.
+	List() (names []string, err error)
+}
+
+// FSLocker is the interface that wraps the Lock method. A FS may
+// optionally implement this interface.
+type FSLocker interface {
+	// Lock acquires an advisory lock on the named file, which is held
+	// until released. Lock must fail if the lock is held by another
+	// process.
+	Lock(name string) (l Locker, err error)
+}
+
+// FSLinker is the interface that wraps the Link method. A FS may
+// optionally implement this interface.
+type FSLinker interface {
+	// Link creates newname as a hard link to oldname of given FS. Link
+	// must fail if src is not on the same filesystem.
+	Link(src FS, oldname, newname string) error
+}
+
+// FSSyncer is the interface that wraps the SyncDir method. A FS may
+// optionally implement this interface.
+type FSSyncer interface {
+	// SyncDir commits files created, renamed or removed within the
+	// database directory to stable storage.
+	SyncDir() error
+}
+
+type fsStorageLock struct {
+	stor *FSStorage
+}
+
+func (lock *fsStorageLock) Release() error {
+	stor := lock.stor
+	stor.mu.Lock()
+	defer stor.mu.Unlock()
+	if stor.slock == nil {
+		return ErrNotLocked
+	}
+	if stor.slock != lock {
+		return ErrInvalidLock
+	}
+	stor.slock = nil
+	return nil
+}
+
+// FSStorage provide implementation of storage backed by a FS.
+type FSStorage struct {
+	fs       FS
+	readOnly bool
+	flock    Locker
+	slock    *fsStorageLock
+	log      Writer
+	buf      []byte
+	mu       sync.Mutex
+}
+
+// NewFSStorage creates new initialized FSStorage backed by given fsys.
+// If fsys implements FSLocker, the LOCK file is locked until the storage
+// is closed; thus any subsequent attempt to open the same fsys will
+// fail. Otherwise concurrent opens are not detected, and a warning is
+// written to the log.
+func NewFSStorage(fsys FS) (d *FSStorage, err error) {
+	return newFSStorage(fsys, false)
+}
+
+func newFSStorage(fsys FS, readOnly bool) (d *FSStorage, err error) {
+	d = &FSStorage{fs: fsys, readOnly: readOnly}
+	if locker, ok := fsys.(FSLocker); ok {
+		d.flock, err = locker.Lock("LOCK")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !readOnly {
+		fsys.Rename("LOG", "LOG.old")
+		d.log, err = fsys.Create("LOG")
+		if err != nil {
+			if d.flock != nil {
+				d.flock.Release()
+			}
+			return nil, err
+		}
+	}
+
+	if d.flock == nil {
+		d.Print("FSStorage: filesystem does not support locking, concurrent use is not detected")
+	}
+	return
+}
+
+// Lock lock the storage.
+func (d *FSStorage) Lock() (l Locker, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.slock != nil {
+		return nil, ErrLocked
+	}
+	d.slock = &fsStorageLock{stor: d}
+	return d.slock, nil
+}
+
+// Cheap integer to fixed-width decimal ASCII.  Give a negative width to avoid zero-padding.
+// Knows the buffer has capacity.
+func itoa(buf *[]byte, i int, wid int) {
+	var u uint = uint(i)
+	if u == 0 && wid <= 1 {
+		*buf = append(*buf, '0')
+		return
+	}
+
+	// Assemble decimal in reverse order.
+	var b [32]byte
+	bp := len(b)
+	for ; u > 0 || wid > 0; u /= 10 {
+		bp--
+		wid--
+		b[bp] = byte(u%10) + '0'
+	}
+	*buf = append(*buf, b[bp:]...)
+}
+
+// Print write given str to the log file.
+func (d *FSStorage) Print(str string) {
+	if d.log == nil {
+		return
+	}
+
+	t := time.Now()
+	year, month, day := t.Date()
+	hour, min, sec := t.Clock()
+	msec := t.Nanosecond() / 1e3
+	d.mu.Lock()
+	d.buf = d.buf[:0]
+
+	// date
+	itoa(&d.buf, year, 4)
+	d.buf = append(d.buf, '/')
+	itoa(&d.buf, int(month), 2)
+	d.buf = append(d.buf, '/')
+	itoa(&d.buf, day, 4)
+	d.buf = append(d.buf, ' ')
+
+	// time
+	itoa(&d.buf, hour, 2)
+	d.buf = append(d.buf, ':')
+	itoa(&d.buf, min, 2)
+	d.buf = append(d.buf, ':')
+	itoa(&d.buf, sec, 2)
+	d.buf = append(d.buf, '.')
+	itoa(&d.buf, msec, 6)
+	d.buf = append(d.buf, ' ')
+
+	// write
+	d.buf = append(d.buf, str...)
+	d.buf = append(d.buf, '\n')
+	d.log.Write(d.buf)
+
+	d.mu.Unlock()
+}
+
+// GetFile get file with given number and type.
+func (d *FSStorage) GetFile(number uint64, t FileType) File {
+	return &file{stor: d, num: number, t: t}
+}
+
+// GetFiles get all files that match given file types; multiple file
+// type may OR'ed together.
+func (d *FSStorage) GetFiles(t FileType) (r []File) {
+	names, err := d.fs.List()
+	if err != nil {
+		return
+	}
+	p := &file{stor: d}
+	for _, name := range names {
+		if p.parse(name) && (p.t&t) != 0 {
+			r = append(r, p)
+			p = &file{stor: d}
+		}
+	}
+	return
+}
+
+// GetManifest get manifest file.
+func (d *FSStorage) GetManifest() (f File, err error) {
+	rw, err := d.fs.Open("CURRENT")
+	if err != nil {
+		if pe, ok := err.(*os.PathError); ok {
+			err = pe.Err
+		}
+		return
+	}
+	defer rw.Close()
+	buf := new(bytes.Buffer)
+	_, err = buf.ReadFrom(rw)
+	if err != nil {
+		return
+	}
+	b := buf.Bytes()
+	p := &file{stor: d}
+	if len(b) < 1 || b[len(b)-1] != '\n' || !p.parse(string(b[:len(b)-1])) {
+		return nil, errors.ErrCorrupt("invalid CURRENT file")
+	}
+	return p, nil
+}
+
+// SetManifest set manifest to given file.
+func (d *FSStorage) SetManifest(f File) (err error) {
+	p, ok := f.(*file)
+	if !ok {
+		return ErrInvalidFile
+	}
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	tmp := fmt.Sprintf("CURRENT.%d", p.num)
+	rw, err := d.fs.Create(tmp)
+	if err != nil {
+		return
+	}
+	_, err = fmt.Fprintln(rw, p.name())
+	if err == nil {
+		err = rw.Sync()
+	}
+	if err != nil {
+		rw.Close()
+		return
+	}
+	rw.Close()
+	if err = d.fs.Rename(tmp, "CURRENT"); err != nil {
+		return
+	}
+	// the switch must be durable before the old manifest may be removed
+	if syncer, ok := d.fs.(FSSyncer); ok {
+		err = syncer.SyncDir()
+	}
+	return
+}
+
+// Link link given file of a FSStorage as the file with given number and
+// type, if the FS implements FSLinker. It returns ErrInvalidFile if src
+// is not a file of a FSStorage.
+func (d *FSStorage) Link(src File, number uint64, t FileType) error {
+	p, ok := src.(*file)
+	if !ok {
+		return ErrInvalidFile
+	}
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	linker, ok := d.fs.(FSLinker)
+	if !ok {
+		return ErrInvalidFile
+	}
+	return linker.Link(p.stor.fs, p.name(), (&file{num: number, t: t}).name())
+}
+
+// Close closes the storage and release the lock.
+func (d *FSStorage) Close() error {
+	if d.log != nil {
+		d.log.Close()
+	}
+	if d.flock != nil {
+		return d.flock.Release()
+	}
+	return nil
+}
+
+type file struct {
+	stor *FSStorage
+	num  uint64
+	t    FileType
+}
+
+func (p *file) Open() (r Reader, err error) {
+	return p.stor.fs.Open(p.name())
+}
+
+func (p *file) Create() (w Writer, err error) {
+	if p.stor.readOnly {
+		return nil, ErrReadOnly
+	}
+	return p.stor.fs.Create(p.name())
+}
+
+func (p *file) Rename(num uint64, t FileType) error {
+	if p.stor.readOnly {
+		return ErrReadOnly
+	}
+	oldName := p.name()
+	p.num = num
+	p.t = t
+	return p.stor.fs.Rename(oldName, p.name())
+}
+
+func (p *file) Exist() bool {
+	_, err := p.stor.fs.Stat(p.name())
+	return err == nil
+}
+
+func (p *file) Type() FileType {
+	return p.t
+}
+
+func (p *file) Num() uint64 {
+	return p.num
+}
+
+func (p *file) Size() (size uint64, err error) {
+	fi, err := p.stor.fs.Stat(p.name())
+	if err == nil {
+		size = uint64(fi.Size())
+	}
+	return
+}
+
+func (p *file) Remove() error {
+	if p.stor.readOnly {
+		return ErrReadOnly
+	}
+	return p.stor.fs.Remove(p.name())
+}
+
+// Archive rename the file by appending ".lost" to its name.
+func (p *file) Archive() error {
+	if p.stor.readOnly {
+		return ErrReadOnly
+	}
+	return p.stor.fs.Rename(p.name(), p.name()+".lost")
+}
+
+func (p *file) name() string {
+	switch p.t {
+	case TypeManifest:
+		return fmt.Sprintf("MANIFEST-%06d", p.num)
+	case TypeJournal:
+		return fmt.Sprintf("%06d.log", p.num)
+	case TypeTable:
+		return fmt.Sprintf("%06d.sst", p.num)
+	default:
+		panic("invalid file type")
+	}
+	return ""
+}
+
+func (p *file) parse(name string) bool {
+	var num uint64
+	var tail string
+	_, err := fmt.Sscanf(name, "%d.%s", &num, &tail)
+	if err == nil {
+		switch tail {
+		case "log":
+			p.t = TypeJournal
+		case "sst":
+			p.t = TypeTable
+		default:
+			return false
+		}
+		p.num = num
+		return true
+	}
+	n, _ := fmt.Sscanf(name, "MANIFEST-%d%s", &num, &tail)
+	if n == 1 {
+		p.t = TypeManifest
+		p.num = num
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Hides the FSLocker implementation of the wrapped FS.
+type noLockFS struct {
+	FS
+}
+
+func TestFSStorage(t *testing.T) {
+	pth := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestfs-%d", os.Getuid()))
+	if err := os.RemoveAll(pth); err != nil {
+		t.Fatal("RemoveAll: got error: ", err)
+	}
+	if err := os.MkdirAll(pth, 0755); err != nil {
+		t.Fatal("MkdirAll: got error: ", err)
+	}
+	defer os.RemoveAll(pth)
+
+	p1, err := NewFSStorage(osFS{path: pth})
+	if err != nil {
+		t.Fatal("NewFSStorage(1): got error: ", err)
+	}
+	if _, err := NewFSStorage(osFS{path: pth}); err == nil {
+		t.Fatal("NewFSStorage(2): expect error for locked fs")
+	}
+
+	f := p1.GetFile(3, TypeManifest)
+	w, err := f.Create()
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	w.Write([]byte("abc"))
+	w.Close()
+	if err := p1.SetManifest(f); err != nil {
+		t.Fatal("SetManifest: got error: ", err)
+	}
+	if err := p1.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+
+	p2, err := NewFSStorage(noLockFS{osFS{path: pth}})
+	if err != nil {
+		t.Fatal("NewFSStorage(3): got error: ", err)
+	}
+	p3, err := NewFSStorage(noLockFS{osFS{path: pth}})
+	if err != nil {
+		t.Fatal("NewFSStorage(4): expect no error without lock support, got: ", err)
+	}
+	p3.Close()
+	defer p2.Close()
+
+	m, err := p2.GetManifest()
+	if err != nil {
+		t.Fatal("GetManifest: got error: ", err)
+	}
+	if m.Num() != 3 || m.Type() != TypeManifest {
+		t.Fatalf("GetManifest: invalid file, num=%d type=%d", m.Num(), m.Type())
+	}
+	if size, err := m.Size(); err != nil || size != 3 {
+		t.Fatalf("Size: invalid size, want=3 got=%d err=%v", size, err)
+	}
+	if ff := p2.GetFiles(TypeAll); len(ff) != 1 {
+		t.Fatal("invalid GetFiles len: ", len(ff))
+	}
+
+	tf := p2.GetFile(5, TypeTable)
+	w, err = tf.Create()
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	w.Close()
+	if err := tf.(Archiver).Archive(); err != nil {
+		t.Fatal("Archive: got error: ", err)
+	}
+	if ff := p2.GetFiles(TypeAll); len(ff) != 1 {
+		t.Fatal("invalid GetFiles len after Archive: ", len(ff))
+	}
+	if _, err := os.Stat(filepath.Join(pth, "000005.sst.lost")); err != nil {
+		t.Fatal("Archive: file not moved aside: ", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(pth, "LOG"))
+	if err != nil {
+		t.Fatal("ReadFile: got error: ", err)
+	}
+	if !bytes.Contains(b, []byte("does not support locking")) {
+		t.Fatalf("LOG: missing lock warning, got %q", b)
+	}
+}
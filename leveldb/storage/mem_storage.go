@@ -31,13 +31,21 @@ func (lock *memStorageLock) Release() error {
 }
 
 // MemStorage provide implementation of memory backed storage.
+// All files, including journal, manifest and tables, are kept in
+// memory and are lost once the storage is garbage collected.
 type MemStorage struct {
 	mu       sync.Mutex
 	slock    *memStorageLock
 	files    map[uint64]*memFile
+	lost     []*memFile
 	manifest *memFilePtr
 }
 
+// NewMemStorage returns a new, empty memory backed storage.
+func NewMemStorage() *MemStorage {
+	return &MemStorage{files: make(map[uint64]*memFile)}
+}
+
 func (m *MemStorage) init() {
 	if m.files == nil {
 		m.files = make(map[uint64]*memFile)
@@ -55,6 +63,10 @@ func (m *MemStorage) Lock() (l Locker, err error) {
 	return m.slock, nil
 }
 
+// Close will do nothing; files are kept until the storage is garbage
+// collected, so a DB may be reopened on the same storage.
+func (*MemStorage) Close() error { return nil }
+
 // Print will do nothing.
 func (*MemStorage) Print(str string) {}
 
@@ -197,3 +209,16 @@ func (p *memFilePtr) Remove() error {
 	}
 	return os.ErrNotExist
 }
+
+func (p *memFilePtr) Archive() error {
+	m := p.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.init()
+	if file, exist := m.files[p.num]; exist && file.t == p.t {
+		delete(m.files, p.num)
+		m.lost = append(m.lost, file)
+		return nil
+	}
+	return os.ErrNotExist
+}
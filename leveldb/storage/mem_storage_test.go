@@ -12,15 +12,15 @@ import (
 )
 
 func TestMemStorage(t *testing.T) {
-	m := new(MemStorage)
+	m := NewMemStorage()
 
 	l, err := m.Lock()
 	if err != nil {
 		t.Fatal("storage lock failed(1): ", err)
 	}
 	_, err = m.Lock()
-	if err == nil {
-		t.Fatal("expect error for second storage lock attempt")
+	if err != ErrLocked {
+		t.Fatal("expect ErrLocked for second storage lock attempt, got: ", err)
 	} else {
 		t.Logf("storage lock got error: %s (expected)", err)
 	}
@@ -39,6 +39,9 @@ func TestMemStorage(t *testing.T) {
 	}
 	w, _ := f.Create()
 	w.Write([]byte("abc"))
+	if err := w.Sync(); err != nil {
+		t.Fatal("Sync: got error: ", err)
+	}
 	w.Close()
 	if len(m.GetFiles(TypeAll)) != 1 {
 		t.Fatal("invalid GetFiles len")
@@ -53,6 +56,12 @@ func TestMemStorage(t *testing.T) {
 	if got := buf.String(); got != "abc" {
 		t.Fatalf("Read: invalid value, want=abc got=%s", got)
 	}
+	r, _ = f.Open()
+	p := make([]byte, 2)
+	if n, err := r.ReadAt(p, 1); err != nil || n != 2 || string(p) != "bc" {
+		t.Fatalf("ReadAt: invalid value, want=bc got=%s err=%v", p[:n], err)
+	}
+	r.Close()
 	f.Rename(2, TypeJournal)
 	if f.Num() != 2 && f.Type() != TypeJournal {
 		t.Fatal("invalid file number and type")
@@ -0,0 +1,66 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Slicer is the interface that wraps the Slice method. Readers whose
+// content is addressable in memory, such as memory-mapped ones, implement
+// it so that the content may be read without copying.
+type Slicer interface {
+	// Slice return n bytes at given offset without copying. The returned
+	// bytes must not be modified, and are valid until the reader is
+	// closed.
+	Slice(off int64, n int) ([]byte, error)
+}
+
+type mmapReader struct {
+	*bytes.Reader
+	data []byte
+	f    *os.File
+}
+
+func (r *mmapReader) Slice(off int64, n int) ([]byte, error) {
+	end := off + int64(n)
+	if off < 0 || n < 0 || end > int64(len(r.data)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return r.data[off:end:end], nil
+}
+
+func (r *mmapReader) Close() error {
+	err := munmap(r.data)
+	if err1 := r.f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// NewMmapReader memory-maps first size bytes of the file backing given
+// reader, which is then read from the mapping. The returned reader
+// unmaps the file and closes given reader once closed. Given reader is
+// returned as is if it is not backed by an OS file, e.g. opened from
+// MemStorage, if size is zero, or if the platform does not support mmap.
+//
+// The returned reader implements Slicer, which return subslices of the
+// mapping; those are invalid once the reader is closed. Read and ReadAt
+// copy from the mapping, so read bytes stay valid after close.
+func NewMmapReader(r Reader, size uint64) (Reader, error) {
+	f, ok := r.(*os.File)
+	if !ok || size == 0 || !mmapSupported {
+		return r, nil
+	}
+	data, err := mmap(f, int(size))
+	if err != nil {
+		return nil, err
+	}
+	return &mmapReader{Reader: bytes.NewReader(data), data: data, f: f}, nil
+}
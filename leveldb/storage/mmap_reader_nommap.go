@@ -0,0 +1,24 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// +build !darwin,!freebsd,!linux,!netbsd,!openbsd
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+const mmapSupported = false
+
+func mmap(f *os.File, size int) ([]byte, error) {
+	return nil, syscall.EINVAL
+}
+
+func munmap(data []byte) error {
+	return syscall.EINVAL
+}
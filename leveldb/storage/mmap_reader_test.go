@@ -0,0 +1,73 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMmapReader(t *testing.T) {
+	pth := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestmmap-%d", os.Getuid()))
+	if err := os.RemoveAll(pth); err != nil {
+		t.Fatal("RemoveAll: got error: ", err)
+	}
+	p, err := OpenFile(pth)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer os.RemoveAll(pth)
+	defer p.Close()
+
+	f := p.GetFile(1, TypeTable)
+	w, err := f.Create()
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	w.Write([]byte("0123456789"))
+	w.Close()
+
+	fr, err := f.Open()
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	r, err := NewMmapReader(fr, 10)
+	if err != nil {
+		t.Fatal("NewMmapReader: got error: ", err)
+	}
+	if _, ok := r.(*mmapReader); ok != mmapSupported {
+		t.Errorf("NewMmapReader: mapped=%v, want %v", ok, mmapSupported)
+	}
+	b := make([]byte, 3)
+	if n, err := r.ReadAt(b, 7); err != nil || string(b[:n]) != "789" {
+		t.Errorf("ReadAt: want=789 got=%q err=%v", b[:n], err)
+	}
+	if s, ok := r.(Slicer); ok {
+		if b, err := s.Slice(2, 3); err != nil || string(b) != "234" || cap(b) != 3 {
+			t.Errorf("Slice: want=234 got=%q cap=%d err=%v", b, cap(b), err)
+		}
+		if _, err := s.Slice(8, 3); err == nil {
+			t.Error("Slice: past the end got no error")
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+
+	// Readers not backed by an OS file are returned as is.
+	m := NewMemStorage()
+	mf := m.GetFile(1, TypeTable)
+	mw, _ := mf.Create()
+	mw.Write([]byte("abc"))
+	mw.Close()
+	mr, _ := mf.Open()
+	if r, err := NewMmapReader(mr, 3); err != nil || r != mr {
+		t.Errorf("NewMmapReader: expect reader returned as is, got %T err=%v", r, err)
+	}
+}
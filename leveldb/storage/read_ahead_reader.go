@@ -0,0 +1,52 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package storage
+
+import (
+	"io"
+	"sync"
+)
+
+type readAheadReader struct {
+	Reader
+	mu  sync.Mutex
+	buf []byte
+	off int64 // offset of buf
+}
+
+// NewReadAheadReader wraps given reader so that each ReadAt not served by
+// the read-ahead buffer reads size bytes ahead into the buffer; thus
+// sequential small ReadAt calls coalesce into fewer and larger reads.
+// ReadAt calls of at least size bytes bypass the buffer. ReadAt is safe
+// for concurrent use, although calls are serialized on buffer refill.
+// Read and Seek are not buffered.
+func NewReadAheadReader(r Reader, size int) Reader {
+	return &readAheadReader{Reader: r, buf: make([]byte, 0, size)}
+}
+
+func (r *readAheadReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if len(p) >= cap(r.buf) {
+		return r.Reader.ReadAt(p, off)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if off < r.off || off+int64(len(p)) > r.off+int64(len(r.buf)) {
+		n, err = r.Reader.ReadAt(r.buf[:cap(r.buf)], off)
+		if err != nil && err != io.EOF {
+			r.buf = r.buf[:0]
+			return 0, err
+		}
+		r.buf = r.buf[:n]
+		r.off = off
+	}
+	n = copy(p, r.buf[off-r.off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
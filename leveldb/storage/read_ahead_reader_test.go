@@ -0,0 +1,48 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package storage
+
+import (
+	"io"
+	"testing"
+)
+
+func TestReadAheadReader(t *testing.T) {
+	m := NewMemStorage()
+	f := m.GetFile(1, TypeTable)
+	w, _ := f.Create()
+	w.Write([]byte("0123456789"))
+	w.Close()
+	fr, err := f.Open()
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	r := NewReadAheadReader(fr, 4)
+	defer r.Close()
+
+	for _, c := range []struct {
+		off  int64
+		n    int
+		want string
+		err  error
+	}{
+		{0, 2, "01", nil},
+		{2, 2, "23", nil},
+		{1, 3, "123", nil},
+		{5, 3, "567", nil},
+		{0, 8, "01234567", nil},
+		{8, 3, "89", io.EOF},
+		{9, 1, "9", nil},
+		{10, 1, "", io.EOF},
+	} {
+		p := make([]byte, c.n)
+		n, err := r.ReadAt(p, c.off)
+		if string(p[:n]) != c.want || err != c.err {
+			t.Errorf("ReadAt(%d, %d): want=%q,%v got=%q,%v", c.off, c.n, c.want, c.err, p[:n], err)
+		}
+	}
+}
@@ -39,8 +39,26 @@ var (
 	ErrLocked      = errors.New("already locked")
 	ErrNotLocked   = errors.New("not locked")
 	ErrInvalidLock = errors.New("invalid lock handle")
+	ErrReadOnly    = errors.New("storage is read-only")
+
+	// ErrLockHeld is returned when the LOCK file is held by a live
+	// process. Locks are OS advisory locks, which are released once the
+	// holding process exits, even if it crashed.
+	ErrLockHeld = errors.New("lock held by another process")
 )
 
+// LockError is returned when the LOCK file cannot be locked for reasons
+// other than being held by another process, e.g. the file cannot be
+// opened or the filesystem does not support locking.
+type LockError struct {
+	Path string
+	Err  error
+}
+
+func (e *LockError) Error() string {
+	return "cannot acquire lock " + e.Path + ": " + e.Err.Error()
+}
+
 type Syncer interface {
 	Sync() error
 }
@@ -58,6 +76,18 @@ type Writer interface {
 	Syncer
 }
 
+// Preallocator is the interface that wraps Preallocate and Truncate
+// methods. A Writer may optionally implement this interface.
+type Preallocator interface {
+	// Preallocate reserve given number of bytes for the file; this is
+	// merely a hint, the storage may choose to ignore it.
+	Preallocate(size int64) error
+
+	// Truncate change the size of the file; used to cut unused
+	// preallocated space.
+	Truncate(size int64) error
+}
+
 type Locker interface {
 	Release() error
 }
@@ -89,6 +119,25 @@ type File interface {
 	Remove() error
 }
 
+// Linker is the interface that wraps the Link method. A Storage may
+// optionally implement this interface.
+type Linker interface {
+	// Link make given file, possibly of another storage, available as
+	// the file of this storage with given number and type without copying
+	// its content, e.g. by hard link. Link fails if it is not possible,
+	// e.g. the file is on another filesystem.
+	Link(src File, number uint64, t FileType) error
+}
+
+// Archiver is the interface that wraps the Archive method. A File may
+// optionally implement this interface.
+type Archiver interface {
+	// Archive move the file aside rather than removing it, thus it is
+	// no longer listed by GetFiles, yet its content is kept, e.g. for
+	// inspection.
+	Archive() error
+}
+
 type Storage interface {
 	// Lock the storage, so any subsequent attempt to lock the same storage
 	// will fail.
@@ -108,6 +157,7 @@ type Storage interface {
 	// Should return os.ErrNotExist if there's no current manifest file.
 	GetManifest() (f File, err error)
 
-	// Set manifest to given file.
+	// Set manifest to given file. The switch must be durable once it
+	// returns, as the previous manifest may be removed afterward.
 	SetManifest(f File) error
 }
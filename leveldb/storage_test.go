@@ -54,6 +54,7 @@ type testingStorage struct {
 	log   testingStorageLogging
 
 	files    map[uint64]*testingFile
+	lost     map[uint64]*testingFile
 	manifest *testingFilePtr
 
 	emuCh        chan struct{}
@@ -70,6 +71,7 @@ func newTestingStorage(log testingStorageLogging) *testingStorage {
 	return &testingStorage{
 		log:   log,
 		files: make(map[uint64]*testingFile),
+		lost:  make(map[uint64]*testingFile),
 		emuCh: make(chan struct{}),
 	}
 }
@@ -110,6 +112,18 @@ func (d *testingStorage) SetSyncErr(t storage.FileType) {
 	d.mu.Unlock()
 }
 
+// DropUnsynced discard unsynced data of files with given type, emulating
+// a power loss.
+func (d *testingStorage) DropUnsynced(t storage.FileType) {
+	d.mu.Lock()
+	for _, f := range d.files {
+		if f.t&t != 0 {
+			f.buf.Truncate(f.synced)
+		}
+	}
+	d.mu.Unlock()
+}
+
 func (d *testingStorage) ReadCounter() uint64 {
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -268,6 +282,7 @@ func (w *testingWriter) Sync() error {
 	if stor.emuSyncErr&p.t != 0 {
 		return errors.New("emulated sync error")
 	}
+	p.synced = p.buf.Len()
 	return nil
 }
 
@@ -320,6 +335,7 @@ type testingFile struct {
 	t    storage.FileType
 
 	buf    bytes.Buffer
+	synced int
 	opened bool
 }
 
@@ -375,6 +391,7 @@ func (p *testingFilePtr) Create() (w storage.Writer, err error) {
 
 	f.opened = true
 	f.buf.Reset()
+	f.synced = 0
 	return &testingWriter{f}, nil
 }
 
@@ -458,3 +475,206 @@ func (p *testingFilePtr) Remove() error {
 
 	return nil
 }
+
+func (p *testingFilePtr) Archive() error {
+	stor := p.stor
+
+	stor.mu.Lock()
+	defer stor.mu.Unlock()
+
+	stor.print(fmt.Sprintf("testingStorage: archiving file, num=%d type=%s", p.num, p.t))
+
+	if f, exist := stor.files[p.id()]; exist {
+		if f.opened {
+			return errFileOpen
+		}
+		delete(stor.files, p.id())
+		stor.lost[p.id()] = f
+		return nil
+	}
+
+	return os.ErrNotExist
+}
+
+type crashFile struct {
+	data, synced []byte
+}
+
+type crashRename struct {
+	oldname, newname string
+	f, replaced      *crashFile
+}
+
+// crashFS is a storage.FS held in memory, which emulates a power loss by
+// an image of what would be left of it: files hold only synced content,
+// and renames not yet committed by SyncDir are undone, while creations
+// and removals are kept, the worst a file system may reorder them.
+type crashFS struct {
+	mu      sync.Mutex
+	files   map[string]*crashFile
+	pending []crashRename
+	ops     int // file system operations, counting creations, renames, removals and syncs
+	crashAt int
+	image   *crashFS
+}
+
+func newCrashFS() *crashFS {
+	return &crashFS{files: make(map[string]*crashFile)}
+}
+
+// Take the crash image once given number of operations from now are done.
+func (fs *crashFS) crashAfter(n int) {
+	fs.mu.Lock()
+	fs.crashAt = fs.ops + n
+	fs.mu.Unlock()
+}
+
+// Return the crash image, or nil if the crash point is yet to be reached.
+func (fs *crashFS) crashImage() *crashFS {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.image
+}
+
+// Count an operation; need fs.mu held.
+func (fs *crashFS) op() {
+	fs.ops++
+	if fs.ops != fs.crashAt {
+		return
+	}
+	files := make(map[string]*crashFile)
+	for name, f := range fs.files {
+		files[name] = f
+	}
+	for i := len(fs.pending) - 1; i >= 0; i-- {
+		r := fs.pending[i]
+		if files[r.newname] == r.f {
+			if r.replaced != nil {
+				files[r.newname] = r.replaced
+			} else {
+				delete(files, r.newname)
+			}
+		}
+		files[r.oldname] = r.f
+	}
+	fs.image = newCrashFS()
+	for name, f := range files {
+		fs.image.files[name] = &crashFile{data: append([]byte{}, f.synced...), synced: append([]byte{}, f.synced...)}
+	}
+}
+
+func (fs *crashFS) Open(name string) (storage.Reader, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return crashReader{bytes.NewReader(append([]byte{}, f.data...))}, nil
+}
+
+func (fs *crashFS) Create(name string) (storage.Writer, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.files[name]
+	if ok {
+		f.data = nil
+	} else {
+		f = &crashFile{}
+		fs.files[name] = f
+	}
+	fs.op()
+	return &crashWriter{fs: fs, f: f}, nil
+}
+
+func (fs *crashFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[name]; !ok {
+		return os.ErrNotExist
+	}
+	delete(fs.files, name)
+	fs.op()
+	return nil
+}
+
+func (fs *crashFS) Rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.files[oldname]
+	if !ok {
+		return os.ErrNotExist
+	}
+	fs.pending = append(fs.pending, crashRename{oldname, newname, f, fs.files[newname]})
+	delete(fs.files, oldname)
+	fs.files[newname] = f
+	fs.op()
+	return nil
+}
+
+func (fs *crashFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return crashFileInfo{name, int64(len(f.data))}, nil
+}
+
+func (fs *crashFS) List() (names []string, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for name := range fs.files {
+		names = append(names, name)
+	}
+	return
+}
+
+func (fs *crashFS) SyncDir() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.pending = nil
+	fs.op()
+	return nil
+}
+
+type crashReader struct {
+	*bytes.Reader
+}
+
+func (crashReader) Close() error { return nil }
+
+type crashWriter struct {
+	fs *crashFS
+	f  *crashFile
+}
+
+func (w *crashWriter) Write(b []byte) (n int, err error) {
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+	w.f.data = append(w.f.data, b...)
+	return len(b), nil
+}
+
+func (w *crashWriter) Sync() error {
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+	w.f.synced = append(w.f.synced[:0], w.f.data...)
+	w.fs.op()
+	return nil
+}
+
+func (w *crashWriter) Close() error { return nil }
+
+type crashFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi crashFileInfo) Name() string       { return fi.name }
+func (fi crashFileInfo) Size() int64        { return fi.size }
+func (fi crashFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi crashFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi crashFileInfo) IsDir() bool        { return false }
+func (fi crashFileInfo) Sys() interface{}   { return nil }
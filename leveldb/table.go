@@ -9,10 +9,13 @@ package leveldb
 import (
 	"runtime"
 	"sort"
+	"sync"
 	"sync/atomic"
+	"unsafe"
 
 	"github.com/syndtr/goleveldb/leveldb/cache"
 	"github.com/syndtr/goleveldb/leveldb/comparer"
+	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/storage"
@@ -25,6 +28,17 @@ type tFile struct {
 	seekLeft int32
 	size     uint64
 	min, max iKey
+
+	// Entries covered by range tombstones with seq number at or below
+	// cleanSeq were dropped when the table was written; zero if unknown.
+	cleanSeq uint64
+
+	// Number of entries and deletions, once known; see tOps.stats.
+	stats unsafe.Pointer // *tStats
+}
+
+type tStats struct {
+	entries, dels uint64
 }
 
 // test if key is after t
@@ -41,7 +55,9 @@ func (t *tFile) incrSeek() int32 {
 	return atomic.AddInt32(&t.seekLeft, -1)
 }
 
-func newTFile(file storage.File, size uint64, min, max iKey) *tFile {
+// Create a tFile allowing a seek for every bytesPerSeek bytes of the table
+// before a seek compaction is triggered.
+func newTFile(file storage.File, size uint64, min, max iKey, bytesPerSeek int) *tFile {
 	f := &tFile{
 		file: file,
 		size: size,
@@ -61,8 +77,8 @@ func newTFile(file storage.File, size uint64, min, max iKey) *tFile {
 	// of 1MB of data.  I.e., one seek costs approximately the
 	// same as the compaction of 40KB of data.  We are a little
 	// conservative and allow approximately one seek for every 16KB
-	// of data before triggering a compaction.
-	f.seekLeft = int32(size / 16384)
+	// of data before triggering a compaction, by default.
+	f.seekLeft = int32(size / uint64(bytesPerSeek))
 	if f.seekLeft < 100 {
 		f.seekLeft = 100
 	}
@@ -106,7 +122,7 @@ func (p tFiles) isOverlaps(min, max []byte, disjSorted bool, cmp *iComparer) boo
 	var idx int
 	if len(min) > 0 {
 		// Find the earliest possible internal key for min
-		idx = p.search(newIKey(min, kMaxSeq, tSeek), cmp)
+		idx = p.search(newSeekIKey(min, kMaxSeq), cmp)
 	}
 
 	if idx >= len(p) {
@@ -206,6 +222,19 @@ func (i *tFilesIter) Seek(key []byte) bool {
 	return i.pos < len(i.tt)
 }
 
+// SeekForPrev position at the last table whose key range starts at or
+// before given key.
+func (i *tFilesIter) SeekForPrev(key []byte) bool {
+	if i.Empty() {
+		return false
+	}
+	i.pos = i.tt.search(iKey(key), i.cmp)
+	if i.pos == len(i.tt) || i.cmp.Compare(i.tt[i.pos].min, key) > 0 {
+		i.pos--
+	}
+	return i.pos >= 0
+}
+
 func (i *tFilesIter) Next() bool {
 	if i.Empty() || i.pos >= len(i.tt) {
 		return false
@@ -222,6 +251,11 @@ func (i *tFilesIter) Prev() bool {
 	return true
 }
 
+func (i *tFilesIter) Release() {
+	i.tt = nil
+	i.pos = -1
+}
+
 func (i *tFilesIter) Get() (it iterator.Iterator, err error) {
 	if i.pos < 0 || i.pos >= len(i.tt) {
 		return &iterator.EmptyIterator{}, nil
@@ -288,30 +322,44 @@ type tOps struct {
 	s       *session
 	cache   cache.Cache
 	cachens cache.Namespace
+	fstats  *table.FilterStats
+
+	skipMu  sync.Mutex
+	skipped map[uint64]bool // tables skipped as corrupt by iterators
 }
 
 func newTableOps(s *session, cacheCap int) *tOps {
 	c := cache.NewLRUCache(cacheCap)
 	ns := c.GetNamespace(0)
-	return &tOps{s, c, ns}
+	ns.SetOnEvict(func(num uint64) {
+		if f := s.o.GetOnTableClose(); f != nil {
+			f(num)
+		}
+	})
+	return &tOps{s: s, cache: c, cachens: ns, fstats: new(table.FilterStats)}
 }
 
-func (t *tOps) create() (w *tWriter, err error) {
+// Create a new table writer, using compression of given level.
+func (t *tOps) create(level int) (w *tWriter, err error) {
 	file := t.s.getTableFile(t.s.allocFileNum())
 	fw, err := file.Create()
 	if err != nil {
 		return
 	}
+	tw := table.NewWriter(fw, t.s.o)
+	tw.SetCompressionType(t.s.o.GetLevelCompressionType(level))
 	return &tWriter{
 		t:    t,
 		file: file,
 		w:    fw,
-		tw:   table.NewWriter(fw, t.s.o),
+		tw:   tw,
 	}, nil
 }
 
-func (t *tOps) createFrom(src iterator.Iterator) (f *tFile, n int, err error) {
-	w, err := t.create()
+// Create a table holding entries of given iterator, using compression of
+// given level; f is nil if the iterator yields no entry.
+func (t *tOps) createFrom(src iterator.Iterator, level int) (f *tFile, n int, err error) {
+	w, err := t.create(level)
 	if err != nil {
 		return
 	}
@@ -334,33 +382,198 @@ func (t *tOps) createFrom(src iterator.Iterator) (f *tFile, n int, err error) {
 	}
 
 	n = w.tw.Len()
+	if n == 0 {
+		w.drop()
+		return
+	}
 	f, err = w.finish()
 	return
 }
 
 func (t *tOps) newIterator(f *tFile, ro *opt.ReadOptions) iterator.Iterator {
+	var it iterator.Iterator
 	c, err := t.lookup(f)
 	if err != nil {
-		return &iterator.EmptyIterator{err}
-	}
-	it := c.Value().(*table.Reader).NewIterator(ro)
-	if p, ok := it.(*iterator.IndexedIterator); ok {
-		runtime.SetFinalizer(p, func(x *iterator.IndexedIterator) {
-			c.Release()
-		})
+		it = &iterator.EmptyIterator{err}
 	} else {
-		panic("not reached")
+		it = c.Value().(*table.Reader).NewIterator(ro)
+		if p, ok := it.(*iterator.IndexedIterator); ok {
+			p.SetReleaser(c)
+			runtime.SetFinalizer(p, (*iterator.IndexedIterator).Release)
+		} else {
+			panic("not reached")
+		}
+	}
+	if ro.HasFlag(opt.RFSkipCorrupt) {
+		it = &skipCorruptIter{Iterator: it, t: t, f: f}
 	}
 	return it
 }
 
+// Record given table as skipped by an iterator due to given corruption.
+func (t *tOps) skip(f *tFile, err error) {
+	num := f.file.Num()
+	t.skipMu.Lock()
+	if t.skipped == nil {
+		t.skipped = make(map[uint64]bool)
+	}
+	t.skipped[num] = true
+	t.skipMu.Unlock()
+	t.s.printf("Table: corrupt table skipped, num=%d err=%q", num, err)
+}
+
+// Return numbers of the tables skipped so far, in ascending order.
+func (t *tOps) getSkipped() (nums []uint64) {
+	t.skipMu.Lock()
+	for num := range t.skipped {
+		nums = append(nums, num)
+	}
+	t.skipMu.Unlock()
+	sort.Sort(uint64Slice(nums))
+	return
+}
+
+// skipCorruptIter is a table iterator which, once the table is found
+// corrupt, records the table as skipped and becomes an exhausted iterator
+// without error; an iterator merging it thus goes on with the other
+// tables.
+type skipCorruptIter struct {
+	iterator.Iterator
+
+	t *tOps
+	f *tFile
+}
+
+// Drop the table iterator if it failed due to corruption; ok is passed
+// through.
+func (i *skipCorruptIter) check(ok bool) bool {
+	if !ok {
+		if err := i.Iterator.Error(); errors.IsCorrupted(err) {
+			i.t.skip(i.f, err)
+			i.Iterator.Release()
+			i.Iterator = &iterator.EmptyIterator{}
+		}
+	}
+	return ok
+}
+
+func (i *skipCorruptIter) First() bool {
+	return i.check(i.Iterator.First())
+}
+
+func (i *skipCorruptIter) Last() bool {
+	return i.check(i.Iterator.Last())
+}
+
+func (i *skipCorruptIter) Seek(key []byte) bool {
+	return i.check(i.Iterator.Seek(key))
+}
+
+func (i *skipCorruptIter) SeekForPrev(key []byte) bool {
+	return i.check(i.Iterator.SeekForPrev(key))
+}
+
+func (i *skipCorruptIter) Next() bool {
+	return i.check(i.Iterator.Next())
+}
+
+func (i *skipCorruptIter) Prev() bool {
+	return i.check(i.Iterator.Prev())
+}
+
 func (t *tOps) get(f *tFile, key []byte, ro *opt.ReadOptions) (rkey, rvalue []byte, err error) {
 	c, err := t.lookup(f)
 	if err != nil {
 		return
 	}
 	defer c.Release()
-	return c.Value().(*table.Reader).Get(key, ro)
+	r := c.Value().(*table.Reader)
+	rkey, rvalue, err = t.readerGet(r, key, ro, false)
+	if r.Mapped() {
+		// read in place, which is unmapped once released
+		rkey, rvalue = dupBytes(rkey), dupBytes(rvalue)
+	}
+	return
+}
+
+func (t *tOps) find(f *tFile, key []byte, ro *opt.ReadOptions) (rkey []byte, err error) {
+	c, err := t.lookup(f)
+	if err != nil {
+		return
+	}
+	defer c.Release()
+	r := c.Value().(*table.Reader)
+	rkey, _, err = t.readerGet(r, key, ro, true)
+	if r.Mapped() {
+		rkey = dupBytes(rkey)
+	}
+	return
+}
+
+// Lookup given internal key from given table reader. A key found with
+// another user key means the key is absent, which is counted as a false
+// positive of the table filter, if any.
+func (t *tOps) readerGet(r *table.Reader, key []byte, ro *opt.ReadOptions, noValue bool) (rkey, rvalue []byte, err error) {
+	if noValue {
+		rkey, err = r.Find(key, ro)
+	} else {
+		rkey, rvalue, err = r.Get(key, ro)
+	}
+	if err == nil && r.HasFilter() && len(rkey) >= 8 {
+		if t.s.cmp.cmp.Compare(iKey(rkey).ukey(), iKey(key).ukey()) != 0 {
+			t.fstats.AddConfirmedAbsent()
+		}
+	}
+	return
+}
+
+// tHandles hold table cache handles looked up by a series of reads, so
+// each table is looked up only once, and slices read in place stay valid;
+// must be released after use.
+type tHandles struct {
+	tops   *tOps
+	num    uint64
+	c      cache.Object // the first table, spares the map of single reads
+	m      map[uint64]cache.Object
+	mapped bool // whether a table read in place was looked up
+}
+
+func (h *tHandles) get(f *tFile, key []byte, ro *opt.ReadOptions, noValue bool) (rkey, rvalue []byte, err error) {
+	num := f.file.Num()
+	c, ok := h.m[num]
+	if h.c != nil && h.num == num {
+		c, ok = h.c, true
+	}
+	if !ok {
+		c, err = h.tops.lookup(f)
+		if err != nil {
+			return
+		}
+		switch {
+		case h.c == nil:
+			h.num, h.c = num, c
+		case h.m == nil:
+			h.m = map[uint64]cache.Object{num: c}
+		default:
+			h.m[num] = c
+		}
+	}
+	r := c.Value().(*table.Reader)
+	if r.Mapped() {
+		h.mapped = true
+	}
+	return h.tops.readerGet(r, key, ro, noValue)
+}
+
+func (h *tHandles) release() {
+	if h.c != nil {
+		h.c.Release()
+		h.c = nil
+	}
+	for _, c := range h.m {
+		c.Release()
+	}
+	h.m = nil
 }
 
 func (t *tOps) approximateOffsetOf(f *tFile, key []byte) (n uint64, err error) {
@@ -373,23 +586,74 @@ func (t *tOps) approximateOffsetOf(f *tFile, key []byte) (n uint64, err error) {
 	return
 }
 
+// Return the number of entries and deletions of given table; ok is false if
+// not recorded by the table. The counts are read from the table metadata
+// unless known already, then kept by the tFile.
+func (t *tOps) stats(f *tFile) (entries, dels uint64, ok bool, err error) {
+	if p := (*tStats)(atomic.LoadPointer(&f.stats)); p != nil {
+		return p.entries, p.dels, true, nil
+	}
+	c, err := t.lookup(f)
+	if err != nil {
+		return
+	}
+	defer c.Release()
+	entries, dels, ok = c.Value().(*table.Reader).Deletions()
+	if ok {
+		atomic.StorePointer(&f.stats, unsafe.Pointer(&tStats{entries, dels}))
+	}
+	return
+}
+
+// Close given table if it is cached; the file is left as is.
+func (t *tOps) evict(f *tFile) {
+	t.cachens.Delete(f.file.Num(), nil)
+}
+
 func (t *tOps) remove(f *tFile) {
 	num := f.file.Num()
 
-	var ns cache.Namespace
-	bc := t.s.o.GetBlockCache()
-	if bc != nil {
+	var ns, cns cache.Namespace
+	if bc := t.s.o.GetBlockCache(); bc != nil {
 		ns = bc.GetNamespace(num)
 	}
+	if cbc := t.s.o.GetCompressedBlockCache(); cbc != nil {
+		cns = cbc.GetNamespace(num)
+	}
 
 	t.cachens.Delete(num, func() {
-		f.file.Remove()
+		t.s.removeFile(f.file)
 		if ns != nil {
 			ns.Zap()
 		}
+		if cns != nil {
+			cns.Zap()
+		}
 	})
 }
 
+// Load given table into the table cache and pin it, so that it is not
+// evicted until unpinned.
+func (t *tOps) pin(f *tFile) error {
+	c, err := t.lookup(f)
+	if err != nil {
+		return err
+	}
+	t.cachens.Pin(f.file.Num())
+	c.Release()
+	return nil
+}
+
+func (t *tOps) unpin(f *tFile) {
+	t.cachens.Unpin(f.file.Num())
+}
+
+// Set the number of tables the table cache may hold open, closing the
+// least recently used tables if lowered.
+func (t *tOps) setCapacity(n int) {
+	t.cache.SetCapacity(n)
+}
+
 func (t *tOps) zapCache() {
 	t.cache.Zap()
 }
@@ -405,6 +669,16 @@ func (t *tOps) lookup(f *tFile) (c cache.Object, err error) {
 		}
 
 		o := t.s.o
+		if o.HasFlag(opt.OFMmapTables) {
+			// Fall back to ReadAt if the mapping fails.
+			if mr, err1 := storage.NewMmapReader(r, f.size); err1 == nil {
+				r = mr
+			} else {
+				t.s.printf("Table: mmap failed, num=%d err=%v", num, err1)
+			}
+		} else if n := o.GetBlockReadAhead(); n > 0 {
+			r = storage.NewReadAheadReader(r, n)
+		}
 
 		var ns cache.Namespace
 		bc := o.GetBlockCache()
@@ -415,8 +689,17 @@ func (t *tOps) lookup(f *tFile) (c cache.Object, err error) {
 		var p *table.Reader
 		p, err = table.NewReader(r, f.size, t.s.o, ns)
 		if err != nil {
+			r.Close()
 			return
 		}
+		if name := p.UnknownFilter(); name != "" {
+			t.s.printf("Table: unknown filter ignored, num=%d filter=%q", num, name)
+		}
+		p.SetFilterStats(t.fstats)
+		p.SetFileNum(num)
+		if cbc := o.GetCompressedBlockCache(); cbc != nil {
+			p.SetCompressedCache(cbc.GetNamespace(num))
+		}
 
 		ok = true
 		value = p
@@ -443,14 +726,19 @@ type tWriter struct {
 }
 
 func (w *tWriter) add(key, value []byte) error {
-	if w.notFirst {
-		w.last = key
-	} else {
-		w.first = key
-		w.last = key
+	// keys are copied, as they may be read in place from a mapped table
+	if !w.notFirst {
+		w.first = append([]byte{}, key...)
 		w.notFirst = true
 	}
-	return w.tw.Add(key, value)
+	w.last = append(w.last[:0], key...)
+	if err := w.tw.Add(key, value); err != nil {
+		return err
+	}
+	if _, t, ok := iKey(key).parseNum(); ok && t == tDel {
+		w.tw.MarkDeletion()
+	}
+	return nil
 }
 
 func (w *tWriter) finish() (t *tFile, err error) {
@@ -466,7 +754,12 @@ func (w *tWriter) finish() (t *tFile, err error) {
 	if err != nil {
 		return
 	}
-	t = newTFile(w.file, uint64(w.tw.Size()), iKey(w.first), iKey(w.last))
+	// Table boundaries are the actual first and last keys, never keys
+	// derived by the comparer, so overlap checks are exact regardless
+	// of the comparer Separator and Successor.
+	t = newTFile(w.file, uint64(w.tw.Size()), iKey(w.first), iKey(w.last),
+		w.t.s.o.GetSeekCompactionBytesPerSeek())
+	t.stats = unsafe.Pointer(&tStats{uint64(w.tw.Len()), uint64(w.tw.Deletions())})
 	return
 }
 
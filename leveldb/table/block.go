@@ -8,12 +8,14 @@ package table
 
 import (
 	"encoding/binary"
+	gohash "hash"
 	"io"
 
 	"code.google.com/p/snappy-go/snappy"
 
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/hash"
+	"github.com/syndtr/goleveldb/leveldb/storage"
 )
 
 // bInfo holds information about where and how long a block is
@@ -45,10 +47,35 @@ func (p *bInfo) encodeTo(b []byte) int {
 	return n + m
 }
 
-// readAll read entire referenced block.
-func (p *bInfo) readAll(r io.ReaderAt, checksum bool) (b []byte, err error) {
-	raw := make([]byte, p.size+5)
-	_, err = r.ReadAt(raw, int64(p.offset))
+// Create a hash computing block checksum of given type. The sum is
+// stored masked, regardless of the type.
+func newChecksum(checksum byte) gohash.Hash32 {
+	if checksum == kXXHash32Checksum {
+		return hash.NewXXHash32(0)
+	}
+	return hash.NewCRC32C()
+}
+
+// readAll read entire referenced block, verifying its checksum of given
+// type if verify is true.
+func (p *bInfo) readAll(r io.ReaderAt, checksum byte, verify bool) (b []byte, err error) {
+	raw, err := p.readRaw(r, checksum, verify)
+	if err != nil {
+		return
+	}
+	return decodeBlock(raw)
+}
+
+// readRaw read referenced block as stored, followed by its compression
+// type byte. The block is read in place if given reader is a
+// storage.Slicer.
+func (p *bInfo) readRaw(r io.ReaderAt, checksum byte, verify bool) (raw []byte, err error) {
+	if s, ok := r.(storage.Slicer); ok {
+		raw, err = s.Slice(int64(p.offset), int(p.size)+5)
+	} else {
+		raw = make([]byte, p.size+5)
+		_, err = r.ReadAt(raw, int64(p.offset))
+	}
 	if err != nil {
 		if err == io.EOF {
 			err = io.ErrUnexpectedEOF
@@ -59,24 +86,36 @@ func (p *bInfo) readAll(r io.ReaderAt, checksum bool) (b []byte, err error) {
 	crcb := raw[len(raw)-4:]
 	raw = raw[:len(raw)-4]
 
-	if checksum {
+	if verify {
 		sum := binary.LittleEndian.Uint32(crcb)
 		sum = hash.UnmaskCRC32(sum)
-		crc := hash.NewCRC32C()
-		crc.Write(raw)
-		if crc.Sum32() != sum {
+		h := newChecksum(checksum)
+		h.Write(raw)
+		if h.Sum32() != sum {
 			err = errors.ErrCorrupt("block checksum mismatch")
 			return
 		}
 	}
+	return
+}
 
+// Return whether given raw block, as read by readRaw, is compressed.
+func isCompressed(raw []byte) bool {
+	return raw[len(raw)-1] != kNoCompression
+}
+
+// Decompress given raw block, as read by readRaw; raw is not modified.
+func decodeBlock(raw []byte) (b []byte, err error) {
 	compression := raw[len(raw)-1]
 	b = raw[:len(raw)-1]
 
 	switch compression {
 	case kNoCompression:
 	case kSnappyCompression:
-		return snappy.Decode(nil, b)
+		b, err = snappy.Decode(nil, b)
+		if err != nil {
+			err = errors.ErrCorrupt("bad snappy block")
+		}
 	default:
 		err = errors.ErrCorrupt("bad block type")
 	}
@@ -12,6 +12,7 @@ import (
 	"io"
 
 	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
 // The magic was picked by running
@@ -19,48 +20,100 @@ import (
 // and taking the leading 64 bits.
 const magic uint64 = 0xdb4775248b80fb57
 
-var magicBytes []byte
+// Magic of versioned footer, used by table format version 1 and later;
+// the version number is stored right before the magic.
+const magicVersioned uint64 = 0x88e241b785f4cff7
+
+var magicBytes, magicVersionedBytes []byte
 
 const (
 	handlesSize = binary.MaxVarintLen64 * 2 * 2
 	magicSize   = 8
+	versionSize = 4
 	footerSize  = handlesSize + magicSize
+
+	// Size of versioned footer.
+	footerVersionedSize = handlesSize + versionSize + magicSize
+
+	// Size of versioned footer recording the block checksum type, used by
+	// table format version 2 and later.
+	footerV2Size = 1 + footerVersionedSize
 )
 
+var errFormatTooNew = errors.ErrInvalid("table format too new")
+
 func init() {
 	magicBytes = make([]byte, magicSize)
 	binary.LittleEndian.PutUint32(magicBytes, uint32(magic&0xffffffff))
 	binary.LittleEndian.PutUint32(magicBytes[4:], uint32(magic>>32))
+	magicVersionedBytes = make([]byte, magicSize)
+	binary.LittleEndian.PutUint64(magicVersionedBytes, magicVersioned)
 }
 
-func writeFooter(w io.Writer, mi, ii *bInfo) (n int, err error) {
-	buf := make([]byte, binary.MaxVarintLen64*2*2)
-	i := mi.encodeTo(buf)
-	ii.encodeTo(buf[i:])
-	_, err = w.Write(buf)
-	if err != nil {
-		return
+func writeFooter(w io.Writer, mi, ii *bInfo, version int, checksum byte) (n int, err error) {
+	buf := make([]byte, footerV2Size)
+	h := buf[1:]
+	i := mi.encodeTo(h)
+	ii.encodeTo(h[i:])
+	if version > opt.TableFormatV0 {
+		binary.LittleEndian.PutUint32(h[handlesSize:], uint32(version))
+		copy(h[handlesSize+versionSize:], magicVersionedBytes)
+		if version >= opt.TableFormatV2 {
+			buf[0] = checksum
+		} else {
+			buf = h
+		}
+	} else {
+		buf = h[:footerSize]
+		copy(buf[handlesSize:], magicBytes)
 	}
-	_, err = w.Write(magicBytes)
-	if err != nil {
-		return
-	}
-	return len(buf) + len(magicBytes), nil
+	return w.Write(buf)
 }
 
-func readFooter(r io.ReaderAt, size uint64) (mi, ii *bInfo, err error) {
+func readFooter(r io.ReaderAt, size uint64) (mi, ii *bInfo, version int, checksum byte, err error) {
 	if size < uint64(footerSize) {
 		err = errors.ErrInvalid("file is too short to be an sstable")
 		return
 	}
 
-	buf := make([]byte, footerSize)
-	n, err := r.ReadAt(buf, int64(size)-footerSize)
+	buf := make([]byte, footerV2Size)
+	if size < uint64(footerV2Size) {
+		buf = buf[footerV2Size-int(size):]
+	}
+	n, err := r.ReadAt(buf, int64(size)-int64(len(buf)))
 	if err != nil {
 		return
 	}
 
-	if bytes.Compare(buf[handlesSize:], magicBytes) != 0 {
+	switch magic := buf[len(buf)-magicSize:]; {
+	case bytes.Equal(magic, magicBytes):
+		version = opt.TableFormatV0
+		checksum = kCRC32CChecksum
+		buf = buf[len(buf)-footerSize:]
+	case bytes.Equal(magic, magicVersionedBytes) && len(buf) >= footerVersionedSize:
+		version = int(binary.LittleEndian.Uint32(buf[len(buf)-magicSize-versionSize:]))
+		if version > opt.MaxTableFormatVersion {
+			err = errFormatTooNew
+			return
+		}
+		if version <= opt.TableFormatV0 {
+			err = errors.ErrCorrupt("invalid table format version")
+			return
+		}
+		checksum = kCRC32CChecksum
+		if version >= opt.TableFormatV2 {
+			if len(buf) < footerV2Size {
+				err = errors.ErrCorrupt("truncated table footer")
+				return
+			}
+			checksum = buf[len(buf)-footerV2Size]
+			if checksum != kCRC32CChecksum && checksum != kXXHash32Checksum {
+				err = errors.ErrCorrupt("unknown block checksum type")
+				return
+			}
+		}
+		buf = buf[len(buf)-footerVersionedSize:]
+	default:
 		err = errors.ErrInvalid("not an sstable (bad magic number)")
 		return
 	}
@@ -8,8 +8,10 @@
 package table
 
 import (
+	"encoding/binary"
 	"runtime"
 	"strings"
+	"sync/atomic"
 
 	"github.com/syndtr/goleveldb/leveldb/block"
 	"github.com/syndtr/goleveldb/leveldb/cache"
@@ -20,6 +22,37 @@ import (
 	"github.com/syndtr/goleveldb/leveldb/storage"
 )
 
+// FilterStats hold counters of filter checks done by table lookups. It is
+// safe for concurrent use and may be shared by many readers.
+type FilterStats struct {
+	checks, absent, confirmed uint64
+}
+
+// Checks return the number of lookups checked against a filter.
+func (s *FilterStats) Checks() uint64 {
+	return atomic.LoadUint64(&s.checks)
+}
+
+// Absent return the number of lookups the filter predicted absent, thus
+// saved reading the data block.
+func (s *FilterStats) Absent() uint64 {
+	return atomic.LoadUint64(&s.absent)
+}
+
+// ConfirmedAbsent return the number of lookups the filter did not rule
+// out but turned out absent after reading the data block, i.e. the
+// filter false positives.
+func (s *FilterStats) ConfirmedAbsent() uint64 {
+	return atomic.LoadUint64(&s.confirmed)
+}
+
+// AddConfirmedAbsent count a lookup the filter did not rule out but
+// was found absent by the caller, e.g. since the key found by the table
+// lookup has another user key.
+func (s *FilterStats) AddConfirmedAbsent() {
+	atomic.AddUint64(&s.confirmed, 1)
+}
+
 // Reader represent a table reader.
 type Reader struct {
 	r storage.Reader
@@ -27,22 +60,32 @@ type Reader struct {
 
 	indexBlock  *block.Reader
 	filterBlock *block.FilterReader
+	ufilter     string // name of unknown filter, if any
+	fstats      *FilterStats
 
-	dataEnd uint64
-	cache   cache.Namespace
+	num      uint64 // file number, reported by corruption errors
+	checksum byte   // block checksum type
+	entries  uint64 // number of records, if recorded
+	dels     uint64 // number of deletions, if recorded
+	hasStats bool
+	dataEnd  uint64
+	mapped   bool // blocks are read in place, see storage.Slicer
+	cache    cache.Namespace
+	ccache   cache.Namespace // compressed blocks, if any
 }
 
 // NewReader create new initialized table reader.
 func NewReader(r storage.Reader, size uint64, o opt.OptionsGetter, cache cache.Namespace) (p *Reader, err error) {
-	mb, ib, err := readFooter(r, size)
+	mb, ib, _, checksum, err := readFooter(r, size)
 	if err != nil {
 		return
 	}
 
-	t := &Reader{r: r, o: o, dataEnd: mb.offset, cache: cache}
+	t := &Reader{r: r, o: o, checksum: checksum, dataEnd: mb.offset, cache: cache}
+	_, t.mapped = r.(storage.Slicer)
 
 	// index block
-	buf, err := ib.readAll(r, true)
+	buf, err := ib.readAll(r, checksum, true)
 	if err != nil {
 		return
 	}
@@ -55,7 +98,7 @@ func NewReader(r storage.Reader, size uint64, o opt.OptionsGetter, cache cache.N
 	// since it is not essential for operation
 
 	// meta block
-	buf, err1 := mb.readAll(r, true)
+	buf, err1 := mb.readAll(r, checksum, true)
 	if err1 != nil {
 		return
 	}
@@ -64,39 +107,105 @@ func NewReader(r storage.Reader, size uint64, o opt.OptionsGetter, cache cache.N
 		return
 	}
 
-	// filter block
+	// filter block and stats
 	iter := meta.NewIterator()
 	for iter.Next() {
 		key := string(iter.Key())
-		if !strings.HasPrefix(key, "filter.") {
+		if key == kStatsKey {
+			t.decodeStats(iter.Value())
+			continue
+		}
+		if !strings.HasPrefix(key, "filter.") || t.filterBlock != nil {
+			continue
+		}
+		filter := o.GetAltFilter(key[7:])
+		if filter == nil {
+			t.ufilter = key[7:]
+			continue
+		}
+		fb := new(bInfo)
+		_, err1 = fb.decodeFrom(iter.Value())
+		if err1 != nil {
 			continue
 		}
-		if filter := o.GetAltFilter(key[7:]); filter != nil {
-			fb := new(bInfo)
-			_, err1 = fb.decodeFrom(iter.Value())
-			if err1 != nil {
-				continue
-			}
 
-			// now the data block end before filter block start offset
-			// instead of meta block start offset
-			t.dataEnd = fb.offset
+		// now the data block end before filter block start offset
+		// instead of meta block start offset
+		t.dataEnd = fb.offset
 
-			buf, err1 = fb.readAll(r, true)
-			if err1 != nil {
-				continue
-			}
-			t.filterBlock, err1 = block.NewFilterReader(buf, filter)
-			if err1 != nil {
-				continue
-			}
-			break
+		buf, err1 = fb.readAll(r, checksum, true)
+		if err1 != nil {
+			continue
+		}
+		t.filterBlock, err1 = block.NewFilterReader(buf, filter)
+		if err1 != nil {
+			continue
 		}
 	}
+	if t.filterBlock != nil {
+		t.ufilter = ""
+	}
 
 	return t, nil
 }
 
+func (t *Reader) decodeStats(b []byte) {
+	entries, n := binary.Uvarint(b)
+	if n <= 0 {
+		return
+	}
+	dels, m := binary.Uvarint(b[n:])
+	if m <= 0 || dels > entries {
+		return
+	}
+	t.entries, t.dels, t.hasStats = entries, dels, true
+}
+
+// Deletions return the number of records and the number of those marked
+// as deletion, as recorded by Writer.MarkDeletion; ok is false if the
+// table has no such record, e.g. it was written by an older version.
+func (t *Reader) Deletions() (entries, deletions uint64, ok bool) {
+	return t.entries, t.dels, t.hasStats
+}
+
+// SetFilterStats set stats the filter checks of this table counted to.
+func (t *Reader) SetFilterStats(s *FilterStats) {
+	t.fstats = s
+}
+
+// SetCompressedCache set cache of compressed blocks of this table. Data
+// blocks missing from the block cache are looked up there before being
+// read from the storage, and are decompressed into the block cache.
+func (t *Reader) SetCompressedCache(ns cache.Namespace) {
+	t.ccache = ns
+}
+
+// SetFileNum set number of the table file, reported by
+// errors.ErrCorrupted when a corrupt block is found.
+func (t *Reader) SetFileNum(num uint64) {
+	t.num = num
+}
+
+// Mapped return true if blocks of this table are read in place, see
+// storage.Slicer.
+func (t *Reader) Mapped() bool {
+	return t.mapped
+}
+
+// HasFilter return true if lookups of this table are checked against a
+// filter.
+func (t *Reader) HasFilter() bool {
+	return t.filterBlock != nil
+}
+
+// UnknownFilter return name of the filter the table was written with if
+// the filter is not known by the options, i.e. neither the filter nor
+// any of the alternative filters. Such filter is ignored and the table
+// is read without filter.
+func (t *Reader) UnknownFilter() string {
+	return t.ufilter
+}
+
 // NewIterator create new iterator over the table.
 func (t *Reader) NewIterator(ro opt.ReadOptionsGetter) iterator.Iterator {
 	index_iter := &indexIter{t: t, ro: ro}
@@ -105,8 +214,20 @@ func (t *Reader) NewIterator(ro opt.ReadOptionsGetter) iterator.Iterator {
 }
 
 // Get lookup for given key on the table. Get returns errors.ErrNotFound if
-// given key did not exist.
+// given key did not exist. The returned slices of a mapped table are only
+// valid until the reader is released, see Mapped.
 func (t *Reader) Get(key []byte, ro opt.ReadOptionsGetter) (rkey, rvalue []byte, err error) {
+	return t.find(key, ro, false)
+}
+
+// Find is like Get but only return the key found, the value is never
+// read out of the data block.
+func (t *Reader) Find(key []byte, ro opt.ReadOptionsGetter) (rkey []byte, err error) {
+	rkey, _, err = t.find(key, ro, true)
+	return
+}
+
+func (t *Reader) find(key []byte, ro opt.ReadOptionsGetter, noValue bool) (rkey, rvalue []byte, err error) {
 	// create an iterator of index block
 	index_iter := t.indexBlock.NewIterator()
 	if !index_iter.Seek(key) {
@@ -125,7 +246,7 @@ func (t *Reader) Get(key []byte, ro opt.ReadOptionsGetter) (rkey, rvalue []byte,
 	}
 
 	// get the data block
-	if t.filterBlock == nil || t.filterBlock.KeyMayMatch(uint(bi.offset), key) {
+	if t.keyMayMatch(bi, key) {
 		var it iterator.Iterator
 		var cache cache.Object
 		it, cache, err = t.getDataIter(bi, ro)
@@ -138,19 +259,41 @@ func (t *Reader) Get(key []byte, ro opt.ReadOptionsGetter) (rkey, rvalue []byte,
 
 		// seek to key
 		if !it.Seek(key) {
-			err = it.Error()
+			err = t.corrupted(bi, it.Error())
 			if err == nil {
 				err = errors.ErrNotFound
+				if t.filterBlock != nil && t.fstats != nil {
+					t.fstats.AddConfirmedAbsent()
+				}
 			}
 			return
 		}
-		rkey, rvalue = it.Key(), it.Value()
+		rkey = it.Key()
+		if !noValue {
+			rvalue = it.Value()
+		}
 	} else {
 		err = errors.ErrNotFound
 	}
 	return
 }
 
+// Check filter of the data block for given key, counting it in the filter
+// stats; true if no filter.
+func (t *Reader) keyMayMatch(bi *bInfo, key []byte) bool {
+	if t.filterBlock == nil {
+		return true
+	}
+	ok := t.filterBlock.KeyMayMatch(uint(bi.offset), key)
+	if t.fstats != nil {
+		atomic.AddUint64(&t.fstats.checks, 1)
+		if !ok {
+			atomic.AddUint64(&t.fstats.absent, 1)
+		}
+	}
+	return ok
+}
+
 // ApproximateOffsetOf approximate the offset of given key in bytes.
 func (t *Reader) ApproximateOffsetOf(key []byte) uint64 {
 	index_iter := t.indexBlock.NewIterator()
@@ -167,13 +310,61 @@ func (t *Reader) ApproximateOffsetOf(key []byte) uint64 {
 	return t.dataEnd
 }
 
-func (t *Reader) getBlock(bi *bInfo, ro opt.ReadOptionsGetter) (b *block.Reader, err error) {
-	buf, err := bi.readAll(t.r, ro.HasFlag(opt.RFVerifyChecksums))
+// Read given block; inPlace is true if the block is read in place, thus
+// is valid only until the reader is closed.
+func (t *Reader) getBlock(bi *bInfo, ro opt.ReadOptionsGetter) (b *block.Reader, inPlace bool, err error) {
+	var buf []byte
+	if t.ccache != nil && !t.mapped {
+		buf, err = t.getCompressedBlock(bi, ro)
+	} else {
+		var raw []byte
+		raw, err = bi.readRaw(t.r, t.checksum, ro.HasFlag(opt.RFVerifyChecksums))
+		if err == nil {
+			inPlace = t.mapped && !isCompressed(raw)
+			buf, err = decodeBlock(raw)
+		}
+	}
+	if err == nil {
+		b, err = block.NewReader(buf, t.o.GetComparer())
+	}
+	err = t.corrupted(bi, err)
+	return
+}
+
+// Identify the table file and given block in err, if it is a corruption.
+func (t *Reader) corrupted(bi *bInfo, err error) error {
+	if e, ok := err.(errors.ErrCorrupt); ok {
+		return &errors.ErrCorrupted{File: t.num, Offset: bi.offset, Err: e}
+	}
+	return err
+}
+
+// Read block through the compressed block cache; only compressed blocks
+// are cached.
+func (t *Reader) getCompressedBlock(bi *bInfo, ro opt.ReadOptionsGetter) (buf []byte, err error) {
+	var raw []byte
+	c, ok := t.ccache.Get(bi.offset, func() (ok bool, value interface{}, charge int, fin func()) {
+		raw, err = bi.readRaw(t.r, t.checksum, ro.HasFlag(opt.RFVerifyChecksums))
+		if err == nil && isCompressed(raw) && !ro.HasFlag(opt.RFDontFillCache) {
+			ok = true
+			value = raw
+			charge = len(raw)
+		}
+		return
+	})
 	if err != nil {
 		return
 	}
-	b, err = block.NewReader(buf, t.o.GetComparer())
-	return
+	if ok {
+		raw = c.Value().([]byte)
+		c.Release()
+	} else if raw == nil {
+		raw, err = bi.readRaw(t.r, t.checksum, ro.HasFlag(opt.RFVerifyChecksums))
+		if err != nil {
+			return
+		}
+	}
+	return decodeBlock(raw)
 }
 
 func (t *Reader) getDataIter(bi *bInfo, ro opt.ReadOptionsGetter) (it *block.Iterator, cache cache.Object, err error) {
@@ -185,8 +376,11 @@ func (t *Reader) getDataIter(bi *bInfo, ro opt.ReadOptionsGetter) (it *block.Ite
 			if ro.HasFlag(opt.RFDontFillCache) {
 				return
 			}
-			b, err = t.getBlock(bi, ro)
-			if err == nil {
+			var inPlace bool
+			b, inPlace, err = t.getBlock(bi, ro)
+			// blocks read in place must not outlive the reader, and
+			// are as cheap to read again as to look up
+			if err == nil && !inPlace {
 				ok = true
 				value = b
 				charge = int(bi.size)
@@ -199,15 +393,17 @@ func (t *Reader) getDataIter(bi *bInfo, ro opt.ReadOptionsGetter) (it *block.Ite
 		}
 
 		if !ok {
-			b, err = t.getBlock(bi, ro)
-			if err != nil {
-				return
+			if b == nil {
+				b, _, err = t.getBlock(bi, ro)
+				if err != nil {
+					return
+				}
 			}
 		} else if b == nil {
 			b = cache.Value().(*block.Reader)
 		}
 	} else {
-		b, err = t.getBlock(bi, ro)
+		b, _, err = t.getBlock(bi, ro)
 		if err != nil {
 			return
 		}
@@ -236,9 +432,8 @@ func (i *indexIter) Get() (it iterator.Iterator, err error) {
 		return
 	}
 	if cache != nil {
-		runtime.SetFinalizer(x, func(x *block.Iterator) {
-			cache.Release()
-		})
+		x.SetReleaser(cache)
+		runtime.SetFinalizer(x, (*block.Iterator).Release)
 	}
 	return x, nil
 }
@@ -8,8 +8,12 @@ package table
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"testing"
 
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/filter"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
@@ -67,3 +71,297 @@ func TestApproximateOffsetOfPlain(t *testing.T) {
 	offsetBetween(t, tr.ApproximateOffsetOf([]byte("k07")), 510000, 511000)
 	offsetBetween(t, tr.ApproximateOffsetOf([]byte("xyz")), 610000, 612000)
 }
+
+func TestTableFormatVersion(t *testing.T) {
+	build := func(version int) []byte {
+		w := new(writer)
+		o := &opt.Options{TableFormatVersion: version}
+		tw := NewWriter(w, o)
+		tw.Add([]byte("k01"), []byte("v01"))
+		tw.Add([]byte("k02"), []byte("v02"))
+		if err := tw.Finish(); err != nil {
+			t.Fatal("error when finalizing table:", err.Error())
+		}
+		return w.Bytes()
+	}
+	open := func(b []byte) (*Reader, error) {
+		r := &reader{*bytes.NewReader(b)}
+		return NewReader(r, uint64(len(b)), &opt.Options{}, nil)
+	}
+
+	for version := opt.TableFormatV0; version <= opt.MaxTableFormatVersion; version++ {
+		b := build(version)
+		_, _, rversion, _, err := readFooter(bytes.NewReader(b), uint64(len(b)))
+		if err != nil {
+			t.Fatalf("version %d: error when reading footer: %v", version, err)
+		}
+		if rversion != version {
+			t.Errorf("version %d: got footer version %d", version, rversion)
+		}
+		tr, err := open(b)
+		if err != nil {
+			t.Fatalf("version %d: error when creating table reader instance: %v", version, err)
+		}
+		if _, v, err := tr.Get([]byte("k02"), &opt.ReadOptions{}); err != nil || string(v) != "v02" {
+			t.Errorf("version %d: Get: got %q, %v", version, v, err)
+		}
+	}
+
+	// Footer with bogus future version.
+	b := build(opt.MaxTableFormatVersion)
+	binary.LittleEndian.PutUint32(b[len(b)-magicSize-versionSize:], opt.MaxTableFormatVersion+1)
+	if _, err := open(b); err != errFormatTooNew {
+		t.Errorf("want %v, got %v", errFormatTooNew, err)
+	}
+}
+
+func TestWriterSetCompressionType(t *testing.T) {
+	build := func(o *opt.Options, compression opt.Compression) byte {
+		w := new(writer)
+		tw := NewWriter(w, o)
+		tw.SetCompressionType(compression)
+		tw.Add([]byte("k01"), []byte("v01"))
+		if err := tw.Finish(); err != nil {
+			t.Fatal("error when finalizing table:", err.Error())
+		}
+		r := &reader{*bytes.NewReader(w.Bytes())}
+		if _, err := NewReader(r, uint64(w.Len()), o, nil); err != nil {
+			t.Fatal("error when creating table reader instance:", err.Error())
+		}
+		// the only data block is at offset zero
+		return w.Bytes()[tw.lblock.size]
+	}
+
+	plain := &opt.Options{CompressionType: opt.NoCompression}
+	snappy := &opt.Options{CompressionType: opt.SnappyCompression}
+	for i, x := range []struct {
+		o           *opt.Options
+		compression opt.Compression
+		want        byte
+	}{
+		{plain, opt.DefaultCompression, kNoCompression},
+		{plain, opt.SnappyCompression, kSnappyCompression},
+		{snappy, opt.DefaultCompression, kSnappyCompression},
+		{snappy, opt.NoCompression, kNoCompression},
+	} {
+		if got := build(x.o, x.compression); got != x.want {
+			t.Errorf("#%d: got block compression %d, want %d", i, got, x.want)
+		}
+	}
+}
+
+func TestReaderFilterByName(t *testing.T) {
+	w := new(writer)
+	tw := NewWriter(w, &opt.Options{Filter: filter.NewBloomFilter(10)})
+	for i := 0; i < 100; i++ {
+		tw.Add([]byte(fmt.Sprintf("k%03d", i)), []byte("v"))
+	}
+	if err := tw.Finish(); err != nil {
+		t.Fatal("error when finalizing table:", err.Error())
+	}
+
+	for i, x := range []struct {
+		o       *opt.Options
+		filter  bool
+		unknown string
+	}{
+		// bits per key is recorded within the filter itself
+		{&opt.Options{Filter: filter.NewBloomFilter(16)}, true, ""},
+		{&opt.Options{AltFilters: []filter.Filter{filter.NewBloomFilter(4)}}, true, ""},
+		{&opt.Options{}, false, "leveldb.BuiltinBloomFilter"},
+	} {
+		r := &reader{*bytes.NewReader(w.Bytes())}
+		tr, err := NewReader(r, uint64(w.Len()), x.o, nil)
+		if err != nil {
+			t.Fatal("error when creating table reader instance:", err.Error())
+		}
+		if got := tr.filterBlock != nil; got != x.filter {
+			t.Errorf("#%d: got filter %v, want %v", i, got, x.filter)
+		}
+		if got := tr.UnknownFilter(); got != x.unknown {
+			t.Errorf("#%d: got unknown filter %q, want %q", i, got, x.unknown)
+		}
+		for j := 0; j < 100; j++ {
+			key := []byte(fmt.Sprintf("k%03d", j))
+			if _, _, err := tr.Get(key, &opt.ReadOptions{}); err != nil {
+				t.Errorf("#%d: Get %q: got error: %v", i, key, err)
+			}
+		}
+	}
+}
+
+func TestReaderSeekForPrev(t *testing.T) {
+	w := new(writer)
+	o := &opt.Options{
+		BlockSize:            64,
+		BlockRestartInterval: 2,
+		CompressionType:      opt.NoCompression,
+	}
+	tw := NewWriter(w, o)
+	// even keys only
+	for i := 0; i < 100; i += 2 {
+		tw.Add([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%03d", i)))
+	}
+	if err := tw.Finish(); err != nil {
+		t.Fatal("error when finalizing table:", err.Error())
+	}
+	r := &reader{*bytes.NewReader(w.Bytes())}
+	tr, err := NewReader(r, uint64(w.Len()), o, nil)
+	if err != nil {
+		t.Fatal("error when creating table reader instance:", err.Error())
+	}
+
+	iter := tr.NewIterator(&opt.ReadOptions{})
+	for i := -1; i < 102; i++ {
+		key := fmt.Sprintf("k%03d", i)
+		want := ""
+		if i >= 0 {
+			want = fmt.Sprintf("k%03d", i&^1)
+			if i >= 100 {
+				want = "k098"
+			}
+		}
+		ok := iter.SeekForPrev([]byte(key))
+		if got := string(iter.Key()); ok != (want != "") || got != want {
+			t.Errorf("SeekForPrev(%q): want=%q got=%q", key, want, got)
+		}
+		if ok && string(iter.Value()) != "v"+want[1:] {
+			t.Errorf("SeekForPrev(%q): invalid value %q", key, iter.Value())
+		}
+	}
+	if err := iter.Error(); err != nil {
+		t.Error("iterator error:", err)
+	}
+}
+
+func TestWriterBlockSettings(t *testing.T) {
+	const n = 500
+	blocks := make(map[int]int)
+	for _, size := range []int{16, 4096, 1 << 20} {
+		for _, interval := range []int{1, 16, 1000} {
+			w := new(writer)
+			tw := NewWriter(w, &opt.Options{
+				BlockSize:            size,
+				BlockRestartInterval: interval,
+			})
+			for i := 0; i < n; i++ {
+				tw.Add([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("v%04d", i)))
+			}
+			if err := tw.Finish(); err != nil {
+				t.Fatalf("size=%d interval=%d: error when finalizing table: %v", size, interval, err)
+			}
+			blocks[size] = tw.CountBlock()
+
+			// The settings are encoded per-block, reader options don't matter.
+			r := &reader{*bytes.NewReader(w.Bytes())}
+			tr, err := NewReader(r, uint64(w.Len()), &opt.Options{}, nil)
+			if err != nil {
+				t.Fatalf("size=%d interval=%d: error when creating table reader: %v", size, interval, err)
+			}
+			iter := tr.NewIterator(&opt.ReadOptions{})
+			i := 0
+			for ; iter.Next(); i++ {
+				if want := fmt.Sprintf("k%04d", i); string(iter.Key()) != want {
+					t.Fatalf("size=%d interval=%d: got key %q, want %q", size, interval, iter.Key(), want)
+				}
+			}
+			if err := iter.Error(); err != nil || i != n {
+				t.Errorf("size=%d interval=%d: iterated %d entries, err=%v", size, interval, i, err)
+			}
+			iter.Release()
+			for _, j := range []int{0, 1, n / 3, n - 1} {
+				key := fmt.Sprintf("k%04d", j)
+				if _, v, err := tr.Get([]byte(key), &opt.ReadOptions{}); err != nil || string(v) != "v"+key[1:] {
+					t.Errorf("size=%d interval=%d: Get %q: got %q, %v", size, interval, key, v, err)
+				}
+			}
+		}
+	}
+	if !(blocks[16] > blocks[4096] && blocks[4096] > blocks[1<<20]) {
+		t.Errorf("expect fewer blocks with larger block size, got %v", blocks)
+	}
+}
+
+func TestChecksumType(t *testing.T) {
+	build := func(checksum opt.Checksum) []byte {
+		w := new(writer)
+		tw := NewWriter(w, &opt.Options{
+			BlockSize:       256,
+			CompressionType: opt.NoCompression,
+			ChecksumType:    checksum,
+		})
+		for i := 0; i < 100; i++ {
+			tw.Add([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%03d", i)))
+		}
+		if err := tw.Finish(); err != nil {
+			t.Fatal("error when finalizing table:", err.Error())
+		}
+		return w.Bytes()
+	}
+	get := func(b []byte, verify bool) ([]byte, error) {
+		r := &reader{*bytes.NewReader(b)}
+		// The reader options select CRC32C, the footer takes precedence.
+		tr, err := NewReader(r, uint64(len(b)), &opt.Options{ChecksumType: opt.CRC32CChecksum}, nil)
+		if err != nil {
+			return nil, err
+		}
+		ro := &opt.ReadOptions{}
+		if verify {
+			ro.Flag = opt.RFVerifyChecksums
+		}
+		_, v, err := tr.Get([]byte("k050"), ro)
+		return v, err
+	}
+
+	for _, checksum := range []opt.Checksum{opt.CRC32CChecksum, opt.XXHash32Checksum} {
+		b := build(checksum)
+		_, _, version, _, err := readFooter(bytes.NewReader(b), uint64(len(b)))
+		if err != nil {
+			t.Fatalf("%v: error when reading footer: %v", checksum, err)
+		}
+		if checksum == opt.XXHash32Checksum && version < opt.TableFormatV2 {
+			t.Errorf("%v: got table format version %d", checksum, version)
+		}
+		if v, err := get(b, true); err != nil || string(v) != "v050" {
+			t.Errorf("%v: Get: got %q, %v", checksum, v, err)
+		}
+
+		// Flip a byte of the value, verification catches it only if
+		// enabled.
+		i := bytes.Index(b, []byte("v050"))
+		b[i+1] ^= 0xff
+		if _, err := get(b, true); !errors.IsCorrupted(err) {
+			t.Errorf("%v: Get on corrupted block with verification: got error %v", checksum, err)
+		}
+		if v, err := get(b, false); err != nil || string(v) == "v050" {
+			t.Errorf("%v: Get on corrupted block without verification: got %q, %v", checksum, v, err)
+		}
+	}
+}
+
+func TestWriterDeletions(t *testing.T) {
+	w := new(writer)
+	tw := NewWriter(w, &opt.Options{Filter: filter.NewBloomFilter(10)})
+	for i := 0; i < 100; i++ {
+		tw.Add([]byte(fmt.Sprintf("k%04d", i)), []byte("v"))
+		if i%4 == 0 {
+			tw.MarkDeletion()
+		}
+	}
+	if err := tw.Finish(); err != nil {
+		t.Fatal("error when finalizing table: ", err)
+	}
+
+	r := &reader{*bytes.NewReader(w.Bytes())}
+	tr, err := NewReader(r, uint64(w.Len()), &opt.Options{Filter: filter.NewBloomFilter(10)}, nil)
+	if err != nil {
+		t.Fatal("error when creating table reader: ", err)
+	}
+	if entries, dels, ok := tr.Deletions(); !ok || entries != 100 || dels != 25 {
+		t.Errorf("Deletions: got %d, %d, %v; want 100, 25, true", entries, dels, ok)
+	}
+	// The filter is still found besides the stats.
+	if !tr.HasFilter() {
+		t.Error("filter block not loaded")
+	}
+}
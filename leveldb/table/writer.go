@@ -23,6 +23,14 @@ const (
 	// Written to disk; don't modify.
 	kNoCompression     = 0
 	kSnappyCompression = 1
+
+	// Block checksum types recorded in the footer; written to disk,
+	// don't modify.
+	kCRC32CChecksum   = 1
+	kXXHash32Checksum = 2
+
+	// Meta block key of the entry and deletion counts.
+	kStatsKey = "stats.deletions"
 )
 
 // Writer represent a table writer.
@@ -32,11 +40,15 @@ type Writer struct {
 	cmp    comparer.Comparer
 	filter filter.Filter
 
+	compression opt.Compression // overrides options, if set
+	checksum    byte            // block checksum type
+
 	dataBlock   *block.Writer
 	indexBlock  *block.Writer
 	filterBlock *block.FilterWriter
 
 	n, off int
+	ndel   int    // records marked as deletion
 	lkey   []byte // last key
 	lblock *bInfo // last block
 	pindex bool   // pending index
@@ -56,9 +68,19 @@ func NewWriter(w storage.Writer, o opt.OptionsGetter) *Writer {
 		t.filterBlock.Generate(0)
 	}
 	t.lblock = new(bInfo)
+	t.checksum = kCRC32CChecksum
+	if o.GetChecksumType() == opt.XXHash32Checksum {
+		t.checksum = kXXHash32Checksum
+	}
 	return t
 }
 
+// SetCompressionType set compression type of blocks written afterwards,
+// overriding the options. DefaultCompression reverts to the options.
+func (t *Writer) SetCompressionType(compression opt.Compression) {
+	t.compression = compression
+}
+
 // Add append key/value to the table.
 func (t *Writer) Add(key, value []byte) (err error) {
 	if t.closed {
@@ -86,6 +108,13 @@ func (t *Writer) Add(key, value []byte) (err error) {
 	return
 }
 
+// MarkDeletion count the last added record as a deletion. The number of
+// records and deletions is recorded in the table metadata, thus may be
+// used to estimate space shadowed by deletions.
+func (t *Writer) MarkDeletion() {
+	t.ndel++
+}
+
 // Flush finalize and write the data block.
 func (t *Writer) Flush() (err error) {
 	if t.closed {
@@ -139,6 +168,10 @@ func (t *Writer) Finish() (err error) {
 		key := []byte("filter." + t.filter.Name())
 		meta.Add(key, fi.encode())
 	}
+	var stats [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(stats[:], uint64(t.n))
+	n += binary.PutUvarint(stats[n:], uint64(t.ndel))
+	meta.Add([]byte(kStatsKey), stats[:n])
 	mb := new(bInfo)
 	err = t.write(meta.Finish(), mb, false)
 	if err != nil {
@@ -158,8 +191,12 @@ func (t *Writer) Finish() (err error) {
 	}
 
 	// Write footer
-	var n int
-	n, err = writeFooter(t.w, mb, ib)
+	version := t.o.GetTableFormatVersion()
+	if t.checksum != kCRC32CChecksum && version < opt.TableFormatV2 {
+		// only recorded by the footer of format version 2 onward
+		version = opt.TableFormatV2
+	}
+	n, err = writeFooter(t.w, mb, ib, version, t.checksum)
 	if err != nil {
 		return
 	}
@@ -178,6 +215,11 @@ func (t *Writer) Size() int {
 	return t.off
 }
 
+// Deletions return the number of records marked as deletion so far.
+func (t *Writer) Deletions() int {
+	return t.ndel
+}
+
 // CountBlock return the number of data block written so far.
 func (t *Writer) CountBlock() int {
 	n := t.indexBlock.Len()
@@ -190,7 +232,11 @@ func (t *Writer) CountBlock() int {
 func (t *Writer) write(buf []byte, bi *bInfo, raw bool) (err error) {
 	compression := kNoCompression
 	if !raw {
-		switch t.o.GetCompressionType() {
+		ct := t.compression
+		if ct == opt.DefaultCompression {
+			ct = t.o.GetCompressionType()
+		}
+		switch ct {
 		case opt.DefaultCompression, opt.SnappyCompression:
 			compression = kSnappyCompression
 			buf, err = snappy.Encode(nil, buf)
@@ -216,10 +262,10 @@ func (t *Writer) write(buf []byte, bi *bInfo, raw bool) (err error) {
 		return
 	}
 
-	crc := hash.NewCRC32C()
-	crc.Write(buf)
-	crc.Write(compbit)
-	err = binary.Write(t.w, binary.LittleEndian, hash.MaskCRC32(crc.Sum32()))
+	h := newChecksum(t.checksum)
+	h.Write(buf)
+	h.Write(compbit)
+	err = binary.Write(t.w, binary.LittleEndian, hash.MaskCRC32(h.Sum32()))
 	if err != nil {
 		return
 	}
@@ -0,0 +1,96 @@
+// Copyright (c) 2013, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+)
+
+// ttlNow return the current time in Unix nanoseconds, against which
+// expiry of TTL values is checked; replaced by tests.
+var ttlNow = func() int64 {
+	return time.Now().UnixNano()
+}
+
+// Encode value of a tTTL entry expiring at given time.
+func encodeTTLValue(value []byte, expiry int64) []byte {
+	b := make([]byte, 8+len(value))
+	binary.LittleEndian.PutUint64(b, uint64(expiry))
+	copy(b[8:], value)
+	return b
+}
+
+// Resolve entry of given type and value: a tTTL entry is resolved into
+// tVal with the expiry stripped off the value, or into tDel if it has
+// expired at given time, or is malformed. Other entries are returned as
+// is.
+func resolveTTL(t vType, value []byte, now int64) (vType, []byte) {
+	if t != tTTL {
+		return t, value
+	}
+	if len(value) < 8 || int64(binary.LittleEndian.Uint64(value)) <= now {
+		return tDel, nil
+	}
+	return tVal, value[8:]
+}
+
+// ttlCompactIter is a forward-only internal key iterator used by
+// compaction. It turns expired TTL values into deletions, which are then
+// dropped just as deletions are. Any other entry is passed through as is.
+type ttlCompactIter struct {
+	iterator.Iterator
+	now int64
+
+	expired bool
+	key     []byte
+}
+
+func newTTLCompactIter(src iterator.Iterator, now int64) *ttlCompactIter {
+	return &ttlCompactIter{Iterator: src, now: now}
+}
+
+func (i *ttlCompactIter) Next() bool {
+	i.expired = false
+	if !i.Iterator.Next() {
+		return false
+	}
+	key := iKey(i.Iterator.Key())
+	if _, t, ok := key.parseNum(); ok && t == tTTL {
+		if t, _ = resolveTTL(t, i.Iterator.Value(), i.now); t == tDel {
+			k := dupBytes(key)
+			k[len(k)-8] = byte(tDel) | k[len(k)-8]&byte(tTs)
+			i.key = k
+			i.expired = true
+		}
+	}
+	return true
+}
+
+func (i *ttlCompactIter) Key() []byte {
+	if i.expired {
+		return i.key
+	}
+	return i.Iterator.Key()
+}
+
+func (i *ttlCompactIter) Value() []byte {
+	if i.expired {
+		return nil
+	}
+	return i.Iterator.Value()
+}
+
+func (i *ttlCompactIter) KeyCopy(dst []byte) []byte {
+	return append(dst, i.Key()...)
+}
+
+func (i *ttlCompactIter) ValueCopy(dst []byte) []byte {
+	return append(dst, i.Value()...)
+}
@@ -11,6 +11,7 @@ import (
 	"io"
 	"sort"
 
+	"github.com/syndtr/goleveldb/leveldb/comparer"
 	"github.com/syndtr/goleveldb/leveldb/journal"
 	"github.com/syndtr/goleveldb/leveldb/storage"
 )
@@ -20,6 +21,18 @@ type readByteReader interface {
 	io.ByteReader
 }
 
+// Copy given bytes into given buffer, reusing it if large enough; the
+// result is nil only if given bytes are.
+func copyBytes(buf, b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	if buf == nil {
+		buf = make([]byte, 0, len(b))
+	}
+	return append(buf[:0], b...)
+}
+
 func dupBytes(b []byte) []byte {
 	if len(b) == 0 {
 		return nil
@@ -29,6 +42,20 @@ func dupBytes(b []byte) []byte {
 	return r
 }
 
+// Return the smallest key after all keys having given prefix in bytewise
+// order, or nil if there is none, i.e. the prefix is all 0xff.
+func prefixLimit(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if c := prefix[i]; c < 0xff {
+			r := make([]byte, i+1)
+			copy(r, prefix)
+			r[i]++
+			return r
+		}
+	}
+	return nil
+}
+
 func sliceBytes(b []byte) []byte {
 	z, n := binary.Uvarint(b)
 	return b[n : n+int(z)]
@@ -85,6 +112,34 @@ func (p files) sort() {
 	sort.Sort(p)
 }
 
+// keysIndex sort indexes of keys by the keys.
+type keysIndex struct {
+	keys [][]byte
+	idx  []int
+	cmp  comparer.BasicComparer
+}
+
+func newKeysIndex(keys [][]byte, cmp comparer.BasicComparer) *keysIndex {
+	p := &keysIndex{keys: keys, idx: make([]int, len(keys)), cmp: cmp}
+	for i := range p.idx {
+		p.idx[i] = i
+	}
+	sort.Sort(p)
+	return p
+}
+
+func (p *keysIndex) Len() int {
+	return len(p.idx)
+}
+
+func (p *keysIndex) Less(i, j int) bool {
+	return p.cmp.Compare(p.keys[p.idx[i]], p.keys[p.idx[j]]) < 0
+}
+
+func (p *keysIndex) Swap(i, j int) {
+	p.idx[i], p.idx[j] = p.idx[j], p.idx[i]
+}
+
 type journalReader struct {
 	file    storage.File
 	reader  storage.Reader
@@ -120,15 +175,11 @@ func (r *journalReader) close() {
 	r.journal = nil
 }
 
-func (r *journalReader) remove() error {
-	r.close()
-	return r.file.Remove()
-}
-
 type journalWriter struct {
-	file    storage.File
-	writer  storage.Writer
-	journal *journal.Writer
+	file     storage.File
+	writer   storage.Writer
+	journal  *journal.Writer
+	prealloc storage.Preallocator
 }
 
 func newJournalWriter(file storage.File) (p *journalWriter, err error) {
@@ -142,6 +193,23 @@ func newJournalWriter(file storage.File) (p *journalWriter, err error) {
 	return w, nil
 }
 
+// Preallocate given number of bytes for the journal file, if supported by
+// the storage. The unused space will be truncated on close.
+func (w *journalWriter) preallocate(size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	p, ok := w.writer.(storage.Preallocator)
+	if !ok {
+		return nil
+	}
+	if err := p.Preallocate(size); err != nil {
+		return err
+	}
+	w.prealloc = p
+	return nil
+}
+
 func (w *journalWriter) closed() bool {
 	return w.writer == nil
 }
@@ -150,6 +218,10 @@ func (w *journalWriter) close() {
 	if w.closed() {
 		return
 	}
+	if w.prealloc != nil {
+		w.prealloc.Truncate(w.journal.Size())
+		w.prealloc = nil
+	}
 	w.writer.Close()
 	w.writer = nil
 	w.journal = nil
@@ -159,3 +231,39 @@ func (w *journalWriter) remove() error {
 	w.close()
 	return w.file.Remove()
 }
+
+// Copy content of src into dst, which is created, and sync it.
+func copyFile(src, dst storage.File) (err error) {
+	r, err := src.Open()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	w, err := dst.Create()
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(w, r)
+	if err == nil {
+		err = w.Sync()
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return
+}
+
+// nopWriter adapts an io.Writer to storage.Writer; Sync and Close are
+// no-op, left to the owner of the underlying writer.
+type nopWriter struct {
+	io.Writer
+}
+
+func (nopWriter) Sync() error  { return nil }
+func (nopWriter) Close() error { return nil }
+
+type uint64Slice []uint64
+
+func (p uint64Slice) Len() int           { return len(p) }
+func (p uint64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p uint64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
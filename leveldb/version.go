@@ -7,26 +7,24 @@
 package leveldb
 
 import (
+	"fmt"
 	"runtime"
 	"sync/atomic"
 	"unsafe"
 
+	"github.com/syndtr/goleveldb/leveldb/comparer"
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
-var levelMaxSize [kNumLevels]float64
-
-func init() {
-	// Precompute max size of each level
-	for level := range levelMaxSize {
-		res := float64(10 * 1048576)
-		for n := level; n > 1; n-- {
-			res *= 10
-		}
-		levelMaxSize[level] = res
+// Max size of given level.
+func levelMaxSize(level int) float64 {
+	res := float64(10 * 1048576)
+	for n := level; n > 1; n-- {
+		res *= 10
 	}
+	return res
 }
 
 type tSet struct {
@@ -37,7 +35,10 @@ type tSet struct {
 type version struct {
 	s *session
 
-	tables [kNumLevels]tFiles
+	tables []tFiles
+
+	// Range tombstones held by tables, so reads need not scan for them.
+	rdels rangeDels
 
 	// Level that should be compacted next and its compaction score.
 	// Score < 1 means compaction is not strictly needed.  These fields
@@ -45,11 +46,19 @@ type version struct {
 	cLevel int
 	cScore float64
 
+	// Table to compact for its deletions, if the compaction score of
+	// cLevel is due to it.
+	cDel *tFile
+
 	cSeek unsafe.Pointer
 
 	next *version
 }
 
+func newVersion(s *session) *version {
+	return &version{s: s, tables: make([]tFiles, s.o.GetNumLevels())}
+}
+
 func (v *version) purge() {
 	if v.next == nil {
 		return
@@ -81,7 +90,9 @@ func (v *version) drop(nv *version) {
 	runtime.SetFinalizer(v, (*version).purge)
 }
 
-func (v *version) get(key iKey, ro *opt.ReadOptions) (value []byte, cstate bool, err error) {
+// Entries which seq number is below given floor are deleted by a range
+// tombstone.
+func (v *version) get(key iKey, floor uint64, ro *opt.ReadOptions, noValue bool, th *tHandles) (value []byte, rlevel int, cstate bool, err error) {
 	s := v.s
 	icmp := s.cmp
 	ucmp := icmp.cmp
@@ -89,7 +100,7 @@ func (v *version) get(key iKey, ro *opt.ReadOptions) (value []byte, cstate bool,
 	ukey := key.ukey()
 
 	var tset *tSet
-	tseek := true
+	tseek := !s.o.HasFlag(opt.OFDisableSeekCompaction)
 
 	// We can search level-by-level since entries never hop across
 	// levels. Therefore we are guaranteed that if we find data
@@ -126,6 +137,7 @@ func (v *version) get(key iKey, ro *opt.ReadOptions) (value []byte, cstate bool,
 		}
 
 		for _, t := range ts {
+			tf := t
 			if tseek {
 				if tset == nil {
 					tset = &tSet{level, t}
@@ -136,7 +148,13 @@ func (v *version) get(key iKey, ro *opt.ReadOptions) (value []byte, cstate bool,
 			}
 
 			var _rkey, rval []byte
-			_rkey, rval, err = s.tops.get(t, key, ro)
+			if th != nil {
+				_rkey, rval, err = th.get(t, key, ro, noValue)
+			} else if noValue {
+				_rkey, err = s.tops.find(t, key, ro)
+			} else {
+				_rkey, rval, err = s.tops.get(t, key, ro)
+			}
 			if err == errors.ErrNotFound {
 				continue
 			} else if err != nil {
@@ -144,13 +162,31 @@ func (v *version) get(key iKey, ro *opt.ReadOptions) (value []byte, cstate bool,
 			}
 
 			rkey := iKey(_rkey)
-			if _, t, ok := rkey.parseNum(); ok {
+			if seq, t, ok := rkey.parseNum(); ok {
 				if ucmp.Compare(ukey, rkey.ukey()) == 0 {
+					rlevel = level
+					if seq < floor {
+						t = tDel
+					}
+					if t == tTTL && noValue {
+						// the expiry is kept within the value
+						if th != nil {
+							_, rval, err = th.get(tf, key, ro, false)
+						} else {
+							_, rval, err = s.tops.get(tf, key, ro)
+						}
+						if err != nil {
+							return
+						}
+					}
+					t, rval = resolveTTL(t, rval, ttlNow())
 					switch t {
 					case tVal:
 						value = rval
-					case tDel:
+					case tDel, tRangeDel:
 						err = errors.ErrNotFound
+					case tMerge:
+						err = errMergeOperand
 					default:
 						panic("not reached")
 					}
@@ -167,30 +203,109 @@ func (v *version) get(key iKey, ro *opt.ReadOptions) (value []byte, cstate bool,
 	return
 }
 
+// Seek given iterator and return the first entry of the seek key's user
+// key that is visible at given seq number, if any.
+func seekVisible(iter iterator.Iterator, key iKey, seq uint64, ucmp comparer.BasicComparer) (rkey iKey, value []byte, err error) {
+	ukey := key.ukey()
+	for ok := iter.Seek(key); ok; ok = iter.Next() {
+		k := iKey(iter.Key())
+		if ucmp.Compare(k.ukey(), ukey) != 0 {
+			break
+		}
+		if kseq, _, ok := k.parseNum(); ok && kseq <= seq {
+			return k, iter.Value(), nil
+		}
+	}
+	return nil, nil, iter.Error()
+}
+
+// getTs is like get, but resolve timestamped keys; since entries with
+// higher timestamp may reside in deeper levels, all levels are searched
+// and the preferred visible entry is returned, or nil if none.
+func (v *version) getTs(key iKey, seq uint64, ro *opt.ReadOptions) (rkey iKey, value []byte, rlevel int, err error) {
+	s := v.s
+	icmp := s.cmp
+	ucmp := icmp.cmp
+
+	ukey := key.ukey()
+	for level, ts := range v.tables {
+		if level > 0 {
+			i := ts.search(key, icmp)
+			if i >= len(ts) {
+				continue
+			}
+			ts = ts[i : i+1]
+		}
+
+		for _, t := range ts {
+			if t.isAfter(ukey, ucmp) || t.isBefore(ukey, ucmp) {
+				continue
+			}
+
+			var k iKey
+			var val []byte
+			it := s.tops.newIterator(t, ro)
+			k, val, err = seekVisible(it, key, seq, ucmp)
+			it.Release()
+			if err != nil {
+				return
+			}
+			if k != nil && (rkey == nil || icmp.Compare(k, rkey) < 0) {
+				// copied, as the iterator is released
+				rkey, value, rlevel = iKey(dupBytes(k)), dupBytes(val), level
+			}
+		}
+	}
+
+	return
+}
+
 func (v *version) getIterators(ro *opt.ReadOptions) (its []iterator.Iterator) {
 	s := v.s
 	icmp := s.cmp
 
+	// Tables outside of the key range of read options are skipped
+	var start, limit []byte
+	if ro != nil {
+		start, limit = ro.Start, ro.Limit
+	}
+	inRange := func(t *tFile) bool {
+		return !t.isAfter(start, icmp.cmp) &&
+			(limit == nil || icmp.cmp.Compare(t.min.ukey(), limit) < 0)
+	}
+
 	// Merge all level zero files together since they may overlap
 	for _, t := range v.tables[0] {
+		if !inRange(t) {
+			continue
+		}
 		it := s.tops.newIterator(t, ro)
-		its = append(its, it)
+		its = append(its, boundIter(it, ro, icmp))
 	}
 
 	for _, tt := range v.tables[1:] {
+		if start != nil || limit != nil {
+			var r tFiles
+			for _, t := range tt {
+				if inRange(t) {
+					r = append(r, t)
+				}
+			}
+			tt = r
+		}
 		if len(tt) == 0 {
 			continue
 		}
 
 		it := iterator.NewIndexedIterator(tt.newIndexIterator(s.tops, icmp, ro))
-		its = append(its, it)
+		its = append(its, boundIter(it, ro, icmp))
 	}
 
 	return
 }
 
 func (v *version) newStaging() *versionStaging {
-	return &versionStaging{base: v}
+	return &versionStaging{base: v, tables: make([]tLevelStaging, len(v.tables))}
 }
 
 // Spawn a new version based on this version.
@@ -206,6 +321,68 @@ func (v *version) fillRecord(r *sessionRecord) {
 			r.addTableFile(level, t)
 		}
 	}
+	for _, rd := range v.rdels {
+		r.addRangeDel(rd)
+	}
+}
+
+// Verify consistency of the version, as done with OFParanoidCheck: tables
+// of levels above 0 must be sorted and not overlap, and tables must open
+// and have first and last keys matching their recorded boundaries. Only
+// tables with number in nums are opened, unless nums is nil.
+func (v *version) check(nums map[uint64]bool) error {
+	s := v.s
+	icmp := s.cmp
+	ro := &opt.ReadOptions{Flag: opt.RFVerifyChecksums | opt.RFDontFillCache}
+	for level, tt := range v.tables {
+		for i, t := range tt {
+			num := t.file.Num()
+			fail := func(format string, a ...interface{}) error {
+				return errors.ErrCorrupt(fmt.Sprintf("paranoid check: table %d at level %d: ", num, level) +
+					fmt.Sprintf(format, a...))
+			}
+
+			if level > 0 && i > 0 && icmp.Compare(tt[i-1].max, t.min) >= 0 {
+				return fail("overlaps with table %d, min=%q prev max=%q", tt[i-1].file.Num(), t.min, tt[i-1].max)
+			}
+			if nums != nil && !nums[num] {
+				continue
+			}
+
+			iter := s.tops.newIterator(t, ro)
+			var first, last []byte
+			if iter.First() {
+				first = iter.KeyCopy(nil)
+			}
+			if iter.Last() {
+				last = iter.KeyCopy(nil)
+			}
+			err := iter.Error()
+			iter.Release()
+			switch {
+			case err != nil:
+				return fail("%v", err)
+			case first == nil:
+				return fail("table is empty")
+			case icmp.Compare(first, t.min) != 0:
+				return fail("first key %q, recorded min %q", iKey(first), t.min)
+			case icmp.Compare(last, t.max) != 0:
+				return fail("last key %q, recorded max %q", iKey(last), t.max)
+			}
+		}
+	}
+	return nil
+}
+
+// Check whether given user key may exist within tables of given level or
+// deeper.
+func (v *version) hasKey(ukey []byte, level int) bool {
+	for ; level < len(v.tables); level++ {
+		if v.tables[level].isOverlaps(ukey, ukey, level > 0, v.s.cmp) {
+			return true
+		}
+	}
+	return false
 }
 
 func (v *version) tLen(level int) int {
@@ -245,19 +422,82 @@ func (v *version) approximateOffsetOf(key iKey) (n uint64, err error) {
 	return
 }
 
+// Approximate size of the range [min, max), with the size of each level
+// discounted by the fraction of its entries estimated to be shadowed by
+// deletions in higher levels. Entry and deletion counts of a table are
+// assumed to spread evenly over the table.
+func (v *version) approximateDiscountedSize(min, max iKey) (n uint64, err error) {
+	icmp := v.s.cmp
+	tops := v.s.tops
+
+	var dels float64 // deletions of higher levels within the range
+	for _, tt := range v.tables {
+		var size uint64
+		var lentries, ldels float64
+		for _, t := range tt {
+			if icmp.Compare(t.max, min) < 0 || icmp.Compare(t.min, max) >= 0 {
+				continue
+			}
+			start, limit := uint64(0), t.size
+			if icmp.Compare(t.min, min) < 0 {
+				if start, err = tops.approximateOffsetOf(t, min); err != nil {
+					return
+				}
+			}
+			if icmp.Compare(t.max, max) >= 0 {
+				if limit, err = tops.approximateOffsetOf(t, max); err != nil {
+					return
+				}
+			}
+			if limit <= start {
+				continue
+			}
+			size += limit - start
+
+			entries, tdels, ok, err := tops.stats(t)
+			if err != nil {
+				return 0, err
+			}
+			if ok && t.size > 0 {
+				frac := float64(limit-start) / float64(t.size)
+				lentries += frac * float64(entries)
+				ldels += frac * float64(tdels)
+			}
+		}
+		if dels > 0 && lentries > 0 {
+			shadowed := dels / lentries
+			if shadowed > 1 {
+				shadowed = 1
+			}
+			size -= uint64(float64(size) * shadowed)
+		}
+		n += size
+		dels += ldels
+	}
+	return
+}
+
 func (v *version) pickLevel(min, max []byte) (level int) {
 	icmp := v.s.cmp
 	ucmp := icmp.cmp
 
+	maxLevel := v.s.o.GetMaxMemCompactLevel()
+	if maxLevel > len(v.tables)-1 {
+		maxLevel = len(v.tables) - 1
+	}
+
 	if !v.tables[0].isOverlaps(min, max, false, icmp) {
 		var r tFiles
-		for ; level < kMaxMemCompactLevel; level++ {
+		for ; level < maxLevel; level++ {
 			if v.tables[level+1].isOverlaps(min, max, true, icmp) {
 				break
 			}
-			v.tables[level+2].getOverlaps(min, max, &r, true, ucmp)
-			if r.size() > kMaxGrandParentOverlapBytes {
-				break
+			if level+2 < len(v.tables) {
+				r = r[:0]
+				v.tables[level+2].getOverlaps(min, max, &r, true, ucmp)
+				if r.size() > kMaxGrandParentOverlapBytes {
+					break
+				}
 			}
 		}
 	}
@@ -270,25 +510,9 @@ func (v *version) computeCompaction() {
 	var bestLevel int = -1
 	var bestScore float64 = -1
 
-	for level, ff := range v.tables {
-		var score float64
-		if level == 0 {
-			// We treat level-0 specially by bounding the number of files
-			// instead of number of bytes for two reasons:
-			//
-			// (1) With larger write-buffer sizes, it is nice not to do too
-			// many level-0 compactions.
-			//
-			// (2) The files in level-0 are merged on every read and
-			// therefore we wish to avoid too many files when the individual
-			// file size is small (perhaps because of a small write-buffer
-			// setting, or very high compression ratios, or lots of
-			// overwrites/deletions).
-			score = float64(len(ff)) / kL0_CompactionTrigger
-		} else {
-			score = float64(ff.size()) / levelMaxSize[level]
-		}
-
+	// The last level is never compacted, there is no level to compact into.
+	for level := range v.tables[:len(v.tables)-1] {
+		score := v.levelScore(level)
 		if score > bestScore {
 			bestLevel = level
 			bestScore = score
@@ -297,16 +521,97 @@ func (v *version) computeCompaction() {
 
 	v.cLevel = bestLevel
 	v.cScore = bestScore
+	if bestScore >= 1 {
+		if t, score := v.deletionScore(bestLevel); score >= bestScore {
+			v.cDel = t
+		}
+	}
+}
+
+// Table of given level with the largest share of deletion entries and its
+// deletion score, which reach 1 once the share reach the
+// CompactionDeletionPercent; only tables with known counts are considered.
+func (v *version) deletionScore(level int) (t *tFile, score float64) {
+	percent := v.s.o.GetCompactionDeletionPercent()
+	if percent <= 0 {
+		return
+	}
+	for _, f := range v.tables[level] {
+		p := (*tStats)(atomic.LoadPointer(&f.stats))
+		if p == nil || p.entries == 0 {
+			continue
+		}
+		if x := float64(p.dels) * 100 / float64(p.entries) / float64(percent); x > score {
+			t, score = f, x
+		}
+	}
+	return
+}
+
+// Compaction score of given level, by its size or by the deletions of
+// its tables; the level need compaction once its score reach 1.
+func (v *version) levelScore(level int) float64 {
+	ff := v.tables[level]
+	var score float64
+	if level == 0 {
+		// We treat level-0 specially by bounding the number of files
+		// instead of number of bytes for two reasons:
+		//
+		// (1) With larger write-buffer sizes, it is nice not to do too
+		// many level-0 compactions.
+		//
+		// (2) The files in level-0 are merged on every read and
+		// therefore we wish to avoid too many files when the individual
+		// file size is small (perhaps because of a small write-buffer
+		// setting, or very high compression ratios, or lots of
+		// overwrites/deletions).
+		score = float64(len(ff)) / float64(v.s.o.GetCompactionL0Trigger())
+	} else {
+		score = float64(ff.size()) / levelMaxSize(level)
+	}
+	if _, x := v.deletionScore(level); x > score {
+		score = x
+	}
+	return score
+}
+
+// Estimated number of bytes to compact until every level is within its
+// size limit; bytes compacted out of a level are carried into the next.
+func (v *version) pendingCompactionBytes() (pending uint64) {
+	var carry uint64
+	for level, tt := range v.tables[:len(v.tables)-1] {
+		size := tt.size() + carry
+		carry = 0
+		var limit uint64
+		if level == 0 {
+			if len(tt) < v.s.o.GetCompactionL0Trigger() {
+				continue
+			}
+		} else {
+			limit = uint64(levelMaxSize(level))
+		}
+		if size > limit {
+			carry = size - limit
+			pending += carry
+		}
+	}
+	return
 }
 
 func (v *version) needCompaction() bool {
 	return v.cScore >= 1 || atomic.LoadPointer(&v.cSeek) != nil
 }
 
+type tLevelStaging struct {
+	added   map[uint64]ntRecord
+	deleted map[uint64]struct{}
+}
+
 type versionStaging struct {
 	base   *version
-	tables [kNumLevels]struct {
-		added   map[uint64]ntRecord
+	tables []tLevelStaging
+	rdels  struct {
+		added   rangeDels
 		deleted map[uint64]struct{}
 	}
 }
@@ -344,6 +649,16 @@ func (p *versionStaging) commit(r *sessionRecord) {
 			delete(tm.deleted, tr.num)
 		}
 	}
+
+	// range tombstones
+	rm := &p.rdels
+	for _, seq := range r.deletedRangeDels {
+		if rm.deleted == nil {
+			rm.deleted = make(map[uint64]struct{})
+		}
+		rm.deleted[seq] = struct{}{}
+	}
+	rm.added = append(rm.added, r.rangeDels...)
 }
 
 func (p *versionStaging) finish() *version {
@@ -351,7 +666,7 @@ func (p *versionStaging) finish() *version {
 	btt := p.base.tables
 
 	// build new version
-	nv := &version{s: s}
+	nv := newVersion(s)
 	sorter := &tFileSorterKey{cmp: s.cmp}
 	for level, tm := range p.tables {
 		bt := btt[level]
@@ -383,6 +698,15 @@ func (p *versionStaging) finish() *version {
 		nv.tables[level] = nt
 	}
 
+	// range tombstones
+	for _, rds := range []rangeDels{p.base.rdels, p.rdels.added} {
+		for _, r := range rds {
+			if _, ok := p.rdels.deleted[r.seq]; !ok {
+				nv.rdels = append(nv.rdels, r)
+			}
+		}
+	}
+
 	// compute compaction score for new version
 	nv.computeCompaction()
 